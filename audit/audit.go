@@ -6,6 +6,8 @@ package audit // import "gopkg.in/juju/charmstore.v5/audit"
 import (
 	"time"
 
+	"github.com/juju/charmrepo/v6/csclient/params"
+
 	"gopkg.in/juju/charmstore.v5/internal/charm"
 )
 
@@ -21,6 +23,30 @@ const (
 	// Required fields: Entity
 	OpPromulgate   Operation = "promulgate"
 	OpUnpromulgate Operation = "unpromulgate"
+
+	// OpDelete, OpRestore represent the deletion of an entity
+	// and the restoring of a deleted entity.
+	// Required fields: Entity
+	OpDelete  Operation = "delete"
+	OpRestore Operation = "restore"
+
+	// OpDeleteAll represents the deletion of a charm or bundle
+	// with all its revisions and resources.
+	// Required fields: Entity
+	OpDeleteAll Operation = "delete-all"
+
+	// OpTransfer represents the transfer of a charm or bundle
+	// to another namespace.
+	// Required fields: Entity, Target
+	OpTransfer Operation = "transfer"
+
+	// OpScheduledPublish, OpScheduledPublishFailed represent the
+	// publication of an entity at a previously scheduled time and
+	// the failure of such a publication.
+	// Required fields: Entity, Channels
+	// OpScheduledPublishFailed also requires: Error
+	OpScheduledPublish       Operation = "scheduled-publish"
+	OpScheduledPublishFailed Operation = "scheduled-publish-failed"
 )
 
 // ACL represents an access control list.
@@ -36,4 +62,15 @@ type Entry struct {
 	Op     Operation  `json:"op"`
 	Entity *charm.URL `json:"entity,omitempty"`
 	ACL    *ACL       `json:"acl,omitempty"`
+
+	// Target holds the new URL of the entity when
+	// it has been moved.
+	Target *charm.URL `json:"target,omitempty"`
+
+	// Channels holds the channels that the entity
+	// has been published to.
+	Channels []params.Channel `json:"channels,omitempty"`
+
+	// Error holds the reason that an operation failed.
+	Error string `json:"error,omitempty"`
 }
@@ -28,6 +28,10 @@ import (
 var (
 	logger        = loggo.GetLogger("charmd")
 	loggingConfig = flag.String("logging-config", "", "specify log levels for modules e.g. <root>=TRACE")
+	scrubBlobs    = flag.Bool("scrub-blobs", false, "verify all stored blobs against their recorded hashes, print any failures and exit")
+	scrubRate     = flag.Int64("scrub-rate", 0, "maximum number of bytes per second to read when scrubbing blobs (defaults to blobstore-scrub-rate)")
+	rotateKeys    = flag.Bool("rotate-blob-keys", false, "re-encrypt the data keys of all encrypted blobs with the current master key and exit")
+	repairBlobs   = flag.Bool("repair-blob-replicas", false, "copy any blobs that are missing from a blob store replica from another replica and exit")
 )
 
 func main() {
@@ -59,6 +63,27 @@ func main() {
 			os.Exit(2)
 		}
 	}
+	if *scrubBlobs {
+		if err := scrub(conf); err != nil {
+			fmt.Fprintf(os.Stderr, "STOP: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+	if *rotateKeys {
+		if err := rotateBlobKeys(conf); err != nil {
+			fmt.Fprintf(os.Stderr, "STOP: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+	if *repairBlobs {
+		if err := repairBlobReplicas(conf); err != nil {
+			fmt.Fprintf(os.Stderr, "STOP: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
 	if err := serve(conf); err != nil {
 		fmt.Fprintf(os.Stderr, "STOP: %v\n", err)
 		os.Exit(1)
@@ -66,17 +91,11 @@ func main() {
 }
 
 func serve(conf *config.Config) error {
-	logger.Infof("connecting to mongo")
-	session, err := mgo.Dial(conf.MongoURL)
+	db, err := dialDB(conf)
 	if err != nil {
-		return errgo.Notef(err, "cannot dial mongo at %q", conf.MongoURL)
-	}
-	defer session.Close()
-	dbName := "juju"
-	if conf.Database != "" {
-		dbName = conf.Database
+		return errgo.Mask(err)
 	}
-	db := session.DB(dbName)
+	defer db.Session.Close()
 
 	var es *elasticsearch.Database
 	if conf.ESAddr != "" {
@@ -112,11 +131,18 @@ func serve(conf *config.Config) error {
 		MaxMgoSessions:                 conf.MaxMgoSessions,
 		HTTPRequestWaitDuration:        conf.RequestTimeout.Duration,
 		SearchCacheMaxAge:              conf.SearchCacheMaxAge.Duration,
+		SearchIndexDir:                 conf.SearchIndexDir,
 		PublicKeyLocator:               keyring,
 		MinUploadPartSize:              conf.MinUploadPartSize,
 		MaxUploadPartSize:              conf.MaxUploadPartSize,
 		MaxUploadParts:                 conf.MaxUploadParts,
 		RunBlobStoreGC:                 true,
+		RunBlobStoreScrubber:           conf.BlobStoreScrub,
+		RunScheduledPublisher:          true,
+		BlobStoreScrubRate:             conf.BlobStoreScrubRate,
+		CompressBlobs:                  conf.BlobStoreCompress,
+		TempDir:                        conf.TempDir,
+		DeletedEntityRetention:         conf.DeletedEntityRetention.Duration,
 		DockerRegistryAddress:          conf.DockerRegistryAddress,
 		DockerRegistryAuthCertificates: conf.DockerRegistryAuthCertificates.Certificates,
 		DockerRegistryAuthKey:          conf.DockerRegistryAuthKey.Key,
@@ -124,22 +150,28 @@ func serve(conf *config.Config) error {
 		DisableSlowMetadata:            conf.DisableSlowMetadata,
 		ReadOnly:                       conf.ReadOnly,
 	}
-	switch conf.BlobStore {
-	case config.MongoDBBlobStore:
-		// This is the default. No need for a custom function.
-	case config.SwiftBlobStore:
-		cred := &identity.Credentials{
-			URL:        conf.SwiftAuthURL,
-			User:       conf.SwiftUsername,
-			Secrets:    conf.SwiftSecret,
-			Region:     conf.SwiftRegion,
-			TenantName: conf.SwiftTenant,
+	cfg.NewBlobBackend, err = newBlobBackend(conf)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if conf.BlobStoreCacheDir != "" {
+		cfg.NewBlobBackend, err = newCachingBlobBackend(conf, cfg.NewBlobBackend)
+		if err != nil {
+			return errgo.Mask(err)
 		}
-		cfg.NewBlobBackend = func(db *mgo.Database) blobstore.Backend {
-			return blobstore.NewSwiftBackend(cred, conf.SwiftAuthMode.Mode, conf.SwiftBucket, conf.TempDir)
+	}
+	if conf.BlobStoreKeyFile != "" {
+		cfg.BlobKeyring, err = blobstore.ReadKeyringFile(conf.BlobStoreKeyFile)
+		if err != nil {
+			return errgo.Mask(err)
 		}
-	default:
-		return errgo.Newf("unknown blob store type")
+	}
+	if conf.BlobStoreMigrateFrom != nil {
+		cfg.NewSecondaryBlobBackend, err = newSecondaryBlobBackend(conf)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		cfg.BlobMigrationName = conf.BlobStoreMigrationName
 	}
 
 	if conf.AuditLogFile != "" {
@@ -179,6 +211,265 @@ func serve(conf *config.Config) error {
 	return http.ListenAndServe(conf.APIAddr, handler)
 }
 
+// scrub verifies the contents of the blob store, printing
+// a line for each blob that fails verification.
+func scrub(conf *config.Config) error {
+	db, err := dialDB(conf)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	defer db.Session.Close()
+	bs, err := newBlobStore(conf, db)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	rate := conf.BlobStoreScrubRate
+	if *scrubRate != 0 {
+		rate = *scrubRate
+	}
+	logger.Infof("scrubbing blob store")
+	stats, err := bs.Scrub(blobstore.ScrubParams{
+		BytesPerSecond: rate,
+	})
+	if err != nil {
+		return errgo.Notef(err, "cannot scrub blob store")
+	}
+	failures, err := bs.ScrubFailures()
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	for _, f := range failures {
+		fmt.Printf("%s %s %s\n", f.Hash, f.Name, f.Error)
+	}
+	logger.Infof("checked %d blobs (%d bytes)", stats.Checked, stats.CheckedBytes)
+	if len(failures) > 0 {
+		return errgo.Newf("%d blobs failed verification", len(failures))
+	}
+	return nil
+}
+
+// rotateBlobKeys re-wraps the data keys of all encrypted blobs
+// with the current master key.
+func rotateBlobKeys(conf *config.Config) error {
+	if conf.BlobStoreKeyFile == "" {
+		return errgo.Newf("no blobstore-key-file specified in configuration")
+	}
+	db, err := dialDB(conf)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	defer db.Session.Close()
+	bs, err := newBlobStore(conf, db)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	logger.Infof("rotating blob keys")
+	n, err := bs.RotateKeys()
+	if err != nil {
+		return errgo.Notef(err, "cannot rotate blob keys (%d blobs updated)", n)
+	}
+	logger.Infof("updated the keys of %d blobs", n)
+	return nil
+}
+
+// repairBlobReplicas copies blobs that are missing from any of the
+// replicas of a replicated blob store.
+func repairBlobReplicas(conf *config.Config) error {
+	if conf.BlobStore != config.ReplicatedBlobStore {
+		return errgo.Newf("blob store is not replicated")
+	}
+	db, err := dialDB(conf)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	defer db.Session.Close()
+	bs, err := newBlobStore(conf, db)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	logger.Infof("repairing blob store replicas")
+	stats, err := bs.RepairReplicas(nil)
+	if err != nil {
+		return errgo.Notef(err, "cannot repair blob store replicas")
+	}
+	logger.Infof("checked %d blobs; made %d copies of %d blobs", stats.Checked, stats.Copies, stats.Repaired)
+	if stats.Failed > 0 {
+		return errgo.Newf("%d blobs could not be repaired", stats.Failed)
+	}
+	return nil
+}
+
+// newBlobStore returns a blob store that accesses the blobs of the
+// charm store directly, without going through any cache.
+func newBlobStore(conf *config.Config, db *mgo.Database) (*blobstore.Store, error) {
+	if conf.TempDir == "" {
+		conf.TempDir = os.TempDir()
+	}
+	newBackend, err := newBlobBackend(conf)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	var backend blobstore.Backend
+	if newBackend != nil {
+		backend = newBackend(db)
+	} else {
+		backend = blobstore.NewMongoBackend(db, "entitystore")
+	}
+	bs := blobstore.New(db, "entitystore", backend)
+	bs.Compress = conf.BlobStoreCompress
+	bs.TempDir = conf.TempDir
+	if conf.BlobStoreKeyFile != "" {
+		bs.Keyring, err = blobstore.ReadKeyringFile(conf.BlobStoreKeyFile)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+	}
+	if conf.BlobStoreMigrateFrom != nil {
+		newSecondary, err := newSecondaryBlobBackend(conf)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		bs.SecondaryBackend = newSecondary(db)
+	}
+	return bs, nil
+}
+
+// newSecondaryBlobBackend returns a function that creates the blob
+// store backend that blobs are being migrated from.
+func newSecondaryBlobBackend(conf *config.Config) (func(db *mgo.Database) blobstore.Backend, error) {
+	newBackend, err := newNestedBlobBackend(conf, conf.BlobStoreMigrateFrom)
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot create secondary blob store backend")
+	}
+	return newBackend, nil
+}
+
+// newReplicatedBlobBackend returns a function that creates a backend
+// that replicates blobs across the backends specified by the replicas
+// in the given configuration.
+func newReplicatedBlobBackend(conf *config.Config) (func(db *mgo.Database) blobstore.Backend, error) {
+	rs, err := blobstore.NewReplicaSet(blobstore.ReplicaSetParams{
+		Replicas:    len(conf.BlobStoreReplicas),
+		WriteQuorum: conf.BlobStoreWriteQuorum,
+		TempDir:     conf.TempDir,
+	})
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	newReplicas := make([]func(db *mgo.Database) blobstore.Backend, len(conf.BlobStoreReplicas))
+	for i, replica := range conf.BlobStoreReplicas {
+		newReplicas[i], err = newNestedBlobBackend(conf, replica)
+		if err != nil {
+			return nil, errgo.Notef(err, "cannot create blob store replica %d", i)
+		}
+	}
+	return func(db *mgo.Database) blobstore.Backend {
+		replicas := make([]blobstore.Backend, len(newReplicas))
+		for i, newReplica := range newReplicas {
+			replicas[i] = newReplica(db)
+		}
+		return rs.Backend(replicas...)
+	}, nil
+}
+
+// newNestedBlobBackend returns a function that creates the blob store
+// backend specified by the given nested configuration, which inherits
+// the temporary directory of its parent.
+func newNestedBlobBackend(parent, conf *config.Config) (func(db *mgo.Database) blobstore.Backend, error) {
+	if conf.TempDir == "" {
+		conf.TempDir = parent.TempDir
+	}
+	newBackend, err := newBlobBackend(conf)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if newBackend == nil {
+		newBackend = func(db *mgo.Database) blobstore.Backend {
+			return blobstore.NewMongoBackend(db, "entitystore")
+		}
+	}
+	return newBackend, nil
+}
+
+// dialDB connects to the MongoDB database specified by the
+// given configuration. The session should be closed after use.
+func dialDB(conf *config.Config) (*mgo.Database, error) {
+	logger.Infof("connecting to mongo")
+	session, err := mgo.Dial(conf.MongoURL)
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot dial mongo at %q", conf.MongoURL)
+	}
+	dbName := "juju"
+	if conf.Database != "" {
+		dbName = conf.Database
+	}
+	return session.DB(dbName), nil
+}
+
+// newBlobBackend returns a function that creates the blob store
+// backend specified by the given configuration.
+func newBlobBackend(conf *config.Config) (func(db *mgo.Database) blobstore.Backend, error) {
+	switch conf.BlobStore {
+	case config.MongoDBBlobStore:
+		// This is the default. No need for a custom function.
+		return nil, nil
+	case config.SwiftBlobStore:
+		cred := &identity.Credentials{
+			URL:        conf.SwiftAuthURL,
+			User:       conf.SwiftUsername,
+			Secrets:    conf.SwiftSecret,
+			Region:     conf.SwiftRegion,
+			TenantName: conf.SwiftTenant,
+		}
+		return func(db *mgo.Database) blobstore.Backend {
+			return blobstore.NewSwiftBackend(cred, conf.SwiftAuthMode.Mode, conf.SwiftBucket, conf.TempDir)
+		}, nil
+	case config.S3BlobStore:
+		backend, err := blobstore.NewS3Backend(blobstore.S3Params{
+			Endpoint:  conf.S3Endpoint,
+			Region:    conf.S3Region,
+			Bucket:    conf.S3Bucket,
+			AccessKey: conf.S3AccessKey,
+			SecretKey: conf.S3SecretKey,
+		})
+		if err != nil {
+			return nil, errgo.Notef(err, "cannot create S3 blob store backend")
+		}
+		return func(db *mgo.Database) blobstore.Backend {
+			return backend
+		}, nil
+	case config.FilesystemBlobStore:
+		return func(db *mgo.Database) blobstore.Backend {
+			return blobstore.NewFilesystemBackend(conf.FilesystemRoot)
+		}, nil
+	case config.ReplicatedBlobStore:
+		return newReplicatedBlobBackend(conf)
+	default:
+		return nil, errgo.Newf("unknown blob store type")
+	}
+}
+
+// newCachingBlobBackend returns a function that creates backends
+// that read blobs created by newBackend through a local cache. If
+// newBackend is nil, the default MongoDB backend is used.
+func newCachingBlobBackend(conf *config.Config, newBackend func(db *mgo.Database) blobstore.Backend) (func(db *mgo.Database) blobstore.Backend, error) {
+	cache, err := blobstore.NewCache(blobstore.CacheParams{
+		Dir:     conf.BlobStoreCacheDir,
+		MaxSize: conf.BlobStoreCacheSize,
+	})
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot create blob cache")
+	}
+	if newBackend == nil {
+		newBackend = func(db *mgo.Database) blobstore.Backend {
+			return blobstore.NewMongoBackend(db, "entitystore")
+		}
+	}
+	return func(db *mgo.Database) blobstore.Backend {
+		return cache.Backend(newBackend(db))
+	}, nil
+}
+
 func addPublicKey(ring *bakery.PublicKeyRing, loc string, key *bakery.PublicKey) error {
 	if key != nil {
 		return ring.AddPublicKeyForLocation(loc, false, key)
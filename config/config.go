@@ -42,6 +42,7 @@ type Config struct {
 	RequestTimeout                 DurationString    `yaml:"request-timeout,omitempty"`
 	StatsCacheMaxAge               DurationString    `yaml:"stats-cache-max-age,omitempty"`
 	SearchCacheMaxAge              DurationString    `yaml:"search-cache-max-age,omitempty"`
+	SearchIndexDir                 string            `yaml:"search-index-dir,omitempty"` // used when elasticsearch-addr is unset
 	Database                       string            `yaml:"database,omitempty"`
 	AccessLog                      string            `yaml:"access-log"`
 	MinUploadPartSize              int64             `yaml:"min-upload-part-size"`
@@ -56,12 +57,29 @@ type Config struct {
 	SwiftRegion                    string            `yaml:"swift-region"`
 	SwiftTenant                    string            `yaml:"swift-tenant"`
 	SwiftAuthMode                  *SwiftAuthMode    `yaml:"swift-authmode"`
+	S3Endpoint                     string            `yaml:"s3-endpoint"`
+	S3Region                       string            `yaml:"s3-region"`
+	S3Bucket                       string            `yaml:"s3-bucket"`
+	S3AccessKey                    string            `yaml:"s3-access-key"`
+	S3SecretKey                    string            `yaml:"s3-secret-key"`
+	FilesystemRoot                 string            `yaml:"filesystem-root"`
+	BlobStoreScrub                 bool              `yaml:"blobstore-scrub"`
+	BlobStoreScrubRate             int64             `yaml:"blobstore-scrub-rate"`
+	BlobStoreCacheDir              string            `yaml:"blobstore-cache-dir"`
+	BlobStoreCacheSize             int64             `yaml:"blobstore-cache-size"`
+	BlobStoreKeyFile               string            `yaml:"blobstore-key-file"`
+	BlobStoreCompress              bool              `yaml:"blobstore-compress"`
+	BlobStoreMigrateFrom           *Config           `yaml:"blobstore-migrate-from"`
+	BlobStoreMigrationName         string            `yaml:"blobstore-migration-name"`
+	BlobStoreReplicas              []*Config         `yaml:"blobstore-replicas"`
+	BlobStoreWriteQuorum           int               `yaml:"blobstore-write-quorum"`
 	LoggingConfig                  string            `yaml:"logging-config"`
 	DockerRegistryAddress          string            `yaml:"docker-registry-address"`
 	DockerRegistryAuthCertificates X509Certificates  `yaml:"docker-registry-auth-certs"`
 	DockerRegistryAuthKey          X509PrivateKey    `yaml:"docker-registry-auth-key"`
 	DockerRegistryTokenDuration    DurationString    `yaml:"docker-registry-token-duration"`
 	DisableSlowMetadata            bool              `yaml:"disable-slow-metadata"`
+	DeletedEntityRetention         DurationString    `yaml:"deleted-entity-retention"`
 	TempDir                        string            `yaml:"tempdir"`
 	ReadOnly                       bool              `yaml:"read-only"`
 }
@@ -69,8 +87,11 @@ type Config struct {
 type BlobStoreType string
 
 const (
-	MongoDBBlobStore BlobStoreType = "mongodb"
-	SwiftBlobStore   BlobStoreType = "swift"
+	MongoDBBlobStore    BlobStoreType = "mongodb"
+	SwiftBlobStore      BlobStoreType = "swift"
+	S3BlobStore         BlobStoreType = "s3"
+	FilesystemBlobStore BlobStoreType = "filesystem"
+	ReplicatedBlobStore BlobStoreType = "replicated"
 )
 
 // SwiftAuthMode implements unmarshaling for
@@ -109,27 +130,72 @@ func (c *Config) validate() error {
 		return fmt.Errorf("invalid user name %q (contains ':')", c.AuthUsername)
 	}
 	needString("auth-password", c.AuthPassword)
+	if err := c.validateBlobStore("", needString); err != nil {
+		return errgo.Mask(err)
+	}
+	if c.BlobStoreMigrateFrom != nil {
+		needString("blobstore-migration-name", c.BlobStoreMigrationName)
+		if err := c.BlobStoreMigrateFrom.validateBlobStore("blobstore-migrate-from.", needString); err != nil {
+			return errgo.Notef(err, "invalid blobstore-migrate-from")
+		}
+	}
+	if c.BlobStoreCacheDir != "" && c.BlobStoreCacheSize <= 0 {
+		missing = append(missing, "blobstore-cache-size")
+	}
+	if len(missing) != 0 {
+		return errgo.Newf("missing fields %s in config file", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// validateBlobStore checks that the fields required by the
+// configured blob store type are present, calling needString
+// for each one with its name prefixed by the given prefix.
+func (c *Config) validateBlobStore(prefix string, needString func(name, val string)) error {
+	need := func(name, val string) {
+		needString(prefix+name, val)
+	}
 	if c.BlobStore == "" {
 		c.BlobStore = MongoDBBlobStore
 	}
 	switch c.BlobStore {
 	case SwiftBlobStore:
-		needString("swift-auth-url", c.SwiftAuthURL)
-		needString("swift-username", c.SwiftUsername)
-		needString("swift-secret", c.SwiftSecret)
-		needString("swift-bucket", c.SwiftBucket)
-		needString("swift-region", c.SwiftRegion)
-		needString("swift-tenant", c.SwiftTenant)
+		need("swift-auth-url", c.SwiftAuthURL)
+		need("swift-username", c.SwiftUsername)
+		need("swift-secret", c.SwiftSecret)
+		need("swift-bucket", c.SwiftBucket)
+		need("swift-region", c.SwiftRegion)
+		need("swift-tenant", c.SwiftTenant)
 		if c.SwiftAuthMode == nil {
-			missing = append(missing, "swift-auth-mode")
+			need("swift-auth-mode", "")
+		}
+	case S3BlobStore:
+		need("s3-endpoint", c.S3Endpoint)
+		need("s3-region", c.S3Region)
+		need("s3-bucket", c.S3Bucket)
+		need("s3-access-key", c.S3AccessKey)
+		need("s3-secret-key", c.S3SecretKey)
+	case FilesystemBlobStore:
+		need("filesystem-root", c.FilesystemRoot)
+	case ReplicatedBlobStore:
+		if len(c.BlobStoreReplicas) == 0 {
+			need("blobstore-replicas", "")
+		}
+		for i, replica := range c.BlobStoreReplicas {
+			if replica.BlobStore == ReplicatedBlobStore {
+				return errgo.Newf("blobstore-replicas[%d] cannot be replicated", i)
+			}
+			if err := replica.validateBlobStore(fmt.Sprintf("%sblobstore-replicas[%d].", prefix, i), needString); err != nil {
+				return errgo.Notef(err, "invalid blobstore-replicas[%d]", i)
+			}
+		}
+		if c.BlobStoreWriteQuorum < 0 || c.BlobStoreWriteQuorum > len(c.BlobStoreReplicas) {
+			return errgo.Newf("invalid blobstore-write-quorum %d (%d replicas)", c.BlobStoreWriteQuorum, len(c.BlobStoreReplicas))
 		}
 	case MongoDBBlobStore:
 	default:
 		return errgo.Newf("invalid blob store type %q", c.BlobStore)
 	}
-	if len(missing) != 0 {
-		return errgo.Newf("missing fields %s in config file", strings.Join(missing, ", "))
-	}
 	return nil
 }
 
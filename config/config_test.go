@@ -91,7 +91,9 @@ docker-registry-auth-key: |
   -----END EC PRIVATE KEY-----
 docker-registry-token-duration: 1h10m
 tempdir: /var/tmp/charmstore
+search-index-dir: /var/lib/charmstore/search
 disable-slow-metadata: true
+deleted-entity-retention: 168h
 read-only: true
 `
 
@@ -158,7 +160,9 @@ func (s *ConfigSuite) TestRead(c *gc.C) {
 		},
 		DockerRegistryTokenDuration: config.DurationString{time.Hour + 10*time.Minute},
 		TempDir:                     "/var/tmp/charmstore",
+		SearchIndexDir:              "/var/lib/charmstore/search",
 		DisableSlowMetadata:         true,
+		DeletedEntityRetention:      config.DurationString{7 * 24 * time.Hour},
 		ReadOnly:                    true,
 	})
 }
@@ -284,6 +288,80 @@ func (s *ConfigSuite) TestValidateConfigError(c *gc.C) {
 	cfg, err = s.readConfig(c, "blobstore: swift\n")
 	c.Assert(err, gc.ErrorMatches, "missing fields mongo-url, api-addr, auth-username, auth-password, swift-auth-url, swift-username, swift-secret, swift-bucket, swift-region, swift-tenant, swift-auth-mode in config file")
 	c.Assert(cfg, gc.IsNil)
+
+	cfg, err = s.readConfig(c, "blobstore: s3\n")
+	c.Assert(err, gc.ErrorMatches, "missing fields mongo-url, api-addr, auth-username, auth-password, s3-endpoint, s3-region, s3-bucket, s3-access-key, s3-secret-key in config file")
+	c.Assert(cfg, gc.IsNil)
+
+	cfg, err = s.readConfig(c, "blobstore: filesystem\n")
+	c.Assert(err, gc.ErrorMatches, "missing fields mongo-url, api-addr, auth-username, auth-password, filesystem-root in config file")
+	c.Assert(cfg, gc.IsNil)
+
+	cfg, err = s.readConfig(c, "blobstore-cache-dir: /tmp/cache\n")
+	c.Assert(err, gc.ErrorMatches, "missing fields mongo-url, api-addr, auth-username, auth-password, blobstore-cache-size in config file")
+	c.Assert(cfg, gc.IsNil)
+
+	cfg, err = s.readConfig(c, "blobstore-migrate-from:\n  blobstore: s3\n  s3-bucket: old\n")
+	c.Assert(err, gc.ErrorMatches, "missing fields mongo-url, api-addr, auth-username, auth-password, blobstore-migration-name, blobstore-migrate-from.s3-endpoint, blobstore-migrate-from.s3-region, blobstore-migrate-from.s3-access-key, blobstore-migrate-from.s3-secret-key in config file")
+	c.Assert(cfg, gc.IsNil)
+
+	cfg, err = s.readConfig(c, "blobstore-migrate-from:\n  blobstore: foo\n")
+	c.Assert(err, gc.ErrorMatches, `invalid blobstore-migrate-from: invalid blob store type "foo"`)
+	c.Assert(cfg, gc.IsNil)
+
+	cfg, err = s.readConfig(c, "blobstore: replicated\n")
+	c.Assert(err, gc.ErrorMatches, "missing fields mongo-url, api-addr, auth-username, auth-password, blobstore-replicas in config file")
+	c.Assert(cfg, gc.IsNil)
+
+	cfg, err = s.readConfig(c, "blobstore: replicated\nblobstore-replicas:\n- blobstore: filesystem\n- blobstore: mongodb\n")
+	c.Assert(err, gc.ErrorMatches, "missing fields mongo-url, api-addr, auth-username, auth-password, blobstore-replicas\\[0\\].filesystem-root in config file")
+	c.Assert(cfg, gc.IsNil)
+
+	cfg, err = s.readConfig(c, "blobstore: replicated\nblobstore-replicas:\n- blobstore: replicated\n")
+	c.Assert(err, gc.ErrorMatches, `blobstore-replicas\[0\] cannot be replicated`)
+	c.Assert(cfg, gc.IsNil)
+
+	cfg, err = s.readConfig(c, "blobstore: replicated\nblobstore-replicas:\n- blobstore: mongodb\nblobstore-write-quorum: 2\n")
+	c.Assert(err, gc.ErrorMatches, `invalid blobstore-write-quorum 2 \(1 replicas\)`)
+	c.Assert(cfg, gc.IsNil)
+
+	cfg, err = s.readConfig(c, "blobstore: foo\n")
+	c.Assert(err, gc.ErrorMatches, `invalid blob store type "foo"`)
+	c.Assert(cfg, gc.IsNil)
+}
+
+func (s *ConfigSuite) TestReadReplicatedBlobStore(c *gc.C) {
+	conf, err := s.readConfig(c, `
+mongo-url: localhost:23456
+api-addr: blah:2324
+auth-username: myuser
+auth-password: mypasswd
+blobstore: replicated
+blobstore-write-quorum: 1
+blobstore-replicas:
+- blobstore: filesystem
+  filesystem-root: /srv/blobs
+- blobstore: s3
+  s3-endpoint: https://s3.example.com
+  s3-region: somewhere
+  s3-bucket: bucket
+  s3-access-key: access
+  s3-secret-key: secret
+`)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(conf.BlobStore, gc.Equals, config.ReplicatedBlobStore)
+	c.Assert(conf.BlobStoreWriteQuorum, gc.Equals, 1)
+	c.Assert(conf.BlobStoreReplicas, jc.DeepEquals, []*config.Config{{
+		BlobStore:      config.FilesystemBlobStore,
+		FilesystemRoot: "/srv/blobs",
+	}, {
+		BlobStore:   config.S3BlobStore,
+		S3Endpoint:  "https://s3.example.com",
+		S3Region:    "somewhere",
+		S3Bucket:    "bucket",
+		S3AccessKey: "access",
+		S3SecretKey: "secret",
+	}})
 }
 
 func mustParseKey(s string) bakery.Key {
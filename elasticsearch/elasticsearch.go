@@ -19,6 +19,7 @@ import (
 	"net/http"
 	"net/url"
 	"path"
+	"sort"
 	"strings"
 
 	"github.com/juju/loggo"
@@ -482,10 +483,63 @@ type SearchResult struct {
 		MaxScore float64 `json:"max_score"`
 		Hits     []Hit   `json:"hits"`
 	} `json:"hits"`
-	Took     int  `json:"took"`
-	TimedOut bool `json:"timed_out"`
+	Took         int                          `json:"took"`
+	TimedOut     bool                         `json:"timed_out"`
+	Aggregations map[string]AggregationResult `json:"aggregations"`
 }
 
+// AggregationResult holds the result of a bucket aggregation, such as
+// a TermsAggregation or a FiltersAggregation.
+type AggregationResult struct {
+	Buckets []Bucket
+}
+
+// Bucket holds a single bucket of an aggregation result.
+type Bucket struct {
+	// Key holds the value of the bucket for a TermsAggregation,
+	// or the name of the filter for a FiltersAggregation.
+	Key string `json:"key"`
+
+	// DocCount holds the number of documents in the bucket.
+	DocCount int `json:"doc_count"`
+}
+
+// UnmarshalJSON implements json.Unmarshaler. Elasticsearch returns the
+// buckets of a terms aggregation as a list, but those of a filters
+// aggregation as an object keyed by filter name, so both forms are
+// accepted. Buckets from an object are sorted by key.
+func (r *AggregationResult) UnmarshalJSON(data []byte) error {
+	var result struct {
+		Buckets json.RawMessage `json:"buckets"`
+	}
+	if err := json.Unmarshal(data, &result); err != nil {
+		return errgo.Mask(err)
+	}
+	r.Buckets = nil
+	if len(result.Buckets) == 0 {
+		return nil
+	}
+	if result.Buckets[0] != '{' {
+		return errgo.Mask(json.Unmarshal(result.Buckets, &r.Buckets))
+	}
+	var keyed map[string]Bucket
+	if err := json.Unmarshal(result.Buckets, &keyed); err != nil {
+		return errgo.Mask(err)
+	}
+	for k, b := range keyed {
+		b.Key = k
+		r.Buckets = append(r.Buckets, b)
+	}
+	sort.Sort(bucketsByKey(r.Buckets))
+	return nil
+}
+
+type bucketsByKey []Bucket
+
+func (b bucketsByKey) Len() int           { return len(b) }
+func (b bucketsByKey) Less(i, j int) bool { return b[i].Key < b[j].Key }
+func (b bucketsByKey) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+
 // Hit represents an individual search hit returned from elasticsearch
 type Hit struct {
 	Index  string          `json:"_index"`
@@ -494,6 +548,10 @@ type Hit struct {
 	Score  float64         `json:"_score"`
 	Source json.RawMessage `json:"_source"`
 	Fields Fields          `json:"fields"`
+
+	// Sort holds a JSON array with the values that the hit was
+	// sorted on, when the search specified a sort.
+	Sort json.RawMessage `json:"sort,omitempty"`
 }
 
 type Fields map[string][]interface{}
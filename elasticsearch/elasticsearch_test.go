@@ -9,6 +9,7 @@ import (
 	"time"
 
 	jujutesting "github.com/juju/testing"
+	jc "github.com/juju/testing/checkers"
 	"github.com/juju/utils"
 	gc "gopkg.in/check.v1"
 	errgo "gopkg.in/errgo.v1"
@@ -255,6 +256,35 @@ func (s *Suite) TestSearch(c *gc.C) {
 	c.Assert(results.Hits.Hits[0].Fields.GetString("foo"), gc.Equals, "baz")
 }
 
+func (s *Suite) TestSearchAggregations(c *gc.C) {
+	for _, foo := range []string{"bar", "baz", "baz"} {
+		_, err := s.ES.PostDocument(s.TestIndex, "testtype", map[string]string{"foo": foo})
+		c.Assert(err, gc.Equals, nil)
+	}
+	s.ES.RefreshIndex(s.TestIndex)
+	q := es.QueryDSL{
+		Query: es.MatchAllQuery{},
+		Aggregations: map[string]es.Aggregation{
+			"terms": es.TermsAggregation{Field: "foo"},
+			"filters": es.FiltersAggregation{
+				"bar": es.TermFilter{Field: "foo", Value: "bar"},
+				"qux": es.TermFilter{Field: "foo", Value: "qux"},
+			},
+		},
+	}
+	results, err := s.ES.Search(s.TestIndex, "testtype", q)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(results.Hits.Total, gc.Equals, 3)
+	c.Assert(results.Aggregations["terms"].Buckets, jc.DeepEquals, []es.Bucket{
+		{Key: "baz", DocCount: 2},
+		{Key: "bar", DocCount: 1},
+	})
+	c.Assert(results.Aggregations["filters"].Buckets, jc.DeepEquals, []es.Bucket{
+		{Key: "bar", DocCount: 1},
+		{Key: "qux", DocCount: 0},
+	})
+}
+
 func (s *Suite) TestPutMapping(c *gc.C) {
 	var mapping = map[string]interface{}{
 		"testtype": map[string]interface{}{
@@ -68,6 +68,13 @@ type MultiMatchQuery struct {
 	// please see:
 	// https://www.elastic.co/guide/en/elasticsearch/reference/current/query-dsl-minimum-should-match.html
 	MinimumShouldMatch string
+
+	// Fuzziness optionally contains the value for the fuzziness
+	// parameter, which allows terms to match terms that are
+	// within an edit distance of them. For details of possible
+	// values please see:
+	// https://www.elastic.co/guide/en/elasticsearch/reference/1.3/common-options.html#fuzziness
+	Fuzziness string
 }
 
 func (m MultiMatchQuery) MarshalJSON() ([]byte, error) {
@@ -78,6 +85,9 @@ func (m MultiMatchQuery) MarshalJSON() ([]byte, error) {
 	if m.MinimumShouldMatch != "" {
 		mm["minimum_should_match"] = m.MinimumShouldMatch
 	}
+	if m.Fuzziness != "" {
+		mm["fuzziness"] = m.Fuzziness
+	}
 	return marshalNamedObject("multi_match", mm)
 }
 
@@ -233,6 +243,11 @@ type QueryDSL struct {
 	Query  Query        `json:"query,omitempty"`
 	Sort   []Sort       `json:"sort,omitempty"`
 	Source SourceFilter `json:"_source,omitempty"`
+
+	// Aggregations holds any aggregations to calculate over
+	// the documents matched by the query, keyed by the name
+	// under which their results will be returned.
+	Aggregations map[string]Aggregation `json:"aggregations,omitempty"`
 }
 
 type Sort struct {
@@ -283,3 +298,39 @@ func (f SourceFilter) MarshalJSON() ([]byte, error) {
 	}
 	return json.Marshal([]string(f))
 }
+
+// Query DSL - Aggregations
+
+// Aggregation represents an aggregation in the elasticsearch DSL. See
+// https://www.elastic.co/guide/en/elasticsearch/reference/1.3/search-aggregations.html
+// for details.
+type Aggregation interface {
+	json.Marshaler
+}
+
+// TermsAggregation provides an aggregation that counts the documents
+// holding each of the values of a field. The field should not be
+// analyzed.
+type TermsAggregation struct {
+	Field string
+
+	// Size optionally holds the maximum number of values to
+	// return. The values with the most documents are returned.
+	Size int
+}
+
+func (a TermsAggregation) MarshalJSON() ([]byte, error) {
+	params := map[string]interface{}{"field": a.Field}
+	if a.Size != 0 {
+		params["size"] = a.Size
+	}
+	return marshalNamedObject("terms", params)
+}
+
+// FiltersAggregation provides an aggregation that counts the documents
+// matching each of a set of named filters.
+type FiltersAggregation map[string]Filter
+
+func (a FiltersAggregation) MarshalJSON() ([]byte, error) {
+	return marshalNamedObject("filters", map[string]interface{}{"filters": map[string]Filter(a)})
+}
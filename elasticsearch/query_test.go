@@ -4,6 +4,8 @@
 package elasticsearch_test
 
 import (
+	"encoding/json"
+
 	jc "github.com/juju/testing/checkers"
 	gc "gopkg.in/check.v1"
 
@@ -39,6 +41,10 @@ func (s *QuerySuite) TestJSONEncodings(c *gc.C) {
 		about: "multi match query",
 		query: MultiMatchQuery{Query: "foo", Fields: []string{BoostField("bar", 2), "baz"}},
 		json:  `{"multi_match": {"query": "foo", "fields": ["bar^2.000000", "baz"]}}`,
+	}, {
+		about: "fuzzy multi match query",
+		query: MultiMatchQuery{Query: "foo", Fields: []string{"bar"}, Fuzziness: "AUTO"},
+		json:  `{"multi_match": {"query": "foo", "fields": ["bar"], "fuzziness": "AUTO"}}`,
 	}, {
 		about: "filtered query",
 		query: FilteredQuery{
@@ -139,6 +145,30 @@ func (s *QuerySuite) TestJSONEncodings(c *gc.C) {
 			Modifier: "bar",
 		},
 		json: `{"field_value_factor": {"field": "foo", "factor": 1.2, "modifier": "bar"}}`,
+	}, {
+		about: "terms aggregation",
+		query: TermsAggregation{Field: "foo", Size: 5},
+		json:  `{"terms": {"field": "foo", "size": 5}}`,
+	}, {
+		about: "terms aggregation without size",
+		query: TermsAggregation{Field: "foo"},
+		json:  `{"terms": {"field": "foo"}}`,
+	}, {
+		about: "filters aggregation",
+		query: FiltersAggregation{
+			"bar": TermFilter{Field: "foo", Value: "bar"},
+			"baz": NotFilter{TermFilter{Field: "foo", Value: "bar"}},
+		},
+		json: `{"filters": {"filters": {"bar": {"term": {"foo": "bar"}}, "baz": {"not": {"term": {"foo": "bar"}}}}}}`,
+	}, {
+		about: "query dsl with aggregations",
+		query: QueryDSL{
+			Query: MatchAllQuery{},
+			Aggregations: map[string]Aggregation{
+				"foo": TermsAggregation{Field: "foo"},
+			},
+		},
+		json: `{"fields": null, "query": {"match_all": {}}, "aggregations": {"foo": {"terms": {"field": "foo"}}}}`,
 	}}
 	for i, test := range tests {
 		c.Logf("%d: %s", i, test.about)
@@ -147,3 +177,34 @@ func (s *QuerySuite) TestJSONEncodings(c *gc.C) {
 		c.Assert(test.json, jc.JSONEquals, test.query)
 	}
 }
+
+var aggregationResultTests = []struct {
+	about  string
+	json   string
+	expect AggregationResult
+}{{
+	about: "terms aggregation result",
+	json:  `{"buckets": [{"key": "foo", "doc_count": 2}, {"key": "bar", "doc_count": 1}]}`,
+	expect: AggregationResult{
+		Buckets: []Bucket{{Key: "foo", DocCount: 2}, {Key: "bar", DocCount: 1}},
+	},
+}, {
+	about: "filters aggregation result",
+	json:  `{"buckets": {"foo": {"doc_count": 1}, "bar": {"doc_count": 2}}}`,
+	expect: AggregationResult{
+		Buckets: []Bucket{{Key: "bar", DocCount: 2}, {Key: "foo", DocCount: 1}},
+	},
+}, {
+	about: "no buckets",
+	json:  `{}`,
+}}
+
+func (s *QuerySuite) TestAggregationResultUnmarshalJSON(c *gc.C) {
+	for i, test := range aggregationResultTests {
+		c.Logf("%d: %s", i, test.about)
+		var r AggregationResult
+		err := json.Unmarshal([]byte(test.json), &r)
+		c.Assert(err, gc.Equals, nil)
+		c.Assert(r, jc.DeepEquals, test.expect)
+	}
+}
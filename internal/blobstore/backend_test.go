@@ -0,0 +1,167 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package blobstore_test
+
+import (
+	"net/http/httptest"
+
+	jujutesting "github.com/juju/testing"
+	gc "gopkg.in/check.v1"
+	"gopkg.in/goose.v2/identity"
+	"gopkg.in/goose.v2/testservices/openstackservice"
+	"gopkg.in/mgo.v2"
+
+	"gopkg.in/juju/charmstore.v5/internal/blobstore"
+	"gopkg.in/juju/charmstore.v5/internal/blobstore/blobstoretesting"
+)
+
+// The suites in this file run the backend conformance
+// tests against each of the backend implementations.
+
+type memoryBackendSuite struct {
+	blobstoretesting.BackendSuite
+}
+
+var _ = gc.Suite(&memoryBackendSuite{})
+
+func (s *memoryBackendSuite) SetUpTest(c *gc.C) {
+	s.NewBackend = func(c *gc.C) blobstore.Backend {
+		return blobstore.NewMemoryBackend()
+	}
+	s.BackendSuite.SetUpTest(c)
+}
+
+type filesystemBackendSuite struct {
+	blobstoretesting.BackendSuite
+}
+
+var _ = gc.Suite(&filesystemBackendSuite{})
+
+func (s *filesystemBackendSuite) SetUpTest(c *gc.C) {
+	s.NewBackend = func(c *gc.C) blobstore.Backend {
+		return blobstore.NewFilesystemBackend(c.MkDir())
+	}
+	s.BackendSuite.SetUpTest(c)
+}
+
+type mongoBackendSuite struct {
+	jujutesting.IsolatedMgoSuite
+	blobstoretesting.BackendSuite
+}
+
+var _ = gc.Suite(&mongoBackendSuite{})
+
+func (s *mongoBackendSuite) SetUpTest(c *gc.C) {
+	s.IsolatedMgoSuite.SetUpTest(c)
+	s.NewBackend = func(c *gc.C) blobstore.Backend {
+		return blobstore.NewMongoBackend(s.Session.DB("db"), "blobstore")
+	}
+	s.BufferedReads = true
+	s.BackendSuite.SetUpTest(c)
+}
+
+type swiftBackendSuite struct {
+	openstack *openstackservice.Openstack
+	blobstoretesting.BackendSuite
+}
+
+var _ = gc.Suite(&swiftBackendSuite{})
+
+func (s *swiftBackendSuite) SetUpTest(c *gc.C) {
+	var cred *identity.Credentials
+	s.openstack, cred = newOpenstack(c)
+	s.NewBackend = func(c *gc.C) blobstore.Backend {
+		return blobstore.NewSwiftBackend(cred, identity.AuthUserPass, "testc", c.MkDir())
+	}
+	s.BufferedReads = true
+	s.BackendSuite.SetUpTest(c)
+}
+
+func (s *swiftBackendSuite) TearDownTest(c *gc.C) {
+	s.openstack.Stop()
+}
+
+type s3BackendSuite struct {
+	server *httptest.Server
+	blobstoretesting.BackendSuite
+}
+
+var _ = gc.Suite(&s3BackendSuite{})
+
+func (s *s3BackendSuite) SetUpTest(c *gc.C) {
+	s.server = httptest.NewServer(newFakeS3("test-access-key", "testbucket"))
+	s.NewBackend = func(c *gc.C) blobstore.Backend {
+		be, err := blobstore.NewS3Backend(blobstore.S3Params{
+			Endpoint:  s.server.URL,
+			Region:    "us-east-1",
+			Bucket:    "testbucket",
+			AccessKey: "test-access-key",
+			SecretKey: "test-secret-key",
+		})
+		c.Assert(err, gc.Equals, nil)
+		return be
+	}
+	s.BufferedReads = true
+	s.BackendSuite.SetUpTest(c)
+}
+
+func (s *s3BackendSuite) TearDownTest(c *gc.C) {
+	s.server.Close()
+}
+
+type cachingBackendSuite struct {
+	blobstoretesting.BackendSuite
+}
+
+var _ = gc.Suite(&cachingBackendSuite{})
+
+func (s *cachingBackendSuite) SetUpTest(c *gc.C) {
+	s.NewBackend = func(c *gc.C) blobstore.Backend {
+		cache, err := blobstore.NewCache(blobstore.CacheParams{
+			Dir:     c.MkDir(),
+			MaxSize: 1024 * 1024,
+		})
+		c.Assert(err, gc.Equals, nil)
+		return cache.Backend(blobstore.NewMemoryBackend())
+	}
+	s.BackendSuite.SetUpTest(c)
+}
+
+type replicatingBackendSuite struct {
+	blobstoretesting.BackendSuite
+}
+
+var _ = gc.Suite(&replicatingBackendSuite{})
+
+func (s *replicatingBackendSuite) SetUpTest(c *gc.C) {
+	s.NewBackend = func(c *gc.C) blobstore.Backend {
+		rs, err := blobstore.NewReplicaSet(blobstore.ReplicaSetParams{
+			Replicas: 3,
+		})
+		c.Assert(err, gc.Equals, nil)
+		return rs.Backend(
+			blobstore.NewMemoryBackend(),
+			blobstore.NewMemoryBackend(),
+			blobstore.NewMemoryBackend(),
+		)
+	}
+	s.BackendSuite.SetUpTest(c)
+}
+
+// MemoryStoreSuite runs the blob store tests
+// with the in-memory backend.
+type MemoryStoreSuite struct {
+	blobStoreSuite
+}
+
+var _ = gc.Suite(&MemoryStoreSuite{})
+
+func (s *MemoryStoreSuite) SetUpTest(c *gc.C) {
+	// All the stores created by a test must share
+	// the same backend.
+	backend := blobstore.NewMemoryBackend()
+	s.blobStoreSuite.SetUpTest(c, func(db *mgo.Database) blobstore.Backend {
+		return backend
+	})
+}
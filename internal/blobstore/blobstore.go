@@ -37,7 +37,8 @@ func NewHash() hash.Hash {
 const hashSize = sha512.Size384
 
 // Backend represents the underlying data store used by blobstore.Store
-// to store blob data.
+// to store blob data. The blobstoretesting package holds tests that
+// check that a Backend implementation behaves as described here.
 type Backend interface {
 	// Get gets a reader for the object with the given name
 	// and its size. The returned reader should be closed after use.
@@ -70,18 +71,60 @@ type blobRefDoc struct {
 	PutTime time.Time
 	// Size holds the size of the blob.
 	Size int64 `bson:"size"`
-
-	// TODO store the kind of object that
-	// caused the reference to be created
-	// so that we can report it as a statistic?
+	// KeyId holds the id of the master key used to wrap
+	// the blob's data key. It is empty if the blob is
+	// not encrypted.
+	KeyId string `bson:"keyid,omitempty"`
+	// DataKey holds the wrapped key that the blob's
+	// data is encrypted with.
+	DataKey []byte `bson:"datakey,omitempty"`
+	// Compression holds the method used to compress the
+	// blob's data (see compression.go). It is empty if the
+	// blob is stored uncompressed.
+	Compression string `bson:"compression,omitempty"`
+	// StoredSize and StoredHash hold the size and hash of the
+	// compressed data of a compressed blob. The hash is that
+	// of the data before any encryption.
+	StoredSize int64  `bson:"storedsize,omitempty"`
+	StoredHash string `bson:"storedhash,omitempty"`
+	// Frames holds the offset of each frame in
+	// the compressed data of a compressed blob.
+	Frames []int64 `bson:"frames,omitempty"`
+	// Kind holds the kind of object that referred to the
+	// blob when the garbage collector last ran. It is
+	// empty if the blob has never been seen by the
+	// garbage collector.
+	Kind BlobKind `bson:"kind,omitempty"`
 }
 
+// BlobKind describes the kind of object that refers to a blob.
+type BlobKind string
+
+const (
+	// ArchiveBlob is used for the archive of a charm or bundle.
+	ArchiveBlob BlobKind = "archive"
+
+	// PreV5ArchiveBlob is used for the extra blob that holds
+	// the pre-v5 compatibility version of a charm archive.
+	PreV5ArchiveBlob BlobKind = "prev5-archive"
+
+	// ResourceBlob is used for the content of a resource.
+	ResourceBlob BlobKind = "resource"
+
+	// MultipartPartBlob is used for a part of a multipart blob,
+	// including the parts of in-progress uploads.
+	MultipartPartBlob BlobKind = "multipart-part"
+)
+
 // Store stores data blobs in mongodb, de-duplicating by
 // blob hash.
 type Store struct {
-	uploadc  *mgo.Collection
-	blobRefc *mgo.Collection
-	backend  Backend
+	uploadc      *mgo.Collection
+	blobRefc     *mgo.Collection
+	scrubc       *mgo.Collection
+	scrubStatusc *mgo.Collection
+	migrationc   *mgo.Collection
+	backend      Backend
 
 	// The following fields are given default values by
 	// New but may be changed away from the defaults
@@ -96,18 +139,41 @@ type Store struct {
 	// MaxParts holds the maximum number of parts that there
 	// can be in a multipart upload.
 	MaxParts int
+
+	// Keyring holds the master keys used to encrypt blob data.
+	// If it is nil, new blobs are stored unencrypted and
+	// encrypted blobs cannot be read.
+	Keyring *Keyring
+
+	// Compress holds whether new blobs should be stored
+	// compressed. Compressed blobs can always be read,
+	// regardless of its value.
+	Compress bool
+
+	// TempDir holds the directory in which temporary files
+	// holding large blobs are created. If it's empty, the
+	// default directory for temporary files is used.
+	TempDir string
+
+	// SecondaryBackend optionally holds a backend that blobs are
+	// being migrated from (see Migrate). Blobs that are not found
+	// in the primary backend are read from it.
+	SecondaryBackend Backend
 }
 
 // New returns a new blob store that writes to the given database,
 // prefixing its collections with the given prefix.
 func New(db *mgo.Database, prefix string, backend Backend) *Store {
 	return &Store{
-		uploadc:     db.C(prefix + ".upload"),
-		blobRefc:    db.C(prefix + ".blobref"),
-		backend:     backend,
-		MinPartSize: defaultMinPartSize,
-		MaxParts:    defaultMaxParts,
-		MaxPartSize: defaultMaxPartSize,
+		uploadc:      db.C(prefix + ".upload"),
+		blobRefc:     db.C(prefix + ".blobref"),
+		scrubc:       db.C(prefix + ".scrub"),
+		scrubStatusc: db.C(prefix + ".scrubstatus"),
+		migrationc:   db.C(prefix + ".migration"),
+		backend:      backend,
+		MinPartSize:  defaultMinPartSize,
+		MaxParts:     defaultMaxParts,
+		MaxPartSize:  defaultMaxPartSize,
 	}
 }
 
@@ -169,15 +235,21 @@ func (s *Store) PutAtTime(r io.Reader, hash string, size int64, now time.Time) e
 	// some of the hash in there for debugging purposes)
 	uuid := uuidGen.Next()
 	name := fmt.Sprintf(hash[0:16] + "-" + fmt.Sprintf("%x", uuid[0:8]))
-	if err := s.backend.Put(name, r, size, hash); err != nil {
-		return errgo.Mask(err, errgo.Is(io.ErrUnexpectedEOF))
-	}
-	err = s.blobRefc.Insert(&blobRefDoc{
+	ref := &blobRefDoc{
 		Hash:    hash,
 		Name:    name,
 		PutTime: now,
 		Size:    size,
-	})
+	}
+	if s.Compress {
+		err = s.putCompressed(ref, r)
+	} else {
+		err = s.putStored(ref, r, size, hash)
+	}
+	if err != nil {
+		return errgo.Mask(err, errgo.Is(io.ErrUnexpectedEOF))
+	}
+	err = s.blobRefc.Insert(ref)
 	if err == nil {
 		return nil
 	}
@@ -204,42 +276,159 @@ func (s *Store) Open(hash string, index *mongodoc.MultipartIndex) (ReadSeekClose
 	if err != nil {
 		return nil, 0, errgo.Mask(err, errgo.Is(ErrNotFound))
 	}
-	r, size, err := s.backend.Get(ref.Name)
+	r, size, err := s.readBackend(s.backend).Get(ref.Name)
 	if err != nil {
 		return nil, 0, errgo.NoteMask(err, "cannot get blob from backend", errgo.Is(ErrNotFound))
 	}
-	return r, size, nil
+	cr, err := s.contentReader(ref, r)
+	if err != nil {
+		r.Close()
+		return nil, 0, errgo.Mask(err)
+	}
+	if ref.Compression != "" {
+		size = ref.Size
+	}
+	return cr, size, nil
+}
+
+// putStored puts the data read from r, which must have the given size
+// and hash, into the backend as the data of the blob with the given
+// ref, encrypting it if the store has a keyring.
+func (s *Store) putStored(ref *blobRefDoc, r io.Reader, size int64, hash string) error {
+	if s.Keyring == nil {
+		return errgo.Mask(s.backend.Put(ref.Name, r, size, hash), errgo.Is(io.ErrUnexpectedEOF))
+	}
+	var err error
+	ref.KeyId, ref.DataKey, err = s.putEncrypted(ref.Name, r, size, hash, ref.Hash)
+	return errgo.Mask(err, errgo.Is(io.ErrUnexpectedEOF))
+}
+
+// storedSize returns the size of the blob's data as held
+// by the backend.
+func (ref *blobRefDoc) storedSize() int64 {
+	if ref.Compression != "" {
+		return ref.StoredSize
+	}
+	return ref.Size
+}
+
+// storedHash returns the hash of the blob's data as held by the
+// backend, or the empty string if it is not known.
+func (ref *blobRefDoc) storedHash() string {
+	switch {
+	case ref.KeyId != "":
+		// The hash of encrypted data isn't recorded.
+		return ""
+	case ref.Compression != "":
+		return ref.StoredHash
+	}
+	return ref.Hash
 }
 
 // GC runs the garbage collector, deleting all blobs not present in refs
 // that have not been Put since the given time.
 // Note that it also adds any internal blobs held by
 // in-progress uploads to refs.
+//
+// The kind of each blob in refs is recorded in its blob ref.
 func (s *Store) GC(refs *Refs, before time.Time) (monitoring.BlobStats, error) {
-	fail := func(err error) (monitoring.BlobStats, error) {
-		return monitoring.BlobStats{}, err
+	report, err := s.gc(refs, before, false)
+	if err != nil {
+		return monitoring.BlobStats{}, errgo.Mask(err)
+	}
+	return report.Stats, nil
+}
+
+// GCDryRun is like GC except that it does not remove or change
+// anything. Instead, it reports the blobs that GC would remove.
+func (s *Store) GCDryRun(refs *Refs, before time.Time) (*GCReport, error) {
+	report, err := s.gc(refs, before, true)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return report, nil
+}
+
+// GCReport holds the results of a garbage collector dry run.
+type GCReport struct {
+	// Stats holds statistics about the blobs that
+	// would be kept.
+	Stats monitoring.BlobStats `json:"stats"`
+
+	// Garbage holds the blobs that would be removed.
+	Garbage []GarbageBlob `json:"garbage"`
+}
+
+// GarbageBlob holds information about a blob that
+// would be removed by the garbage collector.
+type GarbageBlob struct {
+	// Hash holds the hash of the blob.
+	Hash string `json:"hash"`
+
+	// Name holds the name of the blob in the backend.
+	Name string `json:"name"`
+
+	// Size holds the size of the blob.
+	Size int64 `json:"size"`
+
+	// PutTime holds the last time the blob was Put.
+	PutTime time.Time `json:"put-time"`
+
+	// Reason describes why the blob would be removed.
+	Reason string `json:"reason"`
+}
+
+func (s *Store) gc(refs *Refs, before time.Time, dryRun bool) (*GCReport, error) {
+	report := &GCReport{
+		Stats: monitoring.BlobStats{
+			Kinds: make(map[string]monitoring.BlobKindStats),
+		},
+		Garbage: []GarbageBlob{},
 	}
-	var stats monitoring.BlobStats
+	stats := &report.Stats
 	totalSize := int64(0)
 	if err := s.addUploadRefs(refs); err != nil {
-		return fail(errgo.Mask(err))
+		return nil, errgo.Mask(err)
 	}
 	iter := s.blobRefc.Find(bson.D{{"puttime", bson.D{{"$lte", before}}}}).
-		Select(bson.D{{"name", 1}, {"size", 1}}).
+		Select(bson.D{{"name", 1}, {"size", 1}, {"puttime", 1}, {"kind", 1}}).
 		Batch(5000).
 		Iter()
 	var doc blobRefDoc
 	for iter.Next(&doc) {
-		if refs.contains(doc.Hash) {
+		if kind, ok := refs.kind(doc.Hash); ok {
 			totalSize += doc.Size
 			stats.Count++
 			if doc.Size > stats.MaxSize {
 				stats.MaxSize = doc.Size
 			}
+			kindStats := stats.Kinds[string(kind)]
+			kindStats.Count++
+			kindStats.Size += doc.Size
+			stats.Kinds[string(kind)] = kindStats
+			if doc.Kind != kind && !dryRun {
+				if err := s.blobRefc.UpdateId(doc.Hash, bson.D{{"$set", bson.D{{"kind", kind}}}}); err != nil && err != mgo.ErrNotFound {
+					return nil, errgo.Notef(err, "cannot update blobref kind")
+				}
+			}
 			continue
 		}
 		// Blob not found in refs, which means it's garbage
 		// and should be collected right now.
+		if dryRun {
+			reason := "never referenced"
+			if doc.Kind != "" {
+				reason = fmt.Sprintf("no longer referenced as %s", doc.Kind)
+			}
+			report.Garbage = append(report.Garbage, GarbageBlob{
+				Hash:    doc.Hash,
+				Name:    doc.Name,
+				Size:    doc.Size,
+				PutTime: doc.PutTime,
+				Reason:  reason,
+			})
+			continue
+		}
 		if err := s.blobRefc.Remove(bson.D{{
 			"puttime", bson.D{{"$lte", before}},
 		}, {
@@ -253,9 +442,9 @@ func (s *Store) GC(refs *Refs, before time.Time) (monitoring.BlobStats, error) {
 				// remove the blob.
 				continue
 			}
-			return fail(errgo.Notef(err, "cannot remove blobref entry"))
+			return nil, errgo.Notef(err, "cannot remove blobref entry")
 		}
-		if err := s.backend.Remove(doc.Name); err != nil {
+		if err := s.readBackend(s.backend).Remove(doc.Name); err != nil {
 			logger.Errorf("cannot remove garbage blob %q from backend (hash %q)", doc.Name, doc.Hash)
 		}
 		logger.Infof("removed garbage blob %q; hash %s", doc.Name, doc.Hash)
@@ -264,13 +453,14 @@ func (s *Store) GC(refs *Refs, before time.Time) (monitoring.BlobStats, error) {
 		stats.MeanSize = totalSize / int64(stats.Count)
 	}
 	if err := iter.Close(); err != nil {
-		return fail(errgo.Notef(err, "cannot iterate over blobrefs"))
+		return nil, errgo.Notef(err, "cannot iterate over blobrefs")
 	}
-	return stats, nil
+	return report, nil
 }
 
 // Refs holds information about the existence of
-// a set of blob hashes.
+// a set of blob hashes and the kind of object that
+// refers to each one.
 type Refs struct {
 	// TODO this implementation is good enough for up to a million
 	// or so hashes (at the time of writing the number is ~45000),
@@ -278,7 +468,7 @@ type Refs struct {
 	// mitigation without loss of precision would be to limit the
 	// number of bytes used for each entry (even 4 or 8 bytes may be
 	// sufficient, with a probe to check for false positives).
-	refs map[[hashSize]byte]struct{}
+	refs map[[hashSize]byte]BlobKind
 }
 
 // NewRefs returns a new Refs instance,
@@ -287,31 +477,34 @@ type Refs struct {
 // need to match this).
 func NewRefs(n int) *Refs {
 	return &Refs{
-		refs: make(map[[hashSize]byte]struct{}, n),
+		refs: make(map[[hashSize]byte]BlobKind, n),
 	}
 }
 
-// Add records that the given hash is referenced.
-// It ignores the hash if it's invalid.
-func (r *Refs) Add(hash string) {
+// Add records that the given hash is referenced by an object of the
+// given kind. It ignores the hash if it's invalid. If the hash has
+// already been added, the kind it was first added with is retained.
+func (r *Refs) Add(hash string, kind BlobKind) {
 	data, err := decodeHash(hash)
 	if err != nil {
 		logger.Errorf("cannot add bad hash %q: %v", hash, err)
 		return
 	}
-	r.refs[data] = struct{}{}
+	if _, ok := r.refs[data]; !ok {
+		r.refs[data] = kind
+	}
 }
 
-// contains reports whether the given hash has been
-// added to r.
-func (r *Refs) contains(hash string) bool {
+// kind reports whether the given hash has been
+// added to r, and if so, the kind it was added with.
+func (r *Refs) kind(hash string) (BlobKind, bool) {
 	data, err := decodeHash(hash)
 	if err != nil {
 		logger.Errorf("cannot check bad hash %q: %v", hash, err)
-		return false
+		return "", false
 	}
-	_, ok := r.refs[data]
-	return ok
+	kind, ok := r.refs[data]
+	return kind, ok
 }
 
 func (s *Store) updatePutTime(hash string, now time.Time) error {
@@ -333,6 +526,25 @@ func (s *Store) blobRef(hash string) (*blobRefDoc, error) {
 	return &r, nil
 }
 
+// blobRefBatchSize holds the number of blob refs read from
+// the database at a time by blobRefsAfter.
+var blobRefBatchSize = 100
+
+// blobRefsAfter returns the next batch of blob refs in hash order,
+// starting after the given hash. Walks over all the blobs, such as
+// Scrub, read each batch with a new query rather than holding a cursor
+// open for the whole walk, which can take much longer than the
+// server's cursor timeout.
+func (s *Store) blobRefsAfter(hash string) ([]blobRefDoc, error) {
+	var docs []blobRefDoc
+	if err := s.blobRefc.Find(bson.D{{
+		"_id", bson.D{{"$gt", hash}},
+	}}).Sort("_id").Limit(blobRefBatchSize).All(&docs); err != nil {
+		return nil, errgo.Notef(err, "cannot get blobrefs")
+	}
+	return docs, nil
+}
+
 // decodeHash decodes the hex-encoded hash
 // and reports whether it has decoded successfully.
 func decodeHash(hash string) ([hashSize]byte, error) {
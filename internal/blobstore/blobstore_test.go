@@ -4,9 +4,12 @@
 package blobstore_test
 
 import (
+	"bytes"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -59,7 +62,43 @@ type SwiftStoreSuite struct {
 var _ = gc.Suite(&SwiftStoreSuite{})
 
 func (s *SwiftStoreSuite) SetUpTest(c *gc.C) {
-	// Set up an Openstack service.
+	var cred *identity.Credentials
+	s.openstack, cred = newOpenstack(c)
+	s.blobStoreSuite.SetUpTest(c, func(db *mgo.Database) blobstore.Backend {
+		return blobstore.NewSwiftBackend(cred, identity.AuthUserPass, "testc", c.MkDir())
+	})
+}
+
+func (s *SwiftStoreSuite) TearDownTest(c *gc.C) {
+	s.blobStoreSuite.TearDownTest(c)
+	s.openstack.Stop()
+}
+
+func (s *SwiftStoreSuite) TestPutInvalidHashBuffered(c *gc.C) {
+	content := "some data"
+	err := s.store.Put(justReader{strings.NewReader(content)}, hashOf("wrong"), int64(len(content)))
+	c.Assert(err, gc.ErrorMatches, "hash mismatch")
+}
+
+func (s *SwiftStoreSuite) TestTemporaryDirectory(c *gc.C) {
+	cred := &identity.Credentials{
+		URL:        s.openstack.URLs["identity"],
+		User:       "fred",
+		Secrets:    "secret",
+		Region:     "some region",
+		TenantName: "tenant",
+	}
+
+	var r io.Reader
+	be := blobstore.NewSwiftBackend(cred, identity.AuthUserPass, "testc", "/no/such/path")
+	err := be.Put("test", r, 11*1024*1024, "a hash")
+	c.Assert(err, gc.ErrorMatches, `open /no/such/path/test: no such file or directory`)
+}
+
+// newOpenstack starts an Openstack service with a Swift container
+// named "testc" and returns it along with the credentials to use
+// to access it.
+func newOpenstack(c *gc.C) (*openstackservice.Openstack, *identity.Credentials) {
 	cred := &identity.Credentials{
 		URL:        "http://0.1.2.3/",
 		User:       "fred",
@@ -67,15 +106,14 @@ func (s *SwiftStoreSuite) SetUpTest(c *gc.C) {
 		Region:     "some region",
 		TenantName: "tenant",
 	}
-	var logMsg []string
-	s.openstack, logMsg = openstackservice.New(cred, identity.AuthUserPass, false)
+	openstack, logMsg := openstackservice.New(cred, identity.AuthUserPass, false)
 	for _, msg := range logMsg {
 		c.Logf(msg)
 	}
-	s.openstack.SetupHTTP(nil)
+	openstack.SetupHTTP(nil)
 
 	cred2 := &identity.Credentials{
-		URL:        s.openstack.URLs["identity"],
+		URL:        openstack.URLs["identity"],
 		User:       "fred",
 		Secrets:    "secret",
 		Region:     "some region",
@@ -85,42 +123,83 @@ func (s *SwiftStoreSuite) SetUpTest(c *gc.C) {
 	client := client.NewClient(cred, identity.AuthUserPass, nil)
 	sw := swift.New(client)
 	sw.CreateContainer("testc", swift.Private)
+	return openstack, cred2
+}
+
+type FilesystemStoreSuite struct {
+	root string
+	blobStoreSuite
+}
+
+var _ = gc.Suite(&FilesystemStoreSuite{})
 
+func (s *FilesystemStoreSuite) SetUpTest(c *gc.C) {
+	s.root = c.MkDir()
 	s.blobStoreSuite.SetUpTest(c, func(db *mgo.Database) blobstore.Backend {
-		return blobstore.NewSwiftBackend(cred2, identity.AuthUserPass, "testc", c.MkDir())
+		return blobstore.NewFilesystemBackend(s.root)
 	})
 }
 
-func (s *SwiftStoreSuite) TearDownTest(c *gc.C) {
-	s.blobStoreSuite.TearDownTest(c)
-	s.openstack.Stop()
+func (s *FilesystemStoreSuite) TestPutStoresShardedFile(c *gc.C) {
+	be := blobstore.NewFilesystemBackend(s.root)
+	content := "some data"
+	err := be.Put("0123abcd", strings.NewReader(content), int64(len(content)), hashOf(content))
+	c.Assert(err, gc.Equals, nil)
+
+	data, err := ioutil.ReadFile(filepath.Join(s.root, "01", "23", "0123abcd"))
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(string(data), gc.Equals, content)
 }
 
-func (s *SwiftStoreSuite) TestPutInvalidHashBuffered(c *gc.C) {
+func (s *FilesystemStoreSuite) TestPutFailureLeavesNoFiles(c *gc.C) {
+	be := blobstore.NewFilesystemBackend(s.root)
 	content := "some data"
-	err := s.store.Put(justReader{strings.NewReader(content)}, hashOf("wrong"), int64(len(content)))
+	err := be.Put("0123abcd", strings.NewReader(content), int64(len(content)), hashOf("wrong"))
 	c.Assert(err, gc.ErrorMatches, "hash mismatch")
+
+	err = be.Put("0123abcd", strings.NewReader(content), int64(len(content))+1, hashOf(content))
+	c.Assert(errgo.Cause(err), gc.Equals, io.ErrUnexpectedEOF)
+
+	_, _, err = be.Get("0123abcd")
+	c.Assert(errgo.Cause(err), gc.Equals, blobstore.ErrNotFound)
+	tmpFiles, err := ioutil.ReadDir(filepath.Join(s.root, "tmp"))
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(tmpFiles, gc.HasLen, 0)
 }
 
-func (s *SwiftStoreSuite) TestTemporaryDirectory(c *gc.C) {
-	cred := &identity.Credentials{
-		URL:        s.openstack.URLs["identity"],
-		User:       "fred",
-		Secrets:    "secret",
-		Region:     "some region",
-		TenantName: "tenant",
-	}
+func (s *FilesystemStoreSuite) TestRemoveNotFound(c *gc.C) {
+	be := blobstore.NewFilesystemBackend(s.root)
+	err := be.Remove("0123abcd")
+	c.Assert(errgo.Cause(err), gc.Equals, blobstore.ErrNotFound)
+}
 
-	var r io.Reader
-	be := blobstore.NewSwiftBackend(cred, identity.AuthUserPass, "testc", "/no/such/path")
-	err := be.Put("test", r, 11*1024*1024, "a hash")
-	c.Assert(err, gc.ErrorMatches, `open /no/such/path/test: no such file or directory`)
+func (s *FilesystemStoreSuite) TestRemoveWhileReading(c *gc.C) {
+	be := blobstore.NewFilesystemBackend(s.root)
+	content := "some data"
+	err := be.Put("0123abcd", strings.NewReader(content), int64(len(content)), hashOf(content))
+	c.Assert(err, gc.Equals, nil)
+
+	r, _, err := be.Get("0123abcd")
+	c.Assert(err, gc.Equals, nil)
+	defer r.Close()
+	err = be.Remove("0123abcd")
+	c.Assert(err, gc.Equals, nil)
+	_, err = r.Read(make([]byte, 4))
+	c.Assert(errgo.Cause(err), gc.Equals, blobstore.ErrNotFound)
+}
+
+func (s *FilesystemStoreSuite) TestInvalidName(c *gc.C) {
+	be := blobstore.NewFilesystemBackend(s.root)
+	_, _, err := be.Get("../foo")
+	c.Assert(err, gc.ErrorMatches, `invalid blob name "../foo"`)
 }
 
 type blobStoreSuite struct {
 	jujutesting.IsolatedMgoSuite
 	store      *blobstore.Store
 	newBackend func(db *mgo.Database) blobstore.Backend
+	keyring    *blobstore.Keyring
+	compress   bool
 }
 
 func (s *blobStoreSuite) SetUpTest(c *gc.C, newBackend func(db *mgo.Database) blobstore.Backend) {
@@ -150,14 +229,24 @@ func (s *blobStoreSuite) TestGC(c *gc.C) {
 		c.Assert(err, gc.Equals, nil)
 	}
 	refs := blobstore.NewRefs(0)
-	refs.Add(hashOf(content(2)))
-	refs.Add(hashOf(content(5)))
+	refs.Add(hashOf(content(2)), blobstore.ArchiveBlob)
+	refs.Add(hashOf(content(5)), blobstore.ResourceBlob)
 	stats, err := s.store.GC(refs, time.Now())
 	c.Assert(err, gc.Equals, nil)
 	c.Assert(stats, jc.DeepEquals, monitoring.BlobStats{
 		Count:    2,
 		MaxSize:  5,
 		MeanSize: (2 + 5) / 2,
+		Kinds: map[string]monitoring.BlobKindStats{
+			"archive": {
+				Count: 1,
+				Size:  2,
+			},
+			"resource": {
+				Count: 1,
+				Size:  5,
+			},
+		},
 	})
 
 	s.assertBlobContent(c, nil, content(2))
@@ -172,6 +261,229 @@ func (s *blobStoreSuite) TestGC(c *gc.C) {
 	}
 }
 
+func (s *blobStoreSuite) TestGCDryRun(c *gc.C) {
+	contents := []string{"foo", "bar", "baz!"}
+	now := time.Now()
+	put := func(content string) {
+		err := s.store.PutAtTime(strings.NewReader(content), hashOf(content), int64(len(content)), now)
+		c.Assert(err, gc.Equals, nil)
+	}
+	put("foo")
+	put("bar")
+	refs := blobstore.NewRefs(0)
+	refs.Add(hashOf("foo"), blobstore.ArchiveBlob)
+	refs.Add(hashOf("bar"), blobstore.PreV5ArchiveBlob)
+	// The kind that a hash is first added with is used.
+	refs.Add(hashOf("foo"), blobstore.MultipartPartBlob)
+	_, err := s.store.GC(refs, now)
+	c.Assert(err, gc.Equals, nil)
+	put("baz!")
+
+	refs = blobstore.NewRefs(0)
+	refs.Add(hashOf("foo"), blobstore.ArchiveBlob)
+	report, err := s.store.GCDryRun(refs, now)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(report.Stats, jc.DeepEquals, monitoring.BlobStats{
+		Count:    1,
+		MaxSize:  3,
+		MeanSize: 3,
+		Kinds: map[string]monitoring.BlobKindStats{
+			"archive": {
+				Count: 1,
+				Size:  3,
+			},
+		},
+	})
+	for i := range report.Garbage {
+		c.Assert(report.Garbage[i].PutTime.IsZero(), gc.Equals, false)
+		report.Garbage[i].PutTime = time.Time{}
+		c.Assert(report.Garbage[i].Name, gc.Not(gc.Equals), "")
+		report.Garbage[i].Name = ""
+	}
+	sort.Slice(report.Garbage, func(i, j int) bool {
+		return report.Garbage[i].Size < report.Garbage[j].Size
+	})
+	c.Assert(report.Garbage, jc.DeepEquals, []blobstore.GarbageBlob{{
+		Hash:   hashOf("bar"),
+		Size:   3,
+		Reason: "no longer referenced as prev5-archive",
+	}, {
+		Hash:   hashOf("baz!"),
+		Size:   4,
+		Reason: "never referenced",
+	}})
+
+	// Nothing has actually been removed.
+	for _, content := range contents {
+		s.assertBlobContent(c, nil, content)
+	}
+}
+
+func (s *blobStoreSuite) TestScrub(c *gc.C) {
+	contents := []string{"good", "corrupt", "missing"}
+	for _, content := range contents {
+		err := s.store.Put(strings.NewReader(content), hashOf(content), int64(len(content)))
+		c.Assert(err, gc.Equals, nil)
+	}
+	backend := blobstore.StoreBackend(s.store)
+
+	// Replace the content of one blob with some other content.
+	corruptName, err := blobstore.BlobName(s.store, hashOf("corrupt"))
+	c.Assert(err, gc.Equals, nil)
+	r, _, err := backend.Get(corruptName)
+	c.Assert(err, gc.Equals, nil)
+	original, err := ioutil.ReadAll(r)
+	r.Close()
+	c.Assert(err, gc.Equals, nil)
+	err = backend.Remove(corruptName)
+	c.Assert(err, gc.Equals, nil)
+	err = backend.Put(corruptName, strings.NewReader("corrupX"), 7, hashOf("corrupX"))
+	c.Assert(err, gc.Equals, nil)
+
+	// Remove another one from the backend entirely.
+	missingName, err := blobstore.BlobName(s.store, hashOf("missing"))
+	c.Assert(err, gc.Equals, nil)
+	err = backend.Remove(missingName)
+	c.Assert(err, gc.Equals, nil)
+
+	stats, err := s.store.Scrub(blobstore.ScrubParams{})
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(stats, jc.DeepEquals, monitoring.BlobScrubStats{
+		Checked:      3,
+		CheckedBytes: 4 + 7,
+		Failed:       2,
+	})
+	failures, err := s.store.ScrubFailures()
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(failures, gc.HasLen, 2)
+	failureErrors := make(map[string]string)
+	for _, f := range failures {
+		failureErrors[f.Name] = f.Error
+	}
+	c.Assert(failureErrors, jc.DeepEquals, map[string]string{
+		corruptName: "hash mismatch",
+		missingName: "blob not found in backend",
+	})
+
+	// When the blob is fixed, the failure is removed
+	// by the next scrub.
+	err = backend.Remove(corruptName)
+	c.Assert(err, gc.Equals, nil)
+	err = backend.Put(corruptName, bytes.NewReader(original), int64(len(original)), hashOf(string(original)))
+	c.Assert(err, gc.Equals, nil)
+	stats, err = s.store.Scrub(blobstore.ScrubParams{})
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(stats.Failed, gc.Equals, 1)
+	failures, err = s.store.ScrubFailures()
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(failures, gc.HasLen, 1)
+	c.Assert(failures[0].Name, gc.Equals, missingName)
+}
+
+func (s *blobStoreSuite) TestScrubSizeMismatch(c *gc.C) {
+	content := "some data"
+	err := s.store.Put(strings.NewReader(content), hashOf(content), int64(len(content)))
+	c.Assert(err, gc.Equals, nil)
+	backend := blobstore.StoreBackend(s.store)
+	name, err := blobstore.BlobName(s.store, hashOf(content))
+	c.Assert(err, gc.Equals, nil)
+	err = backend.Remove(name)
+	c.Assert(err, gc.Equals, nil)
+	err = backend.Put(name, strings.NewReader("some"), 4, hashOf("some"))
+	c.Assert(err, gc.Equals, nil)
+
+	_, err = s.store.Scrub(blobstore.ScrubParams{})
+	c.Assert(err, gc.Equals, nil)
+	failures, err := s.store.ScrubFailures()
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(failures, gc.HasLen, 1)
+	c.Assert(failures[0].Error, gc.Equals, "size mismatch (got 4, expected 9)")
+	c.Assert(failures[0].ActualSize, gc.Equals, int64(4))
+}
+
+func (s *blobStoreSuite) TestScrubRateLimit(c *gc.C) {
+	content := strings.Repeat("x", 1000)
+	err := s.store.Put(strings.NewReader(content), hashOf(content), int64(len(content)))
+	c.Assert(err, gc.Equals, nil)
+
+	t0 := time.Now()
+	stats, err := s.store.Scrub(blobstore.ScrubParams{
+		BytesPerSecond: 5000,
+	})
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(stats.Failed, gc.Equals, 0)
+	c.Assert(time.Since(t0) >= 200*time.Millisecond, gc.Equals, true)
+}
+
+func (s *blobStoreSuite) TestScrubStop(c *gc.C) {
+	content := strings.Repeat("x", 1000)
+	err := s.store.Put(strings.NewReader(content), hashOf(content), int64(len(content)))
+	c.Assert(err, gc.Equals, nil)
+
+	stop := make(chan struct{})
+	close(stop)
+	_, err = s.store.Scrub(blobstore.ScrubParams{
+		Stop: stop,
+	})
+	c.Assert(err, gc.Equals, blobstore.ErrScrubStopped)
+}
+
+func (s *blobStoreSuite) TestScrubResume(c *gc.C) {
+	s.PatchValue(blobstore.BlobRefBatchSize, 1)
+	for _, content := range []string{"a", "b", "c"} {
+		err := s.store.Put(strings.NewReader(content), hashOf(content), int64(len(content)))
+		c.Assert(err, gc.Equals, nil)
+	}
+	// Stop the scrub while it's reading the first blob.
+	stop := make(chan struct{})
+	backend := &getHookBackend{
+		Backend: blobstore.StoreBackend(s.store),
+		onGet: func() {
+			close(stop)
+		},
+	}
+	store := blobstore.New(s.Session.DB("db"), "blobstore", backend)
+	store.Keyring = s.keyring
+	store.Compress = s.compress
+	stats, err := store.Scrub(blobstore.ScrubParams{
+		Stop: stop,
+	})
+	c.Assert(err, gc.Equals, blobstore.ErrScrubStopped)
+	c.Assert(stats.Checked, gc.Equals, 1)
+	c.Assert(backend.gets, gc.Equals, 1)
+
+	// Scrubbing again checks only the remaining blobs,
+	// but the statistics cover the whole scrub.
+	backend.onGet = nil
+	stats, err = store.Scrub(blobstore.ScrubParams{})
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(stats.Checked, gc.Equals, 3)
+	c.Assert(stats.Failed, gc.Equals, 0)
+	c.Assert(backend.gets, gc.Equals, 3)
+
+	// The next scrub starts from the beginning.
+	stats, err = store.Scrub(blobstore.ScrubParams{})
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(stats.Checked, gc.Equals, 3)
+	c.Assert(backend.gets, gc.Equals, 6)
+}
+
+// getHookBackend counts the number of calls to Get,
+// calling onGet, if set, before each one.
+type getHookBackend struct {
+	blobstore.Backend
+	onGet func()
+	gets  int
+}
+
+func (b *getHookBackend) Get(name string) (blobstore.ReadSeekCloser, int64, error) {
+	b.gets++
+	if b.onGet != nil {
+		b.onGet()
+	}
+	return b.Backend.Get(name)
+}
+
 func (s *blobStoreSuite) TestPutInvalidHash(c *gc.C) {
 	content := "some data"
 	err := s.store.Put(strings.NewReader(content), hashOf("wrong"), int64(len(content)))
@@ -912,6 +1224,8 @@ func (s *blobStoreSuite) TestUploadInfo(c *gc.C) {
 	}
 	info.Expires = time.Time{}
 	c.Assert(info, jc.DeepEquals, blobstore.UploadInfo{
+		Id:    id,
+		Owner: "test",
 		Parts: []*blobstore.PartInfo{{
 			Hash:     hashOf(part0),
 			Size:     int64(len(part0)),
@@ -938,6 +1252,61 @@ func (s *blobStoreSuite) TestUploadInfo(c *gc.C) {
 	s.assertBlobContent(c, idx, part0+part1+part2)
 }
 
+func (s *blobStoreSuite) TestListUploads(c *gc.C) {
+	now := time.Now()
+	id0, err := s.store.NewUploadForUser("bob", now.Add(2*time.Minute))
+	c.Assert(err, gc.Equals, nil)
+	id1, err := s.store.NewUploadForUser("alice", now.Add(3*time.Minute))
+	c.Assert(err, gc.Equals, nil)
+	id2, err := s.store.NewUploadForUser("bob", now.Add(time.Minute))
+	c.Assert(err, gc.Equals, nil)
+	_, err = s.store.NewUploadForUser("bob", now.Add(-time.Minute))
+	c.Assert(err, gc.Equals, nil)
+	id4, err := s.store.NewUpload(now.Add(time.Minute))
+	c.Assert(err, gc.Equals, nil)
+
+	// An upload that has been used is not listed.
+	s.store.MinPartSize = 1
+	content := "some data"
+	id5, err := s.store.NewUploadForUser("bob", now.Add(time.Minute))
+	c.Assert(err, gc.Equals, nil)
+	err = s.store.PutPart(id5, 0, strings.NewReader(content), int64(len(content)), 0, hashOf(content))
+	c.Assert(err, gc.Equals, nil)
+	_, _, err = s.store.FinishUpload(id5, []blobstore.Part{{Hash: hashOf(content)}})
+	c.Assert(err, gc.Equals, nil)
+	err = s.store.SetOwner(id5, "test", now.Add(time.Minute))
+	c.Assert(err, gc.Equals, nil)
+
+	infos, err := s.store.ListUploads("bob")
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(uploadIds(infos), jc.DeepEquals, []string{id2, id0})
+	c.Assert(infos[0].Creator, gc.Equals, "bob")
+
+	infos, err = s.store.ListUploads("alice")
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(uploadIds(infos), jc.DeepEquals, []string{id1})
+
+	infos, err = s.store.ListUploads("")
+	c.Assert(err, gc.Equals, nil)
+	ids := uploadIds(infos)
+	c.Assert(ids, gc.HasLen, 4)
+	c.Assert(ids[3], gc.Equals, id1)
+	c.Assert(ids[2], gc.Equals, id0)
+	c.Assert(ids[:2], jc.SameContents, []string{id2, id4})
+
+	infos, err = s.store.ListUploads("nobody")
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(infos, gc.HasLen, 0)
+}
+
+func uploadIds(infos []blobstore.UploadInfo) []string {
+	ids := make([]string, len(infos))
+	for i, info := range infos {
+		ids[i] = info.Id
+	}
+	return ids
+}
+
 var multipartSeekTests = []struct {
 	initialOffset int64
 	offset        int64
@@ -1042,7 +1411,10 @@ func (s *blobStoreSuite) putMultipartNoRemove(c *gc.C, contents ...string) (stri
 
 func (s *blobStoreSuite) newBlobStore(session *mgo.Session) *blobstore.Store {
 	db := session.DB("db")
-	return blobstore.New(db, "blobstore", s.newBackend(db))
+	store := blobstore.New(db, "blobstore", s.newBackend(db))
+	store.Keyring = s.keyring
+	store.Compress = s.compress
+	return store
 }
 
 func (s *blobStoreSuite) assertUploadDoesNotExist(c *gc.C, id string) {
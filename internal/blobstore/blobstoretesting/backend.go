@@ -0,0 +1,380 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+// Package blobstoretesting provides a test suite that checks that a
+// blobstore.Backend implementation behaves as the interface requires.
+package blobstoretesting // import "gopkg.in/juju/charmstore.v5/internal/blobstore/blobstoretesting"
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"sync"
+	"testing/iotest"
+
+	gc "gopkg.in/check.v1"
+	"gopkg.in/errgo.v1"
+
+	"gopkg.in/juju/charmstore.v5/internal/blobstore"
+)
+
+// DefaultLargeObjectSize holds the size of the object used by
+// BackendSuite.TestLargeObject when BackendSuite.LargeObjectSize is
+// zero. It's larger than the size at which the backends in the
+// blobstore package stop buffering data in memory.
+const DefaultLargeObjectSize = 12 * 1024 * 1024
+
+// BackendSuite holds conformance tests for implementations of
+// blobstore.Backend. To use it, embed it in a suite and set
+// NewBackend before calling BackendSuite.SetUpTest. For example:
+//
+//	type fooSuite struct {
+//		blobstoretesting.BackendSuite
+//	}
+//
+//	var _ = gc.Suite(&fooSuite{})
+//
+//	func (s *fooSuite) SetUpTest(c *gc.C) {
+//		s.NewBackend = func(c *gc.C) blobstore.Backend {
+//			return newFooBackend(c.MkDir())
+//		}
+//		s.BackendSuite.SetUpTest(c)
+//	}
+type BackendSuite struct {
+	// NewBackend returns a new empty backend. It
+	// is called once at the start of each test.
+	NewBackend func(c *gc.C) blobstore.Backend
+
+	// LargeObjectSize holds the size of the object used by
+	// TestLargeObject. If it's zero, DefaultLargeObjectSize
+	// is used.
+	LargeObjectSize int64
+
+	// BufferedReads specifies that a reader returned by the backend
+	// may already hold all the data of an object, so that reading
+	// can complete after the object has been removed. Otherwise
+	// TestRemoveWhileReading requires such reads to fail.
+	BufferedReads bool
+
+	// Backend holds the backend being tested.
+	Backend blobstore.Backend
+}
+
+func (s *BackendSuite) SetUpTest(c *gc.C) {
+	s.Backend = s.NewBackend(c)
+}
+
+func (s *BackendSuite) TestPutGet(c *gc.C) {
+	s.put(c, "0123abcd", "some data")
+	s.assertContent(c, "0123abcd", "some data")
+}
+
+func (s *BackendSuite) TestPutEmpty(c *gc.C) {
+	s.put(c, "0123abcd", "")
+	s.assertContent(c, "0123abcd", "")
+}
+
+func (s *BackendSuite) TestPutWithShortReads(c *gc.C) {
+	content := randomData(1, 100*1024)
+	err := s.Backend.Put("0123abcd", iotest.OneByteReader(bytes.NewReader(content)), int64(len(content)), hashOf(string(content)))
+	c.Assert(err, gc.Equals, nil)
+	s.assertContent(c, "0123abcd", string(content))
+}
+
+func (s *BackendSuite) TestGetNotFound(c *gc.C) {
+	_, _, err := s.Backend.Get("0123abcd")
+	c.Assert(errgo.Cause(err), gc.Equals, blobstore.ErrNotFound)
+}
+
+func (s *BackendSuite) TestPutHashMismatch(c *gc.C) {
+	content := "some data"
+	err := s.Backend.Put("0123abcd", bytes.NewReader([]byte(content)), int64(len(content)), hashOf("other data"))
+	c.Assert(err, gc.ErrorMatches, ".*hash mismatch")
+
+	// Nothing has been stored.
+	_, _, err = s.Backend.Get("0123abcd")
+	c.Assert(errgo.Cause(err), gc.Equals, blobstore.ErrNotFound)
+}
+
+func (s *BackendSuite) TestPutUnexpectedEOF(c *gc.C) {
+	content := "some data"
+	err := s.Backend.Put("0123abcd", bytes.NewReader([]byte(content)), int64(len(content))+1, hashOf(content))
+	c.Assert(errgo.Cause(err), gc.Equals, io.ErrUnexpectedEOF)
+
+	// Nothing has been stored.
+	_, _, err = s.Backend.Get("0123abcd")
+	c.Assert(errgo.Cause(err), gc.Equals, blobstore.ErrNotFound)
+}
+
+func (s *BackendSuite) TestReadWithSmallBuffer(c *gc.C) {
+	content := string(randomData(2, 10000))
+	s.put(c, "0123abcd", content)
+	r, _, err := s.Backend.Get("0123abcd")
+	c.Assert(err, gc.Equals, nil)
+	defer r.Close()
+	data, err := ioutil.ReadAll(iotest.OneByteReader(r))
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(string(data), gc.Equals, content)
+}
+
+func (s *BackendSuite) TestSeek(c *gc.C) {
+	content := string(randomData(3, 10000))
+	s.put(c, "0123abcd", content)
+	r, _, err := s.Backend.Get("0123abcd")
+	c.Assert(err, gc.Equals, nil)
+	defer r.Close()
+
+	buf := make([]byte, 20)
+	for i, test := range []struct {
+		offset    int64
+		whence    int
+		expectPos int64
+	}{
+		{offset: 100, whence: 0, expectPos: 100},
+		{offset: 0, whence: 0, expectPos: 0},
+		{offset: 500, whence: 1, expectPos: 520},
+		{offset: -40, whence: 1, expectPos: 500},
+		{offset: -20, whence: 2, expectPos: 9980},
+		{offset: 5000, whence: 0, expectPos: 5000},
+	} {
+		c.Logf("test %d: seek(%d, %d)", i, test.offset, test.whence)
+		pos, err := r.Seek(test.offset, test.whence)
+		c.Assert(err, gc.Equals, nil)
+		c.Assert(pos, gc.Equals, test.expectPos)
+		_, err = io.ReadFull(r, buf)
+		c.Assert(err, gc.Equals, nil)
+		c.Assert(string(buf), gc.Equals, content[pos:pos+20])
+	}
+
+	// Reading at the end of the data returns io.EOF.
+	_, err = r.Seek(0, 2)
+	c.Assert(err, gc.Equals, nil)
+	n, err := io.ReadFull(r, buf)
+	c.Assert(n, gc.Equals, 0)
+	c.Assert(err, gc.Equals, io.EOF)
+}
+
+func (s *BackendSuite) TestLargeObject(c *gc.C) {
+	size := s.LargeObjectSize
+	if size == 0 {
+		size = DefaultLargeObjectSize
+	}
+	hasher := blobstore.NewHash()
+	_, err := io.Copy(hasher, newRandomReader(4, size))
+	c.Assert(err, gc.Equals, nil)
+	hash := fmt.Sprintf("%x", hasher.Sum(nil))
+
+	err = s.Backend.Put("0123abcd", newRandomReader(4, size), size, hash)
+	c.Assert(err, gc.Equals, nil)
+
+	r, gotSize, err := s.Backend.Get("0123abcd")
+	c.Assert(err, gc.Equals, nil)
+	defer r.Close()
+	c.Assert(gotSize, gc.Equals, size)
+	hasher = blobstore.NewHash()
+	n, err := io.Copy(hasher, r)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(n, gc.Equals, size)
+	c.Assert(fmt.Sprintf("%x", hasher.Sum(nil)), gc.Equals, hash)
+
+	// Check that we can seek back into the
+	// middle of the object.
+	expect := make([]byte, 100)
+	src := newRandomReader(4, size)
+	_, err = io.CopyN(ioutil.Discard, src, size/2)
+	c.Assert(err, gc.Equals, nil)
+	_, err = io.ReadFull(src, expect)
+	c.Assert(err, gc.Equals, nil)
+
+	_, err = r.Seek(size/2, 0)
+	c.Assert(err, gc.Equals, nil)
+	got := make([]byte, 100)
+	_, err = io.ReadFull(r, got)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(got, gc.DeepEquals, expect)
+}
+
+func (s *BackendSuite) TestConcurrentPutGet(c *gc.C) {
+	const N = 10
+	content := func(i int) string {
+		return string(randomData(int64(i), 1000+i))
+	}
+	name := func(i int) string {
+		return fmt.Sprintf("%08x", i)
+	}
+	errs := make([]error, N)
+	var wg sync.WaitGroup
+	for i := 0; i < N; i++ {
+		i := i
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = s.Backend.Put(name(i), bytes.NewReader([]byte(content(i))), int64(len(content(i))), hashOf(content(i)))
+		}()
+	}
+	wg.Wait()
+	for i, err := range errs {
+		c.Assert(err, gc.Equals, nil, gc.Commentf("put %d", i))
+	}
+
+	datas := make([][]byte, N)
+	for i := 0; i < N; i++ {
+		i := i
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			datas[i], errs[i] = s.get(name(i))
+		}()
+	}
+	wg.Wait()
+	for i := 0; i < N; i++ {
+		c.Assert(errs[i], gc.Equals, nil, gc.Commentf("get %d", i))
+		c.Assert(string(datas[i]), gc.Equals, content(i), gc.Commentf("get %d", i))
+	}
+}
+
+func (s *BackendSuite) TestConcurrentReaders(c *gc.C) {
+	const N = 10
+	content := randomData(5, 50000)
+	s.put(c, "0123abcd", string(content))
+	readers := make([]blobstore.ReadSeekCloser, N)
+	for i := range readers {
+		r, _, err := s.Backend.Get("0123abcd")
+		c.Assert(err, gc.Equals, nil)
+		defer r.Close()
+		readers[i] = r
+	}
+	// Each reader reads from a different offset,
+	// so that the readers interleave.
+	errs := make([]error, N)
+	var wg sync.WaitGroup
+	for i, r := range readers {
+		i, r := i, r
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			offset := int64(i * len(content) / N)
+			if _, err := r.Seek(offset, 0); err != nil {
+				errs[i] = err
+				return
+			}
+			data, err := ioutil.ReadAll(r)
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			if !bytes.Equal(data, content[offset:]) {
+				errs[i] = errgo.Newf("unexpected data read from offset %d", offset)
+			}
+		}()
+	}
+	wg.Wait()
+	for i, err := range errs {
+		c.Assert(err, gc.Equals, nil, gc.Commentf("reader %d", i))
+	}
+}
+
+func (s *BackendSuite) TestRemove(c *gc.C) {
+	s.put(c, "0123abcd", "some data")
+	s.put(c, "0123abce", "other data")
+	err := s.Backend.Remove("0123abcd")
+	c.Assert(err, gc.Equals, nil)
+	_, _, err = s.Backend.Get("0123abcd")
+	c.Assert(errgo.Cause(err), gc.Equals, blobstore.ErrNotFound)
+
+	// Other objects are unaffected.
+	s.assertContent(c, "0123abce", "other data")
+}
+
+func (s *BackendSuite) TestRemoveNotFound(c *gc.C) {
+	err := s.Backend.Remove("0123abcd")
+	if err != nil {
+		c.Assert(errgo.Cause(err), gc.Equals, blobstore.ErrNotFound)
+	}
+}
+
+func (s *BackendSuite) TestPutAfterRemove(c *gc.C) {
+	s.put(c, "0123abcd", "some data")
+	err := s.Backend.Remove("0123abcd")
+	c.Assert(err, gc.Equals, nil)
+	s.put(c, "0123abcd", "other data")
+	s.assertContent(c, "0123abcd", "other data")
+}
+
+func (s *BackendSuite) TestRemoveWhileReading(c *gc.C) {
+	content := randomData(6, 100*1024)
+	s.put(c, "0123abcd", string(content))
+	r, _, err := s.Backend.Get("0123abcd")
+	c.Assert(err, gc.Equals, nil)
+	defer r.Close()
+	buf := make([]byte, 10)
+	_, err = io.ReadFull(r, buf)
+	c.Assert(err, gc.Equals, nil)
+
+	err = s.Backend.Remove("0123abcd")
+	c.Assert(err, gc.Equals, nil)
+
+	// Read with io.Copy so that any WriteTo method
+	// of the reader is checked too.
+	var rest bytes.Buffer
+	_, err = io.Copy(&rest, r)
+	if err == nil && s.BufferedReads {
+		// The backend had already read the data.
+		c.Assert(append(buf, rest.Bytes()...), gc.DeepEquals, content)
+		return
+	}
+	c.Assert(errgo.Cause(err), gc.Equals, blobstore.ErrNotFound)
+}
+
+// put puts the given content into the backend with the given name.
+func (s *BackendSuite) put(c *gc.C, name, content string) {
+	err := s.Backend.Put(name, bytes.NewReader([]byte(content)), int64(len(content)), hashOf(content))
+	c.Assert(err, gc.Equals, nil)
+}
+
+// get returns all the data of the object with the given name.
+func (s *BackendSuite) get(name string) ([]byte, error) {
+	r, size, err := s.Backend.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) != size {
+		return nil, errgo.Newf("size mismatch (got %d, expected %d)", len(data), size)
+	}
+	return data, nil
+}
+
+// assertContent checks that the object with the
+// given name holds the given content.
+func (s *BackendSuite) assertContent(c *gc.C, name, content string) {
+	data, err := s.get(name)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(string(data), gc.Equals, content)
+}
+
+func hashOf(s string) string {
+	h := blobstore.NewHash()
+	h.Write([]byte(s))
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+// newRandomReader returns a reader that reads size
+// pseudo-random bytes generated from the given seed.
+func newRandomReader(seed int64, size int64) io.Reader {
+	return io.LimitReader(rand.New(rand.NewSource(seed)), size)
+}
+
+// randomData returns size pseudo-random bytes
+// generated from the given seed.
+func randomData(seed int64, size int) []byte {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(seed)).Read(data)
+	return data
+}
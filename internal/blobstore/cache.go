@@ -0,0 +1,523 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package blobstore // import "gopkg.in/juju/charmstore.v5/internal/blobstore"
+
+import (
+	"container/list"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"gopkg.in/errgo.v1"
+
+	"gopkg.in/juju/charmstore.v5/internal/monitoring"
+)
+
+// CacheParams holds parameters for NewCache.
+type CacheParams struct {
+	// Dir holds the directory that the cached blobs are stored
+	// in. It is created if it does not exist. Blobs left in
+	// the directory by a previous Cache are reused.
+	Dir string
+
+	// MaxSize holds the maximum total size, in bytes, of the
+	// blobs held in the cache. Blobs larger than this are
+	// never cached.
+	MaxSize int64
+}
+
+// Cache holds copies of blobs on local disk, evicting the least
+// recently used blobs when the total size of the cached blobs
+// exceeds its maximum size.
+//
+// Blobs are cached under their backend names. The blob store
+// never reuses a name for different content, so a name identifies
+// the content of a blob as well as its hash does.
+//
+// A Cache can be shared between many caching backends (see
+// Cache.Backend), so that a single cache can be used by backends
+// that are created for each database session.
+type Cache struct {
+	maxSize int64
+	tmpDir  string
+
+	// files is used to determine the paths of the cached blobs,
+	// which are laid out as they are by the filesystem backend.
+	files *filesystemBackend
+
+	// mu guards the fields below it.
+	mu sync.Mutex
+
+	// size holds the total size of the cached blobs.
+	size int64
+
+	// lru holds an element for each cached blob, ordered
+	// from most to least recently used. Each element
+	// holds a *cacheEntry.
+	lru *list.List
+
+	// entries maps from blob name to that blob's element in lru.
+	entries map[string]*list.Element
+
+	// fetches holds an entry for each blob that is
+	// currently being copied into the cache.
+	fetches map[string]*cacheFetch
+}
+
+// cacheEntry holds information about a blob in the cache.
+type cacheEntry struct {
+	name string
+	path string
+	size int64
+
+	// removed records that the blob has been removed from the
+	// backend. It is guarded by Cache.mu.
+	removed bool
+}
+
+// cacheFetch represents a blob being copied into the cache.
+type cacheFetch struct {
+	// done is closed when the fetch has completed.
+	done chan struct{}
+
+	// The following fields are guarded by Cache.mu.
+
+	// removed records that the blob has been removed from the
+	// backend while it was being fetched.
+	removed bool
+
+	// cached records whether the blob was added to the cache.
+	cached bool
+
+	// err holds any error encountered when fetching the blob.
+	err error
+}
+
+// NewCache returns a new cache that stores blobs in the
+// directory specified in the given parameters.
+func NewCache(p CacheParams) (*Cache, error) {
+	if p.Dir == "" {
+		return nil, errgo.Newf("no blob cache directory specified")
+	}
+	if p.MaxSize <= 0 {
+		return nil, errgo.Newf("invalid blob cache size %d", p.MaxSize)
+	}
+	c := &Cache{
+		maxSize: p.MaxSize,
+		tmpDir:  filepath.Join(p.Dir, filesystemTmpDir),
+		files:   &filesystemBackend{root: p.Dir},
+		lru:     list.New(),
+		entries: make(map[string]*list.Element),
+		fetches: make(map[string]*cacheFetch),
+	}
+	// Any temporary files have been left by fetches that
+	// didn't complete, so they can all be removed.
+	if err := os.RemoveAll(c.tmpDir); err != nil {
+		return nil, errgo.Notef(err, "cannot remove old temporary files")
+	}
+	if err := os.MkdirAll(c.tmpDir, 0700); err != nil {
+		return nil, errgo.Notef(err, "cannot create blob cache directory")
+	}
+	if err := c.load(p.Dir); err != nil {
+		return nil, errgo.Notef(err, "cannot load blob cache")
+	}
+	return c, nil
+}
+
+// load populates the cache from the blobs stored under the given
+// directory, treating the most recently modified blobs as the most
+// recently used.
+func (c *Cache) load(dir string) error {
+	var entries []*cacheEntry
+	var mtimes []time.Time
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if path == c.tmpDir {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		entries = append(entries, &cacheEntry{
+			name: info.Name(),
+			path: path,
+			size: info.Size(),
+		})
+		mtimes = append(mtimes, info.ModTime())
+		return nil
+	})
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	sort.Sort(entriesByTime{entries, mtimes})
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, e := range entries {
+		c.entries[e.name] = c.lru.PushBack(e)
+		c.size += e.size
+	}
+	c.evict()
+	return nil
+}
+
+// Backend returns a backend that reads blobs from b, keeping
+// copies of them in the cache.
+func (c *Cache) Backend(b Backend) Backend {
+	return &cachingBackend{
+		cache:   c,
+		backend: b,
+	}
+}
+
+// open returns a reader for the cached blob with the given name. If
+// the blob is not in the cache, it returns a nil reader and the fetch
+// that is populating the cache with the blob; if it returns true, the
+// caller is responsible for populating the cache and then calling
+// c.fetchDone.
+func (c *Cache) open(name string) (_ ReadSeekCloser, _ int64, _ *cacheFetch, leader bool, _ error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[name]; ok {
+		e := elem.Value.(*cacheEntry)
+		// Note: we open the file with the mutex held so that
+		// it can't be evicted before it's open.
+		r, err := c.openEntry(e)
+		if err == nil {
+			c.lru.MoveToFront(elem)
+			return r, e.size, nil, false, nil
+		}
+		if !os.IsNotExist(err) {
+			return nil, 0, nil, false, errgo.Mask(err)
+		}
+		// The file has been removed from under us, so
+		// forget about it and fetch it again.
+		logger.Warningf("cached blob %q has disappeared", name)
+		c.removeEntry(elem)
+	}
+	if f, ok := c.fetches[name]; ok {
+		return nil, 0, f, false, nil
+	}
+	f := &cacheFetch{
+		done: make(chan struct{}),
+	}
+	c.fetches[name] = f
+	return nil, 0, f, true, nil
+}
+
+// add adds the blob with the given name, held in the temporary file
+// tmpPath, to the cache and returns a reader for it. It also
+// completes the fetch f.
+func (c *Cache) add(name, tmpPath string, size int64, f *cacheFetch) (ReadSeekCloser, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	defer c.fetchDoneLocked(name, f)
+	path, err := c.files.path(name)
+	if err != nil {
+		f.err = errgo.Mask(err)
+		return nil, f.err
+	}
+	if f.removed {
+		f.err = errgo.WithCausef(nil, ErrNotFound, "")
+		return nil, f.err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		f.err = errgo.Mask(err)
+		return nil, f.err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		f.err = errgo.Mask(err)
+		return nil, f.err
+	}
+	e := &cacheEntry{
+		name: name,
+		path: path,
+		size: size,
+	}
+	c.entries[name] = c.lru.PushFront(e)
+	c.size += size
+	f.cached = true
+	// Open the file before evicting anything. The new blob can't
+	// be evicted because it's no larger than maxSize and it's
+	// the most recently used.
+	r, err := c.openEntry(e)
+	c.evict()
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return r, nil
+}
+
+// fetchDone marks the fetch for the blob with the given
+// name as completed with the given error.
+func (c *Cache) fetchDone(name string, f *cacheFetch, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	f.err = err
+	c.fetchDoneLocked(name, f)
+}
+
+func (c *Cache) fetchDoneLocked(name string, f *cacheFetch) {
+	delete(c.fetches, name)
+	close(f.done)
+}
+
+// remove removes the blob with the given name from the cache
+// and marks it as removed so that any current readers
+// of the blob will fail.
+func (c *Cache) remove(name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[name]; ok {
+		elem.Value.(*cacheEntry).removed = true
+		c.removeEntry(elem)
+		c.updateMetrics()
+	}
+	if f, ok := c.fetches[name]; ok {
+		f.removed = true
+	}
+}
+
+// evict removes the least recently used blobs from the cache
+// until it is no larger than its maximum size.
+// It must be called with c.mu held.
+func (c *Cache) evict() {
+	for c.size > c.maxSize {
+		c.removeEntry(c.lru.Back())
+	}
+	c.updateMetrics()
+}
+
+// removeEntry removes the given cache element and its file.
+// Blobs that are being read remain readable until they're
+// closed. It must be called with c.mu held.
+func (c *Cache) removeEntry(elem *list.Element) {
+	e := elem.Value.(*cacheEntry)
+	c.lru.Remove(elem)
+	delete(c.entries, e.name)
+	c.size -= e.size
+	if err := os.Remove(e.path); err != nil && !os.IsNotExist(err) {
+		logger.Warningf("cannot remove cached blob: %v", err)
+	}
+}
+
+// openEntry opens the file holding the given cached blob.
+func (c *Cache) openEntry(e *cacheEntry) (ReadSeekCloser, error) {
+	file, err := os.Open(e.path)
+	if err != nil {
+		return nil, err
+	}
+	// Update the modification time so that the usage
+	// order is preserved when the cache is next loaded.
+	now := time.Now()
+	if err := os.Chtimes(e.path, now, now); err != nil {
+		logger.Warningf("cannot update time of cached blob: %v", err)
+	}
+	return &cacheReader{
+		file:  file,
+		cache: c,
+		entry: e,
+	}, nil
+}
+
+// isRemoved reports whether the blob with the given
+// entry has been removed from the backend.
+func (c *Cache) isRemoved(e *cacheEntry) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return e.removed
+}
+
+func (c *Cache) updateMetrics() {
+	monitoring.SetBlobCacheSize(len(c.entries), c.size)
+}
+
+// cachingBackend implements Backend by reading blobs
+// through a Cache.
+type cachingBackend struct {
+	cache   *Cache
+	backend Backend
+}
+
+// Get implements Backend.Get by returning the blob from the cache,
+// copying it into the cache from the underlying backend first if
+// necessary. Concurrent requests for a blob that's not in the cache
+// will fetch the blob from the underlying backend only once.
+func (b *cachingBackend) Get(name string) (ReadSeekCloser, int64, error) {
+	if _, err := b.cache.files.path(name); err != nil {
+		return nil, 0, errgo.Mask(err)
+	}
+	missed := false
+	for {
+		r, size, f, leader, err := b.cache.open(name)
+		if err != nil {
+			return nil, 0, errgo.Mask(err)
+		}
+		if r != nil {
+			if missed {
+				monitoring.BlobCacheMiss()
+			} else {
+				monitoring.BlobCacheHit()
+			}
+			return r, size, nil
+		}
+		if leader {
+			monitoring.BlobCacheMiss()
+			return b.fetch(name, f)
+		}
+		// Some other request is fetching the blob, so wait
+		// for it to be cached and then try again.
+		missed = true
+		<-f.done
+		b.cache.mu.Lock()
+		cached, err := f.cached, f.err
+		b.cache.mu.Unlock()
+		if err != nil {
+			return nil, 0, errgo.Mask(err, errgo.Is(ErrNotFound))
+		}
+		if !cached {
+			// The blob is too large to cache.
+			monitoring.BlobCacheMiss()
+			r, size, err := b.backend.Get(name)
+			if err != nil {
+				return nil, 0, errgo.Mask(err, errgo.Is(ErrNotFound))
+			}
+			return r, size, nil
+		}
+	}
+}
+
+// fetch copies the blob with the given name into the cache,
+// completing the fetch f, and returns a reader for it.
+func (b *cachingBackend) fetch(name string, f *cacheFetch) (ReadSeekCloser, int64, error) {
+	r, size, err := b.backend.Get(name)
+	if err != nil {
+		err = errgo.Mask(err, errgo.Is(ErrNotFound))
+		b.cache.fetchDone(name, f, err)
+		return nil, 0, err
+	}
+	if size > b.cache.maxSize {
+		// The blob's too big to cache, so
+		// read it directly from the backend.
+		b.cache.fetchDone(name, f, nil)
+		return r, size, nil
+	}
+	defer r.Close()
+	tmpPath, err := b.cache.copyToTemp(r, size)
+	if err != nil {
+		err = errgo.Mask(err, errgo.Is(ErrNotFound), errgo.Is(io.ErrUnexpectedEOF))
+		b.cache.fetchDone(name, f, err)
+		return nil, 0, err
+	}
+	cr, err := b.cache.add(name, tmpPath, size, f)
+	if err != nil {
+		if err := os.Remove(tmpPath); err != nil && !os.IsNotExist(err) {
+			logger.Warningf("cannot remove temporary file: %v", err)
+		}
+		return nil, 0, errgo.Mask(err, errgo.Is(ErrNotFound))
+	}
+	return cr, size, nil
+}
+
+// copyToTemp copies size bytes from r to a new temporary
+// file in the cache directory and returns its path.
+func (c *Cache) copyToTemp(r io.Reader, size int64) (_ string, err error) {
+	f, err := ioutil.TempFile(c.tmpDir, "fetch-")
+	if err != nil {
+		return "", errgo.Mask(err)
+	}
+	defer func() {
+		f.Close()
+		if err == nil {
+			return
+		}
+		if err := os.Remove(f.Name()); err != nil {
+			logger.Warningf("cannot remove temporary file: %v", err)
+		}
+	}()
+	n, err := io.Copy(f, io.LimitReader(r, size))
+	if err != nil {
+		return "", errgo.Mask(err, errgo.Any)
+	}
+	if n != size {
+		return "", errgo.WithCausef(nil, io.ErrUnexpectedEOF, "blob is smaller than expected")
+	}
+	if err := f.Close(); err != nil {
+		return "", errgo.Mask(err)
+	}
+	return f.Name(), nil
+}
+
+// Put implements Backend.Put by putting the blob to the underlying
+// backend. The blob will be cached when it's first read.
+func (b *cachingBackend) Put(name string, r io.Reader, size int64, hash string) error {
+	return errgo.Mask(b.backend.Put(name, r, size, hash), errgo.Any)
+}
+
+// Remove implements Backend.Remove by removing the blob from the
+// underlying backend and from the cache.
+func (b *cachingBackend) Remove(name string) error {
+	err := b.backend.Remove(name)
+	// Remove the blob from the cache even if the
+	// backend doesn't know about it.
+	b.cache.remove(name)
+	if err != nil {
+		return errgo.Mask(err, errgo.Is(ErrNotFound))
+	}
+	return nil
+}
+
+// cacheReader reads a blob from the cache. Its reads fail with an
+// ErrNotFound cause if the blob is removed from the backend while
+// it's being read, as required by the Backend.Get contract. A blob
+// that's evicted while it's being read can still be read to the end.
+// As with filesystemReader, the file is not embedded so that io.Copy
+// cannot bypass Read.
+type cacheReader struct {
+	file  *os.File
+	cache *Cache
+	entry *cacheEntry
+}
+
+func (r *cacheReader) Read(buf []byte) (int, error) {
+	if r.cache.isRemoved(r.entry) {
+		return 0, errgo.WithCausef(nil, ErrNotFound, "")
+	}
+	return r.file.Read(buf)
+}
+
+func (r *cacheReader) Seek(offset int64, whence int) (int64, error) {
+	return r.file.Seek(offset, whence)
+}
+
+func (r *cacheReader) Close() error {
+	return r.file.Close()
+}
+
+type entriesByTime struct {
+	entries []*cacheEntry
+	mtimes  []time.Time
+}
+
+func (s entriesByTime) Len() int {
+	return len(s.entries)
+}
+
+// Less orders the most recently modified entries first.
+func (s entriesByTime) Less(i, j int) bool {
+	return s.mtimes[i].After(s.mtimes[j])
+}
+
+func (s entriesByTime) Swap(i, j int) {
+	s.entries[i], s.entries[j] = s.entries[j], s.entries[i]
+	s.mtimes[i], s.mtimes[j] = s.mtimes[j], s.mtimes[i]
+}
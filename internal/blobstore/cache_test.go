@@ -0,0 +1,250 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package blobstore_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	gc "gopkg.in/check.v1"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/mgo.v2"
+
+	"gopkg.in/juju/charmstore.v5/internal/blobstore"
+)
+
+type CachingStoreSuite struct {
+	blobStoreSuite
+}
+
+var _ = gc.Suite(&CachingStoreSuite{})
+
+func (s *CachingStoreSuite) SetUpTest(c *gc.C) {
+	cache, err := blobstore.NewCache(blobstore.CacheParams{
+		Dir:     c.MkDir(),
+		MaxSize: 1024 * 1024,
+	})
+	c.Assert(err, gc.Equals, nil)
+	s.blobStoreSuite.SetUpTest(c, func(db *mgo.Database) blobstore.Backend {
+		return cache.Backend(blobstore.NewMongoBackend(db, "blobstore"))
+	})
+}
+
+// cacheSuite holds tests for the cache that don't
+// need a database.
+type cacheSuite struct {
+	dir     string
+	backend *countingBackend
+}
+
+var _ = gc.Suite(&cacheSuite{})
+
+func (s *cacheSuite) SetUpTest(c *gc.C) {
+	s.dir = c.MkDir()
+	s.backend = &countingBackend{
+		Backend: blobstore.NewFilesystemBackend(c.MkDir()),
+	}
+}
+
+func (s *cacheSuite) newCache(c *gc.C, maxSize int64) blobstore.Backend {
+	cache, err := blobstore.NewCache(blobstore.CacheParams{
+		Dir:     s.dir,
+		MaxSize: maxSize,
+	})
+	c.Assert(err, gc.Equals, nil)
+	return cache.Backend(s.backend)
+}
+
+func (s *cacheSuite) TestNewCacheInvalidParams(c *gc.C) {
+	_, err := blobstore.NewCache(blobstore.CacheParams{
+		MaxSize: 10,
+	})
+	c.Assert(err, gc.ErrorMatches, `no blob cache directory specified`)
+	_, err = blobstore.NewCache(blobstore.CacheParams{
+		Dir: s.dir,
+	})
+	c.Assert(err, gc.ErrorMatches, `invalid blob cache size 0`)
+}
+
+func (s *cacheSuite) TestGetReadsThroughCache(c *gc.C) {
+	be := s.newCache(c, 100)
+	putBlob(c, be, "0123abcd", "some data")
+	for i := 0; i < 3; i++ {
+		c.Assert(getBlob(c, be, "0123abcd"), gc.Equals, "some data")
+	}
+	c.Assert(s.backend.getCount(), gc.Equals, 1)
+}
+
+func (s *cacheSuite) TestGetNotFound(c *gc.C) {
+	be := s.newCache(c, 100)
+	_, _, err := be.Get("0123abcd")
+	c.Assert(errgo.Cause(err), gc.Equals, blobstore.ErrNotFound)
+}
+
+func (s *cacheSuite) TestEvictsLeastRecentlyUsed(c *gc.C) {
+	be := s.newCache(c, 20)
+	putBlob(c, be, "aaaa", "0123456789")
+	putBlob(c, be, "bbbb", "abcdefghij")
+	putBlob(c, be, "cccc", "ABCDEFGHIJ")
+	getBlob(c, be, "aaaa")
+	getBlob(c, be, "bbbb")
+	getBlob(c, be, "aaaa")
+	// Reading cccc should evict bbbb, which is the
+	// least recently used blob.
+	getBlob(c, be, "cccc")
+	c.Assert(s.backend.getCount(), gc.Equals, 3)
+
+	getBlob(c, be, "aaaa")
+	getBlob(c, be, "cccc")
+	c.Assert(s.backend.getCount(), gc.Equals, 3)
+	getBlob(c, be, "bbbb")
+	c.Assert(s.backend.getCount(), gc.Equals, 4)
+}
+
+func (s *cacheSuite) TestBlobTooLargeToCache(c *gc.C) {
+	be := s.newCache(c, 5)
+	putBlob(c, be, "0123abcd", "some data")
+	c.Assert(getBlob(c, be, "0123abcd"), gc.Equals, "some data")
+	c.Assert(getBlob(c, be, "0123abcd"), gc.Equals, "some data")
+	c.Assert(s.backend.getCount(), gc.Equals, 2)
+}
+
+func (s *cacheSuite) TestSeekCachedBlob(c *gc.C) {
+	be := s.newCache(c, 100)
+	putBlob(c, be, "0123abcd", "0123456789")
+	getBlob(c, be, "0123abcd")
+
+	r, size, err := be.Get("0123abcd")
+	c.Assert(err, gc.Equals, nil)
+	defer r.Close()
+	c.Assert(size, gc.Equals, int64(10))
+	_, err = r.Seek(-4, 2)
+	c.Assert(err, gc.Equals, nil)
+	data, err := ioutil.ReadAll(r)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(string(data), gc.Equals, "6789")
+	c.Assert(s.backend.getCount(), gc.Equals, 1)
+}
+
+func (s *cacheSuite) TestRemoveWhileReading(c *gc.C) {
+	be := s.newCache(c, 100)
+	putBlob(c, be, "0123abcd", "some data")
+
+	r, _, err := be.Get("0123abcd")
+	c.Assert(err, gc.Equals, nil)
+	defer r.Close()
+	err = be.Remove("0123abcd")
+	c.Assert(err, gc.Equals, nil)
+	_, err = r.Read(make([]byte, 4))
+	c.Assert(errgo.Cause(err), gc.Equals, blobstore.ErrNotFound)
+
+	_, _, err = be.Get("0123abcd")
+	c.Assert(errgo.Cause(err), gc.Equals, blobstore.ErrNotFound)
+}
+
+func (s *cacheSuite) TestEvictWhileReading(c *gc.C) {
+	be := s.newCache(c, 10)
+	putBlob(c, be, "aaaa", "0123456789")
+	putBlob(c, be, "bbbb", "abcdefghij")
+
+	r, _, err := be.Get("aaaa")
+	c.Assert(err, gc.Equals, nil)
+	defer r.Close()
+	getBlob(c, be, "bbbb")
+
+	// The evicted blob can still be read to the end.
+	data, err := ioutil.ReadAll(r)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(string(data), gc.Equals, "0123456789")
+}
+
+func (s *cacheSuite) TestConcurrentGetFetchesOnce(c *gc.C) {
+	s.backend.delay = 50 * time.Millisecond
+	be := s.newCache(c, 100)
+	putBlob(c, be, "0123abcd", "some data")
+
+	results := make(chan string)
+	for i := 0; i < 10; i++ {
+		go func() {
+			r, _, err := be.Get("0123abcd")
+			if err != nil {
+				results <- err.Error()
+				return
+			}
+			defer r.Close()
+			data, err := ioutil.ReadAll(r)
+			if err != nil {
+				results <- err.Error()
+				return
+			}
+			results <- string(data)
+		}()
+	}
+	for i := 0; i < 10; i++ {
+		c.Assert(<-results, gc.Equals, "some data")
+	}
+	c.Assert(s.backend.getCount(), gc.Equals, 1)
+}
+
+func (s *cacheSuite) TestCacheReloaded(c *gc.C) {
+	be := s.newCache(c, 100)
+	putBlob(c, be, "aaaa", "0123456789")
+	putBlob(c, be, "bbbb", "abcdefghij")
+	getBlob(c, be, "bbbb")
+	getBlob(c, be, "aaaa")
+
+	// Make sure the modification times differ.
+	now := time.Now()
+	err := os.Chtimes(filepath.Join(s.dir, "bb", "bb", "bbbb"), now, now.Add(-time.Minute))
+	c.Assert(err, gc.Equals, nil)
+
+	// A new cache with a smaller size keeps only the
+	// most recently used blob.
+	be = s.newCache(c, 10)
+	getBlob(c, be, "aaaa")
+	c.Assert(s.backend.getCount(), gc.Equals, 2)
+	getBlob(c, be, "bbbb")
+	c.Assert(s.backend.getCount(), gc.Equals, 3)
+}
+
+// countingBackend counts the number of calls to Get.
+type countingBackend struct {
+	blobstore.Backend
+	delay time.Duration
+
+	mu   sync.Mutex
+	gets int
+}
+
+func (b *countingBackend) Get(name string) (blobstore.ReadSeekCloser, int64, error) {
+	b.mu.Lock()
+	b.gets++
+	b.mu.Unlock()
+	time.Sleep(b.delay)
+	return b.Backend.Get(name)
+}
+
+func (b *countingBackend) getCount() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.gets
+}
+
+func putBlob(c *gc.C, be blobstore.Backend, name, content string) {
+	err := be.Put(name, strings.NewReader(content), int64(len(content)), hashOf(content))
+	c.Assert(err, gc.Equals, nil)
+}
+
+func getBlob(c *gc.C, be blobstore.Backend, name string) string {
+	r, _, err := be.Get(name)
+	c.Assert(err, gc.Equals, nil)
+	defer r.Close()
+	data, err := ioutil.ReadAll(r)
+	c.Assert(err, gc.Equals, nil)
+	return string(data)
+}
@@ -0,0 +1,375 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package blobstore // import "gopkg.in/juju/charmstore.v5/internal/blobstore"
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"gopkg.in/errgo.v1"
+)
+
+// When compression is enabled, blob data is split into frames of
+// compressionFrameSize bytes, each of which is compressed
+// independently with DEFLATE. The offset of each frame in the stored
+// data is recorded in the blob's ref document, so a compressed blob
+// can be read from any offset by decompressing from the start of the
+// frame that holds it.
+//
+// The hash and size of a blob are always those of its uncompressed
+// content; the stored data is only ever seen by the backend. When a
+// blob is also encrypted, it is the compressed data that is encrypted.
+//
+// Blobs that don't get any smaller when compressed (for example charm
+// archives, which are already zip files) are stored uncompressed, as
+// are large blobs when the store encrypts blobs.
+
+// compressionFrameSize holds the uncompressed size of each
+// frame of a compressed blob.
+var compressionFrameSize int64 = 256 * 1024
+
+// flateFrames is the compression method recorded for blobs
+// compressed as independent DEFLATE frames.
+const flateFrames = "flate-frames"
+
+// putCompressed compresses the content read from r, checking that it
+// has the size and hash recorded in ref, and puts it into the backend
+// as the blob with the given ref, recording how it has been stored.
+//
+// The backend needs to know the size and hash of the compressed data
+// before it reads it, so the compressed data is buffered in memory or,
+// for large blobs, in a temporary file.
+func (s *Store) putCompressed(ref *blobRefDoc, r io.Reader) error {
+	if s.Keyring != nil && ref.Size > maxBufferSize {
+		// Unencrypted data must never be written to a temporary
+		// file, so large blobs are stored uncompressed when
+		// they're encrypted.
+		return errgo.Mask(s.putStored(ref, r, ref.Size, ref.Hash), errgo.Is(io.ErrUnexpectedEOF))
+	}
+	var buf io.ReadWriter
+	if ref.Size <= maxBufferSize {
+		buf = bytes.NewBuffer(make([]byte, 0, ref.Size/2))
+	} else {
+		f, err := ioutil.TempFile(s.TempDir, "blobstore-compress-")
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		defer func() {
+			f.Close()
+			if err := os.Remove(f.Name()); err != nil {
+				logger.Warningf("cannot remove temporary file: %v", err)
+			}
+		}()
+		buf = f
+	}
+	hasher := NewHash()
+	w, err := newFrameWriter(io.MultiWriter(buf, hasher))
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if err := copyAndCheckHash(w, r, ref.Size, ref.Hash); err != nil {
+		return errgo.Mask(err, errgo.Is(io.ErrUnexpectedEOF))
+	}
+	if err := w.Close(); err != nil {
+		return errgo.Notef(err, "cannot compress blob")
+	}
+	if f, ok := buf.(*os.File); ok {
+		if _, err := f.Seek(0, seekStart); err != nil {
+			return errgo.Mask(err)
+		}
+	}
+	if w.size() >= ref.Size {
+		// Compression hasn't helped, so store the content as is.
+		// We've already consumed r, so recover the content by
+		// decompressing it again.
+		fr := newFrameReader(nopSeekCloser{buf}, w.frames, w.size(), ref.Size)
+		return errgo.Mask(s.putStored(ref, fr, ref.Size, ref.Hash), errgo.Is(io.ErrUnexpectedEOF))
+	}
+	storedHash := fmt.Sprintf("%x", hasher.Sum(nil))
+	if err := s.putStored(ref, buf, w.size(), storedHash); err != nil {
+		return errgo.Mask(err, errgo.Is(io.ErrUnexpectedEOF))
+	}
+	ref.Compression = flateFrames
+	ref.StoredSize = w.size()
+	ref.StoredHash = storedHash
+	ref.Frames = w.frames
+	return nil
+}
+
+// contentReader returns a reader for the content of the blob with the
+// given ref, given a reader for its data as stored in the backend. The
+// data is decrypted and decompressed as necessary.
+func (s *Store) contentReader(ref *blobRefDoc, r ReadSeekCloser) (ReadSeekCloser, error) {
+	dr, err := s.decryptReader(ref, r)
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot decrypt blob")
+	}
+	switch ref.Compression {
+	case "":
+		return dr, nil
+	case flateFrames:
+		return newFrameReader(dr, ref.Frames, ref.StoredSize, ref.Size), nil
+	}
+	return nil, errgo.Newf("blob has unknown compression method %q", ref.Compression)
+}
+
+// frameWriter compresses the data written to it as a sequence of
+// independently compressed frames.
+type frameWriter struct {
+	w  countingWriter
+	fw *flate.Writer
+
+	// frames holds the offset of each frame
+	// in the compressed data.
+	frames []int64
+
+	// n holds the number of bytes written
+	// to the current frame.
+	n int64
+}
+
+func newFrameWriter(w io.Writer) (*frameWriter, error) {
+	fw := &frameWriter{
+		w: countingWriter{w: w},
+	}
+	var err error
+	fw.fw, err = flate.NewWriter(&fw.w, flate.DefaultCompression)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return fw, nil
+}
+
+func (w *frameWriter) Write(buf []byte) (int, error) {
+	total := 0
+	for len(buf) > 0 {
+		if w.n == 0 {
+			w.frames = append(w.frames, w.w.n)
+			w.fw.Reset(&w.w)
+		}
+		chunk := buf
+		if max := compressionFrameSize - w.n; int64(len(chunk)) > max {
+			chunk = chunk[:max]
+		}
+		n, err := w.fw.Write(chunk)
+		total += n
+		w.n += int64(n)
+		if err != nil {
+			return total, err
+		}
+		buf = buf[n:]
+		if w.n == compressionFrameSize {
+			if err := w.fw.Close(); err != nil {
+				return total, err
+			}
+			w.n = 0
+		}
+	}
+	return total, nil
+}
+
+// Close finishes the last frame. It does not
+// close the underlying writer.
+func (w *frameWriter) Close() error {
+	if w.n == 0 {
+		return nil
+	}
+	w.n = 0
+	return w.fw.Close()
+}
+
+// size returns the total size of the compressed data.
+func (w *frameWriter) size() int64 {
+	return w.w.n
+}
+
+// countingWriter counts the bytes written to w.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (w *countingWriter) Write(buf []byte) (int, error) {
+	n, err := w.w.Write(buf)
+	w.n += int64(n)
+	return n, err
+}
+
+// frameReader reads the content of a blob compressed by frameWriter.
+// Seeking is cheap: data is only decompressed from the start of the
+// frame holding the new position when it's next read.
+type frameReader struct {
+	r          ReadSeekCloser
+	frames     []int64
+	storedSize int64
+	size       int64
+
+	// pos holds the current position in the content.
+	pos int64
+
+	// frame holds the index of the frame being decompressed
+	// by fr, and framePos holds the position in the content
+	// that fr will read next. If fr is nil, no frame is
+	// being decompressed.
+	frame    int
+	framePos int64
+	fr       io.ReadCloser
+	limit    *io.LimitedReader
+
+	// storedPos holds the current position of r,
+	// or -1 if it's not known.
+	storedPos int64
+}
+
+func newFrameReader(r ReadSeekCloser, frames []int64, storedSize, size int64) *frameReader {
+	return &frameReader{
+		r:          r,
+		frames:     frames,
+		storedSize: storedSize,
+		size:       size,
+	}
+}
+
+func (r *frameReader) Read(buf []byte) (int, error) {
+	for {
+		if r.pos >= r.size {
+			return 0, io.EOF
+		}
+		if err := r.startFrame(); err != nil {
+			return 0, err
+		}
+		if max := r.size - r.pos; int64(len(buf)) > max {
+			buf = buf[:max]
+		}
+		n, err := r.fr.Read(buf)
+		r.pos += int64(n)
+		r.framePos = r.pos
+		if err == io.EOF {
+			// We've reached the end of the frame. Consume
+			// any remaining stored data so that the next
+			// frame can be read without seeking.
+			if err := r.endFrame(); err != nil {
+				return n, err
+			}
+			if n == 0 {
+				continue
+			}
+			return n, nil
+		}
+		if err != nil {
+			return n, errgo.Mask(err, errgo.Any)
+		}
+		return n, nil
+	}
+}
+
+// startFrame makes r.fr ready to read from r.pos.
+func (r *frameReader) startFrame() error {
+	frame := int(r.pos / compressionFrameSize)
+	if r.fr != nil && frame == r.frame+1 && r.framePos == int64(frame)*compressionFrameSize {
+		// All the content of the previous frame has been
+		// read but we haven't seen the end of it yet.
+		if err := r.endFrame(); err != nil {
+			return err
+		}
+	}
+	if r.fr != nil && (frame != r.frame || r.framePos > r.pos) {
+		r.fr.Close()
+		r.fr = nil
+		r.storedPos = -1
+	}
+	if r.fr == nil {
+		if frame >= len(r.frames) {
+			return errgo.Newf("compressed blob has no frame for offset %d", r.pos)
+		}
+		start, end := r.frames[frame], r.storedSize
+		if frame+1 < len(r.frames) {
+			end = r.frames[frame+1]
+		}
+		if r.storedPos != start {
+			if _, err := r.r.Seek(start, seekStart); err != nil {
+				return errgo.Mask(err, errgo.Any)
+			}
+		}
+		r.limit = &io.LimitedReader{
+			R: r.r,
+			N: end - start,
+		}
+		r.fr = flate.NewReader(bufio.NewReader(r.limit))
+		r.frame = frame
+		r.framePos = int64(frame) * compressionFrameSize
+	}
+	if skip := r.pos - r.framePos; skip > 0 {
+		if _, err := io.CopyN(ioutil.Discard, r.fr, skip); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return errgo.Notef(err, "cannot decompress blob")
+		}
+		r.framePos = r.pos
+	}
+	return nil
+}
+
+// endFrame finishes reading the current frame.
+func (r *frameReader) endFrame() error {
+	if r.framePos != r.size && r.framePos != int64(r.frame+1)*compressionFrameSize {
+		return errgo.Newf("compressed frame %d ends early", r.frame)
+	}
+	r.fr.Close()
+	r.fr = nil
+	if _, err := io.Copy(ioutil.Discard, r.limit); err != nil {
+		r.storedPos = -1
+		return errgo.Mask(err, errgo.Any)
+	}
+	if r.frame+1 < len(r.frames) {
+		r.storedPos = r.frames[r.frame+1]
+	} else {
+		r.storedPos = r.storedSize
+	}
+	return nil
+}
+
+func (r *frameReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case seekStart:
+	case seekCurrent:
+		offset += r.pos
+	case seekEnd:
+		offset += r.size
+	default:
+		return 0, errgo.Newf("unknown seek whence %d", whence)
+	}
+	if offset < 0 {
+		return 0, errgo.Newf("negative seek position %d", offset)
+	}
+	r.pos = offset
+	return offset, nil
+}
+
+func (r *frameReader) Close() error {
+	if r.fr != nil {
+		r.fr.Close()
+	}
+	return r.r.Close()
+}
+
+// nopSeekCloser adds no-op Seek and Close methods to a reader
+// that is only ever read sequentially from its start.
+type nopSeekCloser struct {
+	io.Reader
+}
+
+func (nopSeekCloser) Seek(offset int64, whence int) (int64, error) {
+	return 0, errgo.Newf("cannot seek")
+}
+
+func (nopSeekCloser) Close() error {
+	return nil
+}
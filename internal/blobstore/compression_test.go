@@ -0,0 +1,141 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package blobstore_test
+
+import (
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"strings"
+
+	gc "gopkg.in/check.v1"
+	"gopkg.in/mgo.v2"
+
+	"gopkg.in/juju/charmstore.v5/internal/blobstore"
+)
+
+type CompressedStoreSuite struct {
+	blobStoreSuite
+}
+
+var _ = gc.Suite(&CompressedStoreSuite{})
+
+func (s *CompressedStoreSuite) SetUpTest(c *gc.C) {
+	s.compress = true
+	s.blobStoreSuite.SetUpTest(c, func(db *mgo.Database) blobstore.Backend {
+		return blobstore.NewMongoBackend(db, "blobstore")
+	})
+}
+
+func (s *CompressedStoreSuite) TestDataCompressedInBackend(c *gc.C) {
+	content := strings.Repeat("some data", 1000)
+	err := s.store.Put(strings.NewReader(content), hashOf(content), int64(len(content)))
+	c.Assert(err, gc.Equals, nil)
+
+	data := backendData(c, s.store, hashOf(content))
+	c.Assert(len(data) < len(content)/10, gc.Equals, true, gc.Commentf("stored size %d", len(data)))
+
+	s.assertBlobContent(c, nil, content)
+}
+
+func (s *CompressedStoreSuite) TestIncompressibleDataStoredAsIs(c *gc.C) {
+	content := randomString(5000)
+	err := s.store.Put(strings.NewReader(content), hashOf(content), int64(len(content)))
+	c.Assert(err, gc.Equals, nil)
+
+	c.Assert(string(backendData(c, s.store, hashOf(content))), gc.Equals, content)
+	s.assertBlobContent(c, nil, content)
+}
+
+func (s *CompressedStoreSuite) TestSeek(c *gc.C) {
+	s.PatchValue(blobstore.CompressionFrameSize, int64(1000))
+	content := strings.Repeat("0123456789", 1000)
+	err := s.store.Put(strings.NewReader(content), hashOf(content), int64(len(content)))
+	c.Assert(err, gc.Equals, nil)
+
+	r, size, err := s.store.Open(hashOf(content), nil)
+	c.Assert(err, gc.Equals, nil)
+	defer r.Close()
+	c.Assert(size, gc.Equals, int64(len(content)))
+	buf := make([]byte, 20)
+	for _, pos := range []int64{0, 1, 990, 999, 1000, 4321, 9980, 100, 5000} {
+		_, err := r.Seek(pos, 0)
+		c.Assert(err, gc.Equals, nil)
+		_, err = io.ReadFull(r, buf)
+		c.Assert(err, gc.Equals, nil)
+		c.Assert(string(buf), gc.Equals, content[pos:pos+20], gc.Commentf("pos %d", pos))
+	}
+	_, err = r.Seek(-5, 2)
+	c.Assert(err, gc.Equals, nil)
+	data, err := ioutil.ReadAll(r)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(string(data), gc.Equals, content[len(content)-5:])
+}
+
+func (s *CompressedStoreSuite) TestCompressedBlobsReadableWithoutCompression(c *gc.C) {
+	content := strings.Repeat("some data", 1000)
+	err := s.store.Put(strings.NewReader(content), hashOf(content), int64(len(content)))
+	c.Assert(err, gc.Equals, nil)
+
+	s.store.Compress = false
+	s.assertBlobContent(c, nil, content)
+}
+
+func (s *CompressedStoreSuite) TestCompressedAndEncrypted(c *gc.C) {
+	s.store.Keyring = newKeyring(c, testKey1)
+	content := strings.Repeat("some data", 1000)
+	err := s.store.Put(strings.NewReader(content), hashOf(content), int64(len(content)))
+	c.Assert(err, gc.Equals, nil)
+
+	data := backendData(c, s.store, hashOf(content))
+	c.Assert(len(data) < len(content)/10, gc.Equals, true, gc.Commentf("stored size %d", len(data)))
+	c.Assert(strings.Contains(string(data), "some data"), gc.Equals, false)
+
+	s.assertBlobContent(c, nil, content)
+
+	stats, err := s.store.Scrub(blobstore.ScrubParams{})
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(stats.Failed, gc.Equals, 0)
+	c.Assert(stats.CheckedBytes, gc.Equals, int64(len(content)))
+}
+
+func (s *CompressedStoreSuite) TestScrubCorruptCompressedData(c *gc.C) {
+	content := strings.Repeat("some data", 1000)
+	err := s.store.Put(strings.NewReader(content), hashOf(content), int64(len(content)))
+	c.Assert(err, gc.Equals, nil)
+
+	backend := blobstore.StoreBackend(s.store)
+	name, err := blobstore.BlobName(s.store, hashOf(content))
+	c.Assert(err, gc.Equals, nil)
+	data := backendData(c, s.store, hashOf(content))
+	data[len(data)/2] ^= 0xff
+	err = backend.Remove(name)
+	c.Assert(err, gc.Equals, nil)
+	err = backend.Put(name, strings.NewReader(string(data)), int64(len(data)), hashOf(string(data)))
+	c.Assert(err, gc.Equals, nil)
+
+	stats, err := s.store.Scrub(blobstore.ScrubParams{})
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(stats.Failed, gc.Equals, 1)
+}
+
+// backendData returns the data stored in the backend
+// of the given store for the blob with the given hash.
+func backendData(c *gc.C, store *blobstore.Store, hash string) []byte {
+	name, err := blobstore.BlobName(store, hash)
+	c.Assert(err, gc.Equals, nil)
+	r, _, err := blobstore.StoreBackend(store).Get(name)
+	c.Assert(err, gc.Equals, nil)
+	defer r.Close()
+	data, err := ioutil.ReadAll(r)
+	c.Assert(err, gc.Equals, nil)
+	return data
+}
+
+// randomString returns a string of n random bytes.
+func randomString(n int) string {
+	data := make([]byte, n)
+	rand.Read(data)
+	return string(data)
+}
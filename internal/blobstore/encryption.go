@@ -0,0 +1,340 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package blobstore // import "gopkg.in/juju/charmstore.v5/internal/blobstore"
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"gopkg.in/errgo.v1"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Blob data is encrypted using envelope encryption. Each blob is
+// encrypted with AES-256 in CTR mode, which allows encrypted blobs to
+// be read from any offset, using its own randomly generated data key.
+// Because a data key is never used for more than one blob, a zero
+// initial counter value is used. The data key is itself encrypted
+// ("wrapped") with AES-256-GCM using one of the master keys in a
+// Keyring, and stored in the blob's ref document along with the id
+// of that master key.
+//
+// Changing the master key only requires the data keys to be
+// re-wrapped (see Store.RotateKeys); the blob data itself is
+// not rewritten.
+
+// dataKeySize holds the size of a blob data key.
+const dataKeySize = 32
+
+// MasterKey holds a key that is used to encrypt
+// the data keys of blobs.
+type MasterKey struct {
+	// Id holds the identifier of the key. It is stored
+	// with each blob that is encrypted using the key.
+	Id string
+
+	// Key holds the 32 byte AES-256 key.
+	Key []byte
+}
+
+// Keyring holds the master keys used to encrypt blob data keys.
+type Keyring struct {
+	current string
+	keys    map[string]cipher.AEAD
+}
+
+// NewKeyring returns a keyring that uses the given current key to
+// encrypt new blobs. Blobs encrypted with any of the old keys may
+// still be read.
+func NewKeyring(current MasterKey, old ...MasterKey) (*Keyring, error) {
+	k := &Keyring{
+		current: current.Id,
+		keys:    make(map[string]cipher.AEAD),
+	}
+	for _, key := range append([]MasterKey{current}, old...) {
+		if key.Id == "" || strings.ContainsAny(key.Id, " \t") {
+			return nil, errgo.Newf("invalid master key id %q", key.Id)
+		}
+		if _, ok := k.keys[key.Id]; ok {
+			return nil, errgo.Newf("duplicate master key id %q", key.Id)
+		}
+		if len(key.Key) != dataKeySize {
+			return nil, errgo.Newf("master key %q has invalid length %d (need %d)", key.Id, len(key.Key), dataKeySize)
+		}
+		block, err := aes.NewCipher(key.Key)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		k.keys[key.Id] = aead
+	}
+	return k, nil
+}
+
+// ReadKeyringFile reads a keyring from the file with the given path.
+// Each non-empty line in the file that does not start with "#" holds
+// a key id followed by the base64-encoded key, separated by white
+// space. The first key in the file is the current key; any others
+// are old keys that can still be used to read existing blobs.
+func ReadKeyringFile(path string) (*Keyring, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot read master key file")
+	}
+	var keys []MasterKey
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 2 {
+			return nil, errgo.Newf("%s:%d: expected key id and key", path, line)
+		}
+		key, err := base64.StdEncoding.DecodeString(fields[1])
+		if err != nil {
+			return nil, errgo.Newf("%s:%d: invalid key: %v", path, line, err)
+		}
+		keys = append(keys, MasterKey{
+			Id:  fields[0],
+			Key: key,
+		})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errgo.Notef(err, "cannot read master key file")
+	}
+	if len(keys) == 0 {
+		return nil, errgo.Newf("no keys found in %s", path)
+	}
+	k, err := NewKeyring(keys[0], keys[1:]...)
+	if err != nil {
+		return nil, errgo.Notef(err, "invalid master key file %s", path)
+	}
+	return k, nil
+}
+
+// CurrentKeyId returns the id of the master key
+// used to encrypt new blobs.
+func (k *Keyring) CurrentKeyId() string {
+	return k.current
+}
+
+// wrap encrypts the given data key with the current master key. The
+// wrapped key can only be unwrapped for the blob with the given hash.
+func (k *Keyring) wrap(dataKey []byte, hash string) (keyId string, wrapped []byte, err error) {
+	aead := k.keys[k.current]
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", nil, errgo.Notef(err, "cannot generate nonce")
+	}
+	return k.current, aead.Seal(nonce, nonce, dataKey, []byte(hash)), nil
+}
+
+// unwrap decrypts a data key wrapped by wrap.
+func (k *Keyring) unwrap(keyId string, wrapped []byte, hash string) ([]byte, error) {
+	aead, ok := k.keys[keyId]
+	if !ok {
+		return nil, errgo.Newf("unknown master key %q", keyId)
+	}
+	if len(wrapped) < aead.NonceSize() {
+		return nil, errgo.Newf("wrapped data key too short")
+	}
+	nonce, sealed := wrapped[:aead.NonceSize()], wrapped[aead.NonceSize():]
+	dataKey, err := aead.Open(nil, nonce, sealed, []byte(hash))
+	if err != nil {
+		return nil, errgo.Newf("cannot unwrap data key with master key %q", keyId)
+	}
+	return dataKey, nil
+}
+
+// putEncrypted encrypts the data read from r, checking that it has the
+// given size and hash, and puts it into the backend with the given
+// name. The data key is bound to the blob with the given hash, which
+// differs from the hash of the data when the data is compressed. It
+// returns the id of the master key and the wrapped data key to be
+// stored in the blob ref.
+//
+// The backend needs to know the hash of the encrypted data before it
+// reads it, so the encrypted data is buffered in memory or, for large
+// blobs, in a temporary file. Note that unencrypted data is never
+// written to the temporary file.
+func (s *Store) putEncrypted(name string, r io.Reader, size int64, hash, blobHash string) (keyId string, wrappedKey []byte, err error) {
+	dataKey := make([]byte, dataKeySize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return "", nil, errgo.Notef(err, "cannot generate data key")
+	}
+	keyId, wrappedKey, err = s.Keyring.wrap(dataKey, blobHash)
+	if err != nil {
+		return "", nil, errgo.Mask(err)
+	}
+	var buf io.ReadWriter
+	if size <= maxBufferSize {
+		buf = bytes.NewBuffer(make([]byte, 0, size))
+	} else {
+		f, err := ioutil.TempFile(s.TempDir, "blobstore-encrypt-")
+		if err != nil {
+			return "", nil, errgo.Mask(err)
+		}
+		defer func() {
+			f.Close()
+			if err := os.Remove(f.Name()); err != nil {
+				logger.Warningf("cannot remove temporary file: %v", err)
+			}
+		}()
+		buf = f
+	}
+	encryptedHasher := NewHash()
+	w := &cipher.StreamWriter{
+		S: newDataStream(dataKey, 0),
+		W: io.MultiWriter(buf, encryptedHasher),
+	}
+	if err := copyAndCheckHash(w, r, size, hash); err != nil {
+		return "", nil, errgo.Mask(err, errgo.Is(io.ErrUnexpectedEOF))
+	}
+	if f, ok := buf.(*os.File); ok {
+		if _, err := f.Seek(0, seekStart); err != nil {
+			return "", nil, errgo.Mask(err)
+		}
+	}
+	if err := s.backend.Put(name, buf, size, fmt.Sprintf("%x", encryptedHasher.Sum(nil))); err != nil {
+		return "", nil, errgo.Mask(err, errgo.Is(io.ErrUnexpectedEOF))
+	}
+	return keyId, wrappedKey, nil
+}
+
+// decryptReader returns a reader that decrypts the data read from the
+// given backend reader for the blob with the given ref. If the blob is
+// not encrypted, it returns r unchanged.
+func (s *Store) decryptReader(ref *blobRefDoc, r ReadSeekCloser) (ReadSeekCloser, error) {
+	if ref.KeyId == "" {
+		return r, nil
+	}
+	if s.Keyring == nil {
+		return nil, errgo.Newf("blob is encrypted but no master keys are configured")
+	}
+	dataKey, err := s.Keyring.unwrap(ref.KeyId, ref.DataKey, ref.Hash)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return &decryptingReader{
+		r:       r,
+		dataKey: dataKey,
+		stream:  newDataStream(dataKey, 0),
+	}, nil
+}
+
+// RotateKeys re-wraps the data keys of all encrypted blobs that were
+// not encrypted with the current master key so that they use the
+// current key. The blob data itself is not changed. It returns the
+// number of blobs updated. When RotateKeys has completed, the old
+// master keys are no longer needed.
+//
+// Blobs that were put when no master keys were configured remain
+// unencrypted.
+func (s *Store) RotateKeys() (int, error) {
+	if s.Keyring == nil {
+		return 0, errgo.Newf("no master keys configured")
+	}
+	current := s.Keyring.CurrentKeyId()
+	iter := s.blobRefc.Find(bson.D{{
+		"keyid", bson.D{{"$exists", true}, {"$ne", current}},
+	}}).Select(bson.D{{"keyid", 1}, {"datakey", 1}}).Batch(1000).Iter()
+	defer iter.Close()
+	n := 0
+	var doc blobRefDoc
+	for iter.Next(&doc) {
+		dataKey, err := s.Keyring.unwrap(doc.KeyId, doc.DataKey, doc.Hash)
+		if err != nil {
+			return n, errgo.Notef(err, "cannot rotate key for blob %s", doc.Hash)
+		}
+		keyId, wrappedKey, err := s.Keyring.wrap(dataKey, doc.Hash)
+		if err != nil {
+			return n, errgo.Mask(err)
+		}
+		// Only update the document if the key hasn't changed
+		// since we read it.
+		err = s.blobRefc.Update(bson.D{
+			{"_id", doc.Hash},
+			{"keyid", doc.KeyId},
+		}, bson.D{{
+			"$set", bson.D{
+				{"keyid", keyId},
+				{"datakey", wrappedKey},
+			},
+		}})
+		if err != nil {
+			if err == mgo.ErrNotFound {
+				// The blob has been garbage collected
+				// or its key rotated concurrently.
+				continue
+			}
+			return n, errgo.Notef(err, "cannot update blob ref")
+		}
+		n++
+	}
+	if err := iter.Close(); err != nil {
+		return n, errgo.Notef(err, "cannot iterate over blobrefs")
+	}
+	return n, nil
+}
+
+// newDataStream returns a stream that encrypts or decrypts blob data
+// with the given data key, starting at the given offset.
+func newDataStream(dataKey []byte, offset int64) cipher.Stream {
+	block, err := aes.NewCipher(dataKey)
+	if err != nil {
+		// This can only happen if the key has the wrong
+		// size, and data keys are always dataKeySize bytes.
+		panic(err)
+	}
+	iv := make([]byte, aes.BlockSize)
+	binary.BigEndian.PutUint64(iv[aes.BlockSize-8:], uint64(offset/aes.BlockSize))
+	stream := cipher.NewCTR(block, iv)
+	if skip := offset % aes.BlockSize; skip > 0 {
+		discard := make([]byte, skip)
+		stream.XORKeyStream(discard, discard)
+	}
+	return stream
+}
+
+// decryptingReader decrypts the data read from an encrypted blob.
+type decryptingReader struct {
+	r       ReadSeekCloser
+	dataKey []byte
+	stream  cipher.Stream
+}
+
+func (r *decryptingReader) Read(buf []byte) (int, error) {
+	n, err := r.r.Read(buf)
+	r.stream.XORKeyStream(buf[:n], buf[:n])
+	return n, err
+}
+
+func (r *decryptingReader) Seek(offset int64, whence int) (int64, error) {
+	pos, err := r.r.Seek(offset, whence)
+	if err != nil {
+		return pos, err
+	}
+	r.stream = newDataStream(r.dataKey, pos)
+	return pos, nil
+}
+
+func (r *decryptingReader) Close() error {
+	return r.r.Close()
+}
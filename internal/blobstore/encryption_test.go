@@ -0,0 +1,258 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package blobstore_test
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	gc "gopkg.in/check.v1"
+	"gopkg.in/mgo.v2"
+
+	"gopkg.in/juju/charmstore.v5/internal/blobstore"
+)
+
+var (
+	testKey1 = blobstore.MasterKey{
+		Id:  "key1",
+		Key: bytes.Repeat([]byte{1}, 32),
+	}
+	testKey2 = blobstore.MasterKey{
+		Id:  "key2",
+		Key: bytes.Repeat([]byte{2}, 32),
+	}
+)
+
+type EncryptedStoreSuite struct {
+	blobStoreSuite
+}
+
+var _ = gc.Suite(&EncryptedStoreSuite{})
+
+func (s *EncryptedStoreSuite) SetUpTest(c *gc.C) {
+	s.keyring = newKeyring(c, testKey1)
+	s.blobStoreSuite.SetUpTest(c, func(db *mgo.Database) blobstore.Backend {
+		return blobstore.NewMongoBackend(db, "blobstore")
+	})
+}
+
+func (s *EncryptedStoreSuite) TestDataEncryptedInBackend(c *gc.C) {
+	content := strings.Repeat("some data", 100)
+	err := s.store.Put(strings.NewReader(content), hashOf(content), int64(len(content)))
+	c.Assert(err, gc.Equals, nil)
+
+	data := s.backendData(c, hashOf(content))
+	c.Assert(data, gc.HasLen, len(content))
+	c.Assert(string(data), gc.Not(gc.Equals), content)
+
+	s.assertBlobContent(c, nil, content)
+}
+
+func (s *EncryptedStoreSuite) TestSeek(c *gc.C) {
+	content := strings.Repeat("0123456789", 1000)
+	err := s.store.Put(strings.NewReader(content), hashOf(content), int64(len(content)))
+	c.Assert(err, gc.Equals, nil)
+
+	r, _, err := s.store.Open(hashOf(content), nil)
+	c.Assert(err, gc.Equals, nil)
+	defer r.Close()
+	buf := make([]byte, 20)
+	for _, pos := range []int64{0, 1, 15, 16, 17, 4321, 9980, 100} {
+		_, err := r.Seek(pos, 0)
+		c.Assert(err, gc.Equals, nil)
+		_, err = io.ReadFull(r, buf)
+		c.Assert(err, gc.Equals, nil)
+		c.Assert(string(buf), gc.Equals, content[pos:pos+20], gc.Commentf("pos %d", pos))
+	}
+}
+
+func (s *EncryptedStoreSuite) TestOpenWithoutKeyring(c *gc.C) {
+	content := "some data"
+	err := s.store.Put(strings.NewReader(content), hashOf(content), int64(len(content)))
+	c.Assert(err, gc.Equals, nil)
+
+	s.store.Keyring = nil
+	_, _, err = s.store.Open(hashOf(content), nil)
+	c.Assert(err, gc.ErrorMatches, `cannot decrypt blob: blob is encrypted but no master keys are configured`)
+}
+
+func (s *EncryptedStoreSuite) TestOpenWithUnknownKey(c *gc.C) {
+	content := "some data"
+	err := s.store.Put(strings.NewReader(content), hashOf(content), int64(len(content)))
+	c.Assert(err, gc.Equals, nil)
+
+	s.store.Keyring = newKeyring(c, testKey2)
+	_, _, err = s.store.Open(hashOf(content), nil)
+	c.Assert(err, gc.ErrorMatches, `cannot decrypt blob: unknown master key "key1"`)
+}
+
+func (s *EncryptedStoreSuite) TestUnencryptedBlobsStillReadable(c *gc.C) {
+	s.store.Keyring = nil
+	content := "some data"
+	err := s.store.Put(strings.NewReader(content), hashOf(content), int64(len(content)))
+	c.Assert(err, gc.Equals, nil)
+
+	s.store.Keyring = s.keyring
+	s.assertBlobContent(c, nil, content)
+}
+
+func (s *EncryptedStoreSuite) TestRotateKeys(c *gc.C) {
+	content1, content2 := "some data", "other data"
+	err := s.store.Put(strings.NewReader(content1), hashOf(content1), int64(len(content1)))
+	c.Assert(err, gc.Equals, nil)
+	data1 := s.backendData(c, hashOf(content1))
+
+	// Add a new current key, keeping the old one so
+	// that the existing blob can still be read.
+	s.store.Keyring = newKeyring(c, testKey2, testKey1)
+	err = s.store.Put(strings.NewReader(content2), hashOf(content2), int64(len(content2)))
+	c.Assert(err, gc.Equals, nil)
+	s.assertBlobContent(c, nil, content1)
+	s.assertBlobContent(c, nil, content2)
+
+	n, err := s.store.RotateKeys()
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(n, gc.Equals, 1)
+
+	// The blob data itself has not changed.
+	c.Assert(s.backendData(c, hashOf(content1)), gc.DeepEquals, data1)
+
+	// The old key is no longer needed.
+	s.store.Keyring = newKeyring(c, testKey2)
+	s.assertBlobContent(c, nil, content1)
+	s.assertBlobContent(c, nil, content2)
+
+	n, err = s.store.RotateKeys()
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(n, gc.Equals, 0)
+}
+
+func (s *EncryptedStoreSuite) TestRotateKeysWithoutKeyring(c *gc.C) {
+	s.store.Keyring = nil
+	_, err := s.store.RotateKeys()
+	c.Assert(err, gc.ErrorMatches, `no master keys configured`)
+}
+
+func (s *EncryptedStoreSuite) TestRotateKeysWithMissingKey(c *gc.C) {
+	content := "some data"
+	err := s.store.Put(strings.NewReader(content), hashOf(content), int64(len(content)))
+	c.Assert(err, gc.Equals, nil)
+
+	s.store.Keyring = newKeyring(c, testKey2)
+	_, err = s.store.RotateKeys()
+	c.Assert(err, gc.ErrorMatches, `cannot rotate key for blob [0-9a-f]+: unknown master key "key1"`)
+}
+
+// backendData returns the data stored in the
+// backend for the blob with the given hash.
+func (s *EncryptedStoreSuite) backendData(c *gc.C, hash string) []byte {
+	return backendData(c, s.store, hash)
+}
+
+type keyringSuite struct{}
+
+var _ = gc.Suite(&keyringSuite{})
+
+var newKeyringErrorTests = []struct {
+	about       string
+	current     blobstore.MasterKey
+	old         []blobstore.MasterKey
+	expectError string
+}{{
+	about: "empty key id",
+	current: blobstore.MasterKey{
+		Key: testKey1.Key,
+	},
+	expectError: `invalid master key id ""`,
+}, {
+	about: "key id with space",
+	current: blobstore.MasterKey{
+		Id:  "a key",
+		Key: testKey1.Key,
+	},
+	expectError: `invalid master key id "a key"`,
+}, {
+	about:       "duplicate key id",
+	current:     testKey1,
+	old:         []blobstore.MasterKey{testKey2, testKey1},
+	expectError: `duplicate master key id "key1"`,
+}, {
+	about: "short key",
+	current: blobstore.MasterKey{
+		Id:  "key1",
+		Key: []byte("short"),
+	},
+	expectError: `master key "key1" has invalid length 5 \(need 32\)`,
+}}
+
+func (s *keyringSuite) TestNewKeyringError(c *gc.C) {
+	for i, test := range newKeyringErrorTests {
+		c.Logf("test %d: %s", i, test.about)
+		_, err := blobstore.NewKeyring(test.current, test.old...)
+		c.Assert(err, gc.ErrorMatches, test.expectError)
+	}
+}
+
+func (s *keyringSuite) TestReadKeyringFile(c *gc.C) {
+	path := filepath.Join(c.MkDir(), "keys")
+	data := "# The current key.\n" +
+		"key2 " + base64.StdEncoding.EncodeToString(testKey2.Key) + "\n" +
+		"\n" +
+		"key1\t" + base64.StdEncoding.EncodeToString(testKey1.Key) + "\n"
+	err := ioutil.WriteFile(path, []byte(data), 0600)
+	c.Assert(err, gc.Equals, nil)
+
+	k, err := blobstore.ReadKeyringFile(path)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(k.CurrentKeyId(), gc.Equals, "key2")
+}
+
+var readKeyringFileErrorTests = []struct {
+	about       string
+	data        string
+	expectError string
+}{{
+	about:       "no keys",
+	data:        "# nothing here\n",
+	expectError: `no keys found in .*`,
+}, {
+	about:       "missing key",
+	data:        "key1\n",
+	expectError: `.*:1: expected key id and key`,
+}, {
+	about:       "bad base64",
+	data:        "\nkey1 !!!\n",
+	expectError: `.*:2: invalid key: .*`,
+}, {
+	about:       "bad key",
+	data:        "key1 " + base64.StdEncoding.EncodeToString([]byte("short")) + "\n",
+	expectError: `invalid master key file .*: master key "key1" has invalid length 5 \(need 32\)`,
+}}
+
+func (s *keyringSuite) TestReadKeyringFileError(c *gc.C) {
+	dir := c.MkDir()
+	for i, test := range readKeyringFileErrorTests {
+		c.Logf("test %d: %s", i, test.about)
+		path := filepath.Join(dir, "keys")
+		err := ioutil.WriteFile(path, []byte(test.data), 0600)
+		c.Assert(err, gc.Equals, nil)
+		_, err = blobstore.ReadKeyringFile(path)
+		c.Assert(err, gc.ErrorMatches, test.expectError)
+	}
+}
+
+func (s *keyringSuite) TestReadKeyringFileNotFound(c *gc.C) {
+	_, err := blobstore.ReadKeyringFile(filepath.Join(c.MkDir(), "keys"))
+	c.Assert(err, gc.ErrorMatches, `cannot read master key file: .*`)
+}
+
+func newKeyring(c *gc.C, current blobstore.MasterKey, old ...blobstore.MasterKey) *blobstore.Keyring {
+	k, err := blobstore.NewKeyring(current, old...)
+	c.Assert(err, gc.Equals, nil)
+	return k
+}
@@ -1,11 +1,41 @@
 package blobstore
 
 import (
+	"net/http"
+	"time"
+
 	"gopkg.in/mgo.v2"
 )
 
 type UploadDoc uploadDoc
 
+var S3PartSize = &s3PartSize
+
+var CompressionFrameSize = &compressionFrameSize
+
+var BlobRefBatchSize = &blobRefBatchSize
+
+var MaxMigrationFailures = &maxMigrationFailures
+
+// S3Sign signs the given request with the credentials
+// of the given S3 backend.
+func S3Sign(b Backend, req *http.Request, body []byte, now time.Time) {
+	b.(*s3Backend).sign(req, body, now)
+}
+
 func BackendGridFS(s *Store) *mgo.GridFS {
 	return s.backend.(*mongoBackend).fs
 }
+
+func StoreBackend(s *Store) Backend {
+	return s.backend
+}
+
+// BlobName returns the backend name of the blob with the given hash.
+func BlobName(s *Store, hash string) (string, error) {
+	ref, err := s.blobRef(hash)
+	if err != nil {
+		return "", err
+	}
+	return ref.Name, nil
+}
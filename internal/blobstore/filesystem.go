@@ -0,0 +1,161 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package blobstore // import "gopkg.in/juju/charmstore.v5/internal/blobstore"
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/errgo.v1"
+)
+
+// filesystemTmpDir holds the name of the directory, relative to the
+// backend root, used to hold partially written blobs. It's inside the
+// root so that completed blobs can be atomically renamed into place.
+const filesystemTmpDir = "tmp"
+
+type filesystemBackend struct {
+	root string
+}
+
+// NewFilesystemBackend returns a backend which stores data objects as
+// files in a directory tree under the given root directory. Objects are
+// spread across subdirectories named after the first characters of the
+// object name so that no single directory grows too large.
+func NewFilesystemBackend(root string) Backend {
+	return &filesystemBackend{
+		root: root,
+	}
+}
+
+func (b *filesystemBackend) Get(name string) (ReadSeekCloser, int64, error) {
+	path, err := b.path(name)
+	if err != nil {
+		return nil, 0, errgo.Mask(err)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, 0, errgo.WithCausef(nil, ErrNotFound, "")
+		}
+		return nil, 0, errgo.Mask(err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, errgo.Mask(err)
+	}
+	return &filesystemReader{
+		file: f,
+		path: path,
+	}, info.Size(), nil
+}
+
+func (b *filesystemBackend) Put(name string, r io.Reader, size int64, hash string) error {
+	path, err := b.path(name)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	tmpDir := filepath.Join(b.root, filesystemTmpDir)
+	if err := os.MkdirAll(tmpDir, 0700); err != nil {
+		return errgo.Mask(err)
+	}
+	f, err := ioutil.TempFile(tmpDir, "put-")
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	renamed := false
+	defer func() {
+		f.Close()
+		if renamed {
+			return
+		}
+		if err := os.Remove(f.Name()); err != nil {
+			logger.Warningf("error removing temporary file: %s", err)
+		}
+	}()
+	if err := copyAndCheckHash(f, r, size, hash); err != nil {
+		return errgo.Mask(err, errgo.Is(io.ErrUnexpectedEOF))
+	}
+	// Make sure the data is on disk before the blob becomes
+	// visible under its final name.
+	if err := f.Sync(); err != nil {
+		return errgo.Mask(err)
+	}
+	if err := f.Close(); err != nil {
+		return errgo.Mask(err)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return errgo.Mask(err)
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		return errgo.Mask(err)
+	}
+	renamed = true
+	return nil
+}
+
+func (b *filesystemBackend) Remove(name string) error {
+	path, err := b.path(name)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if err := os.Remove(path); err != nil {
+		if os.IsNotExist(err) {
+			return errgo.WithCausef(nil, ErrNotFound, "")
+		}
+		return errgo.Mask(err)
+	}
+	return nil
+}
+
+// path returns the path of the file holding the object with the given
+// name. Objects are stored two directory levels down, using the first
+// four characters of the name, so the blob "0123abcd" is stored as
+// $root/01/23/0123abcd.
+func (b *filesystemBackend) path(name string) (string, error) {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		return "", errgo.Newf("invalid blob name %q", name)
+	}
+	shard := name
+	for len(shard) < 4 {
+		shard += "_"
+	}
+	return filepath.Join(b.root, shard[0:2], shard[2:4], name), nil
+}
+
+// filesystemReader checks that the file is still present before each
+// read, so that the read error has an ErrNotFound cause if the
+// object is removed while it's being read, as required by the
+// Backend.Get contract. Without this, an open file would remain
+// readable after it had been removed.
+//
+// The file is held in a field rather than embedded so that methods
+// such as WriteTo are not promoted, as they would let io.Copy bypass
+// the check in Read.
+type filesystemReader struct {
+	file *os.File
+	path string
+}
+
+func (r *filesystemReader) Read(buf []byte) (int, error) {
+	if _, err := os.Stat(r.path); err != nil {
+		if os.IsNotExist(err) {
+			return 0, errgo.WithCausef(nil, ErrNotFound, "")
+		}
+		return 0, errgo.Mask(err)
+	}
+	return r.file.Read(buf)
+}
+
+func (r *filesystemReader) Seek(offset int64, whence int) (int64, error) {
+	return r.file.Seek(offset, whence)
+}
+
+func (r *filesystemReader) Close() error {
+	return r.file.Close()
+}
@@ -0,0 +1,108 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package blobstore // import "gopkg.in/juju/charmstore.v5/internal/blobstore"
+
+import (
+	"bytes"
+	"io"
+	"sync"
+
+	"gopkg.in/errgo.v1"
+)
+
+type memoryBackend struct {
+	mu    sync.Mutex
+	blobs map[string]*memoryBlob
+}
+
+// memoryBlob holds the data of a blob. Its data
+// is never changed once it has been put.
+type memoryBlob struct {
+	data []byte
+
+	// removed is set when the blob is removed
+	// from the backend. It is guarded by the
+	// backend's mutex.
+	removed bool
+}
+
+// NewMemoryBackend returns a backend that holds all data objects in
+// memory. It is intended for tests, and is the reference
+// implementation of the Backend interface: it implements all the
+// behaviour described by the interface and nothing more.
+func NewMemoryBackend() Backend {
+	return &memoryBackend{
+		blobs: make(map[string]*memoryBlob),
+	}
+}
+
+func (b *memoryBackend) Get(name string) (ReadSeekCloser, int64, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	blob, ok := b.blobs[name]
+	if !ok {
+		return nil, 0, errgo.WithCausef(nil, ErrNotFound, "")
+	}
+	return &memoryReader{
+		reader:  bytes.NewReader(blob.data),
+		backend: b,
+		blob:    blob,
+	}, int64(len(blob.data)), nil
+}
+
+func (b *memoryBackend) Put(name string, r io.Reader, size int64, hash string) error {
+	var buf bytes.Buffer
+	if err := copyAndCheckHash(&buf, r, size, hash); err != nil {
+		return errgo.Mask(err, errgo.Is(io.ErrUnexpectedEOF))
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if old, ok := b.blobs[name]; ok {
+		old.removed = true
+	}
+	b.blobs[name] = &memoryBlob{
+		data: buf.Bytes(),
+	}
+	return nil
+}
+
+func (b *memoryBackend) Remove(name string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	blob, ok := b.blobs[name]
+	if !ok {
+		return errgo.WithCausef(nil, ErrNotFound, "")
+	}
+	blob.removed = true
+	delete(b.blobs, name)
+	return nil
+}
+
+// memoryReader reads the data of a blob held by a memoryBackend.
+// Its reads fail with an ErrNotFound cause once the blob
+// has been removed. The bytes.Reader is not embedded so that
+// its WriteTo method cannot be used to bypass Read.
+type memoryReader struct {
+	reader  *bytes.Reader
+	backend *memoryBackend
+	blob    *memoryBlob
+}
+
+func (r *memoryReader) Read(buf []byte) (int, error) {
+	r.backend.mu.Lock()
+	removed := r.blob.removed
+	r.backend.mu.Unlock()
+	if removed {
+		return 0, errgo.WithCausef(nil, ErrNotFound, "")
+	}
+	return r.reader.Read(buf)
+}
+
+func (r *memoryReader) Seek(offset int64, whence int) (int64, error) {
+	return r.reader.Seek(offset, whence)
+}
+
+func (r *memoryReader) Close() error {
+	return nil
+}
@@ -0,0 +1,373 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package blobstore // import "gopkg.in/juju/charmstore.v5/internal/blobstore"
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"gopkg.in/errgo.v1"
+	"gopkg.in/mgo.v2"
+)
+
+// ErrMigrationStopped is returned by Migrate when it is
+// stopped before all blobs have been migrated.
+var ErrMigrationStopped = errgo.New("migration stopped")
+
+// maxMigrationFailures holds the maximum number of failures
+// recorded in a MigrationStatus.
+var maxMigrationFailures = 100
+
+// MigrateParams holds parameters for Store.Migrate.
+type MigrateParams struct {
+	// Name identifies the migration. Progress is recorded
+	// under this name so that an interrupted migration
+	// can be resumed.
+	Name string
+
+	// Stop optionally holds a channel that causes the migration
+	// to be suspended with an ErrMigrationStopped error when
+	// it's closed.
+	Stop <-chan struct{}
+}
+
+// MigrationStatus holds the progress of a migration. Note that the
+// MigrationStatus type is also used as a document inside MongoDB.
+type MigrationStatus struct {
+	// Name holds the name of the migration.
+	Name string `bson:"_id" json:"name"`
+
+	// LastHash holds the hash of the last blob processed
+	// by the current pass of the migration. Blobs are
+	// migrated in hash order.
+	LastHash string `bson:"lasthash" json:"last-hash"`
+
+	// Copied and CopiedBytes hold the number and total size of
+	// the blobs copied to the primary backend.
+	Copied      int   `bson:"copied" json:"copied"`
+	CopiedBytes int64 `bson:"copiedbytes" json:"copied-bytes"`
+
+	// Skipped holds the number of blobs that were
+	// already present in the primary backend.
+	Skipped int `bson:"skipped" json:"skipped"`
+
+	// FailureCount holds the number of blobs that could not
+	// be migrated in the current pass. Failed blobs are retried
+	// by the next pass.
+	FailureCount int `bson:"failurecount" json:"failure-count"`
+
+	// Failures holds the first of the blobs that could not be
+	// migrated in the current pass. At most 100 failures are
+	// recorded, so that the status document doesn't grow
+	// without limit when many blobs fail.
+	Failures []MigrationFailure `bson:"failures,omitempty" json:"failures,omitempty"`
+
+	// Complete holds whether all blobs have been
+	// migrated successfully.
+	Complete bool `bson:"complete" json:"complete"`
+
+	// Updated holds when the status was last updated.
+	Updated time.Time `bson:"updated" json:"updated"`
+}
+
+// MigrationFailure holds information about a blob
+// that could not be migrated.
+type MigrationFailure struct {
+	Hash  string `bson:"hash" json:"hash"`
+	Error string `bson:"error" json:"error"`
+}
+
+// Migrate copies all blobs that are held only in the secondary backend
+// to the primary backend, checking their hashes as they're copied. The
+// store remains usable while Migrate runs: blobs that haven't yet been
+// copied are read from the secondary backend, and new blobs are written
+// to the primary backend.
+//
+// Progress is recorded as the migration proceeds. Calling Migrate again
+// with the same name after it has returned an error resumes the
+// migration. If any blobs could not be copied, Migrate returns with
+// the migration marked as incomplete, and the next call will check all
+// the blobs again, copying any that are still missing.
+//
+// The blobs are left in the secondary backend; it can be
+// discarded once the migration is complete.
+func (s *Store) Migrate(p MigrateParams) (MigrationStatus, error) {
+	if s.SecondaryBackend == nil {
+		return MigrationStatus{}, errgo.Newf("no secondary backend to migrate from")
+	}
+	if p.Name == "" {
+		return MigrationStatus{}, errgo.Newf("no migration name specified")
+	}
+	status, err := s.MigrationStatus(p.Name)
+	if err != nil && errgo.Cause(err) != ErrNotFound {
+		return MigrationStatus{}, errgo.Mask(err)
+	}
+	status.Name = p.Name
+	if status.Complete {
+		return status, nil
+	}
+	if status.LastHash == "" {
+		// Starting a new pass, so forget any failures
+		// from the previous one.
+		status.FailureCount = 0
+		status.Failures = nil
+	}
+	for {
+		docs, err := s.blobRefsAfter(status.LastHash)
+		if err != nil {
+			return status, errgo.Mask(err)
+		}
+		if len(docs) == 0 {
+			break
+		}
+		for i := range docs {
+			select {
+			case <-p.Stop:
+				return status, ErrMigrationStopped
+			default:
+			}
+			s.migrateBlobRef(&docs[i], &status)
+			status.LastHash = docs[i].Hash
+			if err := s.saveMigrationStatus(&status); err != nil {
+				return status, errgo.Mask(err)
+			}
+		}
+	}
+	// Start the next pass from the beginning.
+	status.LastHash = ""
+	status.Complete = status.FailureCount == 0
+	if err := s.saveMigrationStatus(&status); err != nil {
+		return status, errgo.Mask(err)
+	}
+	if !status.Complete {
+		return status, errgo.Newf("%d blobs could not be migrated", status.FailureCount)
+	}
+	return status, nil
+}
+
+// migrateBlobRef migrates the blob with the given ref, updating
+// status accordingly.
+func (s *Store) migrateBlobRef(doc *blobRefDoc, status *MigrationStatus) {
+	copied, err := s.migrateBlob(doc)
+	switch {
+	case errgo.Cause(err) == errBlobGone:
+	case err != nil:
+		logger.Errorf("cannot migrate blob %q (hash %s): %v", doc.Name, doc.Hash, err)
+		status.FailureCount++
+		if len(status.Failures) < maxMigrationFailures {
+			status.Failures = append(status.Failures, MigrationFailure{
+				Hash:  doc.Hash,
+				Error: err.Error(),
+			})
+		}
+	case copied:
+		status.Copied++
+		status.CopiedBytes += doc.Size
+	default:
+		status.Skipped++
+	}
+}
+
+// MigrationStatus returns the status of the migration with the given
+// name. If the migration has not been started, it returns an error with
+// an ErrNotFound cause.
+func (s *Store) MigrationStatus(name string) (MigrationStatus, error) {
+	var status MigrationStatus
+	if err := s.migrationc.FindId(name).One(&status); err != nil {
+		if err == mgo.ErrNotFound {
+			return MigrationStatus{}, errgo.WithCausef(nil, ErrNotFound, "migration %q not found", name)
+		}
+		return MigrationStatus{}, errgo.Notef(err, "cannot get migration status")
+	}
+	return status, nil
+}
+
+func (s *Store) saveMigrationStatus(status *MigrationStatus) error {
+	status.Updated = time.Now()
+	if _, err := s.migrationc.UpsertId(status.Name, status); err != nil {
+		return errgo.Notef(err, "cannot save migration status")
+	}
+	return nil
+}
+
+// errBlobGone is used as an error cause by migrateBlob when the blob
+// has been garbage collected.
+var errBlobGone = errgo.New("blob has been removed")
+
+// migrateBlob copies the blob with the given ref from the secondary
+// backend to the primary backend if it's not already there, and
+// reports whether it was copied.
+func (s *Store) migrateBlob(doc *blobRefDoc) (bool, error) {
+	// Use the primary backend directly, so that blobs
+	// aren't added to any cache by the migration.
+	primary := s.uncachedBackend()
+	r, size, err := primary.Get(doc.Name)
+	if err == nil {
+		r.Close()
+		if size == doc.storedSize() {
+			return false, nil
+		}
+		// A previous copy must have been incomplete
+		// somehow, so remove it and try again.
+		logger.Warningf("blob %q has unexpected size %d in primary backend (expected %d)", doc.Name, size, doc.storedSize())
+		if err := primary.Remove(doc.Name); err != nil && errgo.Cause(err) != ErrNotFound {
+			return false, errgo.Notef(err, "cannot remove bad blob from primary backend")
+		}
+	} else if errgo.Cause(err) != ErrNotFound {
+		return false, errgo.Notef(err, "cannot get blob from primary backend")
+	}
+	if err := s.copyFromSecondary(primary, doc); err != nil {
+		if errgo.Cause(err) == ErrNotFound {
+			if _, err := s.blobRef(doc.Hash); errgo.Cause(err) == ErrNotFound {
+				return false, errgo.WithCausef(nil, errBlobGone, "")
+			}
+			return false, errgo.Newf("blob not found in either backend")
+		}
+		return false, errgo.Mask(err)
+	}
+	// The blob might have been garbage collected while we
+	// were copying it, in which case we've just left a
+	// copy in the primary backend that nothing refers to.
+	if _, err := s.blobRef(doc.Hash); errgo.Cause(err) == ErrNotFound {
+		if err := primary.Remove(doc.Name); err != nil {
+			logger.Errorf("cannot remove garbage blob %q from primary backend: %v", doc.Name, err)
+		}
+		return false, errgo.WithCausef(nil, errBlobGone, "")
+	}
+	return true, nil
+}
+
+// copyFromSecondary copies the blob with the given ref from the
+// secondary backend to the given backend.
+func (s *Store) copyFromSecondary(primary Backend, doc *blobRefDoc) error {
+	// The primary backend checks the data against the hash, but
+	// the hash of an encrypted blob's data isn't recorded, so read
+	// the blob once to check that it decrypts correctly and to
+	// find out the hash of its data.
+	dataHash := doc.storedHash()
+	if dataHash == "" {
+		h, err := s.checkSecondary(doc)
+		if err != nil {
+			return errgo.Mask(err, errgo.Is(ErrNotFound))
+		}
+		dataHash = h
+	}
+	r, size, err := s.SecondaryBackend.Get(doc.Name)
+	if err != nil {
+		return errgo.NoteMask(err, "cannot get blob from secondary backend", errgo.Is(ErrNotFound))
+	}
+	defer r.Close()
+	if size != doc.storedSize() {
+		return errgo.Newf("blob has unexpected size %d in secondary backend (expected %d)", size, doc.storedSize())
+	}
+	if err := primary.Put(doc.Name, r, size, dataHash); err != nil {
+		return errgo.NoteMask(err, "cannot put blob to primary backend", errgo.Is(ErrNotFound))
+	}
+	return nil
+}
+
+// checkSecondary checks that the encrypted blob with the given ref
+// in the secondary backend decrypts to data with the expected hash and
+// returns the hash of the encrypted data.
+func (s *Store) checkSecondary(doc *blobRefDoc) (string, error) {
+	r, _, err := s.SecondaryBackend.Get(doc.Name)
+	if err != nil {
+		return "", errgo.NoteMask(err, "cannot get blob from secondary backend", errgo.Is(ErrNotFound))
+	}
+	defer r.Close()
+	dataHasher := NewHash()
+	dr, err := s.contentReader(doc, teeReadSeekCloser{
+		ReadSeekCloser: r,
+		w:              dataHasher,
+	})
+	if err != nil {
+		return "", errgo.Mask(err)
+	}
+	hasher := NewHash()
+	if _, err := io.Copy(hasher, dr); err != nil {
+		return "", errgo.NoteMask(err, "cannot read blob from secondary backend", errgo.Is(ErrNotFound))
+	}
+	if fmt.Sprintf("%x", hasher.Sum(nil)) != doc.Hash {
+		return "", errgo.Newf("hash mismatch")
+	}
+	return fmt.Sprintf("%x", dataHasher.Sum(nil)), nil
+}
+
+// teeReadSeekCloser writes all the data read from
+// its ReadSeekCloser to w.
+type teeReadSeekCloser struct {
+	ReadSeekCloser
+	w io.Writer
+}
+
+func (r teeReadSeekCloser) Read(buf []byte) (int, error) {
+	n, err := r.ReadSeekCloser.Read(buf)
+	r.w.Write(buf[:n])
+	return n, err
+}
+
+// migratingBackend reads blobs from the primary backend, falling
+// back to the secondary backend for blobs that have not been
+// migrated yet. New blobs are only written to the primary backend.
+type migratingBackend struct {
+	primary   Backend
+	secondary Backend
+}
+
+func (b migratingBackend) Get(name string) (ReadSeekCloser, int64, error) {
+	r, size, err := b.primary.Get(name)
+	if errgo.Cause(err) != ErrNotFound {
+		return r, size, errgo.Mask(err)
+	}
+	r, size, err = b.secondary.Get(name)
+	if err != nil {
+		return nil, 0, errgo.Mask(err, errgo.Is(ErrNotFound))
+	}
+	return r, size, nil
+}
+
+func (b migratingBackend) Put(name string, r io.Reader, size int64, hash string) error {
+	return errgo.Mask(b.primary.Put(name, r, size, hash), errgo.Any)
+}
+
+// Remove removes the blob from both backends. It returns an error with
+// an ErrNotFound cause only if the blob was found in neither.
+func (b migratingBackend) Remove(name string) error {
+	err1 := b.primary.Remove(name)
+	err2 := b.secondary.Remove(name)
+	notFound1, notFound2 := errgo.Cause(err1) == ErrNotFound, errgo.Cause(err2) == ErrNotFound
+	switch {
+	case notFound1 && notFound2:
+		return errgo.WithCausef(nil, ErrNotFound, "")
+	case err1 != nil && !notFound1:
+		return errgo.Notef(err1, "cannot remove blob from primary backend")
+	case err2 != nil && !notFound2:
+		return errgo.Notef(err2, "cannot remove blob from secondary backend")
+	}
+	return nil
+}
+
+// readBackend returns the backend that should be used to read and
+// remove blobs. When a secondary backend has been configured, blobs
+// are read from it when they can't be found in the given primary
+// backend.
+func (s *Store) readBackend(primary Backend) Backend {
+	if s.SecondaryBackend == nil {
+		return primary
+	}
+	return migratingBackend{
+		primary:   primary,
+		secondary: s.SecondaryBackend,
+	}
+}
+
+// uncachedBackend returns the primary backend, bypassing
+// any cache.
+func (s *Store) uncachedBackend() Backend {
+	if cb, ok := s.backend.(*cachingBackend); ok {
+		return cb.backend
+	}
+	return s.backend
+}
@@ -0,0 +1,273 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package blobstore_test
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"time"
+
+	jujutesting "github.com/juju/testing"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+	"gopkg.in/errgo.v1"
+
+	"gopkg.in/juju/charmstore.v5/internal/blobstore"
+)
+
+type MigrateSuite struct {
+	jujutesting.IsolatedMgoSuite
+	primaryRoot   string
+	secondaryRoot string
+	keyring       *blobstore.Keyring
+}
+
+var _ = gc.Suite(&MigrateSuite{})
+
+func (s *MigrateSuite) SetUpTest(c *gc.C) {
+	s.IsolatedMgoSuite.SetUpTest(c)
+	s.primaryRoot = c.MkDir()
+	s.secondaryRoot = c.MkDir()
+	s.keyring = nil
+}
+
+// oldStore returns a store that uses only the secondary backend,
+// as the store did before the migration was configured.
+func (s *MigrateSuite) oldStore() *blobstore.Store {
+	store := blobstore.New(s.Session.DB("db"), "blobstore", blobstore.NewFilesystemBackend(s.secondaryRoot))
+	store.Keyring = s.keyring
+	return store
+}
+
+// migratingStore returns a store that uses the primary backend,
+// falling back to the secondary backend.
+func (s *MigrateSuite) migratingStore() *blobstore.Store {
+	store := blobstore.New(s.Session.DB("db"), "blobstore", blobstore.NewFilesystemBackend(s.primaryRoot))
+	store.Keyring = s.keyring
+	store.SecondaryBackend = blobstore.NewFilesystemBackend(s.secondaryRoot)
+	return store
+}
+
+func (s *MigrateSuite) TestMigrate(c *gc.C) {
+	contents := []string{"foo", "bar", "some other data"}
+	putContents(c, s.oldStore(), contents...)
+
+	store := s.migratingStore()
+	// Blobs can be read before they have been migrated.
+	assertContents(c, store, contents...)
+
+	status, err := store.Migrate(blobstore.MigrateParams{
+		Name: "test",
+	})
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(status.Complete, gc.Equals, true)
+	c.Assert(status.Copied, gc.Equals, 3)
+	c.Assert(status.CopiedBytes, gc.Equals, int64(21))
+	c.Assert(status.Skipped, gc.Equals, 0)
+
+	// All the blobs are now in the primary backend.
+	for _, content := range contents {
+		name, err := blobstore.BlobName(store, hashOf(content))
+		c.Assert(err, gc.Equals, nil)
+		c.Assert(getBlob(c, blobstore.NewFilesystemBackend(s.primaryRoot), name), gc.Equals, content)
+	}
+	store.SecondaryBackend = nil
+	assertContents(c, store, contents...)
+
+	status1, err := store.MigrationStatus("test")
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(status1.Updated.IsZero(), gc.Equals, false)
+	status1.Updated = status.Updated
+	c.Assert(status1, jc.DeepEquals, status)
+}
+
+func (s *MigrateSuite) TestMigrateInBatches(c *gc.C) {
+	s.PatchValue(blobstore.BlobRefBatchSize, 2)
+	contents := []string{"foo", "bar", "baz"}
+	putContents(c, s.oldStore(), contents...)
+
+	store := s.migratingStore()
+	status, err := store.Migrate(blobstore.MigrateParams{
+		Name: "test",
+	})
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(status.Complete, gc.Equals, true)
+	c.Assert(status.Copied, gc.Equals, 3)
+	store.SecondaryBackend = nil
+	assertContents(c, store, contents...)
+}
+
+func (s *MigrateSuite) TestMigrateSkipsBlobsInPrimary(c *gc.C) {
+	putContents(c, s.oldStore(), "foo")
+	store := s.migratingStore()
+	putContents(c, store, "bar")
+
+	// The new blob has only been put in the primary backend.
+	name, err := blobstore.BlobName(store, hashOf("bar"))
+	c.Assert(err, gc.Equals, nil)
+	_, _, err = blobstore.NewFilesystemBackend(s.secondaryRoot).Get(name)
+	c.Assert(errgo.Cause(err), gc.Equals, blobstore.ErrNotFound)
+
+	status, err := store.Migrate(blobstore.MigrateParams{
+		Name: "test",
+	})
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(status.Copied, gc.Equals, 1)
+	c.Assert(status.Skipped, gc.Equals, 1)
+}
+
+func (s *MigrateSuite) TestMigrateResumes(c *gc.C) {
+	contents := []string{"foo", "bar", "baz"}
+	putContents(c, s.oldStore(), contents...)
+
+	store := s.migratingStore()
+	stop := make(chan struct{})
+	close(stop)
+	status, err := store.Migrate(blobstore.MigrateParams{
+		Name: "test",
+		Stop: stop,
+	})
+	c.Assert(errgo.Cause(err), gc.Equals, blobstore.ErrMigrationStopped)
+	c.Assert(status.Complete, gc.Equals, false)
+
+	status, err = store.Migrate(blobstore.MigrateParams{
+		Name: "test",
+	})
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(status.Complete, gc.Equals, true)
+	c.Assert(status.Copied, gc.Equals, 3)
+
+	// Migrating again once complete does nothing.
+	status, err = store.Migrate(blobstore.MigrateParams{
+		Name: "test",
+	})
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(status.Copied, gc.Equals, 3)
+}
+
+func (s *MigrateSuite) TestMigrateCorruptBlob(c *gc.C) {
+	putContents(c, s.oldStore(), "foo", "bar")
+	store := s.migratingStore()
+	name, err := blobstore.BlobName(store, hashOf("foo"))
+	c.Assert(err, gc.Equals, nil)
+	path := filepath.Join(s.secondaryRoot, name[0:2], name[2:4], name)
+	err = ioutil.WriteFile(path, []byte("xxx"), 0666)
+	c.Assert(err, gc.Equals, nil)
+
+	status, err := store.Migrate(blobstore.MigrateParams{
+		Name: "test",
+	})
+	c.Assert(err, gc.ErrorMatches, `1 blobs could not be migrated`)
+	c.Assert(status.Complete, gc.Equals, false)
+	c.Assert(status.Copied, gc.Equals, 1)
+	c.Assert(status.FailureCount, gc.Equals, 1)
+	c.Assert(status.Failures, gc.HasLen, 1)
+	c.Assert(status.Failures[0].Hash, gc.Equals, hashOf("foo"))
+	c.Assert(status.Failures[0].Error, gc.Matches, `cannot put blob to primary backend: hash mismatch`)
+
+	// The corrupt blob isn't copied to the primary backend.
+	_, _, err = blobstore.NewFilesystemBackend(s.primaryRoot).Get(name)
+	c.Assert(errgo.Cause(err), gc.Equals, blobstore.ErrNotFound)
+
+	// Once the blob has been repaired, the next pass completes.
+	err = ioutil.WriteFile(path, []byte("foo"), 0666)
+	c.Assert(err, gc.Equals, nil)
+	status, err = store.Migrate(blobstore.MigrateParams{
+		Name: "test",
+	})
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(status.Complete, gc.Equals, true)
+	c.Assert(status.FailureCount, gc.Equals, 0)
+	c.Assert(status.Failures, gc.HasLen, 0)
+	c.Assert(status.Copied, gc.Equals, 2)
+	c.Assert(status.Skipped, gc.Equals, 1)
+}
+
+func (s *MigrateSuite) TestMigrateRecordsLimitedFailures(c *gc.C) {
+	s.PatchValue(blobstore.MaxMigrationFailures, 1)
+	putContents(c, s.oldStore(), "foo", "bar")
+	store := s.migratingStore()
+	for _, content := range []string{"foo", "bar"} {
+		name, err := blobstore.BlobName(store, hashOf(content))
+		c.Assert(err, gc.Equals, nil)
+		path := filepath.Join(s.secondaryRoot, name[0:2], name[2:4], name)
+		err = ioutil.WriteFile(path, []byte("xxx"), 0666)
+		c.Assert(err, gc.Equals, nil)
+	}
+
+	status, err := store.Migrate(blobstore.MigrateParams{
+		Name: "test",
+	})
+	c.Assert(err, gc.ErrorMatches, `2 blobs could not be migrated`)
+	c.Assert(status.Complete, gc.Equals, false)
+	c.Assert(status.FailureCount, gc.Equals, 2)
+	c.Assert(status.Failures, gc.HasLen, 1)
+}
+
+func (s *MigrateSuite) TestMigrateEncrypted(c *gc.C) {
+	s.keyring = newKeyring(c, testKey1)
+	contents := []string{"foo", strings.Repeat("some data", 1000)}
+	putContents(c, s.oldStore(), contents...)
+
+	store := s.migratingStore()
+	status, err := store.Migrate(blobstore.MigrateParams{
+		Name: "test",
+	})
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(status.Copied, gc.Equals, 2)
+
+	store.SecondaryBackend = nil
+	assertContents(c, store, contents...)
+}
+
+func (s *MigrateSuite) TestMigrationStatusNotFound(c *gc.C) {
+	_, err := s.migratingStore().MigrationStatus("test")
+	c.Assert(errgo.Cause(err), gc.Equals, blobstore.ErrNotFound)
+	c.Assert(err, gc.ErrorMatches, `migration "test" not found`)
+}
+
+func (s *MigrateSuite) TestMigrateWithoutSecondary(c *gc.C) {
+	_, err := s.oldStore().Migrate(blobstore.MigrateParams{
+		Name: "test",
+	})
+	c.Assert(err, gc.ErrorMatches, `no secondary backend to migrate from`)
+}
+
+func (s *MigrateSuite) TestGCRemovesFromBothBackends(c *gc.C) {
+	putContents(c, s.oldStore(), "foo")
+	store := s.migratingStore()
+	_, err := store.Migrate(blobstore.MigrateParams{
+		Name: "test",
+	})
+	c.Assert(err, gc.Equals, nil)
+	name, err := blobstore.BlobName(store, hashOf("foo"))
+	c.Assert(err, gc.Equals, nil)
+
+	_, err = store.GC(blobstore.NewRefs(0), time.Now())
+	c.Assert(err, gc.Equals, nil)
+	for _, root := range []string{s.primaryRoot, s.secondaryRoot} {
+		_, _, err = blobstore.NewFilesystemBackend(root).Get(name)
+		c.Assert(errgo.Cause(err), gc.Equals, blobstore.ErrNotFound)
+	}
+}
+
+func putContents(c *gc.C, store *blobstore.Store, contents ...string) {
+	for _, content := range contents {
+		err := store.Put(strings.NewReader(content), hashOf(content), int64(len(content)))
+		c.Assert(err, gc.Equals, nil)
+	}
+}
+
+func assertContents(c *gc.C, store *blobstore.Store, contents ...string) {
+	for _, content := range contents {
+		r, size, err := store.Open(hashOf(content), nil)
+		c.Assert(err, gc.Equals, nil)
+		data, err := ioutil.ReadAll(r)
+		r.Close()
+		c.Assert(err, gc.Equals, nil)
+		c.Assert(size, gc.Equals, int64(len(content)))
+		c.Assert(string(data), gc.Equals, content)
+	}
+}
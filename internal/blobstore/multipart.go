@@ -54,6 +54,11 @@ type uploadDoc struct {
 	// accidentally removing an upload because the
 	// update process failed half-way through.
 	Owner string `bson:",omitempty"`
+
+	// Creator holds the name of the user that created
+	// the upload. It is empty if the upload was not
+	// created on behalf of any particular user.
+	Creator string `bson:"creator,omitempty"`
 }
 
 // Note that the PartInfo type is also used as a document
@@ -75,6 +80,18 @@ type PartInfo struct {
 
 // UploadInfo holds information on a given upload.
 type UploadInfo struct {
+	// Id holds the id of the upload.
+	Id string
+
+	// Creator holds the name of the user that
+	// created the upload, if any.
+	Creator string
+
+	// Owner holds the owner of the upload as
+	// set by SetOwner. It is empty if the upload
+	// has not yet been used.
+	Owner string
+
 	// Parts holds all the known parts of the upload.
 	// Parts that haven't been uploaded yet will have nil
 	// elements. Parts that are in progress or have been
@@ -114,10 +131,18 @@ func (info *UploadInfo) Index() (*mongodoc.MultipartIndex, bool) {
 // creating the upload, each part must be uploaded individually, and
 // then the whole completed by calling FinishUpload and RemoveUpload.
 func (s *Store) NewUpload(expires time.Time) (uploadId string, err error) {
+	return s.NewUploadForUser("", expires)
+}
+
+// NewUploadForUser is like NewUpload except that it records
+// the given user as the creator of the upload, so that
+// the upload will be returned by ListUploads for that user.
+func (s *Store) NewUploadForUser(user string, expires time.Time) (uploadId string, err error) {
 	uploadId = base64.RawURLEncoding.EncodeToString([]byte(bson.NewObjectId()))
 	if err := s.uploadc.Insert(uploadDoc{
 		Id:      uploadId,
 		Expires: expires,
+		Creator: user,
 	}); err != nil {
 		return "", errgo.Notef(err, "cannot create new upload")
 	}
@@ -277,10 +302,10 @@ func (s *Store) addUploadRefs(refs *Refs) error {
 	var uploadDoc uploadDoc
 	iter := s.uploadc.Find(nil).Iter()
 	for iter.Next(&uploadDoc) {
-		refs.Add(uploadDoc.Hash)
+		refs.Add(uploadDoc.Hash, MultipartPartBlob)
 		for _, part := range uploadDoc.Parts {
 			if part != nil {
-				refs.Add(part.Hash)
+				refs.Add(part.Hash, MultipartPartBlob)
 			}
 		}
 	}
@@ -297,11 +322,42 @@ func (s *Store) UploadInfo(uploadId string) (UploadInfo, error) {
 	if err != nil {
 		return UploadInfo{}, errgo.Mask(err, errgo.Is(ErrNotFound))
 	}
+	return udoc.info(), nil
+}
+
+// ListUploads returns information on all the uploads created by
+// the given user that have not yet expired or been used, ordered
+// by expiry time. If user is empty, the uploads of all users
+// are returned.
+func (s *Store) ListUploads(user string) ([]UploadInfo, error) {
+	query := bson.D{
+		{"owner", bson.D{{"$exists", false}}},
+		{"expires", bson.D{{"$gte", time.Now()}}},
+	}
+	if user != "" {
+		query = append(query, bson.DocElem{"creator", user})
+	}
+	var udocs []uploadDoc
+	if err := s.uploadc.Find(query).Sort("expires", "_id").All(&udocs); err != nil {
+		return nil, errgo.Notef(err, "cannot list uploads")
+	}
+	infos := make([]UploadInfo, len(udocs))
+	for i := range udocs {
+		infos[i] = udocs[i].info()
+	}
+	return infos, nil
+}
+
+// info returns the information on the upload held in udoc.
+func (udoc *uploadDoc) info() UploadInfo {
 	return UploadInfo{
+		Id:      udoc.Id,
+		Creator: udoc.Creator,
+		Owner:   udoc.Owner,
 		Parts:   udoc.Parts,
 		Expires: udoc.Expires,
 		Hash:    udoc.Hash,
-	}, nil
+	}
 }
 
 // initializePart creates the initial record for a part.
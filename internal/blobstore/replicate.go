@@ -0,0 +1,504 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package blobstore // import "gopkg.in/juju/charmstore.v5/internal/blobstore"
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"gopkg.in/errgo.v1"
+	"gopkg.in/mgo.v2"
+)
+
+// ErrRepairStopped is returned by Store.RepairReplicas when
+// it is stopped before all blobs have been checked.
+var ErrRepairStopped = errgo.New("repair stopped")
+
+// defaultReplicaRetryInterval holds the default value
+// of ReplicaSetParams.RetryInterval.
+const defaultReplicaRetryInterval = 30 * time.Second
+
+// ReplicaSetParams holds parameters for NewReplicaSet.
+type ReplicaSetParams struct {
+	// Replicas holds the number of replica backends.
+	Replicas int
+
+	// WriteQuorum holds the number of replicas that a blob must
+	// be written to (or removed from) for a Put (or Remove) to
+	// succeed. If it's zero, a majority of the replicas is
+	// required.
+	WriteQuorum int
+
+	// RetryInterval holds how long a replica that has failed is
+	// avoided when reading blobs. If it's zero, a default of 30
+	// seconds is used.
+	RetryInterval time.Duration
+
+	// TempDir holds the directory in which temporary files
+	// holding large blobs are created while they are written
+	// to the replicas. If it's empty, the default directory
+	// for temporary files is used.
+	TempDir string
+}
+
+// ReplicaSet holds the state shared by replicating backends (see
+// ReplicaSet.Backend), so that the health of each replica is known
+// to all the backends that are created for each database session.
+type ReplicaSet struct {
+	replicas      int
+	quorum        int
+	retryInterval time.Duration
+	tempDir       string
+
+	// mu guards failed.
+	mu sync.Mutex
+
+	// failed holds, for each replica, the time it last failed,
+	// or the zero time if it succeeded the last time it was
+	// used.
+	failed []time.Time
+}
+
+// NewReplicaSet returns a new ReplicaSet using the given parameters.
+func NewReplicaSet(p ReplicaSetParams) (*ReplicaSet, error) {
+	if p.Replicas <= 0 {
+		return nil, errgo.Newf("invalid replica count %d", p.Replicas)
+	}
+	if p.WriteQuorum == 0 {
+		p.WriteQuorum = p.Replicas/2 + 1
+	}
+	if p.WriteQuorum < 0 || p.WriteQuorum > p.Replicas {
+		return nil, errgo.Newf("invalid write quorum %d for %d replicas", p.WriteQuorum, p.Replicas)
+	}
+	if p.RetryInterval == 0 {
+		p.RetryInterval = defaultReplicaRetryInterval
+	}
+	return &ReplicaSet{
+		replicas:      p.Replicas,
+		quorum:        p.WriteQuorum,
+		retryInterval: p.RetryInterval,
+		tempDir:       p.TempDir,
+		failed:        make([]time.Time, p.Replicas),
+	}, nil
+}
+
+// Backend returns a backend that stores blobs in all the given replica
+// backends, which must number the same as the replica count that the
+// ReplicaSet was created with.
+//
+// Put and Remove act on all the replicas concurrently, and succeed if
+// they succeed for at least the write quorum of replicas. Get reads
+// from the first replica that holds the blob, trying healthy replicas
+// before any that have failed recently.
+//
+// Replicas that miss writes (for example because they were unavailable
+// at the time) can be brought up to date with Store.RepairReplicas.
+func (rs *ReplicaSet) Backend(replicas ...Backend) Backend {
+	if len(replicas) != rs.replicas {
+		panic(fmt.Sprintf("replica set created with %d replicas, but %d backends provided", rs.replicas, len(replicas)))
+	}
+	return &replicatingBackend{
+		set:      rs,
+		replicas: replicas,
+	}
+}
+
+// setHealthy records whether the replica with the given index
+// succeeded or failed.
+func (rs *ReplicaSet) setHealthy(i int, healthy bool) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if healthy {
+		rs.failed[i] = time.Time{}
+	} else {
+		rs.failed[i] = time.Now()
+	}
+}
+
+// readOrder returns the indexes of the replicas in the order
+// that they should be read from: healthy replicas first,
+// followed by those that have failed recently.
+func (rs *ReplicaSet) readOrder() []int {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	order := make([]int, 0, rs.replicas)
+	var failed []int
+	for i, t := range rs.failed {
+		if !t.IsZero() && time.Since(t) < rs.retryInterval {
+			failed = append(failed, i)
+		} else {
+			order = append(order, i)
+		}
+	}
+	return append(order, failed...)
+}
+
+// replicatingBackend implements Backend by storing
+// blobs in a number of replica backends.
+type replicatingBackend struct {
+	set      *ReplicaSet
+	replicas []Backend
+}
+
+// Get implements Backend.Get.
+func (b *replicatingBackend) Get(name string) (ReadSeekCloser, int64, error) {
+	var lastErr error
+	for _, i := range b.set.readOrder() {
+		r, size, err := b.replicas[i].Get(name)
+		if err == nil {
+			b.set.setHealthy(i, true)
+			return r, size, nil
+		}
+		if errgo.Cause(err) == ErrNotFound {
+			continue
+		}
+		logger.Warningf("cannot get blob %q from replica %d: %v", name, i, err)
+		b.set.setHealthy(i, false)
+		lastErr = err
+	}
+	if lastErr != nil {
+		// The blob might be held by a replica that
+		// we couldn't read from.
+		return nil, 0, errgo.Notef(lastErr, "cannot get blob from any replica")
+	}
+	return nil, 0, errgo.WithCausef(nil, ErrNotFound, "blob %q not found in any replica", name)
+}
+
+// Put implements Backend.Put.
+//
+// The blob data is buffered so that it can be written
+// to all the replicas concurrently.
+func (b *replicatingBackend) Put(name string, r io.Reader, size int64, hash string) error {
+	buf, err := newBlobBuffer(b.set.tempDir, r, size, hash)
+	if err != nil {
+		return errgo.Mask(err, errgo.Is(io.ErrUnexpectedEOF))
+	}
+	defer buf.Close()
+	all := make([]int, len(b.replicas))
+	for i := range all {
+		all[i] = i
+	}
+	errs := b.putReplicas(all, name, buf, hash)
+	var written []int
+	var firstErr error
+	for i, err := range errs {
+		if err == nil {
+			written = append(written, i)
+		} else if firstErr == nil {
+			firstErr = err
+		}
+	}
+	if len(written) < b.set.quorum {
+		// Remove the copies we did manage to write, so that
+		// nothing is left behind that the blob store
+		// doesn't know about.
+		for _, i := range written {
+			if err := b.replicas[i].Remove(name); err != nil {
+				logger.Errorf("cannot remove blob %q from replica %d: %v", name, i, err)
+			}
+		}
+		return errgo.Notef(firstErr, "blob written to only %d of %d replicas (need %d)", len(written), len(b.replicas), b.set.quorum)
+	}
+	return nil
+}
+
+// putReplicas concurrently puts the buffered blob data into the
+// replicas with the given indexes. It returns the error from each
+// replica, indexed by replica.
+func (b *replicatingBackend) putReplicas(indexes []int, name string, buf *blobBuffer, hash string) []error {
+	errs := make([]error, len(b.replicas))
+	var wg sync.WaitGroup
+	for _, i := range indexes {
+		i := i
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := b.replicas[i].Put(name, buf.reader(), buf.size, hash)
+			if err != nil {
+				logger.Warningf("cannot put blob %q to replica %d: %v", name, i, err)
+				errs[i] = errgo.Notef(err, "replica %d", i)
+			}
+			b.set.setHealthy(i, err == nil)
+		}()
+	}
+	wg.Wait()
+	return errs
+}
+
+// Remove implements Backend.Remove. It returns an error with an
+// ErrNotFound cause only if the blob was found in none of the
+// replicas.
+func (b *replicatingBackend) Remove(name string) error {
+	errs := make([]error, len(b.replicas))
+	var wg sync.WaitGroup
+	for i := range b.replicas {
+		i := i
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = b.replicas[i].Remove(name)
+		}()
+	}
+	wg.Wait()
+	removed, notFound := 0, 0
+	var firstErr error
+	for i, err := range errs {
+		switch {
+		case err == nil:
+			removed++
+		case errgo.Cause(err) == ErrNotFound:
+			notFound++
+		default:
+			logger.Warningf("cannot remove blob %q from replica %d: %v", name, i, err)
+			b.set.setHealthy(i, false)
+			if firstErr == nil {
+				firstErr = errgo.Notef(err, "replica %d", i)
+			}
+		}
+	}
+	if notFound == len(b.replicas) {
+		return errgo.WithCausef(nil, ErrNotFound, "")
+	}
+	if removed+notFound < b.set.quorum {
+		return errgo.Notef(firstErr, "blob removed from only %d of %d replicas (need %d)", removed+notFound, len(b.replicas), b.set.quorum)
+	}
+	return nil
+}
+
+// repair copies the blob with the given name to any replicas that
+// don't hold it, and returns the number of replicas that it was copied
+// to. The blob is expected to have the given size and, if hash is
+// non-empty, the given hash.
+func (b *replicatingBackend) repair(name string, size int64, hash string) (int, error) {
+	var missing []int
+	source := -1
+	for i, replica := range b.replicas {
+		r, actualSize, err := replica.Get(name)
+		switch {
+		case err == nil:
+			r.Close()
+			if actualSize == size {
+				if source == -1 {
+					source = i
+				}
+				continue
+			}
+			logger.Warningf("blob %q has unexpected size %d in replica %d (expected %d)", name, actualSize, i, size)
+			if err := replica.Remove(name); err != nil && errgo.Cause(err) != ErrNotFound {
+				return 0, errgo.Notef(err, "cannot remove bad blob from replica %d", i)
+			}
+		case errgo.Cause(err) != ErrNotFound:
+			return 0, errgo.Notef(err, "cannot get blob from replica %d", i)
+		}
+		missing = append(missing, i)
+	}
+	if len(missing) == 0 {
+		return 0, nil
+	}
+	if source == -1 {
+		return 0, errgo.WithCausef(nil, ErrNotFound, "blob not found in any replica")
+	}
+	r, _, err := b.replicas[source].Get(name)
+	if err != nil {
+		return 0, errgo.NoteMask(err, fmt.Sprintf("cannot get blob from replica %d", source), errgo.Is(ErrNotFound))
+	}
+	defer r.Close()
+	buf, err := newBlobBuffer(b.set.tempDir, r, size, hash)
+	if err != nil {
+		return 0, errgo.NoteMask(err, fmt.Sprintf("cannot read blob from replica %d", source), errgo.Is(ErrNotFound))
+	}
+	defer buf.Close()
+	for _, err := range b.putReplicas(missing, name, buf, buf.hash) {
+		if err != nil {
+			return 0, errgo.Mask(err)
+		}
+	}
+	return len(missing), nil
+}
+
+// blobBuffer holds a copy of some blob data, held in memory or, for
+// large blobs, in a temporary file.
+type blobBuffer struct {
+	size int64
+	hash string
+	data []byte
+	file *os.File
+}
+
+// newBlobBuffer reads the given number of bytes from r into a new
+// blobBuffer. If hash is non-empty, the data must have that hash.
+// Large blobs are buffered in a temporary file in tempDir.
+func newBlobBuffer(tempDir string, r io.Reader, size int64, hash string) (_ *blobBuffer, err error) {
+	buf := &blobBuffer{
+		size: size,
+	}
+	var w io.Writer
+	if size <= maxBufferSize {
+		w = bytes.NewBuffer(make([]byte, 0, size))
+	} else {
+		f, err := ioutil.TempFile(tempDir, "blobstore-replicate-")
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		buf.file = f
+		defer func() {
+			if err != nil {
+				buf.Close()
+			}
+		}()
+		w = f
+	}
+	hasher := NewHash()
+	if _, err := io.CopyN(io.MultiWriter(w, hasher), r, size); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, errgo.Mask(err, errgo.Is(io.ErrUnexpectedEOF), errgo.Is(ErrNotFound))
+	}
+	buf.hash = fmt.Sprintf("%x", hasher.Sum(nil))
+	if hash != "" && buf.hash != hash {
+		return nil, errgo.New("hash mismatch")
+	}
+	if b, ok := w.(*bytes.Buffer); ok {
+		buf.data = b.Bytes()
+	}
+	return buf, nil
+}
+
+// reader returns a new reader for the data in the buffer.
+// Each reader may be used concurrently with the others.
+func (buf *blobBuffer) reader() io.Reader {
+	if buf.file != nil {
+		return io.NewSectionReader(buf.file, 0, buf.size)
+	}
+	return bytes.NewReader(buf.data)
+}
+
+// Close releases the resources used by the buffer.
+func (buf *blobBuffer) Close() {
+	if buf.file == nil {
+		return
+	}
+	buf.file.Close()
+	if err := os.Remove(buf.file.Name()); err != nil {
+		logger.Warningf("cannot remove temporary file: %v", err)
+	}
+}
+
+// ReplicaRepairStats holds statistics about a replica repair.
+type ReplicaRepairStats struct {
+	// Checked holds the number of blobs checked.
+	Checked int
+
+	// Repaired holds the number of blobs that were copied
+	// to at least one replica.
+	Repaired int
+
+	// Copies holds the total number of blob copies made.
+	Copies int
+
+	// Failed holds the number of blobs that could not be
+	// repaired.
+	Failed int
+}
+
+// repairStatusId holds the id of the document in the scrub status
+// collection that records the progress of the current replica repair.
+const repairStatusId = "repair"
+
+// repairStatusDoc records the progress of a replica repair so that an
+// interrupted repair can be resumed.
+type repairStatusDoc struct {
+	Id string `bson:"_id"`
+
+	// LastHash holds the hash of the last blob checked.
+	// Blobs are checked in hash order.
+	LastHash string `bson:"lasthash"`
+
+	// ReplicaRepairStats holds the statistics for the
+	// blobs checked so far.
+	ReplicaRepairStats `bson:",inline"`
+}
+
+// RepairReplicas checks that every blob is held by all the replicas of
+// the store's backend, which must have been created by
+// ReplicaSet.Backend, and copies it from another replica to any that
+// are missing it or hold it with the wrong size.
+//
+// Blobs are checked in batches, and progress is recorded after each
+// batch, so calling RepairReplicas after it has been stopped or has
+// returned an error resumes the repair from where it left off. The
+// returned statistics cover the whole repair, including any earlier
+// interrupted calls.
+//
+// The stop channel may be used to abandon the repair, in which case
+// RepairReplicas returns an ErrRepairStopped error.
+func (s *Store) RepairReplicas(stop <-chan struct{}) (ReplicaRepairStats, error) {
+	rb, ok := s.uncachedBackend().(*replicatingBackend)
+	if !ok {
+		return ReplicaRepairStats{}, errgo.Newf("blob store backend is not replicated")
+	}
+	var status repairStatusDoc
+	if err := s.scrubStatusc.FindId(repairStatusId).One(&status); err != nil {
+		if err != mgo.ErrNotFound {
+			return ReplicaRepairStats{}, errgo.Notef(err, "cannot get repair status")
+		}
+		status.Id = repairStatusId
+	}
+	for {
+		docs, err := s.blobRefsAfter(status.LastHash)
+		if err != nil {
+			return status.ReplicaRepairStats, errgo.Mask(err)
+		}
+		if len(docs) == 0 {
+			break
+		}
+		for i := range docs {
+			select {
+			case <-stop:
+				return status.ReplicaRepairStats, ErrRepairStopped
+			default:
+			}
+			s.repairBlob(rb, &docs[i], &status.ReplicaRepairStats)
+			status.LastHash = docs[i].Hash
+		}
+		if _, err := s.scrubStatusc.UpsertId(repairStatusId, &status); err != nil {
+			return status.ReplicaRepairStats, errgo.Notef(err, "cannot save repair status")
+		}
+	}
+	// Start the next repair from the beginning.
+	if err := s.scrubStatusc.RemoveId(repairStatusId); err != nil && err != mgo.ErrNotFound {
+		return status.ReplicaRepairStats, errgo.Notef(err, "cannot remove repair status")
+	}
+	return status.ReplicaRepairStats, nil
+}
+
+// repairBlob repairs the replicas of the blob with the given ref,
+// updating stats accordingly.
+func (s *Store) repairBlob(rb *replicatingBackend, doc *blobRefDoc, stats *ReplicaRepairStats) {
+	n, err := rb.repair(doc.Name, doc.storedSize(), doc.storedHash())
+	if errgo.Cause(err) == ErrNotFound {
+		if _, err := s.blobRef(doc.Hash); errgo.Cause(err) == ErrNotFound {
+			// The blob has been garbage collected
+			// since we started.
+			return
+		}
+	}
+	stats.Checked++
+	if err != nil {
+		logger.Errorf("cannot repair blob %q (hash %s): %v", doc.Name, doc.Hash, err)
+		stats.Failed++
+		return
+	}
+	if n > 0 {
+		logger.Infof("copied blob %q (hash %s) to %d replicas", doc.Name, doc.Hash, n)
+		stats.Repaired++
+		stats.Copies += n
+	}
+}
@@ -0,0 +1,337 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package blobstore_test
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	gc "gopkg.in/check.v1"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/mgo.v2"
+
+	"gopkg.in/juju/charmstore.v5/internal/blobstore"
+)
+
+type ReplicatedStoreSuite struct {
+	roots []string
+	blobStoreSuite
+}
+
+var _ = gc.Suite(&ReplicatedStoreSuite{})
+
+func (s *ReplicatedStoreSuite) SetUpTest(c *gc.C) {
+	s.roots = []string{c.MkDir(), c.MkDir(), c.MkDir()}
+	rs, err := blobstore.NewReplicaSet(blobstore.ReplicaSetParams{
+		Replicas: len(s.roots),
+	})
+	c.Assert(err, gc.Equals, nil)
+	s.blobStoreSuite.SetUpTest(c, func(db *mgo.Database) blobstore.Backend {
+		var replicas []blobstore.Backend
+		for _, root := range s.roots {
+			replicas = append(replicas, blobstore.NewFilesystemBackend(root))
+		}
+		return rs.Backend(replicas...)
+	})
+}
+
+func (s *ReplicatedStoreSuite) TestPutWritesAllReplicas(c *gc.C) {
+	content := "some data"
+	err := s.store.Put(strings.NewReader(content), hashOf(content), int64(len(content)))
+	c.Assert(err, gc.Equals, nil)
+	name, err := blobstore.BlobName(s.store, hashOf(content))
+	c.Assert(err, gc.Equals, nil)
+	for _, root := range s.roots {
+		c.Assert(getBlob(c, blobstore.NewFilesystemBackend(root), name), gc.Equals, content)
+	}
+}
+
+func (s *ReplicatedStoreSuite) TestRepairReplicas(c *gc.C) {
+	contents := []string{"foo", "bar", "baz"}
+	putContents(c, s.store, contents...)
+
+	// Remove one blob from a replica and truncate
+	// another one.
+	name0, err := blobstore.BlobName(s.store, hashOf("foo"))
+	c.Assert(err, gc.Equals, nil)
+	err = blobstore.NewFilesystemBackend(s.roots[0]).Remove(name0)
+	c.Assert(err, gc.Equals, nil)
+	name1, err := blobstore.BlobName(s.store, hashOf("bar"))
+	c.Assert(err, gc.Equals, nil)
+	err = os.Truncate(filepath.Join(s.roots[2], name1[0:2], name1[2:4], name1), 1)
+	c.Assert(err, gc.Equals, nil)
+
+	stats, err := s.store.RepairReplicas(nil)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(stats, gc.Equals, blobstore.ReplicaRepairStats{
+		Checked:  3,
+		Repaired: 2,
+		Copies:   2,
+	})
+	c.Assert(getBlob(c, blobstore.NewFilesystemBackend(s.roots[0]), name0), gc.Equals, "foo")
+	c.Assert(getBlob(c, blobstore.NewFilesystemBackend(s.roots[2]), name1), gc.Equals, "bar")
+
+	stats, err = s.store.RepairReplicas(nil)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(stats, gc.Equals, blobstore.ReplicaRepairStats{
+		Checked: 3,
+	})
+}
+
+func (s *ReplicatedStoreSuite) TestRepairReplicasBlobMissingEverywhere(c *gc.C) {
+	putContents(c, s.store, "foo")
+	name, err := blobstore.BlobName(s.store, hashOf("foo"))
+	c.Assert(err, gc.Equals, nil)
+	for _, root := range s.roots {
+		err := blobstore.NewFilesystemBackend(root).Remove(name)
+		c.Assert(err, gc.Equals, nil)
+	}
+	stats, err := s.store.RepairReplicas(nil)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(stats, gc.Equals, blobstore.ReplicaRepairStats{
+		Checked: 1,
+		Failed:  1,
+	})
+}
+
+func (s *ReplicatedStoreSuite) TestRepairReplicasStop(c *gc.C) {
+	putContents(c, s.store, "foo")
+	stop := make(chan struct{})
+	close(stop)
+	_, err := s.store.RepairReplicas(stop)
+	c.Assert(errgo.Cause(err), gc.Equals, blobstore.ErrRepairStopped)
+}
+
+func (s *ReplicatedStoreSuite) TestRepairReplicasResume(c *gc.C) {
+	s.PatchValue(blobstore.BlobRefBatchSize, 1)
+	putContents(c, s.store, "a", "b", "c")
+
+	// Stop the repair while it's checking the first blob.
+	stop := make(chan struct{})
+	replica0 := &getHookBackend{
+		Backend: blobstore.NewFilesystemBackend(s.roots[0]),
+		onGet: func() {
+			close(stop)
+		},
+	}
+	rs, err := blobstore.NewReplicaSet(blobstore.ReplicaSetParams{
+		Replicas: len(s.roots),
+	})
+	c.Assert(err, gc.Equals, nil)
+	store := blobstore.New(s.Session.DB("db"), "blobstore", rs.Backend(
+		replica0,
+		blobstore.NewFilesystemBackend(s.roots[1]),
+		blobstore.NewFilesystemBackend(s.roots[2]),
+	))
+	store.Keyring = s.keyring
+	store.Compress = s.compress
+	stats, err := store.RepairReplicas(stop)
+	c.Assert(err, gc.Equals, blobstore.ErrRepairStopped)
+	c.Assert(stats, gc.Equals, blobstore.ReplicaRepairStats{
+		Checked: 1,
+	})
+	c.Assert(replica0.gets, gc.Equals, 1)
+
+	// Repairing again checks only the remaining blobs,
+	// but the statistics cover the whole repair.
+	replica0.onGet = nil
+	stats, err = store.RepairReplicas(nil)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(stats, gc.Equals, blobstore.ReplicaRepairStats{
+		Checked: 3,
+	})
+	c.Assert(replica0.gets, gc.Equals, 3)
+
+	// The next repair starts from the beginning.
+	stats, err = store.RepairReplicas(nil)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(stats, gc.Equals, blobstore.ReplicaRepairStats{
+		Checked: 3,
+	})
+	c.Assert(replica0.gets, gc.Equals, 6)
+}
+
+type replicaSuite struct {
+	replicas []*failingBackend
+}
+
+var _ = gc.Suite(&replicaSuite{})
+
+func (s *replicaSuite) SetUpTest(c *gc.C) {
+	s.replicas = nil
+	for i := 0; i < 3; i++ {
+		s.replicas = append(s.replicas, &failingBackend{
+			countingBackend: countingBackend{
+				Backend: blobstore.NewFilesystemBackend(c.MkDir()),
+			},
+		})
+	}
+}
+
+func (s *replicaSuite) newBackend(c *gc.C, quorum int) blobstore.Backend {
+	rs, err := blobstore.NewReplicaSet(blobstore.ReplicaSetParams{
+		Replicas:    len(s.replicas),
+		WriteQuorum: quorum,
+	})
+	c.Assert(err, gc.Equals, nil)
+	var replicas []blobstore.Backend
+	for _, r := range s.replicas {
+		replicas = append(replicas, r)
+	}
+	return rs.Backend(replicas...)
+}
+
+func (s *replicaSuite) TestNewReplicaSetInvalidParams(c *gc.C) {
+	_, err := blobstore.NewReplicaSet(blobstore.ReplicaSetParams{})
+	c.Assert(err, gc.ErrorMatches, `invalid replica count 0`)
+	_, err = blobstore.NewReplicaSet(blobstore.ReplicaSetParams{
+		Replicas:    2,
+		WriteQuorum: 3,
+	})
+	c.Assert(err, gc.ErrorMatches, `invalid write quorum 3 for 2 replicas`)
+}
+
+func (s *replicaSuite) TestPutWithQuorum(c *gc.C) {
+	be := s.newBackend(c, 2)
+	s.replicas[1].setFail(true)
+	putBlob(c, be, "0123abcd", "some data")
+	c.Assert(getBlob(c, s.replicas[0].Backend, "0123abcd"), gc.Equals, "some data")
+	c.Assert(getBlob(c, s.replicas[2].Backend, "0123abcd"), gc.Equals, "some data")
+}
+
+func (s *replicaSuite) TestPutWithoutQuorum(c *gc.C) {
+	be := s.newBackend(c, 2)
+	s.replicas[0].setFail(true)
+	s.replicas[2].setFail(true)
+	content := "some data"
+	err := be.Put("0123abcd", strings.NewReader(content), int64(len(content)), hashOf(content))
+	c.Assert(err, gc.ErrorMatches, `blob written to only 1 of 3 replicas \(need 2\): replica 0: replica unavailable`)
+
+	// The copy that was written has been removed.
+	_, _, err = s.replicas[1].Get("0123abcd")
+	c.Assert(errgo.Cause(err), gc.Equals, blobstore.ErrNotFound)
+}
+
+func (s *replicaSuite) TestPutInvalidHash(c *gc.C) {
+	be := s.newBackend(c, 0)
+	content := "some data"
+	err := be.Put("0123abcd", strings.NewReader(content), int64(len(content)), hashOf("wrong"))
+	c.Assert(err, gc.ErrorMatches, `hash mismatch`)
+	for _, r := range s.replicas {
+		_, _, err = r.Get("0123abcd")
+		c.Assert(errgo.Cause(err), gc.Equals, blobstore.ErrNotFound)
+	}
+}
+
+func (s *replicaSuite) TestGetFromFirstReplicaHoldingBlob(c *gc.C) {
+	be := s.newBackend(c, 0)
+	putBlob(c, s.replicas[2].Backend, "0123abcd", "some data")
+	c.Assert(getBlob(c, be, "0123abcd"), gc.Equals, "some data")
+	for _, r := range s.replicas {
+		c.Assert(r.getCount(), gc.Equals, 1)
+	}
+}
+
+func (s *replicaSuite) TestGetAvoidsFailedReplica(c *gc.C) {
+	be := s.newBackend(c, 0)
+	putBlob(c, be, "0123abcd", "some data")
+
+	s.replicas[0].setFail(true)
+	c.Assert(getBlob(c, be, "0123abcd"), gc.Equals, "some data")
+	c.Assert(s.replicas[0].getCount(), gc.Equals, 1)
+	c.Assert(s.replicas[1].getCount(), gc.Equals, 1)
+
+	// The failed replica is tried last from now on, even
+	// though it's working again.
+	s.replicas[0].setFail(false)
+	c.Assert(getBlob(c, be, "0123abcd"), gc.Equals, "some data")
+	c.Assert(s.replicas[0].getCount(), gc.Equals, 1)
+	c.Assert(s.replicas[1].getCount(), gc.Equals, 2)
+}
+
+func (s *replicaSuite) TestGetNotFound(c *gc.C) {
+	be := s.newBackend(c, 0)
+	_, _, err := be.Get("0123abcd")
+	c.Assert(errgo.Cause(err), gc.Equals, blobstore.ErrNotFound)
+}
+
+func (s *replicaSuite) TestGetAllReplicasFailed(c *gc.C) {
+	be := s.newBackend(c, 0)
+	s.replicas[0].setFail(true)
+	s.replicas[1].setFail(true)
+	_, _, err := be.Get("0123abcd")
+	c.Assert(err, gc.ErrorMatches, `cannot get blob from any replica: replica unavailable`)
+	c.Assert(errgo.Cause(err), gc.Not(gc.Equals), blobstore.ErrNotFound)
+}
+
+func (s *replicaSuite) TestRemove(c *gc.C) {
+	be := s.newBackend(c, 0)
+	putBlob(c, be, "0123abcd", "some data")
+	err := be.Remove("0123abcd")
+	c.Assert(err, gc.Equals, nil)
+	for _, r := range s.replicas {
+		_, _, err = r.Get("0123abcd")
+		c.Assert(errgo.Cause(err), gc.Equals, blobstore.ErrNotFound)
+	}
+	err = be.Remove("0123abcd")
+	c.Assert(errgo.Cause(err), gc.Equals, blobstore.ErrNotFound)
+}
+
+func (s *replicaSuite) TestRemoveWithoutQuorum(c *gc.C) {
+	be := s.newBackend(c, 3)
+	putBlob(c, be, "0123abcd", "some data")
+	s.replicas[1].setFail(true)
+	err := be.Remove("0123abcd")
+	c.Assert(err, gc.ErrorMatches, `blob removed from only 2 of 3 replicas \(need 3\): replica 1: replica unavailable`)
+}
+
+// failingBackend is a countingBackend that can be made to fail.
+type failingBackend struct {
+	countingBackend
+
+	failMu sync.Mutex
+	fail   bool
+}
+
+func (b *failingBackend) setFail(fail bool) {
+	b.failMu.Lock()
+	defer b.failMu.Unlock()
+	b.fail = fail
+}
+
+func (b *failingBackend) err() error {
+	b.failMu.Lock()
+	defer b.failMu.Unlock()
+	if b.fail {
+		return errgo.New("replica unavailable")
+	}
+	return nil
+}
+
+func (b *failingBackend) Get(name string) (blobstore.ReadSeekCloser, int64, error) {
+	if err := b.err(); err != nil {
+		b.countingBackend.mu.Lock()
+		b.gets++
+		b.countingBackend.mu.Unlock()
+		return nil, 0, err
+	}
+	return b.countingBackend.Get(name)
+}
+
+func (b *failingBackend) Put(name string, r io.Reader, size int64, hash string) error {
+	if err := b.err(); err != nil {
+		return err
+	}
+	return b.Backend.Put(name, r, size, hash)
+}
+
+func (b *failingBackend) Remove(name string) error {
+	if err := b.err(); err != nil {
+		return err
+	}
+	return b.Backend.Remove(name)
+}
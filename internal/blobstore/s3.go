@@ -0,0 +1,478 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package blobstore // import "gopkg.in/juju/charmstore.v5/internal/blobstore"
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/errgo.v1"
+)
+
+// s3PartSize holds the size of the parts used when putting
+// an object with a multipart upload. Objects no larger
+// than this are put with a single request.
+var s3PartSize int64 = maxBufferSize
+
+// s3EmptyHash holds the hex-encoded SHA256 hash of
+// an empty request body.
+const s3EmptyHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// S3Params holds the parameters for an S3 backend.
+type S3Params struct {
+	// Endpoint holds the URL of the S3 service,
+	// for example https://s3.amazonaws.com.
+	Endpoint string
+
+	// Region holds the region that requests are signed for.
+	Region string
+
+	// Bucket holds the name of the bucket that
+	// all data objects are stored in.
+	Bucket string
+
+	// AccessKey and SecretKey hold the credentials
+	// used to sign requests.
+	AccessKey string
+	SecretKey string
+
+	// Client holds the HTTP client used to make requests.
+	// If this is nil, http.DefaultClient will be used.
+	Client *http.Client
+}
+
+type s3Backend struct {
+	params   S3Params
+	endpoint *url.URL
+}
+
+// NewS3Backend returns a backend which stores data objects in the
+// bucket of an S3-compatible object store. Buckets are addressed
+// path-style (the bucket name is the first element of the URL path),
+// so the backend works with stand-ins such as MinIO as well as
+// with Amazon S3 itself.
+func NewS3Backend(p S3Params) (Backend, error) {
+	u, err := url.Parse(p.Endpoint)
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot parse S3 endpoint")
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return nil, errgo.Newf("invalid S3 endpoint %q", p.Endpoint)
+	}
+	if p.Bucket == "" {
+		return nil, errgo.Newf("no S3 bucket specified")
+	}
+	if p.Client == nil {
+		p.Client = http.DefaultClient
+	}
+	return &s3Backend{
+		params:   p,
+		endpoint: u,
+	}, nil
+}
+
+func (b *s3Backend) Get(name string) (ReadSeekCloser, int64, error) {
+	resp, err := b.do("HEAD", name, nil, nil, nil)
+	if err != nil {
+		return nil, 0, errgo.Mask(err, errgo.Is(ErrNotFound))
+	}
+	resp.Body.Close()
+	if resp.ContentLength < 0 {
+		return nil, 0, errgo.Newf("no content length for %q", name)
+	}
+	return &s3Reader{
+		backend: b,
+		name:    name,
+		size:    resp.ContentLength,
+	}, resp.ContentLength, nil
+}
+
+func (b *s3Backend) Put(name string, r io.Reader, size int64, hash string) error {
+	if size <= s3PartSize {
+		return errgo.Mask(b.putSingle(name, r, size, hash), errgo.Is(io.ErrUnexpectedEOF))
+	}
+	return errgo.Mask(b.putMultipart(name, r, size, hash), errgo.Is(io.ErrUnexpectedEOF))
+}
+
+// putSingle puts an object with a single PUT request. The data is
+// buffered so that the hash can be checked before anything is
+// written to the store.
+func (b *s3Backend) putSingle(name string, r io.Reader, size int64, hash string) error {
+	buf := bytes.NewBuffer(make([]byte, 0, size))
+	if err := copyAndCheckHash(buf, r, size, hash); err != nil {
+		return errgo.Mask(err, errgo.Is(io.ErrUnexpectedEOF))
+	}
+	resp, err := b.do("PUT", name, nil, nil, buf.Bytes())
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// putMultipart puts an object in parts of s3PartSize bytes. The hash
+// of the whole object is only known after the last part has been
+// read, so the upload is completed only if it matches, and aborted
+// otherwise.
+func (b *s3Backend) putMultipart(name string, r io.Reader, size int64, hash string) (err error) {
+	var initResult struct {
+		UploadId string
+	}
+	if err := b.doXML("POST", name, url.Values{"uploads": {""}}, nil, &initResult); err != nil {
+		return errgo.Notef(err, "cannot initiate multipart upload")
+	}
+	uploadId := initResult.UploadId
+	defer func() {
+		if err == nil {
+			return
+		}
+		resp, err := b.do("DELETE", name, url.Values{"uploadId": {uploadId}}, nil, nil)
+		if err != nil {
+			logger.Warningf("cannot abort multipart upload of %q: %v", name, err)
+			return
+		}
+		resp.Body.Close()
+	}()
+	var complete s3CompleteMultipartUpload
+	hasher := NewHash()
+	r = io.TeeReader(r, hasher)
+	buf := make([]byte, s3PartSize)
+	for remain := size; remain > 0; {
+		n := s3PartSize
+		if remain < n {
+			n = remain
+		}
+		if _, err := io.ReadFull(r, buf[:n]); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return errgo.Mask(err, errgo.Is(io.ErrUnexpectedEOF))
+		}
+		remain -= n
+		partNumber := len(complete.Parts) + 1
+		resp, err := b.do("PUT", name, url.Values{
+			"partNumber": {strconv.Itoa(partNumber)},
+			"uploadId":   {uploadId},
+		}, nil, buf[:n])
+		if err != nil {
+			return errgo.Notef(err, "cannot put part %d", partNumber)
+		}
+		resp.Body.Close()
+		complete.Parts = append(complete.Parts, s3CompletePart{
+			PartNumber: partNumber,
+			ETag:       resp.Header.Get("ETag"),
+		})
+	}
+	if fmt.Sprintf("%x", hasher.Sum(nil)) != hash {
+		return errgo.New("hash mismatch")
+	}
+	data, err := xml.Marshal(complete)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if err := b.doXML("POST", name, url.Values{"uploadId": {uploadId}}, data, nil); err != nil {
+		return errgo.Notef(err, "cannot complete multipart upload")
+	}
+	return nil
+}
+
+func (b *s3Backend) Remove(name string) error {
+	resp, err := b.do("DELETE", name, nil, nil, nil)
+	if err != nil {
+		return errgo.Mask(err, errgo.Is(ErrNotFound))
+	}
+	resp.Body.Close()
+	return nil
+}
+
+type s3CompleteMultipartUpload struct {
+	XMLName xml.Name         `xml:"CompleteMultipartUpload"`
+	Parts   []s3CompletePart `xml:"Part"`
+}
+
+type s3CompletePart struct {
+	PartNumber int
+	ETag       string
+}
+
+// s3Error holds an error response returned by S3.
+type s3Error struct {
+	XMLName xml.Name
+	Code    string
+	Message string
+}
+
+// doXML is like do except that it decodes the XML response body
+// into result, which may be nil. Some S3 operations can fail
+// after returning a successful status code, in which case the
+// error is reported in the response body, so doXML checks for
+// that too.
+func (b *s3Backend) doXML(method, name string, query url.Values, body []byte, result interface{}) error {
+	resp, err := b.do(method, name, query, nil, body)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return errgo.Notef(err, "cannot read response")
+	}
+	var serr s3Error
+	if err := xml.Unmarshal(data, &serr); err == nil && serr.XMLName.Local == "Error" {
+		return errgo.Newf("%s: %s", serr.Code, serr.Message)
+	}
+	if result == nil {
+		return nil
+	}
+	if err := xml.Unmarshal(data, result); err != nil {
+		return errgo.Notef(err, "cannot unmarshal response")
+	}
+	return nil
+}
+
+// do makes a signed request on the object with the given name and
+// returns the response. If the response has an unsuccessful status
+// code, the response body is closed and an error is returned
+// instead; if the object was not found, the error will have an
+// ErrNotFound cause.
+func (b *s3Backend) do(method, name string, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+	u := *b.endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + b.params.Bucket + "/" + name
+	u.RawPath = s3Escape(u.Path, false)
+	u.RawQuery = s3CanonicalQuery(query)
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	b.sign(req, body, time.Now())
+	resp, err := b.params.Client.Do(req)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, errgo.WithCausef(nil, ErrNotFound, "")
+	}
+	var serr s3Error
+	data, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if err := xml.Unmarshal(data, &serr); err != nil || serr.Code == "" {
+		return nil, errgo.Newf("%s %q failed: %s", method, name, resp.Status)
+	}
+	return nil, errgo.Newf("%s %q failed: %s: %s", method, name, serr.Code, serr.Message)
+}
+
+// sign adds AWS signature version 4 authorization to the given request,
+// which must have the given body, as if it was made at the given time.
+// See https://docs.aws.amazon.com/AmazonS3/latest/API/sig-v4-header-based-auth.html.
+func (b *s3Backend) sign(req *http.Request, body []byte, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	payloadHash := s3EmptyHash
+	if len(body) > 0 {
+		payloadHash = hex.EncodeToString(sha256Sum(body))
+	}
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	// Sign the host header, and all the Range, Content-* and
+	// X-Amz-* headers.
+	headers := map[string]string{
+		"host": req.URL.Host,
+	}
+	for k, v := range req.Header {
+		k = strings.ToLower(k)
+		if k == "range" || strings.HasPrefix(k, "content-") || strings.HasPrefix(k, "x-amz-") {
+			headers[k] = strings.TrimSpace(strings.Join(v, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonicalHeaders bytes.Buffer
+	for _, k := range names {
+		fmt.Fprintf(&canonicalHeaders, "%s:%s\n", k, headers[k])
+	}
+	signedHeaders := strings.Join(names, ";")
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	date := now.Format("20060102")
+	scope := date + "/" + b.params.Region + "/s3/aws4_request"
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		hex.EncodeToString(sha256Sum([]byte(canonicalRequest))),
+	}, "\n")
+	key := hmacSHA256([]byte("AWS4"+b.params.SecretKey), date)
+	key = hmacSHA256(key, b.params.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		b.params.AccessKey,
+		scope,
+		signedHeaders,
+		signature,
+	))
+}
+
+func sha256Sum(data []byte) []byte {
+	h := sha256.Sum256(data)
+	return h[:]
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// s3CanonicalQuery returns the query encoded as required
+// for signing, with keys sorted and all values escaped.
+func s3CanonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		vals := append([]string(nil), query[k]...)
+		sort.Strings(vals)
+		for _, v := range vals {
+			parts = append(parts, s3Escape(k, true)+"="+s3Escape(v, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// s3Escape percent-encodes all bytes in s except the unreserved
+// characters. Slashes are also left alone unless escapeSlash
+// is true.
+func s3Escape(s string, escapeSlash bool) string {
+	var buf bytes.Buffer
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			buf.WriteByte(c)
+		case c == '/' && !escapeSlash:
+			buf.WriteByte(c)
+		default:
+			fmt.Fprintf(&buf, "%%%02X", c)
+		}
+	}
+	return buf.String()
+}
+
+// s3Reader reads an S3 object. It makes a ranged GET request
+// starting at the current offset when it's first read and
+// after each Seek that moves away from that offset.
+type s3Reader struct {
+	backend *s3Backend
+	name    string
+	size    int64
+
+	// body holds the body of the current GET response,
+	// or nil if there is none.
+	body io.ReadCloser
+
+	// bodyPos holds the object offset that the next read
+	// from body will return data from.
+	bodyPos int64
+
+	// pos holds the current seek position.
+	pos int64
+}
+
+func (r *s3Reader) Read(buf []byte) (int, error) {
+	if r.pos >= r.size {
+		return 0, io.EOF
+	}
+	if r.body != nil && r.bodyPos != r.pos {
+		r.body.Close()
+		r.body = nil
+	}
+	if r.body == nil {
+		resp, err := r.backend.do("GET", r.name, nil, http.Header{
+			"Range": {fmt.Sprintf("bytes=%d-", r.pos)},
+		}, nil)
+		if err != nil {
+			return 0, errgo.Mask(err, errgo.Is(ErrNotFound))
+		}
+		if resp.StatusCode != http.StatusPartialContent && r.pos != 0 {
+			resp.Body.Close()
+			return 0, errgo.Newf("unexpected status %q for ranged read of %q", resp.Status, r.name)
+		}
+		r.body = resp.Body
+		r.bodyPos = r.pos
+	}
+	n, err := r.body.Read(buf)
+	r.pos += int64(n)
+	r.bodyPos = r.pos
+	if err == io.EOF && r.pos < r.size {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil && err != io.EOF {
+		r.body.Close()
+		r.body = nil
+		return n, errgo.Mask(err, errgo.Is(io.ErrUnexpectedEOF))
+	}
+	return n, err
+}
+
+func (r *s3Reader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case seekStart:
+	case seekCurrent:
+		offset += r.pos
+	case seekEnd:
+		offset += r.size
+	default:
+		return 0, errgo.Newf("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errgo.Newf("negative position")
+	}
+	r.pos = offset
+	return r.pos, nil
+}
+
+func (r *s3Reader) Close() error {
+	if r.body == nil {
+		return nil
+	}
+	err := r.body.Close()
+	r.body = nil
+	return err
+}
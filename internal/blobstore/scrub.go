@@ -0,0 +1,310 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package blobstore // import "gopkg.in/juju/charmstore.v5/internal/blobstore"
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"gopkg.in/errgo.v1"
+	"gopkg.in/mgo.v2"
+
+	"gopkg.in/juju/charmstore.v5/internal/monitoring"
+)
+
+// ErrScrubStopped is returned by Scrub when it is
+// stopped before all blobs have been checked.
+var ErrScrubStopped = errgo.New("scrub stopped")
+
+// ScrubParams holds parameters for Store.Scrub.
+type ScrubParams struct {
+	// BytesPerSecond holds the maximum rate at which blob data
+	// will be read from the backend. If it's zero, the rate
+	// is not limited.
+	BytesPerSecond int64
+
+	// Stop optionally holds a channel that causes the scrub
+	// to be abandoned with an ErrScrubStopped error when
+	// it's closed.
+	Stop <-chan struct{}
+}
+
+// scrubStatusId holds the id of the document that records
+// the progress of the current scrub.
+const scrubStatusId = "scrub"
+
+// scrubStatusDoc records the progress of a scrub so that
+// an interrupted scrub can be resumed.
+type scrubStatusDoc struct {
+	Id string `bson:"_id"`
+
+	// LastHash holds the hash of the last blob checked.
+	// Blobs are checked in hash order.
+	LastHash string `bson:"lasthash"`
+
+	// Checked, CheckedBytes and Failed hold the statistics
+	// for the blobs checked so far.
+	Checked      int   `bson:"checked"`
+	CheckedBytes int64 `bson:"checkedbytes"`
+	Failed       int   `bson:"failed"`
+}
+
+// ScrubFailure holds information about a blob that failed
+// verification. Note that the ScrubFailure type is also used as a
+// document inside MongoDB.
+type ScrubFailure struct {
+	// Hash holds the hash recorded for the blob.
+	Hash string `bson:"_id" json:"hash"`
+
+	// Name holds the name of the blob in the backend.
+	Name string `bson:"name" json:"name"`
+
+	// Size holds the size recorded for the blob.
+	Size int64 `bson:"size" json:"size"`
+
+	// ActualHash and ActualSize hold the hash and size of the
+	// data actually read from the backend. ActualHash is empty
+	// if the blob could not be read in its entirety.
+	ActualHash string `bson:"actualhash,omitempty" json:"actual-hash,omitempty"`
+	ActualSize int64  `bson:"actualsize" json:"actual-size"`
+
+	// Error describes why the blob failed verification.
+	Error string `bson:"error" json:"error"`
+
+	// Time holds when the failure was found.
+	Time time.Time `bson:"time" json:"time"`
+}
+
+// Scrub reads every blob from the backend, checking that its size
+// and hash match the values recorded when it was put. Blobs that fail
+// verification are recorded so that they can be retrieved with
+// ScrubFailures; failures recorded by previous scrubs are removed when
+// the blob verifies successfully or no longer exists.
+//
+// Blobs are checked in batches, and progress is recorded after each
+// batch, so calling Scrub after it has been stopped or has returned an
+// error resumes the scrub from where it left off. The returned
+// statistics cover the whole scrub, including any earlier interrupted
+// calls, and are also exported as metrics.
+func (s *Store) Scrub(p ScrubParams) (monitoring.BlobScrubStats, error) {
+	status, err := s.scrubStatus()
+	if err != nil {
+		return monitoring.BlobScrubStats{}, errgo.Mask(err)
+	}
+	throttle := newThrottle(p.BytesPerSecond, p.Stop)
+	// Check the data held by the underlying backend rather
+	// than any cached copy, and avoid filling the cache
+	// with blobs that nobody has asked for.
+	backend := s.readBackend(s.uncachedBackend())
+	for {
+		docs, err := s.blobRefsAfter(status.LastHash)
+		if err != nil {
+			return status.stats(), errgo.Mask(err)
+		}
+		if len(docs) == 0 {
+			break
+		}
+		for i := range docs {
+			select {
+			case <-p.Stop:
+				return status.stats(), ErrScrubStopped
+			default:
+			}
+			if err := s.scrubBlob(backend, &docs[i], throttle, status); err != nil {
+				if err == ErrScrubStopped {
+					return status.stats(), ErrScrubStopped
+				}
+				return status.stats(), errgo.Mask(err)
+			}
+			status.LastHash = docs[i].Hash
+		}
+		if _, err := s.scrubStatusc.UpsertId(scrubStatusId, status); err != nil {
+			return status.stats(), errgo.Notef(err, "cannot save scrub status")
+		}
+	}
+	// Start the next scrub from the beginning.
+	if err := s.scrubStatusc.RemoveId(scrubStatusId); err != nil && err != mgo.ErrNotFound {
+		return status.stats(), errgo.Notef(err, "cannot remove scrub status")
+	}
+	stats := status.stats()
+	monitoring.SetBlobScrubStats(stats)
+	return stats, nil
+}
+
+// scrubStatus returns the progress of the current scrub.
+func (s *Store) scrubStatus() (*scrubStatusDoc, error) {
+	var status scrubStatusDoc
+	if err := s.scrubStatusc.FindId(scrubStatusId).One(&status); err != nil {
+		if err != mgo.ErrNotFound {
+			return nil, errgo.Notef(err, "cannot get scrub status")
+		}
+		status.Id = scrubStatusId
+	}
+	return &status, nil
+}
+
+// stats returns the statistics recorded in the status.
+func (status *scrubStatusDoc) stats() monitoring.BlobScrubStats {
+	return monitoring.BlobScrubStats{
+		Checked:      status.Checked,
+		CheckedBytes: status.CheckedBytes,
+		Failed:       status.Failed,
+	}
+}
+
+// scrubBlob verifies the blob with the given ref, recording the result
+// in the scrub collection and in the given status.
+func (s *Store) scrubBlob(backend Backend, doc *blobRefDoc, throttle *throttle, status *scrubStatusDoc) error {
+	failure, err := s.verifyBlob(backend, doc, throttle)
+	if errgo.Cause(err) == ErrScrubStopped {
+		return ErrScrubStopped
+	}
+	if errgo.Cause(err) == ErrNotFound {
+		// The blob has been garbage collected since
+		// we started.
+		return errgo.Mask(s.removeScrubFailure(doc.Hash))
+	}
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	status.Checked++
+	status.CheckedBytes += failure.ActualSize
+	if failure.Error == "" {
+		return errgo.Mask(s.removeScrubFailure(doc.Hash))
+	}
+	logger.Errorf("blob %q (hash %s) failed verification: %s", doc.Name, doc.Hash, failure.Error)
+	status.Failed++
+	if _, err := s.scrubc.UpsertId(failure.Hash, failure); err != nil {
+		return errgo.Notef(err, "cannot record scrub failure")
+	}
+	return nil
+}
+
+// verifyBlob reads the blob with the given ref from the given backend and
+// returns a ScrubFailure describing it; if the blob verifies
+// successfully, the Error field will be empty. If the blob ref has
+// been removed, it returns an error with an ErrNotFound cause.
+func (s *Store) verifyBlob(backend Backend, doc *blobRefDoc, throttle *throttle) (*ScrubFailure, error) {
+	failure := &ScrubFailure{
+		Hash: doc.Hash,
+		Name: doc.Name,
+		Size: doc.Size,
+		Time: time.Now(),
+	}
+	r, _, err := backend.Get(doc.Name)
+	if err != nil {
+		if errgo.Cause(err) != ErrNotFound {
+			failure.Error = fmt.Sprintf("cannot get blob: %v", err)
+			return failure, nil
+		}
+		// The blob may be missing from the backend because
+		// it's just been garbage collected, in which case
+		// its ref will have gone too.
+		if _, err := s.blobRef(doc.Hash); err != nil {
+			return nil, errgo.Mask(err, errgo.Is(ErrNotFound))
+		}
+		failure.Error = "blob not found in backend"
+		return failure, nil
+	}
+	defer r.Close()
+	dr, err := s.contentReader(doc, r)
+	if err != nil {
+		failure.Error = err.Error()
+		return failure, nil
+	}
+	hasher := NewHash()
+	n, err := io.Copy(hasher, throttle.reader(dr))
+	failure.ActualSize = n
+	switch {
+	case errgo.Cause(err) == ErrScrubStopped:
+		return nil, ErrScrubStopped
+	case errgo.Cause(err) == ErrNotFound:
+		if _, err := s.blobRef(doc.Hash); err != nil {
+			return nil, errgo.Mask(err, errgo.Is(ErrNotFound))
+		}
+		failure.Error = "blob removed from backend while reading"
+	case err != nil:
+		failure.Error = fmt.Sprintf("cannot read blob: %v", err)
+	default:
+		failure.ActualHash = fmt.Sprintf("%x", hasher.Sum(nil))
+		if n != doc.Size {
+			failure.Error = fmt.Sprintf("size mismatch (got %d, expected %d)", n, doc.Size)
+		} else if failure.ActualHash != doc.Hash {
+			failure.Error = "hash mismatch"
+		}
+	}
+	return failure, nil
+}
+
+// ScrubFailures returns all the blob verification failures
+// recorded by Scrub, ordered by hash.
+func (s *Store) ScrubFailures() ([]ScrubFailure, error) {
+	var failures []ScrubFailure
+	if err := s.scrubc.Find(nil).Sort("_id").All(&failures); err != nil {
+		return nil, errgo.Notef(err, "cannot get scrub failures")
+	}
+	return failures, nil
+}
+
+func (s *Store) removeScrubFailure(hash string) error {
+	if err := s.scrubc.RemoveId(hash); err != nil && err != mgo.ErrNotFound {
+		return errgo.Notef(err, "cannot remove scrub failure")
+	}
+	return nil
+}
+
+// throttle limits the rate at which data is read.
+type throttle struct {
+	bytesPerSecond int64
+	stop           <-chan struct{}
+	start          time.Time
+	total          int64
+}
+
+func newThrottle(bytesPerSecond int64, stop <-chan struct{}) *throttle {
+	return &throttle{
+		bytesPerSecond: bytesPerSecond,
+		stop:           stop,
+		start:          time.Now(),
+	}
+}
+
+// reader returns a reader that reads from r,
+// no faster than allowed by the throttle.
+func (t *throttle) reader(r io.Reader) io.Reader {
+	return throttledReader{r, t}
+}
+
+// wait waits until n more bytes may be read.
+func (t *throttle) wait(n int) error {
+	t.total += int64(n)
+	if t.bytesPerSecond <= 0 {
+		return nil
+	}
+	due := t.start.Add(time.Duration(t.total * int64(time.Second) / t.bytesPerSecond))
+	d := time.Until(due)
+	if d <= 0 {
+		return nil
+	}
+	select {
+	case <-time.After(d):
+		return nil
+	case <-t.stop:
+		return ErrScrubStopped
+	}
+}
+
+type throttledReader struct {
+	r io.Reader
+	t *throttle
+}
+
+func (r throttledReader) Read(buf []byte) (int, error) {
+	n, err := r.r.Read(buf)
+	if werr := r.t.wait(n); werr != nil {
+		return n, werr
+	}
+	return n, err
+}
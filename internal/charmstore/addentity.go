@@ -118,7 +118,8 @@ func (s *Store) AddEntityWithArchive(url *router.ResolvedURL, archive interface{
 //	params.ErrDuplicateUpload if the URL duplicates an existing entity.
 //	params.ErrEntityIdNotAllowed if the id may not be created.
 //	params.ErrInvalidEntity if the provided blob is invalid.
-func (s *Store) UploadEntity(url *router.ResolvedURL, blob io.Reader, blobHash string, size int64, chans []params.Channel) error {
+//	router.ErrQuotaExceeded if the upload would exceed the owner's quota.
+func (s *Store) UploadEntity(url *router.ResolvedURL, blob io.Reader, blobHash string, size int64, chans []params.Channel) (err error) {
 	// Strictly speaking these tests are redundant, because a ResolvedURL should
 	// always be canonical, but check just in case anyway, as this is
 	// final gateway before a potentially invalid url might be stored
@@ -129,6 +130,10 @@ func (s *Store) UploadEntity(url *router.ResolvedURL, blob io.Reader, blobHash s
 	if url.URL.Revision == -1 {
 		return errgo.WithCausef(nil, params.ErrEntityIdNotAllowed, "entity id does not specify revision")
 	}
+	if err := s.chargeQuota(url.URL.User, size); err != nil {
+		return errgo.Mask(err, errgo.Is(router.ErrQuotaExceeded))
+	}
+	defer s.releaseQuotaOnError(url.URL.User, size, &err)
 	blobHash256, err := s.putArchive(blob, size, blobHash)
 	if err != nil {
 		return errgo.Mask(err, errgo.Is(params.ErrInvalidEntity))
@@ -547,7 +552,7 @@ func (s *Store) addCharm(c charm.Charm, p addParams) (err error) {
 func setEntityChannels(entity *mongodoc.Entity, chans []params.Channel) {
 	entity.Published = make(map[params.Channel]bool, len(chans))
 	for _, c := range chans {
-		if params.ValidChannels[c] && c != params.UnpublishedChannel {
+		if c, err := ParseChannel(string(c)); err == nil && c != params.UnpublishedChannel {
 			entity.Published[c] = true
 		}
 	}
@@ -7,9 +7,11 @@ import (
 	"archive/zip"
 	"bytes"
 	"io"
+	"io/ioutil"
 	"os"
 	"path"
 	"strings"
+	"time"
 
 	"github.com/juju/charmrepo/v6/csclient/params"
 	"github.com/juju/utils"
@@ -31,6 +33,9 @@ type Blob struct {
 
 	// Hash holds the hash checksum of the blob.
 	Hash string
+
+	// ModTime holds the time that the blob was uploaded.
+	ModTime time.Time
 }
 
 var preV5ArchiveFields = []string{
@@ -54,7 +59,7 @@ func (s *Store) OpenBlobPreV5(id *router.ResolvedURL) (*Blob, error) {
 }
 
 func (s *Store) openBlob(id *router.ResolvedURL, preV5 bool) (*Blob, error) {
-	entity, err := s.FindEntity(id, FieldSelector(preV5ArchiveFields...))
+	entity, err := s.FindEntity(id, FieldSelector(append([]string{"uploadtime"}, preV5ArchiveFields...)...))
 	if err != nil {
 		return nil, errgo.Mask(err, errgo.Is(params.ErrNotFound))
 	}
@@ -80,6 +85,7 @@ func (s *Store) openBlob(id *router.ResolvedURL, preV5 bool) (*Blob, error) {
 		ReadSeekCloser: r,
 		Size:           size,
 		Hash:           hash,
+		ModTime:        entity.UploadTime,
 	}, nil
 }
 
@@ -108,15 +114,17 @@ func (r *multiReadSeekCloser) Close() error {
 
 // OpenBlobFile opens the file with the given path from the
 // given blob and returns a reader for its contents,
-// and its size.
+// and its size. The returned reader is seekable, so
+// that arbitrary ranges of the file can be read.
 //
 // If no such file was found, it returns an error
 // with a params.ErrNotFound cause.
 //
 // If the file is actually a directory in the blob, it returns
 // an error with a params.ErrForbidden cause.
-func (s *Store) OpenBlobFile(blob *Blob, filePath string) (io.ReadCloser, int64, error) {
-	zipReader, err := zip.NewReader(ReaderAtSeeker(blob), blob.Size)
+func (s *Store) OpenBlobFile(blob *Blob, filePath string) (blobstore.ReadSeekCloser, int64, error) {
+	blobReader := ReaderAtSeeker(blob)
+	zipReader, err := zip.NewReader(blobReader, blob.Size)
 	if err != nil {
 		return nil, 0, errgo.Notef(err, "cannot read archive data")
 	}
@@ -131,15 +139,95 @@ func (s *Store) OpenBlobFile(blob *Blob, filePath string) (io.ReadCloser, int64,
 		if fileInfo.IsDir() {
 			return nil, 0, errgo.WithCausef(nil, params.ErrForbidden, "directory listing not allowed")
 		}
+		if file.Method == zip.Store {
+			// The file is stored uncompressed, so we can
+			// read it directly from the blob.
+			offset, err := file.DataOffset()
+			if err != nil {
+				return nil, 0, errgo.Notef(err, "unable to read file %q", filePath)
+			}
+			return nopCloser(io.NewSectionReader(blobReader, offset, fileInfo.Size())), fileInfo.Size(), nil
+		}
 		content, err := file.Open()
 		if err != nil {
 			return nil, 0, errgo.Notef(err, "unable to read file %q", filePath)
 		}
-		return content, fileInfo.Size(), nil
+		return &zipFileReader{
+			file: file,
+			size: fileInfo.Size(),
+			rc:   content,
+		}, fileInfo.Size(), nil
 	}
 	return nil, 0, errgo.WithCausef(nil, params.ErrNotFound, "file %q not found in the archive", filePath)
 }
 
+// zipFileReader implements blobstore.ReadSeekCloser for a
+// compressed file in a zip archive. As compressed data
+// cannot be read from an arbitrary position, seeking forward
+// discards data and seeking backward reopens the file.
+type zipFileReader struct {
+	file *zip.File
+	size int64
+
+	// rc holds the currently open reader
+	// and rpos its position in the file.
+	rc   io.ReadCloser
+	rpos int64
+
+	// pos holds the position that the next
+	// Read will read from.
+	pos int64
+}
+
+// Read implements io.Reader.Read.
+func (r *zipFileReader) Read(buf []byte) (int, error) {
+	if r.pos >= r.size {
+		return 0, io.EOF
+	}
+	if r.pos < r.rpos {
+		r.rc.Close()
+		rc, err := r.file.Open()
+		if err != nil {
+			return 0, errgo.Mask(err)
+		}
+		r.rc, r.rpos = rc, 0
+	}
+	if r.pos > r.rpos {
+		n, err := io.CopyN(ioutil.Discard, r.rc, r.pos-r.rpos)
+		r.rpos += n
+		if err != nil {
+			return 0, errgo.Mask(err, errgo.Any)
+		}
+	}
+	n, err := r.rc.Read(buf)
+	r.rpos += int64(n)
+	r.pos = r.rpos
+	return n, err
+}
+
+// Seek implements io.Seeker.Seek.
+func (r *zipFileReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.pos
+	case io.SeekEnd:
+		offset += r.size
+	default:
+		return 0, errgo.Newf("invalid whence %d", whence)
+	}
+	if offset < 0 {
+		return 0, errgo.Newf("negative position")
+	}
+	r.pos = offset
+	return offset, nil
+}
+
+// Close implements io.Closer.Close.
+func (r *zipFileReader) Close() error {
+	return r.rc.Close()
+}
+
 // OpenCachedBlobFile opens a file from the given entity's archive blob.
 // The file is identified by the provided fileId. If the file has not
 // previously been opened on this entity, the isFile function will be
@@ -0,0 +1,95 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package charmstore_test
+
+import (
+	"archive/zip"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	jujutesting "github.com/juju/testing"
+	gc "gopkg.in/check.v1"
+
+	"gopkg.in/juju/charmstore.v5/internal/charmstore"
+)
+
+type archiveSuite struct {
+	jujutesting.IsolationSuite
+}
+
+var _ = gc.Suite(&archiveSuite{})
+
+var openBlobFileSeekTests = []struct {
+	about  string
+	method uint16
+}{{
+	about:  "stored file",
+	method: zip.Store,
+}, {
+	about:  "compressed file",
+	method: zip.Deflate,
+}}
+
+func (s *archiveSuite) TestOpenBlobFileSeek(c *gc.C) {
+	content := strings.Repeat("0123456789", 1000)
+	for i, test := range openBlobFileSeekTests {
+		c.Logf("test %d: %s", i, test.about)
+		var buf bytes.Buffer
+		zw := zip.NewWriter(&buf)
+		w, err := zw.CreateHeader(&zip.FileHeader{
+			Name:   "dir/file",
+			Method: test.method,
+		})
+		c.Assert(err, gc.Equals, nil)
+		_, err = io.WriteString(w, content)
+		c.Assert(err, gc.Equals, nil)
+		err = zw.Close()
+		c.Assert(err, gc.Equals, nil)
+
+		blob := &charmstore.Blob{
+			ReadSeekCloser: nopCloser{bytes.NewReader(buf.Bytes())},
+			Size:           int64(buf.Len()),
+		}
+		r, size, err := new(charmstore.Store).OpenBlobFile(blob, "/dir/file")
+		c.Assert(err, gc.Equals, nil)
+		c.Assert(size, gc.Equals, int64(len(content)))
+
+		// Read from the middle of the file.
+		pos, err := r.Seek(5005, io.SeekStart)
+		c.Assert(err, gc.Equals, nil)
+		c.Assert(pos, gc.Equals, int64(5005))
+		data := make([]byte, 10)
+		_, err = io.ReadFull(r, data)
+		c.Assert(err, gc.Equals, nil)
+		c.Assert(string(data), gc.Equals, "5678901234")
+
+		// Seek backwards and read the whole file.
+		_, err = r.Seek(0, io.SeekStart)
+		c.Assert(err, gc.Equals, nil)
+		all, err := ioutil.ReadAll(r)
+		c.Assert(err, gc.Equals, nil)
+		c.Assert(string(all), gc.Equals, content)
+
+		// Seek relative to the end.
+		pos, err = r.Seek(-3, io.SeekEnd)
+		c.Assert(err, gc.Equals, nil)
+		c.Assert(pos, gc.Equals, int64(len(content)-3))
+		all, err = ioutil.ReadAll(r)
+		c.Assert(err, gc.Equals, nil)
+		c.Assert(string(all), gc.Equals, "789")
+
+		err = r.Close()
+		c.Assert(err, gc.Equals, nil)
+	}
+}
+
+type nopCloser struct {
+	io.ReadSeeker
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
@@ -14,6 +14,10 @@ import (
 
 var gcInterval = time.Hour
 
+// gcMinAge holds the minimum time since a blob was last put
+// before it can be garbage collected.
+const gcMinAge = 30 * time.Minute
+
 // blobstoreGC implements the worker that runs the blobstore
 // garbage collector.
 type blobstoreGC struct {
@@ -67,7 +71,21 @@ func (gc *blobstoreGC) doGC() error {
 	if err != nil {
 		return errgo.Notef(err, "expired-upload garbage collection failed")
 	}
-	err = store.BlobStoreGC(time.Now().Add(-30 * time.Minute))
+	n, err := store.ApplyRetentionPolicies(time.Now())
+	if err != nil {
+		return errgo.Notef(err, "cannot apply retention policies")
+	}
+	if n > 0 {
+		logger.Infof("deleted %d revisions by retention policy", n)
+	}
+	n, err = store.PurgeDeletedEntities(time.Now().Add(-store.DeletedEntityRetention()))
+	if err != nil {
+		return errgo.Notef(err, "deleted entity purge failed")
+	}
+	if n > 0 {
+		logger.Infof("purged %d deleted entities", n)
+	}
+	err = store.BlobStoreGC(time.Now().Add(-gcMinAge))
 	if err != nil {
 		return errgo.Notef(err, "blob garbage collection failed")
 	}
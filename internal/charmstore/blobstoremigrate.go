@@ -0,0 +1,81 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package charmstore // import "gopkg.in/juju/charmstore.v5/internal/charmstore"
+
+import (
+	"time"
+
+	"gopkg.in/errgo.v1"
+	tomb "gopkg.in/tomb.v2"
+
+	"gopkg.in/juju/charmstore.v5/internal/blobstore"
+)
+
+var migrateRetryInterval = 10 * time.Minute
+
+// blobstoreMigrator implements the worker that copies blobs
+// from the secondary blobstore backend to the primary one.
+type blobstoreMigrator struct {
+	tomb tomb.Tomb
+	pool *Pool
+	name string
+}
+
+// newBlobstoreMigrator returns a new running blobstore migrator
+// worker that records its progress under the given name.
+func newBlobstoreMigrator(pool *Pool, name string) *blobstoreMigrator {
+	m := &blobstoreMigrator{
+		pool: pool,
+		name: name,
+	}
+	m.tomb.Go(m.run)
+	return m
+}
+
+// Kill implements worker.Worker.Kill.
+func (m *blobstoreMigrator) Kill() {
+	m.tomb.Kill(nil)
+}
+
+// Wait implements worker.Worker.Wait.
+func (m *blobstoreMigrator) Wait() error {
+	return m.tomb.Wait()
+}
+
+func (m *blobstoreMigrator) run() error {
+	for {
+		logger.Infof("starting blobstore migration %q", m.name)
+		err := m.doMigrate()
+		switch {
+		case errgo.Cause(err) == blobstore.ErrMigrationStopped:
+			return tomb.ErrDying
+		case err != nil:
+			logger.Errorf("%v", err)
+		default:
+			// The migration is complete, so there's
+			// nothing more to do.
+			logger.Infof("completed blobstore migration %q", m.name)
+			return nil
+		}
+		select {
+		case <-m.tomb.Dying():
+			return tomb.ErrDying
+		case <-time.After(migrateRetryInterval):
+		}
+	}
+}
+
+func (m *blobstoreMigrator) doMigrate() error {
+	store := m.pool.Store()
+	defer store.Close()
+	status, err := store.BlobStore.Migrate(blobstore.MigrateParams{
+		Name: m.name,
+		Stop: m.tomb.Dying(),
+	})
+	if err != nil {
+		return errgo.NoteMask(err, "blobstore migration failed", errgo.Is(blobstore.ErrMigrationStopped))
+	}
+	logger.Infof("migrated %d blobs (%d bytes); %d already migrated", status.Copied, status.CopiedBytes, status.Skipped)
+	return nil
+}
@@ -0,0 +1,84 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package charmstore // import "gopkg.in/juju/charmstore.v5/internal/charmstore"
+
+import (
+	"time"
+
+	"gopkg.in/errgo.v1"
+	tomb "gopkg.in/tomb.v2"
+
+	"gopkg.in/juju/charmstore.v5/internal/blobstore"
+	"gopkg.in/juju/charmstore.v5/internal/monitoring"
+)
+
+var scrubInterval = 24 * time.Hour
+
+// blobstoreScrubber implements the worker that periodically
+// verifies the contents of the blob store.
+type blobstoreScrubber struct {
+	tomb           tomb.Tomb
+	pool           *Pool
+	bytesPerSecond int64
+}
+
+// newBlobstoreScrubber returns a new running blobstore scrubber
+// worker that reads blob data no faster than the given rate.
+func newBlobstoreScrubber(pool *Pool, bytesPerSecond int64) *blobstoreScrubber {
+	s := &blobstoreScrubber{
+		pool:           pool,
+		bytesPerSecond: bytesPerSecond,
+	}
+	s.tomb.Go(s.run)
+	return s
+}
+
+// Kill implements worker.Worker.Kill.
+func (s *blobstoreScrubber) Kill() {
+	s.tomb.Kill(nil)
+}
+
+// Wait implements worker.Worker.Wait.
+func (s *blobstoreScrubber) Wait() error {
+	return s.tomb.Wait()
+}
+
+func (s *blobstoreScrubber) run() error {
+	for {
+		scrubDuration := monitoring.NewBlobstoreScrubDuration()
+		logger.Infof("starting blobstore scrub")
+		err := s.doScrub()
+		switch {
+		case errgo.Cause(err) == blobstore.ErrScrubStopped:
+			return tomb.ErrDying
+		case err != nil:
+			// Note: don't log the duration when there's an error.
+			logger.Errorf("%v", err)
+		default:
+			logger.Infof("completed blobstore scrub")
+			scrubDuration.Done()
+		}
+		select {
+		case <-s.tomb.Dying():
+			return tomb.ErrDying
+		case <-time.After(scrubInterval):
+		}
+	}
+}
+
+func (s *blobstoreScrubber) doScrub() error {
+	store := s.pool.Store()
+	defer store.Close()
+	stats, err := store.BlobStore.Scrub(blobstore.ScrubParams{
+		BytesPerSecond: s.bytesPerSecond,
+		Stop:           s.tomb.Dying(),
+	})
+	if err != nil {
+		return errgo.NoteMask(err, "blobstore scrub failed", errgo.Is(blobstore.ErrScrubStopped))
+	}
+	if stats.Failed > 0 {
+		logger.Errorf("%d of %d blobs failed verification", stats.Failed, stats.Checked)
+	}
+	return nil
+}
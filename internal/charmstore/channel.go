@@ -0,0 +1,99 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package charmstore // import "gopkg.in/juju/charmstore.v5/internal/charmstore"
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/juju/charmrepo/v6/csclient/params"
+	"gopkg.in/errgo.v1"
+
+	"gopkg.in/juju/charmstore.v5/internal/mongodoc"
+)
+
+// DefaultTrack holds the name of the track that channels without an
+// explicit track refer to. Channels in the default track are stored
+// and reported without the track prefix, so "latest/stable" and
+// "stable" are the same channel.
+const DefaultTrack = "latest"
+
+// validTrack matches valid track names. Note that channel names are
+// used as keys in mongo documents, so any dots must be escaped with
+// mongodoc.ChannelKey when they're used in queries.
+var validTrack = regexp.MustCompile(`^[a-z0-9]+([.-][a-z0-9]+)*$`)
+
+// ParseChannel parses a channel of the form [track/]risk, where risk
+// is one of the channels in params.ValidChannels, and returns it in
+// canonical form, with the default track omitted. The unpublished
+// channel does not belong to any track.
+//
+// It returns an error with a params.ErrBadRequest cause if the channel
+// is not valid.
+func ParseChannel(s string) (params.Channel, error) {
+	i := strings.Index(s, "/")
+	if i == -1 {
+		if !params.ValidChannels[params.Channel(s)] {
+			return params.NoChannel, errgo.WithCausef(nil, params.ErrBadRequest, "invalid channel %q", s)
+		}
+		return params.Channel(s), nil
+	}
+	track, risk := s[:i], params.Channel(s[i+1:])
+	if !validTrack.MatchString(track) {
+		return params.NoChannel, errgo.WithCausef(nil, params.ErrBadRequest, "invalid track in channel %q", s)
+	}
+	if !params.ValidChannels[risk] || risk == params.UnpublishedChannel {
+		return params.NoChannel, errgo.WithCausef(nil, params.ErrBadRequest, "invalid channel %q", s)
+	}
+	if track == DefaultTrack {
+		return risk, nil
+	}
+	return params.Channel(s), nil
+}
+
+// ValidChannel reports whether ch is a valid channel in canonical
+// form (see ParseChannel).
+func ValidChannel(ch params.Channel) bool {
+	canon, err := ParseChannel(string(ch))
+	return err == nil && canon == ch
+}
+
+// ChannelTrack splits the given canonical channel into its track and
+// its risk level. The track of a channel in the default track is
+// DefaultTrack.
+func ChannelTrack(ch params.Channel) (track string, risk params.Channel) {
+	if i := strings.Index(string(ch), "/"); i != -1 {
+		return string(ch[:i]), ch[i+1:]
+	}
+	return DefaultTrack, ch
+}
+
+// TrackChannel returns the canonical channel for the given risk level
+// in the given track. It is the inverse of ChannelTrack.
+func TrackChannel(track string, risk params.Channel) params.Channel {
+	if track == DefaultTrack || risk == params.UnpublishedChannel {
+		return risk
+	}
+	return params.Channel(track + "/" + string(risk))
+}
+
+// ChannelACL returns the ACL that applies to the given channel of the
+// given base entity. A channel in a track other than the default track
+// uses the ACL for the same risk level in the default track for any
+// of its read or write permissions that have not been set explicitly.
+func ChannelACL(baseEntity *mongodoc.BaseEntity, ch params.Channel) mongodoc.ACL {
+	acl := baseEntity.ChannelACLs[ch]
+	track, risk := ChannelTrack(ch)
+	if track == DefaultTrack {
+		return acl
+	}
+	defaultACL := baseEntity.ChannelACLs[risk]
+	if acl.Read == nil {
+		acl.Read = defaultACL.Read
+	}
+	if acl.Write == nil {
+		acl.Write = defaultACL.Write
+	}
+	return acl
+}
@@ -0,0 +1,267 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package charmstore
+
+import (
+	"time"
+
+	"github.com/juju/charmrepo/v6/csclient/params"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+	"gopkg.in/errgo.v1"
+
+	"gopkg.in/juju/charmstore.v5/internal/charm"
+	"gopkg.in/juju/charmstore.v5/internal/mongodoc"
+	"gopkg.in/juju/charmstore.v5/internal/router"
+	"gopkg.in/juju/charmstore.v5/internal/storetesting"
+)
+
+type channelSuite struct {
+	commonSuite
+}
+
+var _ = gc.Suite(&channelSuite{})
+
+var parseChannelTests = []struct {
+	channel     string
+	expect      params.Channel
+	expectError string
+}{{
+	channel: "stable",
+	expect:  params.StableChannel,
+}, {
+	channel: "unpublished",
+	expect:  params.UnpublishedChannel,
+}, {
+	channel: "latest/edge",
+	expect:  params.EdgeChannel,
+}, {
+	channel: "1/stable",
+	expect:  "1/stable",
+}, {
+	channel: "v2-beta/candidate",
+	expect:  "v2-beta/candidate",
+}, {
+	channel:     "",
+	expectError: `invalid channel ""`,
+}, {
+	channel:     "bad",
+	expectError: `invalid channel "bad"`,
+}, {
+	channel:     "1/unpublished",
+	expectError: `invalid channel "1/unpublished"`,
+}, {
+	channel:     "latest/unpublished",
+	expectError: `invalid channel "latest/unpublished"`,
+}, {
+	channel:     "1/bad",
+	expectError: `invalid channel "1/bad"`,
+}, {
+	channel:     "1/",
+	expectError: `invalid channel "1/"`,
+}, {
+	channel:     "/stable",
+	expectError: `invalid track in channel "/stable"`,
+}, {
+	channel: "1.x/stable",
+	expect:  "1.x/stable",
+}, {
+	channel:     "1..x/stable",
+	expectError: `invalid track in channel "1..x/stable"`,
+}, {
+	channel:     "1_x/stable",
+	expectError: `invalid track in channel "1_x/stable"`,
+}, {
+	channel:     "One/stable",
+	expectError: `invalid track in channel "One/stable"`,
+}, {
+	channel:     "1/2/stable",
+	expectError: `invalid channel "1/2/stable"`,
+}}
+
+func (s *channelSuite) TestParseChannel(c *gc.C) {
+	for i, test := range parseChannelTests {
+		c.Logf("test %d: %q", i, test.channel)
+		ch, err := ParseChannel(test.channel)
+		if test.expectError != "" {
+			c.Assert(err, gc.ErrorMatches, test.expectError)
+			c.Assert(errgo.Cause(err), gc.Equals, params.ErrBadRequest)
+			c.Assert(ValidChannel(params.Channel(test.channel)), gc.Equals, false)
+			continue
+		}
+		c.Assert(err, gc.Equals, nil)
+		c.Assert(ch, gc.Equals, test.expect)
+		c.Assert(ValidChannel(params.Channel(test.channel)), gc.Equals, ch == params.Channel(test.channel))
+		track, risk := ChannelTrack(ch)
+		c.Assert(TrackChannel(track, risk), gc.Equals, ch)
+	}
+}
+
+func (s *channelSuite) TestChannelTrack(c *gc.C) {
+	track, risk := ChannelTrack(params.StableChannel)
+	c.Assert(track, gc.Equals, DefaultTrack)
+	c.Assert(risk, gc.Equals, params.StableChannel)
+	track, risk = ChannelTrack("1/edge")
+	c.Assert(track, gc.Equals, "1")
+	c.Assert(risk, gc.Equals, params.EdgeChannel)
+}
+
+func (s *channelSuite) TestChannelACL(c *gc.C) {
+	baseEntity := &mongodoc.BaseEntity{
+		ChannelACLs: map[params.Channel]mongodoc.ACL{
+			params.StableChannel: {
+				Read:  []string{"everyone"},
+				Write: []string{"bob"},
+			},
+			"1/stable": {
+				Write: []string{"alice"},
+			},
+			"2/stable": {
+				Read:  []string{},
+				Write: []string{"charlie"},
+			},
+		},
+	}
+	c.Assert(ChannelACL(baseEntity, params.StableChannel), jc.DeepEquals, mongodoc.ACL{
+		Read:  []string{"everyone"},
+		Write: []string{"bob"},
+	})
+	c.Assert(ChannelACL(baseEntity, "1/stable"), jc.DeepEquals, mongodoc.ACL{
+		Read:  []string{"everyone"},
+		Write: []string{"alice"},
+	})
+	c.Assert(ChannelACL(baseEntity, "2/stable"), jc.DeepEquals, mongodoc.ACL{
+		Read:  []string{},
+		Write: []string{"charlie"},
+	})
+	c.Assert(ChannelACL(baseEntity, "3/stable"), jc.DeepEquals, mongodoc.ACL{
+		Read:  []string{"everyone"},
+		Write: []string{"bob"},
+	})
+	c.Assert(ChannelACL(baseEntity, "3/edge"), jc.DeepEquals, mongodoc.ACL{})
+}
+
+func (s *channelSuite) TestPublishToTrack(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+	ids := s.addRevisions(c, store, 2)
+	err := store.Publish(ids[0], nil, params.StableChannel)
+	c.Assert(err, gc.Equals, nil)
+	err = store.Publish(ids[1], nil, "1/stable", "latest/edge")
+	c.Assert(err, gc.Equals, nil)
+
+	entity, err := store.FindEntity(ids[1], nil)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(entity.Published, jc.DeepEquals, map[params.Channel]bool{
+		params.EdgeChannel: true,
+		"1/stable":         true,
+	})
+	baseEntity, err := store.FindBaseEntity(&ids[0].URL, nil)
+	c.Assert(err, gc.Equals, nil)
+	series := storetesting.SearchSeries[0]
+	c.Assert(baseEntity.ChannelEntities, jc.DeepEquals, map[params.Channel]map[string]*charm.URL{
+		params.StableChannel: {series: &ids[0].URL},
+		params.EdgeChannel:   {series: &ids[1].URL},
+		"1/stable":           {series: &ids[1].URL},
+	})
+
+	url := charm.MustParseURL("~bob/wordpress")
+	for i, test := range []struct {
+		channel     params.Channel
+		expect      *router.ResolvedURL
+		expectError string
+	}{{
+		channel: params.NoChannel,
+		expect:  ids[0],
+	}, {
+		channel: params.StableChannel,
+		expect:  ids[0],
+	}, {
+		channel: params.EdgeChannel,
+		expect:  ids[1],
+	}, {
+		channel: "1/stable",
+		expect:  ids[1],
+	}, {
+		channel:     "1/edge",
+		expectError: `no matching charm or bundle for cs:~bob/wordpress`,
+	}, {
+		channel:     "2/stable",
+		expectError: `no matching charm or bundle for cs:~bob/wordpress`,
+	}} {
+		c.Logf("test %d: %s", i, test.channel)
+		entity, err := store.FindBestEntity(url, test.channel, nil)
+		if test.expectError != "" {
+			c.Assert(err, gc.ErrorMatches, test.expectError)
+			c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+			continue
+		}
+		c.Assert(err, gc.Equals, nil)
+		c.Assert(entity.URL, jc.DeepEquals, &test.expect.URL)
+	}
+
+	// A specific revision is only found in a track channel
+	// it has been published to.
+	_, err = store.FindBestEntity(&ids[0].URL, "1/stable", nil)
+	c.Assert(err, gc.ErrorMatches, `cs:~bob/.*/wordpress-0 not found in 1/stable channel`)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+}
+
+func (s *channelSuite) TestPublishToTrackWithDots(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+	ids := s.addRevisions(c, store, 1)
+	err := store.Publish(ids[0], nil, "1.x/stable")
+	c.Assert(err, gc.Equals, nil)
+	err = store.SetPerms(&ids[0].URL, "1.x/stable.read", "everyone")
+	c.Assert(err, gc.Equals, nil)
+
+	entity, err := store.FindEntity(ids[0], nil)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(entity.Published, jc.DeepEquals, map[params.Channel]bool{
+		"1.x/stable": true,
+	})
+	baseEntity, err := store.FindBaseEntity(&ids[0].URL, nil)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(baseEntity.ChannelEntities["1.x/stable"], jc.DeepEquals, map[string]*charm.URL{
+		storetesting.SearchSeries[0]: &ids[0].URL,
+	})
+	c.Assert(baseEntity.ChannelACLs["1.x/stable"].Read, jc.DeepEquals, []string{"everyone"})
+
+	// The channel is stored with its dots escaped.
+	var doc struct {
+		ChannelEntities map[string]interface{}
+	}
+	err = store.DB.BaseEntities().FindId(baseEntity.URL).One(&doc)
+	c.Assert(err, gc.Equals, nil)
+	_, ok := doc.ChannelEntities["1%2Ex/stable"]
+	c.Assert(ok, gc.Equals, true)
+
+	e, err := store.FindBestEntity(charm.MustParseURL("~bob/wordpress"), "1.x/stable", nil)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(e.URL, jc.DeepEquals, &ids[0].URL)
+}
+
+func (s *channelSuite) TestPublishToInvalidTrack(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+	ids := s.addRevisions(c, store, 1)
+	err := store.Publish(ids[0], nil, "1_x/stable", "1/unpublished")
+	c.Assert(err, gc.ErrorMatches, `cannot update ".*": no valid channels provided`)
+}
+
+func (s *channelSuite) TestRetentionKeepsTrackStableRevisions(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+	ids := s.addRevisions(c, store, 3)
+	for _, id := range ids[:2] {
+		err := store.Publish(id, nil, "1/stable")
+		c.Assert(err, gc.Equals, nil)
+	}
+	err := store.SetRetentionPolicy(&ids[0].URL, &mongodoc.RetentionPolicy{})
+	c.Assert(err, gc.Equals, nil)
+	expired, err := store.ExpiredRevisions(&ids[0].URL, time.Now())
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(expired, jc.DeepEquals, ids[2:])
+}
@@ -0,0 +1,141 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package charmstore // import "gopkg.in/juju/charmstore.v5/internal/charmstore"
+
+import (
+	"sort"
+	"time"
+
+	"github.com/juju/charmrepo/v6/csclient/params"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/mgo.v2/bson"
+
+	"gopkg.in/juju/charmstore.v5/internal/charm"
+	"gopkg.in/juju/charmstore.v5/internal/mongodoc"
+	"gopkg.in/juju/charmstore.v5/internal/router"
+)
+
+// addChannelHistory records that the given entity has been published
+// by the given user for the given series to the given channels with
+// the given resources.
+func (s *Store) addChannelHistory(user string, entity *mongodoc.Entity, series []string, resources []mongodoc.ResourceRevision, channels []params.Channel) error {
+	resources = append([]mongodoc.ResourceRevision(nil), resources...)
+	sort.Slice(resources, func(i, j int) bool {
+		return resources[i].Name < resources[j].Name
+	})
+	now := time.Now()
+	docs := make([]interface{}, len(channels))
+	for i, ch := range channels {
+		docs[i] = &mongodoc.ChannelHistoryEntry{
+			BaseURL:   entity.BaseURL,
+			Channel:   ch,
+			URL:       entity.URL,
+			Series:    series,
+			Resources: resources,
+			User:      user,
+			Time:      now,
+		}
+	}
+	if err := s.DB.ChannelHistory().Insert(docs...); err != nil {
+		return errgo.Notef(err, "cannot add channel history")
+	}
+	return nil
+}
+
+// ChannelHistory returns the publication history of the charm or
+// bundle with the given URL, most recent first. If channel is not
+// params.NoChannel, only publications to that channel are returned. If
+// limit is greater than zero, at most limit entries are returned.
+func (s *Store) ChannelHistory(url *charm.URL, channel params.Channel, limit int) ([]*mongodoc.ChannelHistoryEntry, error) {
+	entries, err := s.channelHistory(url, channel, nil, limit)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return entries, nil
+}
+
+// channelHistory is like ChannelHistory except that, if series is not
+// empty, only publications for at least one of the given series are
+// returned.
+func (s *Store) channelHistory(url *charm.URL, channel params.Channel, series []string, limit int) ([]*mongodoc.ChannelHistoryEntry, error) {
+	q := bson.D{{"baseurl", mongodoc.BaseURL(url)}}
+	if channel != params.NoChannel {
+		q = append(q, bson.DocElem{"channel", channel})
+	}
+	if len(series) > 0 {
+		q = append(q, bson.DocElem{"series", bson.D{{"$in", series}}})
+	}
+	query := s.DB.ChannelHistory().Find(q).Sort("-time", "-_id")
+	if limit > 0 {
+		query = query.Limit(limit)
+	}
+	var entries []*mongodoc.ChannelHistoryEntry
+	if err := query.All(&entries); err != nil {
+		return nil, errgo.Notef(err, "cannot get channel history")
+	}
+	return entries, nil
+}
+
+// RollbackChannel publishes the entity that was published to the given
+// channel before the most recent publication, with the same resources
+// that it was published with, and returns its id. The rollback is
+// itself recorded in the channel history as a publication by the given
+// user, so rolling back twice restores the original state.
+//
+// Only publications for the same series are considered, so that
+// revisions that target different series are rolled back separately.
+// If the URL includes a series, the most recent publication for that
+// series is rolled back; otherwise the most recent publication to the
+// channel is rolled back.
+//
+// If there is no earlier publication to the channel, or the entity has
+// since been deleted, it returns an error with a params.ErrNotFound
+// cause.
+func (s *Store) RollbackChannel(user string, url *charm.URL, channel params.Channel) (*router.ResolvedURL, error) {
+	if !ValidChannel(channel) || channel == params.UnpublishedChannel {
+		return nil, errgo.Newf("cannot roll back %q channel", channel)
+	}
+	var series []string
+	if url.Series != "" {
+		series = []string{url.Series}
+	} else {
+		latest, err := s.ChannelHistory(url, channel, 1)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		if len(latest) == 0 {
+			return nil, errgo.WithCausef(nil, params.ErrNotFound, "no previous publication to %s channel", channel)
+		}
+		series = latest[0].Series
+	}
+	// The first entry is the current publication for the series,
+	// and the second is the one to roll back to.
+	entries, err := s.channelHistory(url, channel, series, 2)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if len(entries) < 2 {
+		return nil, errgo.WithCausef(nil, params.ErrNotFound, "no previous publication to %s channel", channel)
+	}
+	prev := entries[1]
+	entity, err := s.FindEntity(&router.ResolvedURL{URL: *prev.URL}, FieldSelector("promulgated-revision"))
+	if errgo.Cause(err) == params.ErrNotFound {
+		return nil, errgo.WithCausef(nil, params.ErrNotFound, "previously published %s no longer exists", prev.URL)
+	}
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	id := &router.ResolvedURL{
+		URL:                 *entity.URL,
+		PromulgatedRevision: entity.PromulgatedRevision,
+	}
+	resources := make(map[string]int, len(prev.Resources))
+	for _, r := range prev.Resources {
+		resources[r.Name] = r.Revision
+	}
+	if err := s.PublishAs(user, id, resources, channel); err != nil {
+		return nil, errgo.Mask(err, errgo.Is(params.ErrNotFound), errgo.Is(ErrPublishResourceMismatch))
+	}
+	return id, nil
+}
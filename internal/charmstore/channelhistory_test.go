@@ -0,0 +1,184 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package charmstore
+
+import (
+	"time"
+
+	"github.com/juju/charmrepo/v6/csclient/params"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+	"gopkg.in/errgo.v1"
+
+	"gopkg.in/juju/charmstore.v5/internal/charm"
+	"gopkg.in/juju/charmstore.v5/internal/mongodoc"
+	"gopkg.in/juju/charmstore.v5/internal/router"
+	"gopkg.in/juju/charmstore.v5/internal/storetesting"
+)
+
+type channelHistorySuite struct {
+	commonSuite
+}
+
+var _ = gc.Suite(&channelHistorySuite{})
+
+func (s *channelHistorySuite) TestChannelHistory(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+	ids := s.addRevisions(c, store, 2, "someResource")
+	id0, id1 := ids[0], ids[1]
+	err := store.PublishAs("alice", id0, map[string]int{"someResource": 0}, params.EdgeChannel, params.StableChannel)
+	c.Assert(err, gc.Equals, nil)
+	err = store.Publish(id1, map[string]int{"someResource": 1}, params.EdgeChannel)
+	c.Assert(err, gc.Equals, nil)
+
+	history, err := store.ChannelHistory(&id0.URL, params.NoChannel, 0)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(history, gc.HasLen, 3)
+	for _, e := range history {
+		c.Assert(e.Time, jc.TimeBetween(time.Now().Add(-time.Minute), time.Now()))
+		e.Time = time.Time{}
+	}
+	baseURL := mongodoc.BaseURL(&id0.URL)
+	series := []string{storetesting.SearchSeries[0]}
+	c.Assert(history[0], jc.DeepEquals, &mongodoc.ChannelHistoryEntry{
+		BaseURL:   baseURL,
+		Channel:   params.EdgeChannel,
+		URL:       &id1.URL,
+		Series:    series,
+		Resources: []mongodoc.ResourceRevision{{Name: "someResource", Revision: 1}},
+	})
+	// The two entries for the first publication have the same
+	// time, so their order is not defined.
+	if history[1].Channel != params.EdgeChannel {
+		history[1], history[2] = history[2], history[1]
+	}
+	c.Assert(history[1:], jc.DeepEquals, []*mongodoc.ChannelHistoryEntry{{
+		BaseURL:   baseURL,
+		Channel:   params.EdgeChannel,
+		URL:       &id0.URL,
+		Series:    series,
+		Resources: []mongodoc.ResourceRevision{{Name: "someResource", Revision: 0}},
+		User:      "alice",
+	}, {
+		BaseURL:   baseURL,
+		Channel:   params.StableChannel,
+		URL:       &id0.URL,
+		Series:    series,
+		Resources: []mongodoc.ResourceRevision{{Name: "someResource", Revision: 0}},
+		User:      "alice",
+	}})
+
+	history, err = store.ChannelHistory(&id0.URL, params.StableChannel, 0)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(history, gc.HasLen, 1)
+	c.Assert(history[0].URL, jc.DeepEquals, &id0.URL)
+
+	history, err = store.ChannelHistory(&id0.URL, params.NoChannel, 1)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(history, gc.HasLen, 1)
+	c.Assert(history[0].URL, jc.DeepEquals, &id1.URL)
+}
+
+func (s *channelHistorySuite) TestRollbackChannel(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+	ids := s.addRevisions(c, store, 2, "someResource")
+	id0, id1 := ids[0], ids[1]
+	err := store.Publish(id0, map[string]int{"someResource": 0}, params.StableChannel)
+	c.Assert(err, gc.Equals, nil)
+	err = store.Publish(id1, map[string]int{"someResource": 1}, params.StableChannel)
+	c.Assert(err, gc.Equals, nil)
+
+	rid, err := store.RollbackChannel("alice", &id1.URL, params.StableChannel)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(rid, jc.DeepEquals, id0)
+	s.assertPublished(c, store, id0, 0)
+
+	history, err := store.ChannelHistory(&id0.URL, params.StableChannel, 0)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(history, gc.HasLen, 3)
+	c.Assert(history[0].URL, jc.DeepEquals, &id0.URL)
+	c.Assert(history[0].User, gc.Equals, "alice")
+
+	// Rolling back again restores the original state.
+	rid, err = store.RollbackChannel("alice", &id1.URL, params.StableChannel)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(rid, jc.DeepEquals, id1)
+	s.assertPublished(c, store, id1, 1)
+}
+
+func (s *channelHistorySuite) TestRollbackChannelSeries(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+	series0, series1 := storetesting.SearchSeries[0], storetesting.SearchSeries[1]
+	ids := []*router.ResolvedURL{
+		MustParseResolvedURL("~bob/" + series0 + "/wordpress-0"),
+		MustParseResolvedURL("~bob/" + series1 + "/wordpress-1"),
+		MustParseResolvedURL("~bob/" + series0 + "/wordpress-2"),
+	}
+	for _, id := range ids {
+		err := store.AddCharmWithArchive(id, storetesting.NewCharm(nil))
+		c.Assert(err, gc.Equals, nil)
+		err = store.Publish(id, nil, params.StableChannel)
+		c.Assert(err, gc.Equals, nil)
+	}
+
+	// The most recent publication was for series0, so
+	// rolling back republishes the earlier revision for
+	// series0 and leaves series1 alone.
+	rid, err := store.RollbackChannel("alice", charm.MustParseURL("~bob/wordpress"), params.StableChannel)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(rid, jc.DeepEquals, ids[0])
+	baseEntity, err := store.FindBaseEntity(&ids[0].URL, nil)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(baseEntity.ChannelEntities[params.StableChannel], jc.DeepEquals, map[string]*charm.URL{
+		series0: &ids[0].URL,
+		series1: &ids[1].URL,
+	})
+
+	// There has only been one publication for series1.
+	_, err = store.RollbackChannel("alice", &ids[1].URL, params.StableChannel)
+	c.Assert(err, gc.ErrorMatches, `no previous publication to stable channel`)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+}
+
+func (s *channelHistorySuite) assertPublished(c *gc.C, store *Store, id *router.ResolvedURL, resourceRev int) {
+	baseEntity, err := store.FindBaseEntity(&id.URL, nil)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(baseEntity.ChannelEntities[params.StableChannel], jc.DeepEquals, map[string]*charm.URL{
+		storetesting.SearchSeries[0]: &id.URL,
+	})
+	c.Assert(baseEntity.ChannelResources[params.StableChannel], jc.DeepEquals, []mongodoc.ResourceRevision{{
+		Name:     "someResource",
+		Revision: resourceRev,
+	}})
+}
+
+func (s *channelHistorySuite) TestRollbackChannelErrors(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+	ids := s.addRevisions(c, store, 2, "someResource")
+	id0, id1 := ids[0], ids[1]
+
+	_, err := store.RollbackChannel("", &id0.URL, params.StableChannel)
+	c.Assert(err, gc.ErrorMatches, `no previous publication to stable channel`)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+
+	err = store.Publish(id0, map[string]int{"someResource": 0}, params.StableChannel)
+	c.Assert(err, gc.Equals, nil)
+	_, err = store.RollbackChannel("", &id0.URL, params.StableChannel)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+
+	err = store.Publish(id1, map[string]int{"someResource": 1}, params.StableChannel)
+	c.Assert(err, gc.Equals, nil)
+	err = store.DeleteEntity(id0)
+	c.Assert(err, gc.Equals, nil)
+	_, err = store.RollbackChannel("", &id0.URL, params.StableChannel)
+	c.Assert(err, gc.ErrorMatches, `previously published cs:~bob/`+storetesting.SearchSeries[0]+`/wordpress-0 no longer exists`)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+
+	_, err = store.RollbackChannel("", &id0.URL, params.UnpublishedChannel)
+	c.Assert(err, gc.ErrorMatches, `cannot roll back "unpublished" channel`)
+}
@@ -4,6 +4,10 @@
 package charmstore
 
 import (
+	"fmt"
+	"strings"
+	"time"
+
 	"github.com/juju/charmrepo/v6/csclient/params"
 	gc "gopkg.in/check.v1"
 	"gopkg.in/macaroon-bakery.v2-unstable/bakery"
@@ -40,6 +44,34 @@ func (s *commonSuite) newStore(c *gc.C, withElasticSearch bool) *Store {
 	return store
 }
 
+// testEpoch holds an arbitrary fixed time used as a starting point
+// by tests that depend on the time.
+var testEpoch = time.Date(2017, 6, 1, 0, 0, 0, 0, time.UTC)
+
+// addRevisions adds revisions 0 to n-1 of ~bob/wordpress and returns
+// their ids. Each revision has the given resources, and a new revision
+// of each resource is uploaded with it, so that revision i of the charm
+// comes with revision i of its resources.
+func (s *commonSuite) addRevisions(c *gc.C, store *Store, n int, resources ...string) []*router.ResolvedURL {
+	var meta *charm.Meta
+	if len(resources) > 0 {
+		meta = storetesting.MetaWithResources(nil, resources...)
+	}
+	var ids []*router.ResolvedURL
+	for i := 0; i < n; i++ {
+		id := MustParseResolvedURL(fmt.Sprintf("~bob/%s/wordpress-%d", storetesting.SearchSeries[0], i))
+		err := store.AddCharmWithArchive(id, storetesting.NewCharm(meta))
+		c.Assert(err, gc.Equals, nil)
+		for _, name := range resources {
+			blob := fmt.Sprintf("content %d", i)
+			_, err = store.UploadResource(id, name, -1, strings.NewReader(blob), hashOfString(blob), int64(len(blob)))
+			c.Assert(err, gc.Equals, nil)
+		}
+		ids = append(ids, id)
+	}
+	return ids
+}
+
 func addRequiredCharms(c *gc.C, store *Store, bundle charm.Bundle) {
 	for _, app := range bundle.Data().Applications {
 		u := charm.MustParseURL(app.Charm)
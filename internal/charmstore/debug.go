@@ -19,6 +19,7 @@ import (
 	"gopkg.in/errgo.v1"
 	"gopkg.in/mgo.v2"
 
+	"gopkg.in/juju/charmstore.v5/internal/blobstore"
 	"gopkg.in/juju/charmstore.v5/internal/monitoring"
 	"gopkg.in/juju/charmstore.v5/internal/router"
 	appver "gopkg.in/juju/charmstore.v5/version"
@@ -217,9 +218,64 @@ func newServiceDebugHandler(p *Pool, c ServerParams, hnd http.Handler) http.Hand
 		"elasticsearch": checkES(p.es),
 	}))
 	mux.Handle("/fullcheck", authorized(c, debugFullCheck(hnd)))
+	mux.Handle("/blobscrub", authorized(c, router.HandleJSON(debugBlobScrub(p))))
+	mux.Handle("/blobgc", authorized(c, router.HandleJSON(debugBlobGC(p))))
+	mux.Handle("/blobmigration", authorized(c, router.HandleJSON(debugBlobMigration(p, c.BlobMigrationName))))
 	return handler{mux}
 }
 
+// GET /debug/blobscrub
+func debugBlobScrub(p *Pool) func(http.Header, *http.Request) (interface{}, error) {
+	return func(http.Header, *http.Request) (interface{}, error) {
+		store := p.Store()
+		defer store.Close()
+		failures, err := store.BlobStore.ScrubFailures()
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		if failures == nil {
+			failures = []blobstore.ScrubFailure{}
+		}
+		return failures, nil
+	}
+}
+
+// GET /debug/blobgc
+//
+// debugBlobGC reports the blobs that the blob store garbage collector
+// would remove if it ran now, along with statistics about the blobs
+// that would be kept.
+func debugBlobGC(p *Pool) func(http.Header, *http.Request) (interface{}, error) {
+	return func(http.Header, *http.Request) (interface{}, error) {
+		store := p.Store()
+		defer store.Close()
+		report, err := store.BlobStoreGCDryRun(time.Now().Add(-gcMinAge))
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		return report, nil
+	}
+}
+
+// GET /debug/blobmigration
+func debugBlobMigration(p *Pool, name string) func(http.Header, *http.Request) (interface{}, error) {
+	return func(http.Header, *http.Request) (interface{}, error) {
+		if name == "" {
+			return nil, errgo.WithCausef(nil, params.ErrNotFound, "no blob migration configured")
+		}
+		store := p.Store()
+		defer store.Close()
+		status, err := store.BlobStore.MigrationStatus(name)
+		if errgo.Cause(err) == blobstore.ErrNotFound {
+			return nil, errgo.WithCausef(nil, params.ErrNotFound, "blob migration %q not started", name)
+		}
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		return status, nil
+	}
+}
+
 type handler struct {
 	mux *router.ServeMux
 }
@@ -0,0 +1,110 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package charmstore // import "gopkg.in/juju/charmstore.v5/internal/charmstore"
+
+import (
+	"time"
+
+	"github.com/juju/charmrepo/v6/csclient/params"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+
+	"gopkg.in/juju/charmstore.v5/internal/charm"
+	"gopkg.in/juju/charmstore.v5/internal/mongodoc"
+	"gopkg.in/juju/charmstore.v5/internal/router"
+)
+
+// defaultDeletedEntityRetention holds how long deleted entities
+// are kept when ServerParams.DeletedEntityRetention is zero.
+const defaultDeletedEntityRetention = 30 * 24 * time.Hour
+
+// trashEntity copies the entity with the given id
+// into the deleted entities collection.
+func (s *Store) trashEntity(id *router.ResolvedURL) error {
+	var entity mongodoc.Entity
+	if err := s.DB.Entities().FindId(&id.URL).One(&entity); err != nil {
+		if err == mgo.ErrNotFound {
+			return errgo.WithCausef(nil, params.ErrNotFound, "")
+		}
+		return errgo.Notef(err, "cannot get entity")
+	}
+	if _, err := s.DB.DeletedEntities().UpsertId(&id.URL, &mongodoc.DeletedEntity{
+		URL:     entity.URL,
+		BaseURL: entity.BaseURL,
+		Entity:  &entity,
+		Deleted: time.Now(),
+	}); err != nil {
+		return errgo.Notef(err, "cannot save deleted entity")
+	}
+	return nil
+}
+
+// DeletedEntityRetention returns how long deleted
+// entities are kept before they are purged.
+func (s *Store) DeletedEntityRetention() time.Duration {
+	return s.pool.config.DeletedEntityRetention
+}
+
+// DeletedEntities returns all the deleted entities with the given base
+// URL that have not yet been purged, most recently deleted first. The
+// entity documents are not included in the results.
+func (s *Store) DeletedEntities(baseURL *charm.URL) ([]*mongodoc.DeletedEntity, error) {
+	var docs []*mongodoc.DeletedEntity
+	err := s.DB.DeletedEntities().Find(bson.D{{"baseurl", baseURL}}).
+		Select(bson.D{{"entity", 0}}).
+		Sort("-deleted").
+		All(&docs)
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot get deleted entities")
+	}
+	return docs, nil
+}
+
+// RestoreEntity restores the deleted entity with the given URL, which
+// must be fully specified and not promulgated, and returns its resolved
+// URL. If there is no such deleted entity, it returns an error with a
+// params.ErrNotFound cause. If restoring the entity would exceed the
+// quota of its owner, it returns an error with a router.ErrQuotaExceeded
+// cause.
+func (s *Store) RestoreEntity(url *charm.URL) (_ *router.ResolvedURL, err error) {
+	var doc mongodoc.DeletedEntity
+	if err := s.DB.DeletedEntities().FindId(url).One(&doc); err != nil {
+		if err == mgo.ErrNotFound {
+			return nil, errgo.WithCausef(nil, params.ErrNotFound, "deleted entity %q not found", url)
+		}
+		return nil, errgo.Notef(err, "cannot get deleted entity")
+	}
+	if _, err := s.FindBaseEntity(doc.BaseURL, FieldSelector("_id")); err != nil {
+		return nil, errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	if err := s.chargeQuota(url.User, doc.Entity.Size); err != nil {
+		return nil, errgo.Mask(err, errgo.Is(router.ErrQuotaExceeded))
+	}
+	defer s.releaseQuotaOnError(url.User, doc.Entity.Size, &err)
+	if err := s.DB.Entities().Insert(doc.Entity); err != nil {
+		if mgo.IsDup(err) {
+			return nil, errgo.WithCausef(nil, params.ErrDuplicateUpload, "%q already exists", url)
+		}
+		return nil, errgo.Notef(err, "cannot restore entity")
+	}
+	if err := s.DB.DeletedEntities().RemoveId(url); err != nil && err != mgo.ErrNotFound {
+		// The entity has been restored, so don't return an error;
+		// the stale document will be purged eventually.
+		logger.Errorf("cannot remove restored entity %q from deleted entities: %v", url, err)
+	}
+	return EntityResolvedURL(doc.Entity), nil
+}
+
+// PurgeDeletedEntities permanently removes all the entities that were
+// deleted before the given time, and returns how many were removed.
+// Once an entity has been purged, its blobs will be removed by the next
+// blobstore garbage collection.
+func (s *Store) PurgeDeletedEntities(before time.Time) (int, error) {
+	info, err := s.DB.DeletedEntities().RemoveAll(bson.D{{"deleted", bson.D{{"$lt", before}}}})
+	if err != nil {
+		return 0, errgo.Notef(err, "cannot purge deleted entities")
+	}
+	return info.Removed, nil
+}
@@ -0,0 +1,130 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package charmstore
+
+import (
+	"time"
+
+	"github.com/juju/charmrepo/v6/csclient/params"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+	"gopkg.in/errgo.v1"
+
+	"gopkg.in/juju/charmstore.v5/internal/mongodoc"
+	"gopkg.in/juju/charmstore.v5/internal/router"
+	"gopkg.in/juju/charmstore.v5/internal/storetesting"
+)
+
+type deletedSuite struct {
+	commonSuite
+}
+
+var _ = gc.Suite(&deletedSuite{})
+
+func (s *deletedSuite) TestDeleteAndRestoreEntity(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+	id0 := s.addRevisions(c, store, 2)[0]
+	entity, err := store.FindEntity(id0, nil)
+	c.Assert(err, gc.Equals, nil)
+	before, err := store.Quota("bob")
+	c.Assert(err, gc.Equals, nil)
+
+	err = store.DeleteEntity(id0)
+	c.Assert(err, gc.Equals, nil)
+	_, err = store.FindEntity(id0, nil)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+
+	docs, err := store.DeletedEntities(mongodoc.BaseURL(&id0.URL))
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(docs, gc.HasLen, 1)
+	c.Assert(docs[0].URL, jc.DeepEquals, &id0.URL)
+	c.Assert(docs[0].BaseURL, jc.DeepEquals, mongodoc.BaseURL(&id0.URL))
+	c.Assert(docs[0].Entity, gc.IsNil)
+	c.Assert(docs[0].Deleted, jc.TimeBetween(time.Now().Add(-time.Minute), time.Now()))
+
+	rid, err := store.RestoreEntity(&id0.URL)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(rid, jc.DeepEquals, id0)
+
+	restored, err := store.FindEntity(id0, nil)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(restored, jc.DeepEquals, entity)
+
+	docs, err = store.DeletedEntities(mongodoc.BaseURL(&id0.URL))
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(docs, gc.HasLen, 0)
+
+	after, err := store.Quota("bob")
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(after, jc.DeepEquals, before)
+
+	// The entity can be deleted again.
+	err = store.DeleteEntity(id0)
+	c.Assert(err, gc.Equals, nil)
+}
+
+func (s *deletedSuite) TestRestoreEntityNotFound(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+	id0 := s.addRevisions(c, store, 2)[0]
+
+	_, err := store.RestoreEntity(&id0.URL)
+	c.Assert(err, gc.ErrorMatches, `deleted entity "cs:~bob/`+storetesting.SearchSeries[0]+`/wordpress-0" not found`)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+}
+
+func (s *deletedSuite) TestRestoreEntityQuotaExceeded(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+	id0 := s.addRevisions(c, store, 2)[0]
+
+	err := store.DeleteEntity(id0)
+	c.Assert(err, gc.Equals, nil)
+	err = store.SetQuota("bob", 0, 1)
+	c.Assert(err, gc.Equals, nil)
+
+	_, err = store.RestoreEntity(&id0.URL)
+	c.Assert(errgo.Cause(err), gc.Equals, router.ErrQuotaExceeded)
+
+	// The entity is still deleted and can be
+	// restored when there's room for it.
+	_, err = store.FindEntity(id0, nil)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+	err = store.SetQuota("bob", 0, 2)
+	c.Assert(err, gc.Equals, nil)
+	_, err = store.RestoreEntity(&id0.URL)
+	c.Assert(err, gc.Equals, nil)
+}
+
+func (s *deletedSuite) TestPurgeDeletedEntities(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+	id0 := s.addRevisions(c, store, 2)[0]
+	err := store.DeleteEntity(id0)
+	c.Assert(err, gc.Equals, nil)
+
+	n, err := store.PurgeDeletedEntities(time.Now().Add(-time.Hour))
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(n, gc.Equals, 0)
+	docs, err := store.DeletedEntities(mongodoc.BaseURL(&id0.URL))
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(docs, gc.HasLen, 1)
+
+	n, err = store.PurgeDeletedEntities(time.Now().Add(time.Second))
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(n, gc.Equals, 1)
+	docs, err = store.DeletedEntities(mongodoc.BaseURL(&id0.URL))
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(docs, gc.HasLen, 0)
+
+	_, err = store.RestoreEntity(&id0.URL)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+}
+
+func (s *deletedSuite) TestDeletedEntityRetention(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+	c.Assert(store.DeletedEntityRetention(), gc.Equals, defaultDeletedEntityRetention)
+}
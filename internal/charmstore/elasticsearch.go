@@ -10,7 +10,7 @@ var (
 	esMapping = mustParseJSON(esMappingJSON)
 )
 
-const esSettingsVersion = 12
+const esSettingsVersion = 14
 
 func mustParseJSON(s string) interface{} {
 	var j json.RawMessage
@@ -295,6 +295,42 @@ const esMappingJSON = `
         "omit_norms": true,
         "index_options": "docs"
       },
+      "CharmConfigOptions": {
+        "type": "string",
+        "index": "not_analyzed",
+        "omit_norms": true,
+        "index_options": "docs"
+      },
+      "CharmActionNames": {
+        "type": "string",
+        "index": "not_analyzed",
+        "omit_norms": true,
+        "index_options": "docs"
+      },
+      "CharmResourceNames": {
+        "type": "string",
+        "index": "not_analyzed",
+        "omit_norms": true,
+        "index_options": "docs"
+      },
+      "CharmResourceTypes": {
+        "type": "string",
+        "index": "not_analyzed",
+        "omit_norms": true,
+        "index_options": "docs"
+      },
+      "CharmStorageNames": {
+        "type": "string",
+        "index": "not_analyzed",
+        "omit_norms": true,
+        "index_options": "docs"
+      },
+      "CharmDeviceNames": {
+        "type": "string",
+        "index": "not_analyzed",
+        "omit_norms": true,
+        "index_options": "docs"
+      },
       "BundleData": {
         "type": "object",
         "dynamic": "false",
@@ -397,6 +433,12 @@ const esMappingJSON = `
         "index": "not_analyzed",
         "omit_norms": true,
         "index_options": "docs"
+      },
+      "Tags": {
+        "type": "string",
+        "index": "not_analyzed",
+        "omit_norms": true,
+        "index_options": "docs"
       }
     }
   }
@@ -0,0 +1,940 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package charmstore // import "gopkg.in/juju/charmstore.v5/internal/charmstore"
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/juju/charmrepo/v6/csclient/params"
+	"gopkg.in/errgo.v1"
+
+	"gopkg.in/juju/charmstore.v5/internal/charm"
+	"gopkg.in/juju/charmstore.v5/internal/mongodoc"
+)
+
+// embeddedSearchVersion holds the version of the format of the
+// embedded search index. When it changes, any existing index is
+// discarded and rebuilt from mongodb.
+const embeddedSearchVersion = 2
+
+const (
+	// embeddedSearchVersionFile holds the name of the file in the
+	// index directory that holds the version of the index.
+	embeddedSearchVersionFile = "version"
+
+	// embeddedSearchDocSuffix holds the suffix of the files in the
+	// index directory that hold search documents.
+	embeddedSearchDocSuffix = ".json"
+
+	// embeddedSearchTempPrefix holds the prefix of the temporary
+	// files used while writing search documents.
+	embeddedSearchTempPrefix = "tmp-"
+)
+
+// defaultSearchLimit holds the number of results returned by the
+// embedded search index when no limit is specified. This is the
+// same as the elasticsearch default.
+const defaultSearchLimit = 10
+
+// embeddedSearchIndex implements SearchEngine with an inverted index
+// held in memory. Each search document is also stored in its own file
+// in a directory on local disk, so that the index can be reloaded when
+// the server restarts without being rebuilt from mongodb.
+//
+// The index is only updated by the server that holds it, so it is
+// only suitable for deployments with a single charm store server.
+type embeddedSearchIndex struct {
+	dir string
+
+	// mu guards the fields below it.
+	mu sync.RWMutex
+
+	// docs holds all the indexed documents, keyed by document id.
+	docs map[string]*SearchDoc
+
+	// postings holds the inverted index. It maps each text field to
+	// a map from each term in that field to the set of ids of the
+	// documents containing that term.
+	postings map[string]map[string]map[string]bool
+}
+
+// newEmbeddedSearchIndex returns an embedded search index stored in the
+// given directory, which is created if necessary. It also reports
+// whether the index has been newly created, in which case it will need
+// to be populated and then marked as complete with setComplete.
+func newEmbeddedSearchIndex(dir string) (*embeddedSearchIndex, bool, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, false, errgo.Notef(err, "cannot create search index directory")
+	}
+	si := &embeddedSearchIndex{
+		dir:      dir,
+		docs:     make(map[string]*SearchDoc),
+		postings: make(map[string]map[string]map[string]bool),
+	}
+	created, err := si.load()
+	if err != nil {
+		return nil, false, errgo.Notef(err, "cannot load search index from %q", dir)
+	}
+	return si, created, nil
+}
+
+// load reads all the documents in the index directory. If the
+// directory does not hold a complete index with the current version,
+// any documents in it are removed and load reports that a new index
+// has been created.
+func (si *embeddedSearchIndex) load() (bool, error) {
+	created := false
+	data, err := ioutil.ReadFile(filepath.Join(si.dir, embeddedSearchVersionFile))
+	if err != nil && !os.IsNotExist(err) {
+		return false, errgo.Mask(err)
+	}
+	if v, _ := strconv.Atoi(strings.TrimSpace(string(data))); v != embeddedSearchVersion {
+		created = true
+	}
+	infos, err := ioutil.ReadDir(si.dir)
+	if err != nil {
+		return false, errgo.Mask(err)
+	}
+	for _, info := range infos {
+		name := info.Name()
+		path := filepath.Join(si.dir, name)
+		switch {
+		case strings.HasPrefix(name, embeddedSearchTempPrefix):
+			// A temporary file left behind by a server that
+			// stopped while writing a document.
+			if err := os.Remove(path); err != nil {
+				return false, errgo.Mask(err)
+			}
+		case !strings.HasSuffix(name, embeddedSearchDocSuffix):
+		case created:
+			if err := os.Remove(path); err != nil {
+				return false, errgo.Mask(err)
+			}
+		default:
+			data, err := ioutil.ReadFile(path)
+			if err != nil {
+				return false, errgo.Mask(err)
+			}
+			var doc SearchDoc
+			if err := json.Unmarshal(data, &doc); err != nil {
+				return false, errgo.Notef(err, "cannot unmarshal search document %q", name)
+			}
+			si.add(strings.TrimSuffix(name, embeddedSearchDocSuffix), &doc)
+		}
+	}
+	return created, nil
+}
+
+// setComplete records that a newly created index has been fully
+// populated. Until it's called, the index is discarded and created
+// again when it's next loaded, so that an index left partly populated
+// by a server that stopped is never used.
+func (si *embeddedSearchIndex) setComplete() error {
+	if err := si.writeFile(embeddedSearchVersionFile, []byte(strconv.Itoa(embeddedSearchVersion))); err != nil {
+		return errgo.Mask(err)
+	}
+	return nil
+}
+
+// GetSearchDocument implements SearchEngine.GetSearchDocument.
+func (si *embeddedSearchIndex) GetSearchDocument(id *charm.URL) (*SearchDoc, error) {
+	si.mu.RLock()
+	defer si.mu.RUnlock()
+	doc := si.docs[searchDocID(id)]
+	if doc == nil {
+		return nil, errgo.Newf("cannot retrieve search document for %v: not found", id)
+	}
+	doc1 := *doc
+	return &doc1, nil
+}
+
+// update implements SearchEngine.update. As with elasticsearch, a
+// document is not replaced by a document for an earlier revision.
+func (si *embeddedSearchIndex) update(doc *SearchDoc) error {
+	si.mu.Lock()
+	defer si.mu.Unlock()
+	for _, doc := range expandSearchDoc(doc) {
+		id := searchDocID(doc.URL)
+		if old := si.docs[id]; old != nil && old.URL.Revision > doc.URL.Revision {
+			continue
+		}
+		// Store the document as it will be read back from disk,
+		// so that searches return the same results whether or not
+		// the index has been reloaded.
+		data, err := json.Marshal(doc)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		var stored SearchDoc
+		if err := json.Unmarshal(data, &stored); err != nil {
+			return errgo.Mask(err)
+		}
+		if err := si.writeFile(id+embeddedSearchDocSuffix, data); err != nil {
+			return errgo.Mask(err)
+		}
+		si.delete(id)
+		si.add(id, &stored)
+	}
+	return nil
+}
+
+// remove implements SearchEngine.remove.
+func (si *embeddedSearchIndex) remove(entities []*mongodoc.Entity) error {
+	si.mu.Lock()
+	defer si.mu.Unlock()
+	for _, id := range searchDocIDs(entities) {
+		err := os.Remove(filepath.Join(si.dir, id+embeddedSearchDocSuffix))
+		if err != nil && !os.IsNotExist(err) {
+			return errgo.Mask(err)
+		}
+		si.delete(id)
+	}
+	return nil
+}
+
+// writeFile atomically writes the file with the given name in the
+// index directory.
+func (si *embeddedSearchIndex) writeFile(name string, data []byte) error {
+	f, err := ioutil.TempFile(si.dir, embeddedSearchTempPrefix)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	_, err = f.Write(data)
+	if err1 := f.Close(); err == nil {
+		err = err1
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), filepath.Join(si.dir, name))
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return errgo.Notef(err, "cannot write %q", name)
+	}
+	return nil
+}
+
+// add adds the document with the given id to the in-memory index.
+// It must be called with si.mu held.
+func (si *embeddedSearchIndex) add(id string, doc *SearchDoc) {
+	si.docs[id] = doc
+	for _, f := range embeddedTextFields {
+		for _, term := range f.terms(doc) {
+			terms := si.postings[f.name]
+			if terms == nil {
+				terms = make(map[string]map[string]bool)
+				si.postings[f.name] = terms
+			}
+			ids := terms[term]
+			if ids == nil {
+				ids = make(map[string]bool)
+				terms[term] = ids
+			}
+			ids[id] = true
+		}
+	}
+}
+
+// delete removes the document with the given id from the in-memory
+// index, if it is present. It must be called with si.mu held.
+func (si *embeddedSearchIndex) delete(id string) {
+	doc := si.docs[id]
+	if doc == nil {
+		return
+	}
+	delete(si.docs, id)
+	for _, f := range embeddedTextFields {
+		terms := si.postings[f.name]
+		for _, term := range f.terms(doc) {
+			delete(terms[term], id)
+			if len(terms[term]) == 0 {
+				delete(terms, term)
+			}
+		}
+	}
+}
+
+// search implements SearchEngine.search. It supports the same
+// parameters as the elasticsearch query built by createSearchDSL, and
+// scores and filters documents in the same way.
+func (si *embeddedSearchIndex) search(sp SearchParams, fuzzy bool, fields map[string]int) (*searchResult, error) {
+	start := time.Now()
+	si.mu.RLock()
+	defer si.mu.RUnlock()
+
+	scores := si.textScores(sp, fuzzy)
+	filter := embeddedFilter(sp)
+	hits := make([]embeddedHit, 0, len(scores))
+	for id, score := range scores {
+		doc := si.docs[id]
+		if !filter(doc) {
+			continue
+		}
+		hits = append(hits, embeddedHit{
+			doc:   doc,
+			score: score * embeddedBoost(doc),
+		})
+	}
+	sort.Sort(embeddedHitsBySort{hits, sp.Sort})
+
+	result := &searchResult{
+		total: len(hits),
+	}
+	for _, f := range sp.Facets {
+		values, ok := embeddedFacets[f]
+		if !ok {
+			continue
+		}
+		if result.facets == nil {
+			result.facets = make(map[string][]FacetCount)
+		}
+		counts := make(map[string]int)
+		for _, h := range hits {
+			for _, v := range values(h.doc) {
+				counts[v]++
+			}
+		}
+		result.facets[f] = facetCounts(counts)
+	}
+	if fuzzy {
+		result.names = embeddedNames(hits)
+	}
+	if len(sp.After) > 0 {
+		i, err := searchAfter(hits, sp)
+		if err != nil {
+			return nil, errgo.Mask(err, errgo.Is(params.ErrBadRequest))
+		}
+		hits = hits[i:]
+	}
+	limit := sp.Limit
+	if limit <= 0 {
+		limit = defaultSearchLimit
+	}
+	if sp.Skip < len(hits) {
+		hits = hits[sp.Skip:]
+		if len(hits) > limit {
+			hits = hits[:limit]
+			cursor, err := makeCursor(embeddedSortValues(hits[limit-1], sp.Sort))
+			if err != nil {
+				return nil, errgo.Mask(err)
+			}
+			result.cursor = cursor
+		}
+		result.docs = make([]*SearchDoc, len(hits))
+		for i, h := range hits {
+			result.docs[i] = h.doc
+		}
+	}
+	result.took = time.Since(start)
+	return result, nil
+}
+
+// textScores returns the score of each document matching the full
+// text search in sp, keyed by document id. As with the multi-match
+// query built by createSearchDSL, a document matches when all the
+// terms of the query are found in one of the text fields, and its
+// score is the highest boost of all the fields that match. If fuzzy is
+// true, query terms also match terms within the fuzziness edit distance
+// of them.
+func (si *embeddedSearchIndex) textScores(sp SearchParams, fuzzy bool) map[string]float64 {
+	scores := make(map[string]float64)
+	if sp.Text == "" {
+		for id := range si.docs {
+			scores[id] = 1
+		}
+		return scores
+	}
+	nameField := "Name.tok"
+	if sp.AutoComplete {
+		nameField = "Name.ngrams"
+	}
+	for _, f := range embeddedTextFields {
+		if strings.HasPrefix(f.name, "Name.") && f.name != nameField {
+			continue
+		}
+		terms := f.analyze(sp.Text)
+		if len(terms) == 0 {
+			continue
+		}
+		postings := si.postings[f.name]
+		ids := termIDs(postings, terms[0], fuzzy)
+		for _, term := range terms[1:] {
+			tids := termIDs(postings, term, fuzzy)
+			matched := make(map[string]bool)
+			for id := range ids {
+				if tids[id] {
+					matched[id] = true
+				}
+			}
+			ids = matched
+		}
+		for id := range ids {
+			if f.boost > scores[id] {
+				scores[id] = f.boost
+			}
+		}
+	}
+	return scores
+}
+
+// termIDs returns the set of ids of the documents that hold the given
+// term in the given postings. If fuzzy is true, documents holding any
+// term within the fuzziness edit distance of the term are included.
+func termIDs(postings map[string]map[string]bool, term string, fuzzy bool) map[string]bool {
+	if !fuzzy {
+		return postings[term]
+	}
+	max := fuzziness(term)
+	n := utf8.RuneCountInString(term)
+	ids := make(map[string]bool)
+	for t, tids := range postings {
+		if d := utf8.RuneCountInString(t) - n; d > max || -d > max {
+			// The lengths differ by more than the
+			// edit distance could account for.
+			continue
+		}
+		if editDistance(term, t) > max {
+			continue
+		}
+		for id := range tids {
+			ids[id] = true
+		}
+	}
+	return ids
+}
+
+// embeddedBoost returns the factor by which the score of the given
+// document is multiplied, using the same functions as those in the
+// function score query built by createSearchDSL.
+func embeddedBoost(doc *SearchDoc) float64 {
+	boost := math.Log(2 + float64(doc.TotalDownloads)*0.000001)
+	if doc.PromulgatedURL != nil {
+		boost *= 1.25
+	}
+	for _, s := range doc.Series {
+		if b, ok := seriesBoost[s]; ok {
+			boost *= b
+		}
+	}
+	return boost
+}
+
+// embeddedTextField holds a text field in the embedded search index.
+type embeddedTextField struct {
+	// name holds the name of the field, as used in the
+	// elasticsearch mapping.
+	name string
+
+	// boost holds the boost given to matches in the field
+	// by a full text search.
+	boost float64
+
+	// terms returns the terms indexed for the given document.
+	terms func(doc *SearchDoc) []string
+
+	// analyze splits the text of a query into the terms
+	// that are looked up in the field.
+	analyze func(text string) []string
+}
+
+// embeddedTextFields holds the fields used by the full text search.
+// Their analysis mirrors that of the corresponding fields in the
+// elasticsearch mapping.
+var embeddedTextFields = []embeddedTextField{{
+	name:  "Name.tok",
+	boost: 10,
+	terms: func(doc *SearchDoc) []string {
+		return simpleTerms(doc.Name)
+	},
+	analyze: simpleTerms,
+}, {
+	name:  "Name.ngrams",
+	boost: 10,
+	terms: func(doc *SearchDoc) []string {
+		return ngrams(strings.ToLower(doc.Name), 3, 20)
+	},
+	analyze: lowercaseWords,
+}, {
+	name:  "User.tok",
+	boost: 7,
+	terms: func(doc *SearchDoc) []string {
+		return lowercaseWords(doc.User)
+	},
+	analyze: lowercaseWords,
+}, {
+	name:  "CharmMeta.Categories.tok",
+	boost: 5,
+	terms: func(doc *SearchDoc) []string {
+		if doc.CharmMeta == nil {
+			return nil
+		}
+		return lowercaseWords(strings.Join(doc.CharmMeta.Categories, " "))
+	},
+	analyze: lowercaseWords,
+}, {
+	name:  "CharmMeta.Tags.tok",
+	boost: 5,
+	terms: func(doc *SearchDoc) []string {
+		if doc.CharmMeta == nil {
+			return nil
+		}
+		return lowercaseWords(strings.Join(doc.CharmMeta.Tags, " "))
+	},
+	analyze: lowercaseWords,
+}, {
+	name:  "BundleData.Tags.tok",
+	boost: 5,
+	terms: func(doc *SearchDoc) []string {
+		if doc.BundleData == nil {
+			return nil
+		}
+		return lowercaseWords(strings.Join(doc.BundleData.Tags, " "))
+	},
+	analyze: lowercaseWords,
+}}
+
+// simpleTerms splits the given text into lower-case terms at every
+// character that is not a letter, as the elasticsearch simple analyzer
+// does.
+func simpleTerms(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r)
+	})
+}
+
+// standardTerms splits the given text into lower-case terms at every
+// character that is not a letter or a digit, approximating the
+// elasticsearch standard analyzer.
+func standardTerms(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// lowercaseWords splits the given text into lower-case terms at white
+// space.
+func lowercaseWords(text string) []string {
+	return strings.Fields(strings.ToLower(text))
+}
+
+// ngrams returns all the substrings of s with lengths between min and
+// max characters inclusive.
+func ngrams(s string, min, max int) []string {
+	rs := []rune(s)
+	var grams []string
+	for i := range rs {
+		for n := min; n <= max && i+n <= len(rs); n++ {
+			grams = append(grams, string(rs[i:i+n]))
+		}
+	}
+	return grams
+}
+
+// containsPhrase reports whether the terms of the given phrase appear
+// consecutively in the given text.
+func containsPhrase(text, phrase string) bool {
+	terms := standardTerms(text)
+	pterms := standardTerms(phrase)
+	if len(pterms) == 0 {
+		return false
+	}
+	for i := 0; i+len(pterms) <= len(terms); i++ {
+		matched := true
+		for j, t := range pterms {
+			if terms[i+j] != t {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(ss []string, s string) bool {
+	for _, t := range ss {
+		if t == s {
+			return true
+		}
+	}
+	return false
+}
+
+// embeddedFilter returns a function that reports whether a document
+// satisfies the filters and the ACL restrictions in sp, as the filter
+// built by createFilters does.
+func embeddedFilter(sp SearchParams) func(doc *SearchDoc) bool {
+	var fs []func(*SearchDoc) bool
+	if sp.ExpandedMultiSeries {
+		fs = append(fs, func(doc *SearchDoc) bool {
+			return doc.SingleSeries
+		})
+	} else {
+		fs = append(fs, func(doc *SearchDoc) bool {
+			return doc.AllSeries
+		})
+	}
+	for k, vals := range sp.Filters {
+		filter, ok := embeddedFilters[k]
+		if !ok {
+			continue
+		}
+		ofs := make([]func(*SearchDoc) bool, len(vals))
+		for i, v := range vals {
+			ofs[i] = filter(v)
+		}
+		fs = append(fs, func(doc *SearchDoc) bool {
+			for _, f := range ofs {
+				if f(doc) {
+					return true
+				}
+			}
+			return false
+		})
+	}
+	if !sp.Admin {
+		groups := append([]string{params.Everyone}, sp.Groups...)
+		fs = append(fs, func(doc *SearchDoc) bool {
+			for _, g := range groups {
+				if containsString(doc.ReadACLs, g) {
+					return true
+				}
+			}
+			return false
+		})
+	}
+	return func(doc *SearchDoc) bool {
+		for _, f := range fs {
+			if !f(doc) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// embeddedFilters holds the embedded equivalent of each of the
+// filters in the filters map.
+var embeddedFilters = map[string]func(string) func(*SearchDoc) bool{
+	"actions": embeddedTermFilter(func(doc *SearchDoc) []string {
+		return doc.CharmActionNames
+	}),
+	"config": embeddedTermFilter(func(doc *SearchDoc) []string {
+		return doc.CharmConfigOptions
+	}),
+	"description": func(value string) func(*SearchDoc) bool {
+		return func(doc *SearchDoc) bool {
+			return doc.CharmMeta != nil && containsPhrase(doc.CharmMeta.Description, value)
+		}
+	},
+	"devices": embeddedTermFilter(func(doc *SearchDoc) []string {
+		return doc.CharmDeviceNames
+	}),
+	"name": func(value string) func(*SearchDoc) bool {
+		return func(doc *SearchDoc) bool {
+			return doc.Name == value
+		}
+	},
+	"owner": func(value string) func(*SearchDoc) bool {
+		if value == "" {
+			return embeddedPromulgatedFilter("1")
+		}
+		return func(doc *SearchDoc) bool {
+			return doc.User == value
+		}
+	},
+	"promulgated": embeddedPromulgatedFilter,
+	"provides": embeddedTermFilter(func(doc *SearchDoc) []string {
+		return doc.CharmProvidedInterfaces
+	}),
+	"requires": embeddedTermFilter(func(doc *SearchDoc) []string {
+		return doc.CharmRequiredInterfaces
+	}),
+	"resources": embeddedTermFilter(func(doc *SearchDoc) []string {
+		return doc.CharmResourceNames
+	}),
+	"resource-types": embeddedTermFilter(func(doc *SearchDoc) []string {
+		return doc.CharmResourceTypes
+	}),
+	"series": func(value string) func(*SearchDoc) bool {
+		return func(doc *SearchDoc) bool {
+			return containsString(doc.Series, value)
+		}
+	},
+	"storage": embeddedTermFilter(func(doc *SearchDoc) []string {
+		return doc.CharmStorageNames
+	}),
+	"summary": func(value string) func(*SearchDoc) bool {
+		return func(doc *SearchDoc) bool {
+			return doc.CharmMeta != nil && containsPhrase(doc.CharmMeta.Summary, value)
+		}
+	},
+	"tags": embeddedTermFilter(func(doc *SearchDoc) []string {
+		return entityTags(doc.Entity)
+	}),
+	"type": func(value string) func(*SearchDoc) bool {
+		return func(doc *SearchDoc) bool {
+			return containsString(doc.Series, "bundle") == (value == "bundle")
+		}
+	},
+}
+
+// embeddedNames returns the most common names of the given hits, as
+// collected by the names aggregation in the query built by
+// createSearchDSL, in order of decreasing frequency.
+func embeddedNames(hits []embeddedHit) []string {
+	counts := make(map[string]int)
+	for _, h := range hits {
+		if h.doc.Entity != nil {
+			counts[h.doc.Name]++
+		}
+	}
+	fcs := make([]FacetCount, 0, len(counts))
+	for name, n := range counts {
+		fcs = append(fcs, FacetCount{Value: name, Count: n})
+	}
+	sort.Sort(facetCountsByCount(fcs))
+	if len(fcs) > maxSuggestionNames {
+		fcs = fcs[:maxSuggestionNames]
+	}
+	names := make([]string, len(fcs))
+	for i, fc := range fcs {
+		names[i] = fc.Value
+	}
+	return names
+}
+
+// embeddedType returns "bundle" if the given document is for a
+// bundle, and "charm" otherwise.
+func embeddedType(doc *SearchDoc) string {
+	if containsString(doc.Series, "bundle") {
+		return "bundle"
+	}
+	return "charm"
+}
+
+// embeddedFacets holds the embedded equivalent of each of the
+// aggregations in the facetAggregations map. Each function returns the
+// values of the facet for a document.
+var embeddedFacets = map[string]func(*SearchDoc) []string{
+	"owner": func(doc *SearchDoc) []string {
+		return []string{doc.User}
+	},
+	"series": func(doc *SearchDoc) []string {
+		return doc.Series
+	},
+	"tags": func(doc *SearchDoc) []string {
+		return entityTags(doc.Entity)
+	},
+	"type": func(doc *SearchDoc) []string {
+		return []string{embeddedType(doc)}
+	},
+}
+
+// embeddedPromulgatedFilter returns a filter that matches promulgated
+// documents when value is "1" and other documents otherwise.
+func embeddedPromulgatedFilter(value string) func(*SearchDoc) bool {
+	return func(doc *SearchDoc) bool {
+		return (doc.PromulgatedURL != nil) == (value == "1")
+	}
+}
+
+// embeddedTermFilter returns a function that generates a filter that
+// matches documents for which the values returned by the given function
+// include every space-separated term in the filter value.
+func embeddedTermFilter(values func(*SearchDoc) []string) func(string) func(*SearchDoc) bool {
+	return func(value string) func(*SearchDoc) bool {
+		terms := strings.Fields(value)
+		return func(doc *SearchDoc) bool {
+			vals := values(doc)
+			for _, t := range terms {
+				if !containsString(vals, t) {
+					return false
+				}
+			}
+			return true
+		}
+	}
+}
+
+// embeddedHit holds a document matched by a search in the embedded
+// index.
+type embeddedHit struct {
+	doc   *SearchDoc
+	score float64
+}
+
+// embeddedHitsBySort sorts hits by the given sort parameters, as
+// elasticsearch does. When no sort parameters are given, hits are
+// sorted by descending score. Any remaining ties are broken by
+// document URL so that the order is stable.
+type embeddedHitsBySort struct {
+	hits []embeddedHit
+	sort []SortParam
+}
+
+func (s embeddedHitsBySort) Len() int {
+	return len(s.hits)
+}
+
+func (s embeddedHitsBySort) Swap(i, j int) {
+	s.hits[i], s.hits[j] = s.hits[j], s.hits[i]
+}
+
+func (s embeddedHitsBySort) Less(i, j int) bool {
+	hi, hj := s.hits[i], s.hits[j]
+	for _, sp := range s.sort {
+		c := compareSortField(hi.doc, hj.doc, sp)
+		if c != 0 {
+			return c < 0
+		}
+	}
+	if len(s.sort) == 0 && hi.score != hj.score {
+		return hi.score > hj.score
+	}
+	return hi.doc.URL.String() < hj.doc.URL.String()
+}
+
+// compareSortField compares the given documents on the field in sp,
+// returning a negative number if a sorts before b, a positive number if
+// it sorts after and zero if they are equivalent. As in elasticsearch,
+// an ascending sort on the multi-valued Series field uses the lowest
+// value and a descending sort uses the highest.
+func compareSortField(a, b *SearchDoc, sp SortParam) int {
+	var c int
+	switch sp.Field {
+	case "name":
+		c = strings.Compare(a.Name, b.Name)
+	case "owner":
+		c = strings.Compare(a.User, b.User)
+	case "series":
+		c = strings.Compare(sortSeries(a, sp.Descending), sortSeries(b, sp.Descending))
+	case "downloads":
+		switch {
+		case a.TotalDownloads < b.TotalDownloads:
+			c = -1
+		case a.TotalDownloads > b.TotalDownloads:
+			c = 1
+		}
+	}
+	if sp.Descending {
+		return -c
+	}
+	return c
+}
+
+// embeddedSortValues returns the values that the given hit is sorted
+// on, in the same order as the sort values that elasticsearch returns
+// for hits of the query built by createSearchDSL.
+func embeddedSortValues(h embeddedHit, sort []SortParam) []interface{} {
+	values := make([]interface{}, 0, len(sort)+2)
+	for _, sp := range sort {
+		switch sp.Field {
+		case "name":
+			values = append(values, h.doc.Name)
+		case "owner":
+			values = append(values, h.doc.User)
+		case "series":
+			values = append(values, sortSeries(h.doc, sp.Descending))
+		case "downloads":
+			values = append(values, h.doc.TotalDownloads)
+		}
+	}
+	if len(sort) == 0 {
+		values = append(values, h.score)
+	}
+	return append(values, h.doc.URL.String())
+}
+
+// searchAfter returns the index of the first of the given sorted hits
+// that sorts after the position held in sp.After.
+func searchAfter(hits []embeddedHit, sp SearchParams) (int, error) {
+	for i, h := range hits {
+		c, err := compareSortValues(embeddedSortValues(h, sp.Sort), sp.After, sp.Sort)
+		if err != nil {
+			return 0, errgo.Mask(err, errgo.Is(params.ErrBadRequest))
+		}
+		if c > 0 {
+			return i, nil
+		}
+	}
+	return len(hits), nil
+}
+
+// compareSortValues compares the sort values of a hit, as returned by
+// embeddedSortValues or by elasticsearch, with the sort values held in
+// a cursor. It returns
+// a negative number if the hit sorts before the position of the
+// cursor, a positive number if it sorts after it and zero if the hit
+// is at that position.
+func compareSortValues(values []interface{}, after []json.RawMessage, sort []SortParam) (int, error) {
+	if len(after) != len(values) {
+		return 0, errgo.WithCausef(nil, params.ErrBadRequest, "cursor does not match search")
+	}
+	for i, v := range values {
+		var c int
+		var err error
+		switch v := v.(type) {
+		case string:
+			var a string
+			err = json.Unmarshal(after[i], &a)
+			c = strings.Compare(v, a)
+		case int64:
+			var a int64
+			err = json.Unmarshal(after[i], &a)
+			c = compareFloats(float64(v), float64(a))
+		case float64:
+			var a float64
+			err = json.Unmarshal(after[i], &a)
+			c = compareFloats(v, a)
+		}
+		if err != nil {
+			return 0, errgo.WithCausef(nil, params.ErrBadRequest, "cursor does not match search")
+		}
+		// Sort fields may be descending, as is the score when
+		// there are no sort fields. The final URL is always
+		// ascending.
+		if (i < len(sort) && sort[i].Descending) || (len(sort) == 0 && i == 0) {
+			c = -c
+		}
+		if c != 0 {
+			return c, nil
+		}
+	}
+	return 0, nil
+}
+
+func compareFloats(a, b float64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// sortSeries returns the series value used to sort the given document:
+// its highest series if highest is true and its lowest otherwise.
+func sortSeries(doc *SearchDoc, highest bool) string {
+	var s string
+	for i, t := range doc.Series {
+		if i == 0 || (t > s) == highest {
+			s = t
+		}
+	}
+	return s
+}
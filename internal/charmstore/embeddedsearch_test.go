@@ -0,0 +1,413 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package charmstore
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/juju/charmrepo/v6/csclient/params"
+	jujutesting "github.com/juju/testing"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+	"gopkg.in/errgo.v1"
+
+	"gopkg.in/juju/charmstore.v5/internal/charm"
+	"gopkg.in/juju/charmstore.v5/internal/mongodoc"
+	"gopkg.in/juju/charmstore.v5/internal/storetesting"
+)
+
+type embeddedSearchSuite struct {
+	jujutesting.IsolatedMgoSuite
+	dir   string
+	pool  *Pool
+	store *Store
+}
+
+var _ = gc.Suite(&embeddedSearchSuite{})
+
+func (s *embeddedSearchSuite) SetUpTest(c *gc.C) {
+	s.IsolatedMgoSuite.SetUpTest(c)
+	s.dir = filepath.Join(c.MkDir(), "search")
+	s.pool = s.newPool(c)
+	s.store = s.pool.Store()
+	addSearchEntities(c, s.store)
+}
+
+func (s *embeddedSearchSuite) TearDownTest(c *gc.C) {
+	if s.store != nil {
+		s.store.Close()
+	}
+	if s.pool != nil {
+		s.pool.Close()
+	}
+	s.IsolatedMgoSuite.TearDownTest(c)
+}
+
+// newPool returns a new pool that uses the embedded
+// search index in s.dir.
+func (s *embeddedSearchSuite) newPool(c *gc.C) *Pool {
+	pool, err := NewPool(s.Session.DB("foo"), nil, nil, ServerParams{
+		SearchIndexDir: s.dir,
+	})
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(pool.embeddedSearch, gc.NotNil)
+	return pool
+}
+
+// reopen closes the pool and opens a new one
+// using the same search index directory.
+func (s *embeddedSearchSuite) reopen(c *gc.C) {
+	s.store.Close()
+	s.pool.Close()
+	s.pool = s.newPool(c)
+	s.store = s.pool.Store()
+}
+
+func (s *embeddedSearchSuite) entity(c *gc.C, ent storetesting.SearchEntity) *mongodoc.Entity {
+	e, err := s.store.FindEntity(ent.ResolvedURL(), nil)
+	c.Assert(err, gc.Equals, nil)
+	return e
+}
+
+func (s *embeddedSearchSuite) TestSearches(c *gc.C) {
+	// The embedded index gives the same results
+	// as elasticsearch for all the search tests.
+	for i, test := range searchTests {
+		c.Logf("test %d: %s", i, test.about)
+		total, res := search(c, s.store, test.sp)
+		sort.Sort(resolvedURLsByString(res))
+		expected := make(Entities, len(test.results))
+		for i, r := range test.results {
+			expected[i] = s.entity(c, r)
+		}
+		sort.Sort(resolvedURLsByString(expected))
+		c.Check(Entities(res), jc.DeepEquals, expected)
+		c.Check(total, gc.Equals, len(test.results)+test.totalDiff)
+	}
+}
+
+func (s *embeddedSearchSuite) TestFacets(c *gc.C) {
+	// The embedded index counts facets in the same
+	// way as elasticsearch.
+	for i, test := range facetTests {
+		c.Logf("test %d: %s", i, test.about)
+		total, facets := searchFacets(c, s.store, test.sp)
+		c.Check(total, gc.Equals, test.total)
+		c.Check(facets, jc.DeepEquals, test.expect)
+	}
+}
+
+func (s *embeddedSearchSuite) TestCharmFieldFilters(c *gc.C) {
+	id := addTranscoderForSearch(c, s.store)
+	testCharmFieldFilters(c, s.store, id)
+}
+
+func (s *embeddedSearchSuite) TestFuzzySearch(c *gc.C) {
+	testFuzzySearch(c, s.store)
+}
+
+func (s *embeddedSearchSuite) TestSearchCursor(c *gc.C) {
+	testSearchCursor(c, s.store)
+}
+
+func (s *embeddedSearchSuite) TestSearchCursorMismatch(c *gc.C) {
+	var sp SearchParams
+	err := sp.ParseCursor("WyJ4Il0")
+	c.Assert(err, gc.Equals, nil)
+	q := s.store.SearchQuery(sp)
+	it := q.Iter(nil)
+	var e mongodoc.Entity
+	c.Assert(it.Next(&e), gc.Equals, false)
+	c.Assert(it.Err(), gc.ErrorMatches, "cursor does not match search")
+	c.Assert(errgo.Cause(it.Err()), gc.Equals, params.ErrBadRequest)
+}
+
+func (s *embeddedSearchSuite) TestBoosting(c *gc.C) {
+	_, res := search(c, s.store, SearchParams{})
+	c.Assert(Entities(res), jc.DeepEquals, Entities{
+		s.entity(c, storetesting.SearchEntities["multi-series"]),
+		s.entity(c, storetesting.SearchEntities["wordpress-simple"]),
+		s.entity(c, storetesting.SearchEntities["wordpress"]),
+		s.entity(c, storetesting.SearchEntities["mysql"]),
+		s.entity(c, storetesting.SearchEntities["squid-forwardproxy"]),
+		s.entity(c, storetesting.SearchEntities["cloud-controller-worker-v2"]),
+		s.entity(c, storetesting.SearchEntities["varnish"]),
+	})
+}
+
+func (s *embeddedSearchSuite) TestSorting(c *gc.C) {
+	tests := []struct {
+		about     string
+		sortQuery string
+		results   []storetesting.SearchEntity
+	}{{
+		about:     "name descending",
+		sortQuery: "-name",
+		results: []storetesting.SearchEntity{
+			storetesting.SearchEntities["wordpress-simple"],
+			storetesting.SearchEntities["wordpress"],
+			storetesting.SearchEntities["varnish"],
+			storetesting.SearchEntities["squid-forwardproxy"],
+			storetesting.SearchEntities["mysql"],
+			storetesting.SearchEntities["multi-series"],
+			storetesting.SearchEntities["cloud-controller-worker-v2"],
+		},
+	}, {
+		about:     "series descending",
+		sortQuery: "-series,name",
+		results: storetesting.SortBySeries([]storetesting.SearchEntity{
+			storetesting.SearchEntities["cloud-controller-worker-v2"],
+			storetesting.SearchEntities["multi-series"],
+			storetesting.SearchEntities["mysql"],
+			storetesting.SearchEntities["squid-forwardproxy"],
+			storetesting.SearchEntities["varnish"],
+			storetesting.SearchEntities["wordpress"],
+			storetesting.SearchEntities["wordpress-simple"],
+		}, true),
+	}, {
+		about:     "owner ascending",
+		sortQuery: "owner,name",
+		results: []storetesting.SearchEntity{
+			storetesting.SearchEntities["cloud-controller-worker-v2"],
+			storetesting.SearchEntities["multi-series"],
+			storetesting.SearchEntities["squid-forwardproxy"],
+			storetesting.SearchEntities["wordpress"],
+			storetesting.SearchEntities["wordpress-simple"],
+			storetesting.SearchEntities["varnish"],
+			storetesting.SearchEntities["mysql"],
+		},
+	}, {
+		about:     "downloads descending",
+		sortQuery: "-downloads,name",
+		results: []storetesting.SearchEntity{
+			storetesting.SearchEntities["varnish"],
+			storetesting.SearchEntities["cloud-controller-worker-v2"],
+			storetesting.SearchEntities["mysql"],
+			storetesting.SearchEntities["squid-forwardproxy"],
+			storetesting.SearchEntities["wordpress-simple"],
+			storetesting.SearchEntities["multi-series"],
+			storetesting.SearchEntities["wordpress"],
+		},
+	}}
+	for i, test := range tests {
+		c.Logf("test %d. %s", i, test.about)
+		var sp SearchParams
+		err := sp.ParseSortFields(test.sortQuery)
+		c.Assert(err, gc.Equals, nil)
+		total, res := search(c, s.store, sp)
+		expected := make([]*mongodoc.Entity, len(test.results))
+		for i, r := range test.results {
+			expected[i] = s.entity(c, r)
+		}
+		c.Assert(Entities(res), jc.DeepEquals, Entities(expected))
+		c.Assert(total, gc.Equals, len(test.results))
+	}
+}
+
+func (s *embeddedSearchSuite) TestExpandedMultiSeries(c *gc.C) {
+	_, res := search(c, s.store, SearchParams{
+		Filters: map[string][]string{
+			"name": {"multi-series"},
+		},
+		ExpandedMultiSeries: true,
+	})
+	var series []string
+	for _, e := range res {
+		c.Assert(e.Name, gc.Equals, "multi-series")
+		series = append(series, e.URL.Series)
+	}
+	sort.Strings(series)
+	expect := append([]string(nil), storetesting.SearchSeries...)
+	sort.Strings(expect)
+	c.Assert(series, jc.DeepEquals, expect)
+}
+
+func (s *embeddedSearchSuite) TestLimit(c *gc.C) {
+	total, res := search(c, s.store, SearchParams{
+		Admin: true,
+		Limit: 3,
+		Skip:  2,
+	})
+	c.Assert(total, gc.Equals, 8)
+	c.Assert(Entities(res), jc.DeepEquals, Entities{
+		s.entity(c, storetesting.SearchEntities["wordpress"]),
+		s.entity(c, storetesting.SearchEntities["mysql"]),
+		s.entity(c, storetesting.SearchEntities["squid-forwardproxy"]),
+	})
+}
+
+func (s *embeddedSearchSuite) TestGetSearchDocument(c *gc.C) {
+	ent := storetesting.SearchEntities["mysql"]
+	doc, err := s.pool.embeddedSearch.GetSearchDocument(ent.URL)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(doc.URL, jc.DeepEquals, ent.URL)
+	c.Assert(doc.ReadACLs, jc.DeepEquals, ent.ACL)
+	c.Assert(doc.TotalDownloads, gc.Equals, int64(ent.Downloads))
+
+	_, err = s.pool.embeddedSearch.GetSearchDocument(charm.MustParseURL("~bob/" + storetesting.SearchSeries[0] + "/nothing-0"))
+	c.Assert(err, gc.ErrorMatches, `cannot retrieve search document for cs:~bob/.*/nothing-0: not found`)
+}
+
+func (s *embeddedSearchSuite) TestIndexPersists(c *gc.C) {
+	// Remove an entity from mongodb without updating the
+	// search index, so that we can tell that the index is
+	// not rebuilt when it is reopened.
+	ent := storetesting.SearchEntities["varnish"]
+	err := s.store.DB.Entities().RemoveId(ent.URL.String())
+	c.Assert(err, gc.Equals, nil)
+	s.reopen(c)
+
+	_, res := search(c, s.store, SearchParams{
+		Filters: map[string][]string{
+			"name": {"varnish"},
+		},
+	})
+	c.Assert(res, gc.HasLen, 1)
+	c.Assert(res[0].URL, jc.DeepEquals, ent.URL)
+}
+
+func (s *embeddedSearchSuite) TestIndexRebuiltOnVersionChange(c *gc.C) {
+	ent := storetesting.SearchEntities["varnish"]
+	err := s.store.DB.Entities().RemoveId(ent.URL.String())
+	c.Assert(err, gc.Equals, nil)
+	err = ioutil.WriteFile(filepath.Join(s.dir, embeddedSearchVersionFile), []byte("0"), 0600)
+	c.Assert(err, gc.Equals, nil)
+	s.reopen(c)
+
+	// The index has been rebuilt from mongodb, so the removed
+	// entity is no longer found but the others are.
+	total, _ := search(c, s.store, SearchParams{
+		Filters: map[string][]string{
+			"name": {"varnish"},
+		},
+	})
+	c.Assert(total, gc.Equals, 0)
+	total, _ = search(c, s.store, SearchParams{
+		Text: "wordpress",
+	})
+	c.Assert(total, gc.Equals, 2)
+}
+
+func (s *embeddedSearchSuite) TestIncompleteIndexRebuilt(c *gc.C) {
+	dir := filepath.Join(c.MkDir(), "search")
+	_, created, err := newEmbeddedSearchIndex(dir)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(created, gc.Equals, true)
+
+	// The index hasn't been marked as complete,
+	// so it's created again when it's reopened.
+	_, created, err = newEmbeddedSearchIndex(dir)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(created, gc.Equals, true)
+
+	si, _, err := newEmbeddedSearchIndex(dir)
+	c.Assert(err, gc.Equals, nil)
+	err = si.setComplete()
+	c.Assert(err, gc.Equals, nil)
+	_, created, err = newEmbeddedSearchIndex(dir)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(created, gc.Equals, false)
+}
+
+func (s *embeddedSearchSuite) TestNewPoolPopulatesIndex(c *gc.C) {
+	s.store.Close()
+	s.pool.Close()
+	s.store = nil
+	err := os.RemoveAll(s.dir)
+	c.Assert(err, gc.Equals, nil)
+
+	s.pool = s.newPool(c)
+	s.store = s.pool.Store()
+	total, _ := search(c, s.store, SearchParams{})
+	c.Assert(total, gc.Equals, 7)
+}
+
+func (s *embeddedSearchSuite) TestDeleteBaseEntityRemovesSearchDocuments(c *gc.C) {
+	entity := s.entity(c, storetesting.SearchEntities["multi-series"])
+	urls := []*charm.URL{entity.URL}
+	for _, series := range entity.SupportedSeries {
+		u := *entity.URL
+		u.Series = series
+		urls = append(urls, &u)
+	}
+	for _, u := range urls {
+		_, err := os.Stat(filepath.Join(s.dir, searchDocID(u)+embeddedSearchDocSuffix))
+		c.Assert(err, gc.Equals, nil, gc.Commentf("%v", u))
+	}
+
+	err := s.store.DeleteBaseEntity(entity.URL)
+	c.Assert(err, gc.Equals, nil)
+
+	for _, u := range urls {
+		_, err := os.Stat(filepath.Join(s.dir, searchDocID(u)+embeddedSearchDocSuffix))
+		c.Assert(os.IsNotExist(err), gc.Equals, true, gc.Commentf("%v", u))
+		_, err = s.pool.embeddedSearch.GetSearchDocument(u)
+		c.Assert(err, gc.ErrorMatches, `.*not found`)
+	}
+	total, _ := search(c, s.store, SearchParams{
+		Filters: map[string][]string{
+			"name": {"multi-series"},
+		},
+		ExpandedMultiSeries: true,
+	})
+	c.Assert(total, gc.Equals, 0)
+}
+
+func (s *embeddedSearchSuite) TestOnlyIndexStableCharms(c *gc.C) {
+	id := MustParseResolvedURL("~test/" + storetesting.SearchSeries[2] + "/test-0")
+	err := s.store.AddCharmWithArchive(id, storetesting.NewCharm(&charm.Meta{
+		Name: "test",
+	}))
+	c.Assert(err, gc.Equals, nil)
+	err = s.store.SetPerms(&id.URL, "stable.read", params.Everyone)
+	c.Assert(err, gc.Equals, nil)
+	err = s.store.Publish(id, nil, params.EdgeChannel)
+	c.Assert(err, gc.Equals, nil)
+	_, err = s.pool.embeddedSearch.GetSearchDocument(&id.URL)
+	c.Assert(err, gc.ErrorMatches, `.*not found`)
+
+	err = s.store.Publish(id, nil, params.StableChannel)
+	c.Assert(err, gc.Equals, nil)
+	doc, err := s.pool.embeddedSearch.GetSearchDocument(&id.URL)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(doc.URL, jc.DeepEquals, &id.URL)
+	_, res := search(c, s.store, SearchParams{
+		Text: "test",
+	})
+	c.Assert(res, gc.HasLen, 1)
+	c.Assert(res[0].URL, jc.DeepEquals, &id.URL)
+}
+
+var embeddedTermsTests = []struct {
+	about  string
+	f      func(string) []string
+	text   string
+	expect []string
+}{{
+	about:  "simple",
+	f:      simpleTerms,
+	text:   "Squid-forwardproxy2 x",
+	expect: []string{"squid", "forwardproxy", "x"},
+}, {
+	about:  "standard",
+	f:      standardTerms,
+	text:   "A Database-engine, v2.",
+	expect: []string{"a", "database", "engine", "v2"},
+}, {
+	about:  "lowercase words",
+	f:      lowercaseWords,
+	text:   " Squid-F  wordPRESS ",
+	expect: []string{"squid-f", "wordpress"},
+}}
+
+func (s *embeddedSearchSuite) TestTerms(c *gc.C) {
+	for i, test := range embeddedTermsTests {
+		c.Logf("test %d: %s", i, test.about)
+		c.Assert(test.f(test.text), jc.DeepEquals, test.expect)
+	}
+	c.Assert(ngrams("abcde", 3, 4), jc.DeepEquals, []string{"abc", "abcd", "bcd", "bcde", "cde"})
+}
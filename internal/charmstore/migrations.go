@@ -31,6 +31,7 @@ const (
 	migrationCandidateBetaChannels   mongodoc.MigrationName = "populate candidate and beta channel ACLs"
 	migrationRevisionsCollection     mongodoc.MigrationName = "populate revisions collection"
 	migrationBlobRefs                mongodoc.MigrationName = "populate blobref table"
+	migrationQuotaUsage              mongodoc.MigrationName = "populate quota usage"
 )
 
 // migrations holds all the migration functions that are executed in the order
@@ -87,6 +88,9 @@ var migrations = []migration{{
 }, {
 	name:    migrationBlobRefs,
 	migrate: migrateBlobRefs,
+}, {
+	name:    migrationQuotaUsage,
+	migrate: migrateQuotaUsage,
 }}
 
 // migration holds a migration function with its corresponding name.
@@ -215,6 +219,48 @@ func migrateRevisionsCollection(db StoreDatabase) error {
 	return nil
 }
 
+// migrateQuotaUsage populates the quotas collection with the
+// storage currently used by each namespace.
+func migrateQuotaUsage(db StoreDatabase) error {
+	usage := make(map[string]*mongodoc.Quota)
+	add := func(namespace string, size int64) {
+		q := usage[namespace]
+		if q == nil {
+			q = &mongodoc.Quota{Namespace: namespace}
+			usage[namespace] = q
+		}
+		q.Bytes += size
+		q.Revisions++
+	}
+	var entity mongodoc.Entity
+	iter := db.Entities().Find(nil).Select(bson.D{{"user", 1}, {"size", 1}}).Iter()
+	for iter.Next(&entity) {
+		add(entity.User, entity.Size)
+	}
+	if err := iter.Err(); err != nil {
+		return errgo.Notef(err, "could not iterate through all entities")
+	}
+	var resource mongodoc.Resource
+	iter = db.Resources().Find(nil).Select(bson.D{{"baseurl", 1}, {"size", 1}}).Iter()
+	for iter.Next(&resource) {
+		add(resource.BaseURL.User, resource.Size)
+	}
+	if err := iter.Err(); err != nil {
+		return errgo.Notef(err, "could not iterate through all resources")
+	}
+	for _, q := range usage {
+		if _, err := db.Quotas().UpsertId(q.Namespace, bson.D{{
+			"$set", bson.D{
+				{"bytes", q.Bytes},
+				{"revisions", q.Revisions},
+			},
+		}}); err != nil {
+			return errgo.Notef(err, "cannot update quota usage for %q", q.Namespace)
+		}
+	}
+	return nil
+}
+
 // blobRefDoc holds a mapping from blob hash to
 // backend blob name.
 // This is duplicated from internal/blobstore.
@@ -262,8 +308,14 @@ func migrateBlobRefs(db StoreDatabase) error {
 	return nil
 }
 
+// legacyEntity holds the fields of an entity document that are used by
+// updatePreV5BlobExtraHashes. Note that it can't embed mongodoc.Entity,
+// because the entity's SetBSON method would then hide the BlobName
+// field.
 type legacyEntity struct {
-	mongodoc.Entity `bson:",inline"`
+	URL           *charm.URL `bson:"_id"`
+	BlobHash      string
+	PreV5BlobHash string
 
 	// BlobName holds the name that the archive blob is given in the blob store.
 	// For multi-series charms, there is also a second blob which
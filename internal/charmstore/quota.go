@@ -0,0 +1,158 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package charmstore // import "gopkg.in/juju/charmstore.v5/internal/charmstore"
+
+import (
+	"gopkg.in/errgo.v1"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+
+	"gopkg.in/juju/charmstore.v5/internal/mongodoc"
+	"gopkg.in/juju/charmstore.v5/internal/router"
+)
+
+// maxQuotaChargeAttempts holds the maximum number of times that
+// chargeQuota will try to update the usage of a namespace when
+// racing with concurrent uploads to the same namespace.
+const maxQuotaChargeAttempts = 10
+
+// Quota returns the storage quota and current usage of the given
+// namespace (a user or group name). If no quota has been set and
+// nothing has been stored in the namespace, it returns a quota with
+// no limits and no usage.
+func (s *Store) Quota(namespace string) (*mongodoc.Quota, error) {
+	var q mongodoc.Quota
+	if err := s.DB.Quotas().FindId(namespace).One(&q); err != nil {
+		if err != mgo.ErrNotFound {
+			return nil, errgo.Notef(err, "cannot get quota for %q", namespace)
+		}
+		q.Namespace = namespace
+	}
+	return &q, nil
+}
+
+// SetQuota sets the limits of the storage quota of the given
+// namespace. A zero limit means that there is no limit. Setting a
+// limit below the current usage does not remove anything, but
+// prevents any further uploads to the namespace.
+func (s *Store) SetQuota(namespace string, maxBytes int64, maxRevisions int) error {
+	if maxBytes < 0 || maxRevisions < 0 {
+		return errgo.Newf("negative quota limit")
+	}
+	if _, err := s.DB.Quotas().UpsertId(namespace, bson.D{{
+		"$set", bson.D{
+			{"maxbytes", maxBytes},
+			{"maxrevisions", maxRevisions},
+		},
+	}}); err != nil {
+		return errgo.Notef(err, "cannot set quota for %q", namespace)
+	}
+	return nil
+}
+
+// chargeQuota records that a new revision holding the given number
+// of bytes is being added to the given namespace. If that would take
+// the namespace over its quota, it returns an error with a
+// router.ErrQuotaExceeded cause and nothing is recorded.
+//
+// If the revision is not subsequently added, the charge should
+// be undone by calling releaseQuota.
+func (s *Store) chargeQuota(namespace string, size int64) error {
+	inc := bson.D{{
+		"$inc", bson.D{
+			{"bytes", size},
+			{"revisions", 1},
+		},
+	}}
+	for i := 0; i < maxQuotaChargeAttempts; i++ {
+		q, err := s.Quota(namespace)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		if q.MaxBytes == 0 && q.MaxRevisions == 0 {
+			// There's no limit, so we can update
+			// the usage unconditionally.
+			if _, err := s.DB.Quotas().UpsertId(namespace, inc); err != nil {
+				return errgo.Notef(err, "cannot update quota usage for %q", namespace)
+			}
+			return nil
+		}
+		query := bson.D{
+			{"_id", namespace},
+			{"maxbytes", q.MaxBytes},
+			{"maxrevisions", q.MaxRevisions},
+		}
+		if q.MaxBytes > 0 {
+			if q.Bytes+size > q.MaxBytes {
+				return errgo.WithCausef(nil, router.ErrQuotaExceeded, "storage quota for %q exceeded (%d of %d bytes used, %d more needed)", namespace, q.Bytes, q.MaxBytes, size)
+			}
+			query = append(query, bson.DocElem{"bytes", bson.D{{"$lte", q.MaxBytes - size}}})
+		}
+		if q.MaxRevisions > 0 {
+			if q.Revisions >= q.MaxRevisions {
+				return errgo.WithCausef(nil, router.ErrQuotaExceeded, "revision quota for %q exceeded (%d of %d revisions used)", namespace, q.Revisions, q.MaxRevisions)
+			}
+			query = append(query, bson.DocElem{"revisions", bson.D{{"$lt", q.MaxRevisions}}})
+		}
+		err = s.DB.Quotas().Update(query, inc)
+		if err == nil {
+			return nil
+		}
+		if err != mgo.ErrNotFound {
+			return errgo.Notef(err, "cannot update quota usage for %q", namespace)
+		}
+		// The quota or usage has changed since we read it,
+		// so try again.
+	}
+	return errgo.Newf("cannot update quota usage for %q: too many concurrent updates", namespace)
+}
+
+// releaseQuota records that a revision holding the given number of
+// bytes has been removed from the given namespace, or that a charge
+// made by chargeQuota is no longer needed.
+func (s *Store) releaseQuota(namespace string, size int64) error {
+	err := s.DB.Quotas().UpdateId(namespace, bson.D{{
+		"$inc", bson.D{
+			{"bytes", -size},
+			{"revisions", -1},
+		},
+	}})
+	if err != nil && err != mgo.ErrNotFound {
+		return errgo.Notef(err, "cannot update quota usage for %q", namespace)
+	}
+	return nil
+}
+
+// moveQuotaUsage records that revisions holding the given total
+// number of bytes have been moved from one namespace to another. The
+// quota of the destination namespace is not checked.
+func (s *Store) moveQuotaUsage(from, to string, bytes int64, revisions int) error {
+	for _, u := range []struct {
+		namespace string
+		sign      int
+	}{{from, -1}, {to, 1}} {
+		_, err := s.DB.Quotas().UpsertId(u.namespace, bson.D{{
+			"$inc", bson.D{
+				{"bytes", int64(u.sign) * bytes},
+				{"revisions", u.sign * revisions},
+			},
+		}})
+		if err != nil {
+			return errgo.Notef(err, "cannot update quota usage for %q", u.namespace)
+		}
+	}
+	return nil
+}
+
+// releaseQuotaOnError calls releaseQuota if *err is non-nil.
+// It is designed to be deferred after a successful call
+// to chargeQuota.
+func (s *Store) releaseQuotaOnError(namespace string, size int64, err *error) {
+	if *err == nil {
+		return
+	}
+	if releaseErr := s.releaseQuota(namespace, size); releaseErr != nil {
+		logger.Errorf("cannot release quota charge: %v", releaseErr)
+	}
+}
@@ -0,0 +1,170 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package charmstore
+
+import (
+	"strings"
+
+	"github.com/juju/charmrepo/v6/csclient/params"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+	"gopkg.in/errgo.v1"
+
+	"gopkg.in/juju/charmstore.v5/internal/charm"
+	"gopkg.in/juju/charmstore.v5/internal/mongodoc"
+	"gopkg.in/juju/charmstore.v5/internal/router"
+	"gopkg.in/juju/charmstore.v5/internal/storetesting"
+)
+
+type quotaSuite struct {
+	commonSuite
+}
+
+var _ = gc.Suite(&quotaSuite{})
+
+func (s *quotaSuite) TestQuotaNotSet(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+	q, err := store.Quota("bob")
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(q, jc.DeepEquals, &mongodoc.Quota{
+		Namespace: "bob",
+	})
+}
+
+func (s *quotaSuite) TestSetQuota(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+	err := store.SetQuota("bob", 1000, 10)
+	c.Assert(err, gc.Equals, nil)
+	q, err := store.Quota("bob")
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(q, jc.DeepEquals, &mongodoc.Quota{
+		Namespace:    "bob",
+		MaxBytes:     1000,
+		MaxRevisions: 10,
+	})
+
+	err = store.SetQuota("bob", -1, 10)
+	c.Assert(err, gc.ErrorMatches, `negative quota limit`)
+}
+
+func (s *quotaSuite) TestUsageTracked(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+
+	id0 := MustParseResolvedURL("cs:~bob/precise/wordpress-0")
+	meta := storetesting.MetaWithResources(nil, "someResource")
+	err := store.AddCharmWithArchive(id0, storetesting.NewCharm(meta))
+	c.Assert(err, gc.Equals, nil)
+	e0, err := store.FindEntity(id0, FieldSelector("size"))
+	c.Assert(err, gc.Equals, nil)
+	s.assertUsage(c, store, "bob", e0.Size, 1)
+
+	id1 := MustParseResolvedURL("cs:~bob/precise/wordpress-1")
+	err = store.AddCharmWithArchive(id1, storetesting.NewCharm(meta))
+	c.Assert(err, gc.Equals, nil)
+	e1, err := store.FindEntity(id1, FieldSelector("size"))
+	c.Assert(err, gc.Equals, nil)
+	s.assertUsage(c, store, "bob", e0.Size+e1.Size, 2)
+
+	blob := "content 1"
+	_, err = store.UploadResource(id0, "someResource", -1, strings.NewReader(blob), hashOfString(blob), int64(len(blob)))
+	c.Assert(err, gc.Equals, nil)
+	blob = "content 22"
+	_, err = store.UploadResource(id0, "someResource", -1, strings.NewReader(blob), hashOfString(blob), int64(len(blob)))
+	c.Assert(err, gc.Equals, nil)
+	s.assertUsage(c, store, "bob", e0.Size+e1.Size+19, 4)
+
+	// Other namespaces are not affected.
+	s.assertUsage(c, store, "alice", 0, 0)
+
+	err = store.DeleteResource(id0, mongodoc.ResourceRevision{
+		Name:     "someResource",
+		Revision: 0,
+	})
+	c.Assert(err, gc.Equals, nil)
+	s.assertUsage(c, store, "bob", e0.Size+e1.Size+10, 3)
+
+	err = store.DeleteEntity(id0)
+	c.Assert(err, gc.Equals, nil)
+	s.assertUsage(c, store, "bob", e1.Size+10, 2)
+}
+
+func (s *quotaSuite) TestBytesQuotaExceeded(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+
+	id := MustParseResolvedURL("cs:~bob/precise/wordpress-0")
+	meta := storetesting.MetaWithResources(nil, "someResource")
+	err := store.AddCharmWithArchive(id, storetesting.NewCharm(meta))
+	c.Assert(err, gc.Equals, nil)
+	e, err := store.FindEntity(id, FieldSelector("size"))
+	c.Assert(err, gc.Equals, nil)
+
+	err = store.SetQuota("bob", e.Size+10, 0)
+	c.Assert(err, gc.Equals, nil)
+
+	blob := "0123456789"
+	_, err = store.UploadResource(id, "someResource", -1, strings.NewReader(blob), hashOfString(blob), int64(len(blob)))
+	c.Assert(err, gc.Equals, nil)
+
+	blob = "x"
+	_, err = store.UploadResource(id, "someResource", -1, strings.NewReader(blob), hashOfString(blob), int64(len(blob)))
+	c.Assert(err, gc.ErrorMatches, `storage quota for "bob" exceeded \(\d+ of \d+ bytes used, 1 more needed\)`)
+	c.Assert(errgo.Cause(err), gc.Equals, router.ErrQuotaExceeded)
+	s.assertUsage(c, store, "bob", e.Size+10, 2)
+
+	err = store.AddCharmWithArchive(MustParseResolvedURL("cs:~bob/precise/wordpress-1"), storetesting.NewCharm(meta))
+	c.Assert(errgo.Cause(err), gc.Equals, router.ErrQuotaExceeded)
+	s.assertUsage(c, store, "bob", e.Size+10, 2)
+}
+
+func (s *quotaSuite) TestRevisionQuotaExceeded(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+	err := store.SetQuota("bob", 0, 1)
+	c.Assert(err, gc.Equals, nil)
+
+	err = store.AddCharmWithArchive(MustParseResolvedURL("cs:~bob/precise/wordpress-0"), storetesting.NewCharm(nil))
+	c.Assert(err, gc.Equals, nil)
+	err = store.AddCharmWithArchive(MustParseResolvedURL("cs:~bob/precise/wordpress-1"), storetesting.NewCharm(&charm.Meta{
+		Summary: "another",
+	}))
+	c.Assert(err, gc.ErrorMatches, `revision quota for "bob" exceeded \(1 of 1 revisions used\)`)
+	c.Assert(errgo.Cause(err), gc.Equals, router.ErrQuotaExceeded)
+
+	// Other namespaces are not affected.
+	err = store.AddCharmWithArchive(MustParseResolvedURL("cs:~alice/precise/wordpress-0"), storetesting.NewCharm(nil))
+	c.Assert(err, gc.Equals, nil)
+}
+
+func (s *quotaSuite) TestChargeReleasedOnFailure(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+
+	id := MustParseResolvedURL("cs:~bob/precise/wordpress-0")
+	meta := storetesting.MetaWithResources(nil, "someResource")
+	err := store.AddCharmWithArchive(id, storetesting.NewCharm(meta))
+	c.Assert(err, gc.Equals, nil)
+	e, err := store.FindEntity(id, FieldSelector("size"))
+	c.Assert(err, gc.Equals, nil)
+
+	blob := "content"
+	_, err = store.UploadResource(id, "someResource", -1, strings.NewReader(blob), hashOfString("other"), int64(len(blob)))
+	c.Assert(err, gc.NotNil)
+	s.assertUsage(c, store, "bob", e.Size, 1)
+
+	// Uploading a duplicate entity does not count.
+	err = store.AddCharmWithArchive(id, storetesting.NewCharm(meta))
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrDuplicateUpload)
+	s.assertUsage(c, store, "bob", e.Size, 1)
+}
+
+func (s *quotaSuite) assertUsage(c *gc.C, store *Store, namespace string, bytes int64, revisions int) {
+	q, err := store.Quota(namespace)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(q.Bytes, gc.Equals, bytes)
+	c.Assert(q.Revisions, gc.Equals, revisions)
+}
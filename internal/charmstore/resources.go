@@ -201,7 +201,9 @@ func (s *Store) DeleteResource(id *router.ResolvedURL, rev mongodoc.ResourceRevi
 		}
 		return errgo.Mask(err, errgo.Is(params.ErrNotFound))
 	}
-
+	if err := s.releaseQuota(id.URL.User, res.Size); err != nil {
+		logger.Errorf("cannot release quota for deleted resource: %v", err)
+	}
 	return nil
 }
 
@@ -212,7 +214,10 @@ func (s *Store) DeleteResource(id *router.ResolvedURL, rev mongodoc.ResourceRevi
 // TODO consider restricting uploads so that if the hash matches the
 // latest revision then a new revision isn't created. This would match
 // the behaviour for charms and bundles.
-func (s *Store) UploadResource(id *router.ResolvedURL, name string, revision int, blob io.Reader, blobHash string, size int64) (*mongodoc.Resource, error) {
+//
+// If the new resource would exceed the quota of the entity's owner,
+// an error with a router.ErrQuotaExceeded cause is returned.
+func (s *Store) UploadResource(id *router.ResolvedURL, name string, revision int, blob io.Reader, blobHash string, size int64) (_ *mongodoc.Resource, err error) {
 	entity, err := s.FindEntity(id, FieldSelector("charmmeta", "baseurl"))
 	if err != nil {
 		return nil, errgo.Mask(err, errgo.Is(params.ErrNotFound))
@@ -220,6 +225,10 @@ func (s *Store) UploadResource(id *router.ResolvedURL, name string, revision int
 	if !charmHasResource(entity.CharmMeta, name) {
 		return nil, errgo.Newf("charm does not have resource %q", name)
 	}
+	if err := s.chargeQuota(id.URL.User, size); err != nil {
+		return nil, errgo.Mask(err, errgo.Is(router.ErrQuotaExceeded))
+	}
+	defer s.releaseQuotaOnError(id.URL.User, size, &err)
 	if _, err := s.putArchive(blob, size, blobHash); err != nil {
 		return nil, errgo.Mask(err)
 	}
@@ -239,7 +248,7 @@ func (s *Store) UploadResource(id *router.ResolvedURL, name string, revision int
 
 // AddResourceWithUploadId is like UploadResource except that it associates
 // the resource with an already-uploaded multipart upload.
-func (s *Store) AddResourceWithUploadId(id *router.ResolvedURL, name string, revision int, uploadId string) (*mongodoc.Resource, error) {
+func (s *Store) AddResourceWithUploadId(id *router.ResolvedURL, name string, revision int, uploadId string) (_ *mongodoc.Resource, err error) {
 	entity, err := s.FindEntity(id, FieldSelector("charmmeta", "baseurl"))
 	if err != nil {
 		return nil, errgo.Mask(err, errgo.Is(params.ErrNotFound))
@@ -259,6 +268,10 @@ func (s *Store) AddResourceWithUploadId(id *router.ResolvedURL, name string, rev
 	if !ok {
 		return nil, errgo.Newf("upload not completed yet")
 	}
+	if err := s.chargeQuota(id.URL.User, size); err != nil {
+		return nil, errgo.Mask(err, errgo.Is(router.ErrQuotaExceeded))
+	}
+	defer s.releaseQuotaOnError(id.URL.User, size, &err)
 	res, err := s.addResource(&mongodoc.Resource{
 		BaseURL:    entity.BaseURL,
 		Name:       name,
@@ -281,7 +294,7 @@ func (s *Store) AddResourceWithUploadId(id *router.ResolvedURL, name string, rev
 //
 // If revision is -1 the revision of the new resource will be calculated
 // to be one higher than any existing resources.
-func (s *Store) AddDockerResource(id *router.ResolvedURL, resourceName string, revision int, imageName, digest string) (*mongodoc.Resource, error) {
+func (s *Store) AddDockerResource(id *router.ResolvedURL, resourceName string, revision int, imageName, digest string) (_ *mongodoc.Resource, err error) {
 	entity, err := s.FindEntity(id, FieldSelector("charmmeta", "baseurl"))
 	if err != nil {
 		return nil, errgo.Mask(err, errgo.Is(params.ErrNotFound))
@@ -292,6 +305,12 @@ func (s *Store) AddDockerResource(id *router.ResolvedURL, resourceName string, r
 	if !charmHasDockerResource(entity.CharmMeta, resourceName) {
 		return nil, errgo.Newf("%q does not have image resource %q", id, resourceName)
 	}
+	// Docker images are not held in the blob store, but
+	// they still count towards the revision quota.
+	if err := s.chargeQuota(id.URL.User, 0); err != nil {
+		return nil, errgo.Mask(err, errgo.Is(router.ErrQuotaExceeded))
+	}
+	defer s.releaseQuotaOnError(id.URL.User, 0, &err)
 	res, err := s.addResource(&mongodoc.Resource{
 		BaseURL:           entity.BaseURL,
 		Name:              resourceName,
@@ -425,6 +444,7 @@ func (s *Store) OpenResourceBlob(res *mongodoc.Resource) (*Blob, error) {
 		ReadSeekCloser: r,
 		Size:           size,
 		Hash:           res.BlobHash,
+		ModTime:        res.UploadTime,
 	}, nil
 }
 
@@ -0,0 +1,141 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package charmstore // import "gopkg.in/juju/charmstore.v5/internal/charmstore"
+
+import (
+	"time"
+
+	"github.com/juju/charmrepo/v6/csclient/params"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+
+	"gopkg.in/juju/charmstore.v5/internal/charm"
+	"gopkg.in/juju/charmstore.v5/internal/mongodoc"
+	"gopkg.in/juju/charmstore.v5/internal/router"
+)
+
+// SetRetentionPolicy sets the retention policy of the charm or bundle
+// with the given URL. If p is nil, the retention policy is removed.
+func (s *Store) SetRetentionPolicy(url *charm.URL, p *mongodoc.RetentionPolicy) error {
+	var update bson.D
+	if p == nil {
+		update = bson.D{{"$unset", bson.D{{"retentionpolicy", nil}}}}
+	} else {
+		update = bson.D{{"$set", bson.D{{"retentionpolicy", p}}}}
+	}
+	if err := s.DB.BaseEntities().UpdateId(mongodoc.BaseURL(url), update); err != nil {
+		if errgo.Cause(err) == mgo.ErrNotFound {
+			return errgo.WithCausef(nil, params.ErrNotFound, "base entity not found")
+		}
+		return errgo.Notef(err, "cannot set retention policy")
+	}
+	return nil
+}
+
+// ExpiredRevisions returns the revisions of the charm or bundle with
+// the given URL that its retention policy allows to be deleted at the
+// given time, most recently uploaded first. The last remaining
+// revision is never included, so the result holds exactly the
+// revisions that ApplyRetentionPolicies would delete.
+//
+// If the charm or bundle has no retention policy, it returns no
+// revisions.
+func (s *Store) ExpiredRevisions(url *charm.URL, now time.Time) ([]*router.ResolvedURL, error) {
+	baseEntity, err := s.FindBaseEntity(url, FieldSelector("channelentities", "retentionpolicy"))
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	policy := baseEntity.RetentionPolicy
+	if policy == nil {
+		return nil, nil
+	}
+	current := make(map[charm.URL]bool)
+	for _, ids := range baseEntity.ChannelEntities {
+		for _, id := range ids {
+			current[*id] = true
+		}
+	}
+	var entities []*mongodoc.Entity
+	if err := s.DB.Entities().
+		Find(bson.D{{"baseurl", baseEntity.URL}}).
+		Select(FieldSelector("promulgated-revision", "published", "uploadtime")).
+		Sort("-uploadtime", "-_id").
+		All(&entities); err != nil {
+		return nil, errgo.Notef(err, "cannot get revisions of %q", baseEntity.URL)
+	}
+	var expired []*router.ResolvedURL
+	n := 0
+	for _, e := range entities {
+		if publishedStable(e) || current[*e.URL] {
+			continue
+		}
+		n++
+		if n <= policy.KeepUnpublished {
+			continue
+		}
+		if policy.KeepFor > 0 && e.UploadTime.After(now.Add(-policy.KeepFor)) {
+			continue
+		}
+		expired = append(expired, &router.ResolvedURL{
+			URL:                 *e.URL,
+			PromulgatedRevision: e.PromulgatedRevision,
+		})
+	}
+	if len(expired) == len(entities) && len(expired) > 0 {
+		// DeleteEntity refuses to delete the last revision,
+		// so keep the most recent one.
+		expired = expired[1:]
+	}
+	return expired, nil
+}
+
+// ApplyRetentionPolicies deletes all the revisions that the retention
+// policies of all charms and bundles allow to be deleted at the given
+// time. The revisions are deleted with DeleteEntity, so they can be
+// restored until they are purged. It returns the number of revisions
+// deleted.
+func (s *Store) ApplyRetentionPolicies(now time.Time) (int, error) {
+	iter := s.DB.BaseEntities().
+		Find(bson.D{{"retentionpolicy", bson.D{{"$exists", true}}}}).
+		Select(FieldSelector("_id")).
+		Iter()
+	n := 0
+	var baseEntity mongodoc.BaseEntity
+	for iter.Next(&baseEntity) {
+		expired, err := s.ExpiredRevisions(baseEntity.URL, now)
+		if err != nil {
+			if errgo.Cause(err) != params.ErrNotFound {
+				logger.Errorf("cannot apply retention policy of %q: %v", baseEntity.URL, err)
+			}
+			continue
+		}
+		for _, id := range expired {
+			if err := s.DeleteEntity(id); err != nil {
+				// The entity may have been published or deleted
+				// since we looked, which is fine.
+				if cause := errgo.Cause(err); cause != params.ErrForbidden && cause != params.ErrNotFound {
+					logger.Errorf("cannot delete %q: %v", &id.URL, err)
+				}
+				continue
+			}
+			n++
+		}
+	}
+	if err := iter.Close(); err != nil {
+		return n, errgo.Notef(err, "cannot iterate base entities")
+	}
+	return n, nil
+}
+
+// publishedStable reports whether the given entity has ever been
+// published to the stable channel of any track.
+func publishedStable(e *mongodoc.Entity) bool {
+	for ch, published := range e.Published {
+		if _, risk := ChannelTrack(ch); published && risk == params.StableChannel {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,172 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package charmstore
+
+import (
+	"time"
+
+	"github.com/juju/charmrepo/v6/csclient/params"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/mgo.v2/bson"
+
+	"gopkg.in/juju/charmstore.v5/internal/charm"
+	"gopkg.in/juju/charmstore.v5/internal/mongodoc"
+	"gopkg.in/juju/charmstore.v5/internal/router"
+	"gopkg.in/juju/charmstore.v5/internal/storetesting"
+)
+
+type retentionSuite struct {
+	commonSuite
+}
+
+var _ = gc.Suite(&retentionSuite{})
+
+// addPublishedRevisions adds revisions 0 to 4 of ~bob/wordpress,
+// uploaded an hour apart starting at testEpoch. Revisions 0 and 1 have
+// been published to the stable channel, and revision 3 to the edge
+// channel.
+func (s *retentionSuite) addPublishedRevisions(c *gc.C, store *Store) []*router.ResolvedURL {
+	ids := s.addRevisions(c, store, 5)
+	for i, id := range ids {
+		err := store.DB.Entities().UpdateId(&id.URL, bson.D{{
+			"$set", bson.D{{"uploadtime", testEpoch.Add(time.Duration(i) * time.Hour)}},
+		}})
+		c.Assert(err, gc.Equals, nil)
+	}
+	for _, p := range []struct {
+		rev int
+		ch  params.Channel
+	}{{0, params.StableChannel}, {1, params.StableChannel}, {3, params.EdgeChannel}} {
+		err := store.Publish(ids[p.rev], nil, p.ch)
+		c.Assert(err, gc.Equals, nil)
+	}
+	return ids
+}
+
+var expiredRevisionsTests = []struct {
+	about  string
+	policy *mongodoc.RetentionPolicy
+	expect []int
+}{{
+	about: "no policy",
+}, {
+	about: "keep one unpublished revision",
+	policy: &mongodoc.RetentionPolicy{
+		KeepUnpublished: 1,
+	},
+	expect: []int{2},
+}, {
+	about: "keep two unpublished revisions",
+	policy: &mongodoc.RetentionPolicy{
+		KeepUnpublished: 2,
+	},
+}, {
+	about: "keep recent revisions",
+	policy: &mongodoc.RetentionPolicy{
+		KeepFor: 3 * time.Hour,
+	},
+	expect: []int{2},
+}, {
+	about: "keep all recent revisions",
+	policy: &mongodoc.RetentionPolicy{
+		KeepFor: 5 * time.Hour,
+	},
+}, {
+	about: "keep nothing",
+	policy: &mongodoc.RetentionPolicy{
+		KeepFor: time.Nanosecond,
+	},
+	expect: []int{4, 2},
+}}
+
+func (s *retentionSuite) TestExpiredRevisions(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+	ids := s.addPublishedRevisions(c, store)
+	now := testEpoch.Add(6 * time.Hour)
+	for i, test := range expiredRevisionsTests {
+		c.Logf("test %d: %s", i, test.about)
+		err := store.SetRetentionPolicy(&ids[0].URL, test.policy)
+		c.Assert(err, gc.Equals, nil)
+		expired, err := store.ExpiredRevisions(&ids[0].URL, now)
+		c.Assert(err, gc.Equals, nil)
+		var expect []*router.ResolvedURL
+		for _, rev := range test.expect {
+			expect = append(expect, ids[rev])
+		}
+		c.Assert(expired, jc.DeepEquals, expect)
+	}
+}
+
+func (s *retentionSuite) TestExpiredRevisionsKeepsLastRevision(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+	id := MustParseResolvedURL("~bob/" + storetesting.SearchSeries[0] + "/wordpress-0")
+	err := store.AddCharmWithArchive(id, storetesting.NewCharm(nil))
+	c.Assert(err, gc.Equals, nil)
+	err = store.SetRetentionPolicy(&id.URL, &mongodoc.RetentionPolicy{
+		KeepFor: time.Nanosecond,
+	})
+	c.Assert(err, gc.Equals, nil)
+	expired, err := store.ExpiredRevisions(&id.URL, time.Now().Add(time.Hour))
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(expired, gc.HasLen, 0)
+}
+
+func (s *retentionSuite) TestExpiredRevisionsNotFound(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+	_, err := store.ExpiredRevisions(charm.MustParseURL("~bob/wordpress"), time.Now())
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+	err = store.SetRetentionPolicy(charm.MustParseURL("~bob/wordpress"), nil)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+}
+
+func (s *retentionSuite) TestApplyRetentionPolicies(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+	ids := s.addPublishedRevisions(c, store)
+
+	// A charm without a retention policy is not affected.
+	other := MustParseResolvedURL("~bob/" + storetesting.SearchSeries[0] + "/mysql-0")
+	err := store.AddCharmWithArchive(other, storetesting.NewCharm(nil))
+	c.Assert(err, gc.Equals, nil)
+	other1 := MustParseResolvedURL("~bob/" + storetesting.SearchSeries[0] + "/mysql-1")
+	err = store.AddCharmWithArchive(other1, storetesting.NewCharm(nil))
+	c.Assert(err, gc.Equals, nil)
+
+	err = store.SetRetentionPolicy(&ids[0].URL, &mongodoc.RetentionPolicy{
+		KeepUnpublished: 1,
+	})
+	c.Assert(err, gc.Equals, nil)
+	n, err := store.ApplyRetentionPolicies(time.Now())
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(n, gc.Equals, 1)
+
+	for i, id := range ids {
+		_, err := store.FindEntity(id, nil)
+		if i == 2 {
+			c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+		} else {
+			c.Assert(err, gc.Equals, nil, gc.Commentf("revision %d", i))
+		}
+	}
+	for _, id := range []*router.ResolvedURL{other, other1} {
+		_, err := store.FindEntity(id, nil)
+		c.Assert(err, gc.Equals, nil)
+	}
+
+	// The deleted revision can be restored.
+	docs, err := store.DeletedEntities(mongodoc.BaseURL(&ids[0].URL))
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(docs, gc.HasLen, 1)
+	c.Assert(docs[0].URL, jc.DeepEquals, &ids[2].URL)
+
+	// Applying the policies again does nothing.
+	n, err = store.ApplyRetentionPolicies(time.Now())
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(n, gc.Equals, 0)
+}
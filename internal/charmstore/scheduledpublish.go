@@ -0,0 +1,275 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package charmstore // import "gopkg.in/juju/charmstore.v5/internal/charmstore"
+
+import (
+	"sort"
+	"time"
+
+	"github.com/juju/charmrepo/v6/csclient/params"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	tomb "gopkg.in/tomb.v2"
+
+	"gopkg.in/juju/charmstore.v5/audit"
+	"gopkg.in/juju/charmstore.v5/internal/charm"
+	"gopkg.in/juju/charmstore.v5/internal/mongodoc"
+	"gopkg.in/juju/charmstore.v5/internal/router"
+)
+
+var scheduledPublishInterval = time.Minute
+
+// SchedulePublish schedules the entity with the given id to be
+// published by the given user to the given channels, with the given
+// resources, at the given time. The publication is checked as it would
+// be by Publish, so that a publication that could never succeed is
+// rejected now rather than when it becomes due.
+//
+// If the given resources do not match those expected by the entity, it
+// returns an error with an ErrPublishResourceMismatch cause.
+func (s *Store) SchedulePublish(user string, id *router.ResolvedURL, resources map[string]int, channels []params.Channel, t time.Time) (*mongodoc.ScheduledPublish, error) {
+	docs, err := s.ScheduleStagedPublish(user, id, resources, []ScheduleStage{{
+		Channels: channels,
+		Time:     t,
+	}})
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(params.ErrNotFound), errgo.Is(ErrPublishResourceMismatch))
+	}
+	return docs[0], nil
+}
+
+// ScheduleStage holds one stage of a publication scheduled
+// with ScheduleStagedPublish.
+type ScheduleStage struct {
+	// Channels holds the channels to publish to.
+	Channels []params.Channel
+
+	// Time holds the time at which to publish.
+	Time time.Time
+}
+
+// ScheduleStagedPublish schedules the entity with the given id to be
+// published by the given user, with the given resources, in each of
+// the given stages, and returns the scheduled publications in the same
+// order as the stages. Every stage is checked, as by SchedulePublish,
+// before any is scheduled, and if any of them cannot be scheduled,
+// none of them are.
+func (s *Store) ScheduleStagedPublish(user string, id *router.ResolvedURL, resources map[string]int, stages []ScheduleStage) ([]*mongodoc.ScheduledPublish, error) {
+	docs := make([]*mongodoc.ScheduledPublish, len(stages))
+	for i, stage := range stages {
+		doc, err := s.newScheduledPublish(user, id, resources, stage.Channels, stage.Time)
+		if err != nil {
+			return nil, errgo.Mask(err, errgo.Is(params.ErrNotFound), errgo.Is(ErrPublishResourceMismatch))
+		}
+		docs[i] = doc
+	}
+	for i, doc := range docs {
+		if err := s.DB.ScheduledPublishes().Insert(doc); err != nil {
+			// Remove the stages that have already been
+			// scheduled, so that none of them are made.
+			ids := make([]bson.ObjectId, i)
+			for j := range ids {
+				ids[j] = docs[j].Id
+			}
+			if _, err := s.DB.ScheduledPublishes().RemoveAll(bson.D{{"_id", bson.D{{"$in", ids}}}}); err != nil {
+				logger.Errorf("cannot remove partly scheduled publication of %q: %v", id, err)
+			}
+			return nil, errgo.Notef(err, "cannot add scheduled publication")
+		}
+	}
+	return docs, nil
+}
+
+// newScheduledPublish checks that the entity with the given id can be
+// published with the given resources to the given channels, and returns
+// a new scheduled publication document for it.
+func (s *Store) newScheduledPublish(user string, id *router.ResolvedURL, resources map[string]int, channels []params.Channel, t time.Time) (*mongodoc.ScheduledPublish, error) {
+	if len(channels) == 0 {
+		return nil, errgo.Newf("cannot schedule publication of %q: no channels provided", id)
+	}
+	canonChannels := make([]params.Channel, len(channels))
+	for i, c := range channels {
+		canon, err := ParseChannel(string(c))
+		if err != nil || canon == params.UnpublishedChannel {
+			return nil, errgo.Newf("cannot schedule publication of %q to %q channel", id, c)
+		}
+		canonChannels[i] = canon
+	}
+	entity, err := s.FindEntity(id, FieldSelector("charmmeta", "baseurl"))
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	if err := s.checkPublishedResources(entity, resources); err != nil {
+		return nil, errgo.WithCausef(err, ErrPublishResourceMismatch, "")
+	}
+	resourceDocs := make([]mongodoc.ResourceRevision, 0, len(resources))
+	for name, rev := range resources {
+		resourceDocs = append(resourceDocs, mongodoc.ResourceRevision{
+			Name:     name,
+			Revision: rev,
+		})
+	}
+	sort.Slice(resourceDocs, func(i, j int) bool {
+		return resourceDocs[i].Name < resourceDocs[j].Name
+	})
+	return &mongodoc.ScheduledPublish{
+		Id:        bson.NewObjectId(),
+		BaseURL:   entity.BaseURL,
+		URL:       entity.URL,
+		Channels:  canonChannels,
+		Resources: resourceDocs,
+		User:      user,
+		Time:      t,
+	}, nil
+}
+
+// ScheduledPublishes returns the pending scheduled publications of the
+// charm or bundle with the given URL, earliest first.
+func (s *Store) ScheduledPublishes(url *charm.URL) ([]*mongodoc.ScheduledPublish, error) {
+	var docs []*mongodoc.ScheduledPublish
+	if err := s.DB.ScheduledPublishes().
+		Find(bson.D{{"baseurl", mongodoc.BaseURL(url)}}).
+		Sort("time", "_id").
+		All(&docs); err != nil {
+		return nil, errgo.Notef(err, "cannot get scheduled publications")
+	}
+	return docs, nil
+}
+
+// CancelScheduledPublish cancels the pending scheduled publication with
+// the given id of the charm or bundle with the given URL. If there is no
+// such publication, it returns an error with a params.ErrNotFound
+// cause.
+func (s *Store) CancelScheduledPublish(url *charm.URL, id string) error {
+	if !bson.IsObjectIdHex(id) {
+		return errgo.WithCausef(nil, params.ErrNotFound, "scheduled publication %q not found", id)
+	}
+	err := s.DB.ScheduledPublishes().Remove(bson.D{
+		{"_id", bson.ObjectIdHex(id)},
+		{"baseurl", mongodoc.BaseURL(url)},
+	})
+	if err == mgo.ErrNotFound {
+		return errgo.WithCausef(nil, params.ErrNotFound, "scheduled publication %q not found", id)
+	}
+	if err != nil {
+		return errgo.Notef(err, "cannot cancel scheduled publication")
+	}
+	return nil
+}
+
+// PublishScheduled makes all the scheduled publications that are due at
+// the given time, earliest first, and returns the number that
+// succeeded. Each publication is removed before it is made, so that it
+// is made at most once even when several servers are running; a
+// publication that fails is not retried. Successful and failed
+// publications are both recorded in the audit log.
+func (s *Store) PublishScheduled(now time.Time) (int, error) {
+	var due []*mongodoc.ScheduledPublish
+	if err := s.DB.ScheduledPublishes().
+		Find(bson.D{{"time", bson.D{{"$lte", now}}}}).
+		Sort("time", "_id").
+		All(&due); err != nil {
+		return 0, errgo.Notef(err, "cannot get scheduled publications")
+	}
+	n := 0
+	for _, doc := range due {
+		if err := s.DB.ScheduledPublishes().RemoveId(doc.Id); err != nil {
+			if err == mgo.ErrNotFound {
+				// The publication has been cancelled or
+				// made by another server since we looked.
+				continue
+			}
+			return n, errgo.Notef(err, "cannot remove scheduled publication")
+		}
+		entry := audit.Entry{
+			User:     doc.User,
+			Op:       audit.OpScheduledPublish,
+			Entity:   doc.URL,
+			Channels: doc.Channels,
+		}
+		if err := s.publishScheduled(doc); err != nil {
+			logger.Errorf("cannot make scheduled publication of %q: %v", doc.URL, err)
+			entry.Op = audit.OpScheduledPublishFailed
+			entry.Error = err.Error()
+		} else {
+			n++
+		}
+		s.AddAudit(entry)
+	}
+	return n, nil
+}
+
+// publishScheduled makes the given scheduled publication.
+func (s *Store) publishScheduled(doc *mongodoc.ScheduledPublish) error {
+	entity, err := s.FindEntity(&router.ResolvedURL{URL: *doc.URL}, FieldSelector("promulgated-revision"))
+	if err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	id := &router.ResolvedURL{
+		URL:                 *entity.URL,
+		PromulgatedRevision: entity.PromulgatedRevision,
+	}
+	resources := make(map[string]int, len(doc.Resources))
+	for _, r := range doc.Resources {
+		resources[r.Name] = r.Revision
+	}
+	if err := s.PublishAs(doc.User, id, resources, doc.Channels...); err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrNotFound), errgo.Is(ErrPublishResourceMismatch))
+	}
+	return nil
+}
+
+// scheduledPublisher implements the worker that makes
+// scheduled publications when they become due.
+type scheduledPublisher struct {
+	tomb tomb.Tomb
+	pool *Pool
+}
+
+// newScheduledPublisher returns a new running scheduled
+// publication worker.
+func newScheduledPublisher(pool *Pool) *scheduledPublisher {
+	p := &scheduledPublisher{
+		pool: pool,
+	}
+	p.tomb.Go(p.run)
+	return p
+}
+
+// Kill implements worker.Worker.Kill.
+func (p *scheduledPublisher) Kill() {
+	p.tomb.Kill(nil)
+}
+
+// Wait implements worker.Worker.Wait.
+func (p *scheduledPublisher) Wait() error {
+	return p.tomb.Wait()
+}
+
+func (p *scheduledPublisher) run() error {
+	for {
+		if err := p.doPublish(); err != nil {
+			logger.Errorf("%v", err)
+		}
+		select {
+		case <-p.tomb.Dying():
+			return tomb.ErrDying
+		case <-time.After(scheduledPublishInterval):
+		}
+	}
+}
+
+func (p *scheduledPublisher) doPublish() error {
+	store := p.pool.Store()
+	defer store.Close()
+	n, err := store.PublishScheduled(time.Now())
+	if err != nil {
+		return errgo.Notef(err, "scheduled publication failed")
+	}
+	if n > 0 {
+		logger.Infof("made %d scheduled publications", n)
+	}
+	return nil
+}
@@ -0,0 +1,253 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package charmstore
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/juju/charmrepo/v6/csclient/params"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/natefinch/lumberjack.v2"
+
+	"gopkg.in/juju/charmstore.v5/audit"
+	"gopkg.in/juju/charmstore.v5/internal/charm"
+	"gopkg.in/juju/charmstore.v5/internal/mongodoc"
+	"gopkg.in/juju/charmstore.v5/internal/router"
+	"gopkg.in/juju/charmstore.v5/internal/storetesting"
+)
+
+type scheduledPublishSuite struct {
+	commonSuite
+}
+
+var _ = gc.Suite(&scheduledPublishSuite{})
+
+func (s *scheduledPublishSuite) TestSchedulePublish(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+	ids := s.addRevisions(c, store, 2, "someResource")
+	id0, id1 := ids[0], ids[1]
+
+	doc1, err := store.SchedulePublish("alice", id1, map[string]int{"someResource": 1}, []params.Channel{params.StableChannel}, testEpoch.Add(time.Hour))
+	c.Assert(err, gc.Equals, nil)
+	doc0, err := store.SchedulePublish("alice", id0, map[string]int{"someResource": 0}, []params.Channel{"latest/candidate", "1/stable"}, testEpoch)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(doc0.BaseURL, jc.DeepEquals, charm.MustParseURL("cs:~bob/wordpress"))
+	c.Assert(doc0.URL, jc.DeepEquals, &id0.URL)
+	c.Assert(doc0.Channels, jc.DeepEquals, []params.Channel{params.CandidateChannel, "1/stable"})
+	c.Assert(doc0.Resources, jc.DeepEquals, []mongodoc.ResourceRevision{{
+		Name:     "someResource",
+		Revision: 0,
+	}})
+	c.Assert(doc0.User, gc.Equals, "alice")
+
+	docs, err := store.ScheduledPublishes(charm.MustParseURL("~bob/wordpress"))
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(docs, gc.HasLen, 2)
+	for i, expect := range []*mongodoc.ScheduledPublish{doc0, doc1} {
+		c.Assert(docs[i].Time.Equal(expect.Time), gc.Equals, true)
+		docs[i].Time = expect.Time
+		c.Assert(docs[i], jc.DeepEquals, expect)
+	}
+
+	docs, err = store.ScheduledPublishes(charm.MustParseURL("~bob/mysql"))
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(docs, gc.HasLen, 0)
+}
+
+func (s *scheduledPublishSuite) TestSchedulePublishErrors(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+	id0 := s.addRevisions(c, store, 2, "someResource")[0]
+	resources := map[string]int{"someResource": 0}
+
+	_, err := store.SchedulePublish("", id0, resources, nil, testEpoch)
+	c.Assert(err, gc.ErrorMatches, `cannot schedule publication of "cs:~bob/.*/wordpress-0": no channels provided`)
+
+	_, err = store.SchedulePublish("", id0, resources, []params.Channel{params.UnpublishedChannel}, testEpoch)
+	c.Assert(err, gc.ErrorMatches, `cannot schedule publication of "cs:~bob/.*/wordpress-0" to "unpublished" channel`)
+
+	_, err = store.SchedulePublish("", id0, resources, []params.Channel{params.StableChannel, "bad"}, testEpoch)
+	c.Assert(err, gc.ErrorMatches, `cannot schedule publication of "cs:~bob/.*/wordpress-0" to "bad" channel`)
+
+	_, err = store.SchedulePublish("", id0, nil, []params.Channel{params.StableChannel}, testEpoch)
+	c.Assert(errgo.Cause(err), gc.Equals, ErrPublishResourceMismatch)
+	c.Assert(err, gc.ErrorMatches, `resources are missing from publish request: someResource`)
+
+	_, err = store.SchedulePublish("", MustParseResolvedURL("~bob/precise/mysql-0"), nil, []params.Channel{params.StableChannel}, testEpoch)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+
+	docs, err := store.ScheduledPublishes(&id0.URL)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(docs, gc.HasLen, 0)
+}
+
+func (s *scheduledPublishSuite) TestScheduleStagedPublish(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+	id0 := s.addRevisions(c, store, 1, "someResource")[0]
+	resources := map[string]int{"someResource": 0}
+
+	docs, err := store.ScheduleStagedPublish("alice", id0, resources, []ScheduleStage{{
+		Channels: []params.Channel{params.CandidateChannel},
+		Time:     testEpoch,
+	}, {
+		Channels: []params.Channel{params.StableChannel},
+		Time:     testEpoch.Add(time.Hour),
+	}})
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(docs, gc.HasLen, 2)
+	c.Assert(docs[0].Channels, jc.DeepEquals, []params.Channel{params.CandidateChannel})
+	c.Assert(docs[1].Channels, jc.DeepEquals, []params.Channel{params.StableChannel})
+
+	scheduled, err := store.ScheduledPublishes(&id0.URL)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(scheduled, gc.HasLen, 2)
+}
+
+func (s *scheduledPublishSuite) TestScheduleStagedPublishChecksAllStages(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+	id0 := s.addRevisions(c, store, 1, "someResource")[0]
+	resources := map[string]int{"someResource": 0}
+
+	_, err := store.ScheduleStagedPublish("alice", id0, resources, []ScheduleStage{{
+		Channels: []params.Channel{params.CandidateChannel},
+		Time:     testEpoch,
+	}, {
+		Channels: []params.Channel{"bad"},
+		Time:     testEpoch.Add(time.Hour),
+	}})
+	c.Assert(err, gc.ErrorMatches, `cannot schedule publication of "cs:~bob/.*/wordpress-0" to "bad" channel`)
+
+	// The valid first stage has not been scheduled.
+	docs, err := store.ScheduledPublishes(&id0.URL)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(docs, gc.HasLen, 0)
+}
+
+func (s *scheduledPublishSuite) TestCancelScheduledPublish(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+	id0 := s.addRevisions(c, store, 2, "someResource")[0]
+	doc, err := store.SchedulePublish("", id0, map[string]int{"someResource": 0}, []params.Channel{params.StableChannel}, testEpoch)
+	c.Assert(err, gc.Equals, nil)
+
+	err = store.CancelScheduledPublish(charm.MustParseURL("~bob/mysql"), doc.Id.Hex())
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+	err = store.CancelScheduledPublish(&id0.URL, "bad-id")
+	c.Assert(err, gc.ErrorMatches, `scheduled publication "bad-id" not found`)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+
+	err = store.CancelScheduledPublish(&id0.URL, doc.Id.Hex())
+	c.Assert(err, gc.Equals, nil)
+	docs, err := store.ScheduledPublishes(&id0.URL)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(docs, gc.HasLen, 0)
+
+	err = store.CancelScheduledPublish(&id0.URL, doc.Id.Hex())
+	c.Assert(err, gc.ErrorMatches, fmt.Sprintf(`scheduled publication %q not found`, doc.Id.Hex()))
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+}
+
+func (s *scheduledPublishSuite) TestPublishScheduled(c *gc.C) {
+	filename := filepath.Join(c.MkDir(), "audit.log")
+	p, err := NewPool(s.Session.DB("juju_test"), nil, nil, ServerParams{
+		AuditLogger: &lumberjack.Logger{
+			Filename: filename,
+		},
+	})
+	c.Assert(err, gc.Equals, nil)
+	defer p.Close()
+	store := p.Store()
+	defer store.Close()
+
+	ids := s.addRevisions(c, store, 2, "someResource")
+	id0, id1 := ids[0], ids[1]
+	id2 := MustParseResolvedURL(fmt.Sprintf("~bob/%s/wordpress-2", storetesting.SearchSeries[0]))
+	err = store.AddCharmWithArchive(id2, storetesting.NewCharm(storetesting.MetaWithResources(nil, "someResource")))
+	c.Assert(err, gc.Equals, nil)
+	_, err = store.SchedulePublish("alice", id0, map[string]int{"someResource": 0}, []params.Channel{params.CandidateChannel}, testEpoch)
+	c.Assert(err, gc.Equals, nil)
+	_, err = store.SchedulePublish("alice", id1, map[string]int{"someResource": 1}, []params.Channel{params.StableChannel}, testEpoch.Add(time.Hour))
+	c.Assert(err, gc.Equals, nil)
+	_, err = store.SchedulePublish("alice", id2, map[string]int{"someResource": 1}, []params.Channel{params.EdgeChannel}, testEpoch.Add(2*time.Hour))
+	c.Assert(err, gc.Equals, nil)
+	future, err := store.SchedulePublish("alice", id1, map[string]int{"someResource": 1}, []params.Channel{params.EdgeChannel}, testEpoch.Add(24*time.Hour))
+	c.Assert(err, gc.Equals, nil)
+
+	// Delete the revision published by the third schedule
+	// so that it fails.
+	err = store.DeleteEntity(id2)
+	c.Assert(err, gc.Equals, nil)
+
+	n, err := store.PublishScheduled(testEpoch.Add(3 * time.Hour))
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(n, gc.Equals, 2)
+
+	url := charm.MustParseURL("~bob/wordpress")
+	for ch, expect := range map[params.Channel]*router.ResolvedURL{
+		params.CandidateChannel: id0,
+		params.StableChannel:    id1,
+	} {
+		entity, err := store.FindBestEntity(url, ch, nil)
+		c.Assert(err, gc.Equals, nil)
+		c.Assert(entity.URL, jc.DeepEquals, &expect.URL)
+	}
+	_, err = store.FindBestEntity(url, params.EdgeChannel, nil)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+	history, err := store.ChannelHistory(url, params.StableChannel, 0)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(history, gc.HasLen, 1)
+	c.Assert(history[0].User, gc.Equals, "alice")
+
+	// Only the schedule that is not yet due remains.
+	docs, err := store.ScheduledPublishes(url)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(docs, gc.HasLen, 1)
+	c.Assert(docs[0].Id, gc.Equals, future.Id)
+
+	data, err := ioutil.ReadFile(filename)
+	c.Assert(err, gc.Equals, nil)
+	lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	c.Assert(lines, gc.HasLen, 3)
+	var entries []audit.Entry
+	for _, line := range lines {
+		var e audit.Entry
+		err := json.Unmarshal([]byte(line), &e)
+		c.Assert(err, gc.Equals, nil)
+		e.Time = time.Time{}
+		entries = append(entries, e)
+	}
+	c.Assert(entries[2].Error, gc.Not(gc.Equals), "")
+	entries[2].Error = ""
+	c.Assert(entries, jc.DeepEquals, []audit.Entry{{
+		User:     "alice",
+		Op:       audit.OpScheduledPublish,
+		Entity:   &id0.URL,
+		Channels: []params.Channel{params.CandidateChannel},
+	}, {
+		User:     "alice",
+		Op:       audit.OpScheduledPublish,
+		Entity:   &id1.URL,
+		Channels: []params.Channel{params.StableChannel},
+	}, {
+		User:     "alice",
+		Op:       audit.OpScheduledPublishFailed,
+		Entity:   &id2.URL,
+		Channels: []params.Channel{params.EdgeChannel},
+	}})
+
+	// Nothing more is due.
+	n, err = store.PublishScheduled(testEpoch.Add(3 * time.Hour))
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(n, gc.Equals, 0)
+}
@@ -9,8 +9,10 @@ import (
 	"encoding/json"
 	"fmt"
 	"reflect"
+	"sort"
 	"strings"
 	"time"
+	"unicode/utf8"
 
 	"github.com/juju/charmrepo/v6/csclient/params"
 	"github.com/juju/utils"
@@ -25,6 +27,63 @@ import (
 	"gopkg.in/juju/charmstore.v5/internal/series"
 )
 
+// SearchEngine is the interface implemented by the search backends
+// used by the charm store. SearchIndex implements it using
+// elasticsearch. When no elasticsearch database is configured, an
+// embedded index held on local disk may be used instead (see
+// ServerParams.SearchIndexDir).
+type SearchEngine interface {
+	// GetSearchDocument retrieves the current search record for
+	// the charm reference id.
+	GetSearchDocument(id *charm.URL) (*SearchDoc, error)
+
+	// update adds the given document to the index, replacing any
+	// existing document for the same entity. Multi-series charms
+	// are also indexed once for each supported series.
+	update(doc *SearchDoc) error
+
+	// remove removes the search documents for all the given
+	// entities. Only the URL and SupportedSeries fields of the
+	// entities are used. It is not an error if an entity has no
+	// search document.
+	remove(entities []*mongodoc.Entity) error
+
+	// search returns the documents matching the given
+	// parameters. The fields parameter holds the entity fields
+	// that will be used from the results. If fuzzy is true, the
+	// terms of the full text search also match terms that are
+	// within the edit distance returned by fuzziness.
+	search(sp SearchParams, fuzzy bool, fields map[string]int) (*searchResult, error)
+}
+
+// searchResult holds the result of a search.
+type searchResult struct {
+	// total holds the total number of matching documents,
+	// regardless of any limit or offset.
+	total int
+
+	// took holds the time spent performing the search.
+	took time.Duration
+
+	// docs holds the requested page of results.
+	docs []*SearchDoc
+
+	// facets holds the counts for each of the requested facets,
+	// calculated over all the matching documents.
+	facets map[string][]FacetCount
+
+	// cursor holds a cursor that continues the search after
+	// the returned documents, if there may be more of them.
+	cursor string
+
+	// names holds the most common names of all the matching
+	// documents, regardless of any limit or offset, in order of
+	// decreasing frequency. It is only set for fuzzy searches, so
+	// that suggestions can be made from it.
+	names []string
+}
+
+// SearchIndex is a SearchEngine implemented with elasticsearch.
 type SearchIndex struct {
 	*elasticsearch.Database
 	Index string
@@ -66,6 +125,43 @@ type SearchDoc struct {
 	// be a bundle, a single-series charm or the canonical record for
 	// a multi-series charm.
 	AllSeries bool
+
+	// Tags holds the tags of the entity, including the categories
+	// of a charm, so that they can be counted in a single facet.
+	Tags []string `json:",omitempty"`
+
+	// CharmConfigOptions holds the names of the charm's
+	// config options.
+	CharmConfigOptions []string `json:",omitempty"`
+
+	// CharmActionNames holds the names of the charm's actions.
+	CharmActionNames []string `json:",omitempty"`
+
+	// CharmResourceNames holds the names of the charm's resources.
+	CharmResourceNames []string `json:",omitempty"`
+
+	// CharmResourceTypes holds the types of the charm's
+	// resources, such as "file" or "oci-image".
+	CharmResourceTypes []string `json:",omitempty"`
+
+	// CharmStorageNames holds the names of the charm's storage.
+	CharmStorageNames []string `json:",omitempty"`
+
+	// CharmDeviceNames holds the names of the charm's devices.
+	CharmDeviceNames []string `json:",omitempty"`
+}
+
+// searchEngine returns the search engine used by the store, or nil if
+// no search engine is configured. An elasticsearch index is used in
+// preference to the embedded index.
+func (s *Store) searchEngine() SearchEngine {
+	if s.ES != nil && s.ES.Database != nil {
+		return s.ES
+	}
+	if s.pool.embeddedSearch != nil {
+		return s.pool.embeddedSearch
+	}
+	return nil
 }
 
 // UpdateSearchAsync will update the search record for the entity
@@ -83,7 +179,7 @@ func (s *Store) UpdateSearchAsync(r *router.ResolvedURL) {
 // so the latest stable revision of the charm specified by r will be
 // indexed.
 func (s *Store) UpdateSearch(r *router.ResolvedURL) error {
-	if s.ES == nil || s.ES.Database == nil {
+	if s.searchEngine() == nil {
 		return nil
 	}
 	// For multi-series charms update the whole base URL.
@@ -118,7 +214,7 @@ func (s *Store) UpdateSearch(r *router.ResolvedURL) error {
 // the specified base URL. It must be called whenever the entry for the
 // given URL in the BaseEntitites collection has changed.
 func (s *Store) UpdateSearchBaseURL(baseURL *charm.URL) error {
-	if s.ES == nil || s.ES.Database == nil {
+	if s.searchEngine() == nil {
 		return nil
 	}
 	baseEntity, err := s.FindBaseEntity(baseURL, nil)
@@ -146,12 +242,22 @@ func (s *Store) UpdateSearchBaseURL(baseURL *charm.URL) error {
 	return nil
 }
 
+// removeSearch removes the search documents for the given entities
+// from the search engine, if one is configured.
+func (s *Store) removeSearch(entities []*mongodoc.Entity) error {
+	se := s.searchEngine()
+	if se == nil {
+		return nil
+	}
+	return se.remove(entities)
+}
+
 func (s *Store) updateSearchEntity(entity *mongodoc.Entity, baseEntity *mongodoc.BaseEntity) error {
 	doc, err := s.searchDocFromEntity(entity, baseEntity)
 	if err != nil {
 		return errgo.Mask(err)
 	}
-	if err := s.ES.update(doc); err != nil {
+	if err := s.searchEngine().update(doc); err != nil {
 		return errgo.Notef(err, "cannot update search index")
 	}
 	return nil
@@ -188,9 +294,64 @@ func (s *Store) searchDocFromEntity(e *mongodoc.Entity, be *mongodoc.BaseEntity)
 	}
 	doc.AllSeries = true
 	doc.SingleSeries = doc.Entity.Series != ""
+	doc.Tags = entityTags(e)
+	if e.CharmConfig != nil {
+		doc.CharmConfigOptions = sortedKeys(e.CharmConfig.Options)
+	}
+	if e.CharmActions != nil {
+		doc.CharmActionNames = sortedKeys(e.CharmActions.ActionSpecs)
+	}
+	if e.CharmMeta != nil {
+		doc.CharmResourceNames = sortedKeys(e.CharmMeta.Resources)
+		for _, r := range e.CharmMeta.Resources {
+			if t := r.Type.String(); !containsString(doc.CharmResourceTypes, t) {
+				doc.CharmResourceTypes = append(doc.CharmResourceTypes, t)
+			}
+		}
+		sort.Strings(doc.CharmResourceTypes)
+		doc.CharmStorageNames = sortedKeys(e.CharmMeta.Storage)
+		doc.CharmDeviceNames = sortedKeys(e.CharmMeta.Devices)
+	}
 	return &doc, nil
 }
 
+// sortedKeys returns the keys of m, which must be a map with string
+// keys, in sorted order. It returns nil if m is empty.
+func sortedKeys(m interface{}) []string {
+	v := reflect.ValueOf(m)
+	if v.Len() == 0 {
+		return nil
+	}
+	keys := make([]string, 0, v.Len())
+	for _, k := range v.MapKeys() {
+		keys = append(keys, k.String())
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// entityTags returns the tags of the given entity without duplicates.
+// For a charm these are its categories and tags; for a bundle they are
+// the tags in the bundle data.
+func entityTags(e *mongodoc.Entity) []string {
+	var tags []string
+	add := func(ts []string) {
+		for _, t := range ts {
+			if t != "" && !containsString(tags, t) {
+				tags = append(tags, t)
+			}
+		}
+	}
+	if e.CharmMeta != nil {
+		add(e.CharmMeta.Categories)
+		add(e.CharmMeta.Tags)
+	}
+	if e.BundleData != nil {
+		add(e.BundleData.Tags)
+	}
+	return tags
+}
+
 // update inserts an entity into elasticsearch if elasticsearch
 // is configured. The entity with id r is extracted from mongodb
 // and written into elasticsearch.
@@ -198,44 +359,105 @@ func (si *SearchIndex) update(doc *SearchDoc) error {
 	if si == nil || si.Database == nil {
 		return nil
 	}
-	err := si.PutDocumentVersionWithType(
-		si.Index,
-		typeName,
-		si.getID(doc.URL),
-		int64(doc.URL.Revision),
-		elasticsearch.ExternalGTE,
-		doc)
-	if err != nil && !elasticsearch.IsConflictError(errgo.Cause(err)) {
-		return errgo.Mask(err)
+	for _, doc := range expandSearchDoc(doc) {
+		err := si.PutDocumentVersionWithType(
+			si.Index,
+			typeName,
+			si.getID(doc.URL),
+			int64(doc.URL.Revision),
+			elasticsearch.ExternalGTE,
+			doc)
+		if err != nil && !elasticsearch.IsConflictError(errgo.Cause(err)) {
+			return errgo.Mask(err)
+		}
 	}
+	return nil
+}
+
+// expandSearchDoc returns the documents that should be indexed for the
+// given document. For a multi-series charm this is the document itself
+// followed by a copy of it for each of the supported series; otherwise
+// it is just the document itself.
+func expandSearchDoc(doc *SearchDoc) []*SearchDoc {
+	docs := []*SearchDoc{doc}
 	if doc.Entity.URL.Series != "" {
-		return nil
+		return docs
 	}
-	// This document represents a multi-series charm. Expand the
-	// document for each of the supported series.
 	for _, series := range doc.Entity.SupportedSeries {
-		u := *doc.Entity.URL
+		e := *doc.Entity
+		u := *e.URL
 		u.Series = series
-		doc.Entity.URL = &u
-		if doc.PromulgatedURL != nil {
-			u := *doc.Entity.PromulgatedURL
+		e.URL = &u
+		if e.PromulgatedURL != nil {
+			u := *e.PromulgatedURL
 			u.Series = series
-			doc.Entity.PromulgatedURL = &u
+			e.PromulgatedURL = &u
 		}
-		doc.Series = []string{series}
-		doc.AllSeries = false
-		doc.SingleSeries = true
-		if err := si.update(doc); err != nil {
+		doc1 := *doc
+		doc1.Entity = &e
+		doc1.Series = []string{series}
+		doc1.AllSeries = false
+		doc1.SingleSeries = true
+		docs = append(docs, &doc1)
+	}
+	return docs
+}
+
+// remove removes the search documents for all the given entities, if
+// elasticsearch is configured. Only the URL and SupportedSeries fields
+// of the entities are used. It is not an error if an entity has no
+// search document.
+func (si *SearchIndex) remove(entities []*mongodoc.Entity) error {
+	if si == nil || si.Database == nil {
+		return nil
+	}
+	for _, id := range searchDocIDs(entities) {
+		err := si.DeleteDocument(si.Index, typeName, id)
+		if err != nil && !elasticsearch.IsNotFoundError(errgo.Cause(err)) {
 			return errgo.Mask(err)
 		}
 	}
 	return nil
 }
 
+// searchDocIDs returns the ids of all the search documents that may
+// have been indexed for the given entities.
+func searchDocIDs(entities []*mongodoc.Entity) []string {
+	var ids []string
+	seen := make(map[string]bool)
+	add := func(u *charm.URL) {
+		id := searchDocID(u)
+		if !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	for _, e := range entities {
+		add(e.URL)
+		if e.URL.Series != "" {
+			continue
+		}
+		// Multi-series charms also have a document
+		// for each supported series.
+		for _, series := range e.SupportedSeries {
+			u := *e.URL
+			u.Series = series
+			add(&u)
+		}
+	}
+	return ids
+}
+
 // getID returns an ID for the elasticsearch document based on the contents of the
 // mongoDB document. This is to allow elasticsearch documents to be replaced with
 // updated versions when charm data is changed.
 func (si *SearchIndex) getID(r *charm.URL) string {
+	return searchDocID(r)
+}
+
+// searchDocID returns the id of the search document for the entity
+// with the given URL. All revisions of an entity share the same id.
+func searchDocID(r *charm.URL) string {
 	ref := *r
 	ref.Revision = -1
 	b := sha1.Sum([]byte(ref.String()))
@@ -370,7 +592,7 @@ func (si *SearchIndex) updateVersion(v version, dv int64) (bool, error) {
 // syncSearch populates the SearchIndex with all the data currently stored in
 // mongodb. If the SearchIndex is not configured then this method returns a nil error.
 func (s *Store) syncSearch() error {
-	if s.ES == nil || s.ES.Database == nil {
+	if s.searchEngine() == nil {
 		return nil
 	}
 	var result mongodoc.Entity
@@ -417,6 +639,18 @@ type SearchParams struct {
 	// ExpandedMultiSeries returns a number of entries for
 	// multi-series charms, one for each entity.
 	ExpandedMultiSeries bool
+	// Facets holds the names of the facets to count over all the
+	// matching items, regardless of Limit and Skip.
+	Facets []string
+	// Fuzzy specifies that when no items match Text exactly, items
+	// that match with misspelt terms are returned instead, along
+	// with suggested names.
+	Fuzzy bool
+	// After holds the sort values of the last item returned by a
+	// previous query with the same parameters, as decoded from its
+	// cursor by ParseCursor. When it is set, only the items that
+	// sort after that item are returned.
+	After []json.RawMessage
 }
 
 var allowedSortFields = map[string]bool{
@@ -445,6 +679,172 @@ func (sp *SearchParams) ParseSortFields(f ...string) error {
 	return nil
 }
 
+// ParseCursor sets sp.After from the given cursor, as returned by
+// SearchQuery.NextCursor or ListQuery.NextCursor, so that a query
+// continues where the query that returned the cursor stopped.
+func (sp *SearchParams) ParseCursor(cursor string) error {
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return errgo.Newf("invalid cursor %q", cursor)
+	}
+	var after []json.RawMessage
+	if err := json.Unmarshal(data, &after); err != nil || len(after) == 0 {
+		return errgo.Newf("invalid cursor %q", cursor)
+	}
+	sp.After = after
+	return nil
+}
+
+// makeCursor returns an opaque cursor holding the given sort values,
+// which must marshal to a JSON array. The values can be retrieved
+// with SearchParams.ParseCursor.
+func makeCursor(values interface{}) (string, error) {
+	data, err := json.Marshal(values)
+	if err != nil {
+		return "", errgo.Notef(err, "cannot make cursor")
+	}
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+// ParseFacets parses the names of the facets requested in a search.
+// Each value may hold several comma-separated facet names.
+func (sp *SearchParams) ParseFacets(f ...string) error {
+	for _, s := range f {
+		for _, s := range strings.Split(s, ",") {
+			if _, ok := facetAggregations[s]; !ok {
+				return errgo.Newf("unrecognized facet %q", s)
+			}
+			if !containsString(sp.Facets, s) {
+				sp.Facets = append(sp.Facets, s)
+			}
+		}
+	}
+	return nil
+}
+
+// maxFacetValues holds the maximum number of values returned
+// for each facet. The values with the highest counts are returned.
+const maxFacetValues = 20
+
+// FacetCount holds the number of search results that have
+// a particular value for a facet.
+type FacetCount struct {
+	Value string
+	Count int
+}
+
+// facetCounts returns the given counts as a slice of FacetCount sorted
+// by decreasing count and then by value. Values with a zero count are
+// omitted, and at most maxFacetValues values are returned.
+func facetCounts(counts map[string]int) []FacetCount {
+	fcs := make([]FacetCount, 0, len(counts))
+	for v, n := range counts {
+		if n > 0 {
+			fcs = append(fcs, FacetCount{Value: v, Count: n})
+		}
+	}
+	sort.Sort(facetCountsByCount(fcs))
+	if len(fcs) > maxFacetValues {
+		fcs = fcs[:maxFacetValues]
+	}
+	return fcs
+}
+
+type facetCountsByCount []FacetCount
+
+func (f facetCountsByCount) Len() int      { return len(f) }
+func (f facetCountsByCount) Swap(i, j int) { f[i], f[j] = f[j], f[i] }
+func (f facetCountsByCount) Less(i, j int) bool {
+	if f[i].Count != f[j].Count {
+		return f[i].Count > f[j].Count
+	}
+	return f[i].Value < f[j].Value
+}
+
+// maxSuggestions holds the maximum number of names suggested
+// for a fuzzy search.
+const maxSuggestions = 5
+
+// maxSuggestionNames holds the maximum number of the names of the
+// documents matching a fuzzy search that are considered when making
+// suggestions. The most common names are considered.
+const maxSuggestionNames = 100
+
+// namesAggregation holds the name of the aggregation that collects
+// the names of the documents matching a fuzzy search. It cannot clash
+// with the name of a facet.
+const namesAggregation = "_names"
+
+// suggestNames returns the given names that are close enough to the
+// given text to be suggested as corrections for it. The closest names
+// are returned first, and names that are equally close are returned in
+// the order they were given.
+func suggestNames(text string, names []string) []string {
+	text = strings.ToLower(strings.TrimSpace(text))
+	max := fuzziness(text)
+	var suggestions []string
+	distances := make(map[string]int)
+	for _, name := range names {
+		d := editDistance(text, strings.ToLower(name))
+		if d > max || containsString(suggestions, name) {
+			continue
+		}
+		suggestions = append(suggestions, name)
+		distances[name] = d
+	}
+	sort.SliceStable(suggestions, func(i, j int) bool {
+		return distances[suggestions[i]] < distances[suggestions[j]]
+	})
+	if len(suggestions) > maxSuggestions {
+		suggestions = suggestions[:maxSuggestions]
+	}
+	return suggestions
+}
+
+// fuzziness returns the maximum number of edits allowed for the given
+// term to match another term in a fuzzy search. This is the same as
+// the AUTO fuzziness in elasticsearch.
+func fuzziness(term string) int {
+	switch n := utf8.RuneCountInString(term); {
+	case n <= 2:
+		return 0
+	case n <= 5:
+		return 1
+	}
+	return 2
+}
+
+// editDistance returns the Levenshtein distance between a and b: the
+// minimum number of single character insertions, deletions and
+// substitutions needed to change one into the other.
+func editDistance(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	cur := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		cur[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			cur[j] = minInt(prev[j]+1, minInt(cur[j-1]+1, prev[j-1]+cost))
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(rb)]
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
 // sortOrder defines the order in which a field should be sorted.
 type sortOrder int
 
@@ -454,12 +854,15 @@ type SortParam struct {
 	Descending bool
 }
 
-// SearchQuery represents a query on the elasticsearch index.
+// SearchQuery represents a query on the search index.
 type SearchQuery struct {
-	index    *SearchIndex
-	params   SearchParams
-	total    int
-	duration time.Duration
+	engine      SearchEngine
+	params      SearchParams
+	total       int
+	duration    time.Duration
+	facets      map[string][]FacetCount
+	suggestions []string
+	cursor      string
 }
 
 // Total returns the total number of hits found in the index. This will
@@ -474,18 +877,65 @@ func (q *SearchQuery) Duration() time.Duration {
 	return q.duration
 }
 
+// Facets returns the counts for each facet requested in the search
+// parameters, keyed by facet name. This will only be correct after
+// the iteration has completed successfully.
+func (q *SearchQuery) Facets() map[string][]FacetCount {
+	return q.facets
+}
+
+// Suggestions returns the names suggested as corrections for the text
+// of a fuzzy search that had no exact matches. This will only be
+// correct after the iteration has completed successfully.
+func (q *SearchQuery) Suggestions() []string {
+	return q.suggestions
+}
+
+// NextCursor returns a cursor that can be passed to
+// SearchParams.ParseCursor to retrieve the results following those
+// returned by the query, or the empty string if there are no more
+// results. This will only be correct after the iteration has completed
+// successfully.
+func (q *SearchQuery) NextCursor() string {
+	return q.cursor
+}
+
 // Iter returns a new StoreIter to iterate through the results of the
 // query. The returned StoreIter will be an instance of SearchQueryIter.
 func (q *SearchQuery) Iter(fields map[string]int) entitycache.StoreIter {
-	if q.index == nil || q.index.Database == nil {
+	if q.engine == nil {
 		return new(searchQueryIter)
 	}
-	qdsl := createSearchDSL(q.params)
+	result, err := q.engine.search(q.params, false, fields)
+	if err == nil && result.total == 0 && q.params.Fuzzy && q.params.Text != "" {
+		// Nothing matches exactly, so try again allowing
+		// for misspelt terms.
+		result, err = q.engine.search(q.params, true, fields)
+		if err == nil {
+			q.suggestions = suggestNames(q.params.Text, result.names)
+		}
+	}
+	if err != nil {
+		return &searchQueryIter{
+			err: err,
+		}
+	}
+	q.total = result.total
+	q.duration = result.took
+	q.facets = result.facets
+	q.cursor = result.cursor
+	return &searchQueryIter{
+		docs: result.docs,
+	}
+}
+
+// search implements SearchEngine.search by querying elasticsearch.
+func (si *SearchIndex) search(sp SearchParams, fuzzy bool, fields map[string]int) (*searchResult, error) {
+	qdsl := createSearchDSL(sp, fuzzy)
 	qdsl.Source = elasticsearch.SourceFilter{
 		"AllSeries",
 		"SingleSeries",
 	}
-
 	for k := range fields {
 		f, ok := searchFields[k]
 		if !ok {
@@ -494,19 +944,176 @@ func (q *SearchQuery) Iter(fields map[string]int) entitycache.StoreIter {
 		}
 		qdsl.Source = append(qdsl.Source, f)
 	}
-	result, err := q.index.Search(q.index.Index, typeName, qdsl)
-	q.total = result.Hits.Total
-	q.duration = time.Duration(result.Took) * time.Millisecond
-	return &searchQueryIter{
-		result: result,
-		err:    err,
+	limit := sp.Limit
+	if limit <= 0 {
+		limit = defaultSearchLimit
+	}
+	result, hits, err := si.searchPage(&qdsl, sp, limit)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(params.ErrBadRequest))
+	}
+	docs := make([]*SearchDoc, len(hits))
+	for i, hit := range hits {
+		var doc SearchDoc
+		if err := json.Unmarshal(hit.Source, &doc); err != nil {
+			return nil, errgo.Mask(err)
+		}
+		docs[i] = &doc
 	}
+	var names []string
+	for _, b := range result.Aggregations[namesAggregation].Buckets {
+		names = append(names, b.Key)
+	}
+	var facets map[string][]FacetCount
+	for name := range qdsl.Aggregations {
+		if name == namesAggregation {
+			continue
+		}
+		if facets == nil {
+			facets = make(map[string][]FacetCount)
+		}
+		counts := make(map[string]int)
+		for _, b := range result.Aggregations[name].Buckets {
+			counts[b.Key] = b.DocCount
+		}
+		facets[name] = facetCounts(counts)
+	}
+	var cursor string
+	if n := len(hits); n > 0 && n == limit {
+		// There may be more results, which can be retrieved
+		// by continuing after the position of the last hit.
+		var values []json.RawMessage
+		if err := json.Unmarshal(hits[n-1].Sort, &values); err != nil {
+			return nil, errgo.Notef(err, "cannot unmarshal sort values")
+		}
+		offset := qdsl.From + n
+		cursor, err = makeCursor(append([]interface{}{offset}, rawValues(values)...))
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+	}
+	return &searchResult{
+		total:  result.Hits.Total,
+		took:   time.Duration(result.Took) * time.Millisecond,
+		docs:   docs,
+		facets: facets,
+		cursor: cursor,
+		names:  names,
+	}, nil
+}
+
+// maxCursorSearches holds the maximum number of searches made to find
+// the position of a cursor in the results of an elasticsearch query.
+var maxCursorSearches = 5
+
+// searchPage performs the given elasticsearch query and returns the
+// result along with the hits in the requested page. If sp.After holds a
+// cursor made by SearchIndex.search, the page starts after the position
+// of the cursor, which holds the offset of that position and the sort
+// values of the hit before it.
+//
+// As search_after is not supported by the elasticsearch versions used
+// by the charm store, the page is found with from and size. The search
+// starts at the hit before the offset, and each hit is checked against
+// the cursor's sort values so that a hit is neither repeated nor
+// skipped when entities have been added to or removed from the index
+// since the cursor was made. When that has happened, the search is
+// repeated from a different offset until the cursor's position is
+// found. If it cannot be found within maxCursorSearches searches,
+// searchPage returns an error with a params.ErrBadRequest cause. On
+// return, qdsl.From holds the offset of the first hit in the page.
+func (si *SearchIndex) searchPage(qdsl *elasticsearch.QueryDSL, sp SearchParams, limit int) (elasticsearch.SearchResult, []elasticsearch.Hit, error) {
+	if len(sp.After) == 0 {
+		result, err := si.Search(si.Index, typeName, *qdsl)
+		if err != nil {
+			return elasticsearch.SearchResult{}, nil, errgo.Mask(err)
+		}
+		return result, result.Hits.Hits, nil
+	}
+	var offset int
+	if len(sp.After) < 2 || json.Unmarshal(sp.After[0], &offset) != nil || offset < 1 {
+		return elasticsearch.SearchResult{}, nil, errgo.WithCausef(nil, params.ErrBadRequest, "cursor does not match search")
+	}
+	after := sp.After[1:]
+	qdsl.From = offset - 1
+	qdsl.Size = limit + 1
+	for i := 0; i < maxCursorSearches; i++ {
+		result, err := si.Search(si.Index, typeName, *qdsl)
+		if err != nil {
+			return elasticsearch.SearchResult{}, nil, errgo.Mask(err)
+		}
+		hits := result.Hits.Hits
+		n, err := hitsBefore(hits, after, sp.Sort)
+		if err != nil {
+			return elasticsearch.SearchResult{}, nil, errgo.Mask(err, errgo.Is(params.ErrBadRequest))
+		}
+		if n == 0 && qdsl.From > 0 {
+			// Every hit sorts after the cursor, so
+			// entities before it have been removed and
+			// its position is earlier.
+			qdsl.From = maxInt(qdsl.From-limit, 0)
+			continue
+		}
+		if len(hits) == qdsl.Size && len(hits)-n < limit {
+			// Entities have been added before the
+			// cursor, so its position is later.
+			qdsl.From += n - 1
+			qdsl.Size = limit + 1
+			continue
+		}
+		hits = hits[n:]
+		if len(hits) > limit {
+			hits = hits[:limit]
+		}
+		qdsl.From += n
+		return result, hits, nil
+	}
+	// Returning the hits found so far could give a short page
+	// with no cursor, which would look like the end of the
+	// results, so the client must start again instead.
+	return elasticsearch.SearchResult{}, nil, errgo.WithCausef(nil, params.ErrBadRequest, "cannot find position of cursor in changed search results; restart the search without a cursor")
+}
+
+// hitsBefore returns the number of the given elasticsearch hits, which
+// must be sorted by the given sort parameters, that sort at or before
+// the position of a cursor with the given sort values.
+func hitsBefore(hits []elasticsearch.Hit, after []json.RawMessage, sort []SortParam) (int, error) {
+	for i, hit := range hits {
+		var values []interface{}
+		if err := json.Unmarshal(hit.Sort, &values); err != nil {
+			return 0, errgo.Notef(err, "cannot unmarshal sort values")
+		}
+		c, err := compareSortValues(values, after, sort)
+		if err != nil {
+			return 0, errgo.Mask(err, errgo.Is(params.ErrBadRequest))
+		}
+		if c > 0 {
+			return i, nil
+		}
+	}
+	return len(hits), nil
+}
+
+// rawValues returns the given JSON values as a slice of interface{}.
+func rawValues(values []json.RawMessage) []interface{} {
+	vs := make([]interface{}, len(values))
+	for i, v := range values {
+		vs[i] = v
+	}
+	return vs
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
 }
 
 type searchQueryIter struct {
-	n      int
-	result elasticsearch.SearchResult
-	err    error
+	n    int
+	docs []*SearchDoc
+	err  error
 }
 
 func (i *searchQueryIter) Err() error {
@@ -518,14 +1125,10 @@ func (i *searchQueryIter) Close() error {
 }
 
 func (i *searchQueryIter) Next(v interface{}) bool {
-	if i.n >= len(i.result.Hits.Hits) || i.err != nil {
-		return false
-	}
-	var doc SearchDoc
-	if err := json.Unmarshal(i.result.Hits.Hits[i.n].Source, &doc); err != nil {
-		i.err = errgo.Mask(err)
+	if i.n >= len(i.docs) || i.err != nil {
 		return false
 	}
+	doc := i.docs[i.n]
 	e := v.(*mongodoc.Entity)
 	*e = *doc.Entity
 	if doc.SingleSeries && doc.AllSeries && len(doc.Series) > 0 {
@@ -551,8 +1154,9 @@ func encodeFields(fields map[string]float64) []string {
 }
 
 // createSearchDSL builds an elasticsearch query from the query parameters.
+// If fuzzy is true, the full text search will also match misspelt terms.
 // http://www.elasticsearch.org/guide/en/elasticsearch/reference/current/query-dsl.html
-func createSearchDSL(sp SearchParams) elasticsearch.QueryDSL {
+func createSearchDSL(sp SearchParams, fuzzy bool) elasticsearch.QueryDSL {
 	qdsl := elasticsearch.QueryDSL{
 		From: sp.Skip,
 		Size: sp.Limit,
@@ -567,7 +1171,7 @@ func createSearchDSL(sp SearchParams) elasticsearch.QueryDSL {
 	if sp.Text == "" {
 		q = elasticsearch.MatchAllQuery{}
 	} else {
-		q = elasticsearch.MultiMatchQuery{
+		mm := elasticsearch.MultiMatchQuery{
 			Query: sp.Text,
 			Fields: encodeFields(map[string]float64{
 				nameField:                  10,
@@ -578,6 +1182,12 @@ func createSearchDSL(sp SearchParams) elasticsearch.QueryDSL {
 			}),
 			MinimumShouldMatch: "100%",
 		}
+		if fuzzy {
+			// The AUTO fuzziness allows the same edit
+			// distances as the fuzziness function.
+			mm.Fuzziness = "AUTO"
+		}
+		q = mm
 	}
 
 	// Boosting
@@ -615,6 +1225,42 @@ func createSearchDSL(sp SearchParams) elasticsearch.QueryDSL {
 	for _, s := range sp.Sort {
 		qdsl.Sort = append(qdsl.Sort, createElasticSort(s))
 	}
+	if len(sp.Sort) == 0 {
+		qdsl.Sort = append(qdsl.Sort, elasticsearch.Sort{
+			Field: "_score",
+			Order: elasticsearch.Descending,
+		})
+	}
+	// Break any ties by URL so that the order is stable and
+	// each hit has distinct sort values to find a cursor's
+	// position by.
+	qdsl.Sort = append(qdsl.Sort, elasticsearch.Sort{
+		Field: "URL",
+		Order: elasticsearch.Ascending,
+	})
+
+	// Facets
+	for _, f := range sp.Facets {
+		agg, ok := facetAggregations[f]
+		if !ok {
+			continue
+		}
+		if qdsl.Aggregations == nil {
+			qdsl.Aggregations = make(map[string]elasticsearch.Aggregation)
+		}
+		qdsl.Aggregations[f] = agg
+	}
+	if fuzzy {
+		// Collect the names of all the matching documents
+		// so that suggestions can be made from them.
+		if qdsl.Aggregations == nil {
+			qdsl.Aggregations = make(map[string]elasticsearch.Aggregation)
+		}
+		qdsl.Aggregations[namesAggregation] = elasticsearch.TermsAggregation{
+			Field: "Name",
+			Size:  maxSuggestionNames,
+		}
+	}
 
 	return qdsl
 }
@@ -673,16 +1319,22 @@ func createFilters(sp SearchParams) elasticsearch.Filter {
 // function that will generate an elasticsearch query DSL filter for the
 // given value.
 var filters = map[string]func(string) elasticsearch.Filter{
-	"description": descriptionFilter,
-	"name":        nameFilter,
-	"owner":       ownerFilter,
-	"promulgated": promulgatedFilter,
-	"provides":    termFilter("CharmProvidedInterfaces"),
-	"requires":    termFilter("CharmRequiredInterfaces"),
-	"series":      seriesFilter,
-	"summary":     summaryFilter,
-	"tags":        tagsFilter,
-	"type":        typeFilter,
+	"actions":        termFilter("CharmActionNames"),
+	"config":         termFilter("CharmConfigOptions"),
+	"description":    descriptionFilter,
+	"devices":        termFilter("CharmDeviceNames"),
+	"name":           nameFilter,
+	"owner":          ownerFilter,
+	"promulgated":    promulgatedFilter,
+	"provides":       termFilter("CharmProvidedInterfaces"),
+	"requires":       termFilter("CharmRequiredInterfaces"),
+	"resources":      termFilter("CharmResourceNames"),
+	"resource-types": termFilter("CharmResourceTypes"),
+	"series":         seriesFilter,
+	"storage":        termFilter("CharmStorageNames"),
+	"summary":        summaryFilter,
+	"tags":           tagsFilter,
+	"type":           typeFilter,
 }
 
 // descriptionFilter generates a filter that will match against the
@@ -818,6 +1470,30 @@ func typeFilter(value string) elasticsearch.Filter {
 	return elasticsearch.NotFilter{bundleFilter}
 }
 
+// facetAggregations contains a mapping from each facet that may be
+// requested in a search to the elasticsearch aggregation that counts
+// the values of that facet. As they are part of the query, the
+// aggregations only count documents that pass the filters, including
+// the ACL filter.
+var facetAggregations = map[string]elasticsearch.Aggregation{
+	"owner": elasticsearch.TermsAggregation{
+		Field: "User",
+		Size:  maxFacetValues,
+	},
+	"series": elasticsearch.TermsAggregation{
+		Field: "Series",
+		Size:  maxFacetValues,
+	},
+	"tags": elasticsearch.TermsAggregation{
+		Field: "Tags",
+		Size:  maxFacetValues,
+	},
+	"type": elasticsearch.FiltersAggregation{
+		"bundle": bundleFilter,
+		"charm":  elasticsearch.NotFilter{bundleFilter},
+	},
+}
+
 // sortFields contains a mapping from api fieldnames to the entity fields to search.
 var sortESFields = map[string]string{
 	"name":      "Name",
@@ -5,6 +5,7 @@ package charmstore
 
 import (
 	"encoding/json"
+	"fmt"
 	"sort"
 	"strings"
 	"sync"
@@ -12,7 +13,9 @@ import (
 	"github.com/juju/charmrepo/v6/csclient/params"
 	jc "github.com/juju/testing/checkers"
 	gc "gopkg.in/check.v1"
+	"gopkg.in/errgo.v1"
 
+	"gopkg.in/juju/charmstore.v5/elasticsearch"
 	"gopkg.in/juju/charmstore.v5/internal/charm"
 	"gopkg.in/juju/charmstore.v5/internal/mongodoc"
 	"gopkg.in/juju/charmstore.v5/internal/router"
@@ -58,20 +61,26 @@ func (s *StoreSearchSuite) entity(c *gc.C, rurl *router.ResolvedURL) *mongodoc.E
 }
 
 func (s *StoreSearchSuite) addEntities(c *gc.C) {
+	addSearchEntities(c, s.store)
+}
+
+// addSearchEntities adds all of storetesting.SearchEntities to the
+// given store and synchronises its search index.
+func addSearchEntities(c *gc.C, store *Store) {
 	for _, ent := range storetesting.SearchEntities {
 		if ent.URL.Series == "bundle" {
 			continue
 		}
-		addCharmForSearch(c, s.store, ent.ResolvedURL(), ent.Charm, ent.ACL, ent.Downloads)
+		addCharmForSearch(c, store, ent.ResolvedURL(), ent.Charm, ent.ACL, ent.Downloads)
 
 	}
 	for _, ent := range storetesting.SearchEntities {
 		if ent.URL.Series == "bundle" {
-			addBundleForSearch(c, s.store, ent.ResolvedURL(), ent.Bundle, ent.ACL, ent.Downloads)
+			addBundleForSearch(c, store, ent.ResolvedURL(), ent.Bundle, ent.ACL, ent.Downloads)
 		}
 	}
-	s.store.pool.statsCache.EvictAll()
-	err := s.store.syncSearch()
+	store.pool.statsCache.EvictAll()
+	err := store.syncSearch()
 	c.Assert(err, gc.Equals, nil)
 }
 
@@ -94,11 +103,42 @@ func (s *StoreSearchSuite) TestSuccessfulExport(c *gc.C) {
 			AllSeries:      true,
 			SingleSeries:   ent.URL.Series != "",
 			TotalDownloads: int64(ent.Downloads),
+			Tags:           entityTags(entity),
 		}
 		c.Assert(string(actual), jc.JSONEquals, doc)
 	}
 }
 
+func (s *StoreSearchSuite) TestDeleteBaseEntityRemovesSearchDocuments(c *gc.C) {
+	entity := s.entity(c, storetesting.SearchEntities["multi-series"].ResolvedURL())
+	c.Assert(entity.SupportedSeries, gc.Not(gc.HasLen), 0)
+	urls := []*charm.URL{entity.URL}
+	for _, series := range entity.SupportedSeries {
+		u := *entity.URL
+		u.Series = series
+		urls = append(urls, &u)
+	}
+	for _, u := range urls {
+		present, err := s.store.ES.HasDocument(s.TestIndex, typeName, s.store.ES.getID(u))
+		c.Assert(err, gc.Equals, nil)
+		c.Assert(present, gc.Equals, true, gc.Commentf("%v", u))
+	}
+
+	err := s.store.DeleteBaseEntity(entity.URL)
+	c.Assert(err, gc.Equals, nil)
+
+	for _, u := range urls {
+		present, err := s.store.ES.HasDocument(s.TestIndex, typeName, s.store.ES.getID(u))
+		c.Assert(err, gc.Equals, nil)
+		c.Assert(present, gc.Equals, false, gc.Commentf("%v", u))
+	}
+	// Other documents are not affected.
+	entity = s.entity(c, storetesting.SearchEntities["wordpress"].ResolvedURL())
+	present, err := s.store.ES.HasDocument(s.TestIndex, typeName, s.store.ES.getID(entity.URL))
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(present, gc.Equals, true)
+}
+
 func (s *StoreSearchSuite) TestNoExportDeprecated(c *gc.C) {
 	charmArchive := storetesting.NewCharm(nil)
 	url := router.MustNewResolvedURL("cs:~charmers/saucy/mysql-4", -1)
@@ -149,6 +189,7 @@ func (s *StoreSearchSuite) TestExportOnlyLatest(c *gc.C) {
 		Series:       expected.SupportedSeries,
 		SingleSeries: true,
 		AllSeries:    true,
+		Tags:         entityTags(expected),
 	}
 	c.Assert(string(actual), jc.JSONEquals, doc)
 }
@@ -188,6 +229,7 @@ func (s *StoreSearchSuite) TestExportMultiSeriesCharmsCreateExpandedVersions(c *
 		Series:       expected.SupportedSeries,
 		SingleSeries: false,
 		AllSeries:    true,
+		Tags:         entityTags(expected),
 	}
 	c.Assert(string(actual), jc.JSONEquals, doc)
 	err = s.store.ES.GetDocument(s.TestIndex, typeName, s.store.ES.getID(old.URL), &actual)
@@ -199,6 +241,7 @@ func (s *StoreSearchSuite) TestExportMultiSeriesCharmsCreateExpandedVersions(c *
 		Series:       []string{old.URL.Series},
 		SingleSeries: true,
 		AllSeries:    false,
+		Tags:         entityTags(expected),
 	}
 	c.Assert(string(actual), jc.JSONEquals, doc)
 }
@@ -837,6 +880,660 @@ func (s *StoreSearchSuite) TestBoosting(c *gc.C) {
 	})
 }
 
+var facetTests = []struct {
+	about  string
+	sp     SearchParams
+	total  int
+	expect map[string][]FacetCount
+}{{
+	about: "type facet",
+	sp: SearchParams{
+		Facets: []string{"type"},
+	},
+	total: 7,
+	expect: map[string][]FacetCount{
+		"type": {{"charm", 6}, {"bundle", 1}},
+	},
+}, {
+	about: "owner facet includes entities readable by groups",
+	sp: SearchParams{
+		Facets: []string{"owner"},
+		Groups: []string{"charmers"},
+	},
+	total: 8,
+	expect: map[string][]FacetCount{
+		"owner": {{"charmers", 5}, {"cf-charmers", 1}, {"foo", 1}, {"openstack-charmers", 1}},
+	},
+}, {
+	about: "admin owner facet",
+	sp: SearchParams{
+		Facets: []string{"owner"},
+		Admin:  true,
+	},
+	total: 8,
+	expect: map[string][]FacetCount{
+		"owner": {{"charmers", 5}, {"cf-charmers", 1}, {"foo", 1}, {"openstack-charmers", 1}},
+	},
+}, {
+	about: "facets are not affected by limit and skip",
+	sp: SearchParams{
+		Text:   "wordpress",
+		Facets: []string{"series"},
+		Limit:  1,
+		Skip:   1,
+	},
+	total: 2,
+	expect: map[string][]FacetCount{
+		"series": facetCounts(map[string]int{
+			storetesting.SearchSeries[0]: 1,
+			"bundle":                     1,
+		}),
+	},
+}, {
+	about: "tags facet with filter",
+	sp: SearchParams{
+		Filters: map[string][]string{
+			"series": {storetesting.SearchSeries[2]},
+		},
+		Facets: []string{"tags"},
+	},
+	total: 4,
+	expect: map[string][]FacetCount{
+		"tags": {
+			{"bar", 1},
+			{"multi-series", 1},
+			{"multi-seriesCAT", 1},
+			{"multi-seriesTAG", 1},
+			{"mysql", 1},
+			{"mysqlTAG", 1},
+			{"varnish", 1},
+			{"varnishTAG", 1},
+		},
+	},
+}, {
+	about: "multiple facets",
+	sp: SearchParams{
+		Filters: map[string][]string{
+			"type": {"bundle"},
+		},
+		Facets: []string{"owner", "tags", "type"},
+	},
+	total: 1,
+	expect: map[string][]FacetCount{
+		"owner": {{"charmers", 1}},
+		"tags":  {{"wordpress", 1}},
+		"type":  {{"bundle", 1}},
+	},
+}, {
+	about: "expanded multi-series charms",
+	sp: SearchParams{
+		Filters: map[string][]string{
+			"name": {"multi-series"},
+		},
+		Facets:              []string{"type"},
+		ExpandedMultiSeries: true,
+	},
+	total: len(storetesting.SearchSeries),
+	expect: map[string][]FacetCount{
+		"type": {{"charm", len(storetesting.SearchSeries)}},
+	},
+}, {
+	about: "no matches",
+	sp: SearchParams{
+		Text:   "nothing",
+		Facets: []string{"series"},
+	},
+	expect: map[string][]FacetCount{
+		"series": {},
+	},
+}}
+
+func (s *StoreSearchSuite) TestFacets(c *gc.C) {
+	err := s.store.ES.Database.RefreshIndex(s.TestIndex)
+	c.Assert(err, gc.Equals, nil)
+	for i, test := range facetTests {
+		c.Logf("test %d: %s", i, test.about)
+		total, facets := searchFacets(c, s.store, test.sp)
+		c.Check(total, gc.Equals, test.total)
+		c.Check(facets, jc.DeepEquals, test.expect)
+	}
+}
+
+func (s *StoreSearchSuite) TestNoFacets(c *gc.C) {
+	err := s.store.ES.Database.RefreshIndex(s.TestIndex)
+	c.Assert(err, gc.Equals, nil)
+	_, facets := searchFacets(c, s.store, SearchParams{})
+	c.Assert(facets, gc.IsNil)
+}
+
+var parseFacetsTests = []struct {
+	about       string
+	facets      []string
+	expect      []string
+	expectError string
+}{{
+	about:  "single facet",
+	facets: []string{"series"},
+	expect: []string{"series"},
+}, {
+	about:  "comma separated facets",
+	facets: []string{"series,owner", "tags"},
+	expect: []string{"series", "owner", "tags"},
+}, {
+	about:  "duplicate facets",
+	facets: []string{"type,type", "type"},
+	expect: []string{"type"},
+}, {
+	about:       "unknown facet",
+	facets:      []string{"series,name"},
+	expectError: `unrecognized facet "name"`,
+}}
+
+func (s *StoreSearchSuite) TestParseFacets(c *gc.C) {
+	for i, test := range parseFacetsTests {
+		c.Logf("test %d: %s", i, test.about)
+		var sp SearchParams
+		err := sp.ParseFacets(test.facets...)
+		if test.expectError != "" {
+			c.Assert(err, gc.ErrorMatches, test.expectError)
+			continue
+		}
+		c.Assert(err, gc.Equals, nil)
+		c.Assert(sp.Facets, jc.DeepEquals, test.expect)
+	}
+}
+
+func (s *StoreSearchSuite) TestFacetCounts(c *gc.C) {
+	counts := map[string]int{
+		"a": 1,
+		"b": 3,
+		"c": 0,
+		"d": 1,
+	}
+	for i := 0; i < maxFacetValues-2; i++ {
+		counts[fmt.Sprintf("e%02d", i)] = 2
+	}
+	fcs := facetCounts(counts)
+	c.Assert(fcs, gc.HasLen, maxFacetValues)
+	c.Assert(fcs[0], gc.Equals, FacetCount{"b", 3})
+	c.Assert(fcs[1], gc.Equals, FacetCount{"e00", 2})
+	c.Assert(fcs[maxFacetValues-1], gc.Equals, FacetCount{"a", 1})
+}
+
+// addTranscoderForSearch adds the transcoder test charm, which has
+// config options, actions, a resource, storage and devices, and
+// publishes it so that it is indexed in search.
+func addTranscoderForSearch(c *gc.C, store *Store) *router.ResolvedURL {
+	id := router.MustNewResolvedURL("cs:~charmers/"+storetesting.SearchSeries[0]+"/transcoder-1", 1)
+	err := store.AddCharmWithArchive(id, storetesting.Charms.CharmDir("transcoder"))
+	c.Assert(err, gc.Equals, nil)
+	content := "ffmpeg content"
+	_, err = store.UploadResource(id, "ffmpeg", -1, strings.NewReader(content), hashOfString(content), int64(len(content)))
+	c.Assert(err, gc.Equals, nil)
+	err = store.SetPerms(&id.URL, "stable.read", params.Everyone)
+	c.Assert(err, gc.Equals, nil)
+	err = store.Publish(id, map[string]int{"ffmpeg": 0}, params.StableChannel)
+	c.Assert(err, gc.Equals, nil)
+	return id
+}
+
+var charmFieldFilterTests = []struct {
+	about       string
+	filters     map[string][]string
+	expectMatch bool
+}{{
+	about: "config option",
+	filters: map[string][]string{
+		"config": {"codec"},
+	},
+	expectMatch: true,
+}, {
+	about: "all config options must match",
+	filters: map[string][]string{
+		"config": {"codec resolution"},
+	},
+}, {
+	about: "any filter value may match",
+	filters: map[string][]string{
+		"config": {"resolution", "codec bitrate"},
+	},
+	expectMatch: true,
+}, {
+	about: "action",
+	filters: map[string][]string{
+		"actions": {"backup"},
+	},
+	expectMatch: true,
+}, {
+	about: "unknown action",
+	filters: map[string][]string{
+		"actions": {"snapshot"},
+	},
+}, {
+	about: "resource",
+	filters: map[string][]string{
+		"resources": {"ffmpeg"},
+	},
+	expectMatch: true,
+}, {
+	about: "resource type",
+	filters: map[string][]string{
+		"resource-types": {"file"},
+	},
+	expectMatch: true,
+}, {
+	about: "other resource type",
+	filters: map[string][]string{
+		"resource-types": {"oci-image"},
+	},
+}, {
+	about: "storage",
+	filters: map[string][]string{
+		"storage": {"media scratch"},
+	},
+	expectMatch: true,
+}, {
+	about: "device",
+	filters: map[string][]string{
+		"devices": {"gpu"},
+	},
+	expectMatch: true,
+}, {
+	about: "unknown device",
+	filters: map[string][]string{
+		"devices": {"tpu"},
+	},
+}, {
+	about: "several filters",
+	filters: map[string][]string{
+		"actions": {"transcode"},
+		"storage": {"media"},
+		"config":  {"bitrate"},
+	},
+	expectMatch: true,
+}}
+
+// testCharmFieldFilters checks that the filters on the names of charm
+// config options, actions, resources, storage and devices match the
+// transcoder charm with the given id, and no other entity.
+func testCharmFieldFilters(c *gc.C, store *Store, id *router.ResolvedURL) {
+	doc, err := store.searchEngine().GetSearchDocument(&id.URL)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(doc.CharmConfigOptions, jc.DeepEquals, []string{"bitrate", "codec"})
+	c.Assert(doc.CharmActionNames, jc.DeepEquals, []string{"backup", "transcode"})
+	c.Assert(doc.CharmResourceNames, jc.DeepEquals, []string{"ffmpeg"})
+	c.Assert(doc.CharmResourceTypes, jc.DeepEquals, []string{"file"})
+	c.Assert(doc.CharmStorageNames, jc.DeepEquals, []string{"media", "scratch"})
+	c.Assert(doc.CharmDeviceNames, jc.DeepEquals, []string{"gpu"})
+
+	for i, test := range charmFieldFilterTests {
+		c.Logf("test %d: %s", i, test.about)
+		_, res := search(c, store, SearchParams{
+			Filters: test.filters,
+		})
+		var urls []string
+		for _, e := range res {
+			urls = append(urls, e.URL.String())
+		}
+		if test.expectMatch {
+			c.Check(urls, jc.DeepEquals, []string{id.URL.String()})
+		} else {
+			c.Check(urls, gc.HasLen, 0)
+		}
+	}
+}
+
+func (s *StoreSearchSuite) TestCharmFieldFilters(c *gc.C) {
+	id := addTranscoderForSearch(c, s.store)
+	err := s.store.ES.Database.RefreshIndex(s.TestIndex)
+	c.Assert(err, gc.Equals, nil)
+	testCharmFieldFilters(c, s.store, id)
+}
+
+var fuzzySearchTests = []struct {
+	about             string
+	sp                SearchParams
+	expectResults     []string
+	expectTotal       int
+	expectSuggestions []string
+}{{
+	about: "misspelt name",
+	sp: SearchParams{
+		Text:  "wordpres",
+		Fuzzy: true,
+	},
+	expectResults: []string{
+		storetesting.SearchEntities["wordpress-simple"].URL.String(),
+		storetesting.SearchEntities["wordpress"].URL.String(),
+	},
+	expectTotal:       2,
+	expectSuggestions: []string{"wordpress"},
+}, {
+	about: "misspelt name with matches beyond the requested page",
+	sp: SearchParams{
+		Text:  "wordpres",
+		Fuzzy: true,
+		Skip:  2,
+	},
+	expectTotal:       2,
+	expectSuggestions: []string{"wordpress"},
+}, {
+	about: "misspelt name with fuzzy search disabled",
+	sp: SearchParams{
+		Text: "wordpres",
+	},
+}, {
+	about: "exact match",
+	sp: SearchParams{
+		Text:  "wordpress",
+		Fuzzy: true,
+	},
+	expectResults: []string{
+		storetesting.SearchEntities["wordpress-simple"].URL.String(),
+		storetesting.SearchEntities["wordpress"].URL.String(),
+	},
+	expectTotal: 2,
+}, {
+	about: "nothing close",
+	sp: SearchParams{
+		Text:  "xyzzyx",
+		Fuzzy: true,
+	},
+}}
+
+// testFuzzySearch checks that fuzzy searches fall back to matching
+// misspelt terms and suggest corrections only when nothing matches
+// exactly.
+func testFuzzySearch(c *gc.C, store *Store) {
+	for i, test := range fuzzySearchTests {
+		c.Logf("test %d: %s", i, test.about)
+		q := store.SearchQuery(test.sp)
+		it := q.Iter(nil)
+		var urls []string
+		var e mongodoc.Entity
+		for it.Next(&e) {
+			urls = append(urls, e.URL.String())
+		}
+		c.Assert(it.Err(), gc.Equals, nil)
+		sort.Strings(urls)
+		c.Check(urls, jc.DeepEquals, test.expectResults)
+		c.Check(q.Total(), gc.Equals, test.expectTotal)
+		c.Check(q.Suggestions(), jc.DeepEquals, test.expectSuggestions)
+	}
+}
+
+func (s *StoreSearchSuite) TestFuzzySearch(c *gc.C) {
+	err := s.store.ES.Database.RefreshIndex(s.TestIndex)
+	c.Assert(err, gc.Equals, nil)
+	testFuzzySearch(c, s.store)
+}
+
+var editDistanceTests = []struct {
+	a, b   string
+	expect int
+}{
+	{"", "", 0},
+	{"wordpress", "wordpress", 0},
+	{"wordpres", "wordpress", 1},
+	{"postgressql", "postgresql", 1},
+	{"mysql", "mysqk", 1},
+	{"kitten", "sitting", 3},
+	{"", "abc", 3},
+	{"café", "cafe", 1},
+}
+
+var suggestNamesTests = []struct {
+	about  string
+	text   string
+	names  []string
+	expect []string
+}{{
+	about:  "closest names first",
+	text:   "mysql",
+	names:  []string{"mysqlx", "postgresql", "mysql", "mysqk"},
+	expect: []string{"mysql", "mysqlx", "mysqk"},
+}, {
+	about:  "case insensitive",
+	text:   "WordPres",
+	names:  []string{"wordpress"},
+	expect: []string{"wordpress"},
+}, {
+	about:  "at most maxSuggestions names",
+	text:   "abcdef",
+	names:  []string{"abcdeg", "abcdeh", "abcdei", "abcdej", "abcdek", "abcdel"},
+	expect: []string{"abcdeg", "abcdeh", "abcdei", "abcdej", "abcdek"},
+}, {
+	about: "nothing close",
+	text:  "xyzzyx",
+	names: []string{"wordpress", "mysql"},
+}}
+
+func (s *StoreSearchSuite) TestSuggestNames(c *gc.C) {
+	for i, test := range suggestNamesTests {
+		c.Logf("test %d: %s", i, test.about)
+		c.Check(suggestNames(test.text, test.names), jc.DeepEquals, test.expect)
+	}
+}
+
+func (s *StoreSearchSuite) TestEditDistance(c *gc.C) {
+	for i, test := range editDistanceTests {
+		c.Logf("test %d: %q %q", i, test.a, test.b)
+		c.Check(editDistance(test.a, test.b), gc.Equals, test.expect)
+		c.Check(editDistance(test.b, test.a), gc.Equals, test.expect)
+	}
+}
+
+var parseCursorTests = []struct {
+	about       string
+	cursor      string
+	expect      []json.RawMessage
+	expectError string
+}{{
+	about:  "valid cursor",
+	cursor: "WyJ4IiwyXQ",
+	expect: []json.RawMessage{json.RawMessage(`"x"`), json.RawMessage(`2`)},
+}, {
+	about:       "invalid base64",
+	cursor:      "!!",
+	expectError: `invalid cursor "!!"`,
+}, {
+	about:       "not an array",
+	cursor:      "eyJ4IjoyfQ",
+	expectError: `invalid cursor "eyJ4IjoyfQ"`,
+}, {
+	about:       "empty array",
+	cursor:      "W10",
+	expectError: `invalid cursor "W10"`,
+}}
+
+func (s *StoreSearchSuite) TestParseCursor(c *gc.C) {
+	for i, test := range parseCursorTests {
+		c.Logf("test %d: %s", i, test.about)
+		var sp SearchParams
+		err := sp.ParseCursor(test.cursor)
+		if test.expectError != "" {
+			c.Assert(err, gc.ErrorMatches, test.expectError)
+			continue
+		}
+		c.Assert(err, gc.Equals, nil)
+		c.Assert(sp.After, jc.DeepEquals, test.expect)
+	}
+	cursor, err := makeCursor([]interface{}{"x", 2})
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(cursor, gc.Equals, parseCursorTests[0].cursor)
+}
+
+func (s *StoreSearchSuite) TestSearchSortDSL(c *gc.C) {
+	var sp SearchParams
+	err := sp.ParseSortFields("-downloads")
+	c.Assert(err, gc.Equals, nil)
+	qdsl := createSearchDSL(sp, false)
+	c.Assert(qdsl.Sort, jc.DeepEquals, []elasticsearch.Sort{{
+		Field: "TotalDownloads",
+		Order: elasticsearch.Descending,
+	}, {
+		Field: "URL",
+		Order: elasticsearch.Ascending,
+	}})
+
+	qdsl = createSearchDSL(SearchParams{}, false)
+	c.Assert(qdsl.Sort, jc.DeepEquals, []elasticsearch.Sort{{
+		Field: "_score",
+		Order: elasticsearch.Descending,
+	}, {
+		Field: "URL",
+		Order: elasticsearch.Ascending,
+	}})
+}
+
+func (s *StoreSearchSuite) TestSearchCursor(c *gc.C) {
+	err := s.store.ES.Database.RefreshIndex(s.TestIndex)
+	c.Assert(err, gc.Equals, nil)
+	testSearchCursor(c, s.store)
+}
+
+func (s *StoreSearchSuite) TestSearchCursorIndexChanges(c *gc.C) {
+	err := s.store.ES.Database.RefreshIndex(s.TestIndex)
+	c.Assert(err, gc.Equals, nil)
+	sp := SearchParams{Limit: 100}
+	err = sp.ParseSortFields("name")
+	c.Assert(err, gc.Equals, nil)
+	want, _, _ := searchURLs(c, s.store, sp)
+	c.Assert(len(want) >= 6, gc.Equals, true)
+
+	sp.Limit = 2
+	page, _, cursor := searchURLs(c, s.store, sp)
+	c.Assert(page, jc.DeepEquals, want[:2])
+
+	// Remove the first result from the index so that the
+	// position of the cursor moves back.
+	entity, err := s.store.FindEntity(router.MustNewResolvedURL(want[0], -1), nil)
+	c.Assert(err, gc.Equals, nil)
+	err = s.store.ES.remove([]*mongodoc.Entity{entity})
+	c.Assert(err, gc.Equals, nil)
+	err = s.store.ES.Database.RefreshIndex(s.TestIndex)
+	c.Assert(err, gc.Equals, nil)
+	err = sp.ParseCursor(cursor)
+	c.Assert(err, gc.Equals, nil)
+	page, _, cursor = searchURLs(c, s.store, sp)
+	c.Assert(page, jc.DeepEquals, want[2:4])
+
+	// Add it back so that the position of the cursor moves
+	// forward.
+	err = s.store.UpdateSearch(EntityResolvedURL(entity))
+	c.Assert(err, gc.Equals, nil)
+	err = s.store.ES.Database.RefreshIndex(s.TestIndex)
+	c.Assert(err, gc.Equals, nil)
+	err = sp.ParseCursor(cursor)
+	c.Assert(err, gc.Equals, nil)
+	page, _, _ = searchURLs(c, s.store, sp)
+	c.Assert(page, jc.DeepEquals, want[4:6])
+}
+
+func (s *StoreSearchSuite) TestSearchCursorPositionNotFound(c *gc.C) {
+	s.PatchValue(&maxCursorSearches, 1)
+	err := s.store.ES.Database.RefreshIndex(s.TestIndex)
+	c.Assert(err, gc.Equals, nil)
+	sp := SearchParams{Limit: 2}
+	err = sp.ParseSortFields("name")
+	c.Assert(err, gc.Equals, nil)
+	page, _, cursor := searchURLs(c, s.store, sp)
+	c.Assert(page, gc.HasLen, 2)
+
+	// Remove the first result from the index so that the
+	// position of the cursor can't be found in one search.
+	entity, err := s.store.FindEntity(router.MustNewResolvedURL(page[0], -1), nil)
+	c.Assert(err, gc.Equals, nil)
+	err = s.store.ES.remove([]*mongodoc.Entity{entity})
+	c.Assert(err, gc.Equals, nil)
+	err = s.store.ES.Database.RefreshIndex(s.TestIndex)
+	c.Assert(err, gc.Equals, nil)
+	err = sp.ParseCursor(cursor)
+	c.Assert(err, gc.Equals, nil)
+	q := s.store.SearchQuery(sp)
+	it := q.Iter(nil)
+	var e mongodoc.Entity
+	c.Assert(it.Next(&e), gc.Equals, false)
+	c.Assert(it.Err(), gc.ErrorMatches, "cannot find position of cursor in changed search results; restart the search without a cursor")
+	c.Assert(errgo.Cause(it.Err()), gc.Equals, params.ErrBadRequest)
+	c.Assert(q.NextCursor(), gc.Equals, "")
+}
+
+func (s *StoreSearchSuite) TestSearchCursorMismatch(c *gc.C) {
+	var sp SearchParams
+	err := sp.ParseCursor("WyJ4Il0")
+	c.Assert(err, gc.Equals, nil)
+	q := s.store.SearchQuery(sp)
+	it := q.Iter(nil)
+	var e mongodoc.Entity
+	c.Assert(it.Next(&e), gc.Equals, false)
+	c.Assert(it.Err(), gc.ErrorMatches, "cursor does not match search")
+	c.Assert(errgo.Cause(it.Err()), gc.Equals, params.ErrBadRequest)
+}
+
+var searchCursorTests = []struct {
+	about string
+	sort  string
+}{{
+	about: "default order",
+}, {
+	about: "sort by name",
+	sort:  "name",
+}, {
+	about: "sort by descending downloads",
+	sort:  "-downloads",
+}, {
+	about: "sort by series and owner",
+	sort:  "-series,owner",
+}}
+
+// testSearchCursor checks that walking through search results a page
+// at a time with cursors returns the same results in the same order
+// as retrieving them all at once.
+func testSearchCursor(c *gc.C, store *Store) {
+	for i, test := range searchCursorTests {
+		c.Logf("test %d: %s", i, test.about)
+		var sp SearchParams
+		if test.sort != "" {
+			err := sp.ParseSortFields(test.sort)
+			c.Assert(err, gc.Equals, nil)
+		}
+		sp.Limit = 100
+		want, total, cursor := searchURLs(c, store, sp)
+		c.Assert(want, gc.HasLen, total)
+		c.Assert(cursor, gc.Equals, "")
+
+		sp.Limit = 2
+		var got []string
+		for {
+			urls, pageTotal, cursor := searchURLs(c, store, sp)
+			c.Assert(len(urls) <= sp.Limit, gc.Equals, true)
+			c.Assert(pageTotal, gc.Equals, total)
+			got = append(got, urls...)
+			if cursor == "" {
+				break
+			}
+			err := sp.ParseCursor(cursor)
+			c.Assert(err, gc.Equals, nil)
+		}
+		c.Assert(got, jc.DeepEquals, want)
+	}
+}
+
+// searchURLs performs the given search and returns the URLs of the
+// results, the total number of results and the next cursor.
+func searchURLs(c *gc.C, store *Store, sp SearchParams) ([]string, int, string) {
+	q := store.SearchQuery(sp)
+	it := q.Iter(nil)
+	var urls []string
+	var e mongodoc.Entity
+	for it.Next(&e) {
+		urls = append(urls, e.URL.String())
+	}
+	c.Assert(it.Err(), gc.Equals, nil)
+	return urls, q.Total(), q.NextCursor()
+}
+
 func (s *StoreSearchSuite) TestEnsureIndex(c *gc.C) {
 	s.store.ES.Index = s.TestIndex + "-ensure-index"
 	defer s.ES.DeleteDocument(".versions", "version", s.store.ES.Index)
@@ -1059,6 +1756,7 @@ func (s *StoreSearchSuite) TestOnlyIndexStableCharms(c *gc.C) {
 		Series:       []string{storetesting.SearchSeries[2]},
 		AllSeries:    true,
 		SingleSeries: true,
+		Tags:         entityTags(entity),
 	}
 	c.Assert(string(actual), jc.JSONEquals, doc)
 }
@@ -1109,6 +1807,18 @@ func (es Entities) String() string {
 	return "[" + strings.Join(urls, ", ") + "]"
 }
 
+// searchFacets performs the given search and returns the total number
+// of results and the facet counts.
+func searchFacets(c *gc.C, store *Store, sp SearchParams) (int, map[string][]FacetCount) {
+	q := store.SearchQuery(sp)
+	it := q.Iter(nil)
+	var e mongodoc.Entity
+	for it.Next(&e) {
+	}
+	c.Assert(it.Err(), gc.Equals, nil)
+	return q.Total(), q.Facets()
+}
+
 func search(c *gc.C, store *Store, params SearchParams) (int, []*mongodoc.Entity) {
 	q := store.SearchQuery(params)
 	var entities []*mongodoc.Entity
@@ -91,6 +91,15 @@ type ServerParams struct {
 	// refreshes of entities in the search cache.
 	SearchCacheMaxAge time.Duration
 
+	// SearchIndexDir holds the directory in which the embedded
+	// search index is stored. The embedded index is used only when
+	// no elasticsearch database is configured, and only reflects
+	// changes made through this server, so it should not be used
+	// when several servers share the same database. If it is empty
+	// and there is no elasticsearch database, searches return no
+	// results.
+	SearchIndexDir string
+
 	// MaxMgoSessions specifies a soft limit on the maximum
 	// number of mongo sessions used. Each concurrent
 	// HTTP request will use one session.
@@ -130,6 +139,21 @@ type ServerParams struct {
 	// the blobstore garbage collector worker.
 	RunBlobStoreGC bool
 
+	// RunScheduledPublisher holds whether the server will run
+	// the worker that makes scheduled publications when
+	// they become due.
+	RunScheduledPublisher bool
+
+	// RunBlobStoreScrubber holds whether the server will run
+	// the worker that periodically verifies the contents of
+	// the blob store.
+	RunBlobStoreScrubber bool
+
+	// BlobStoreScrubRate holds the maximum number of bytes per
+	// second that the blob store scrubber will read. If it's zero,
+	// the rate is not limited.
+	BlobStoreScrubRate int64
+
 	// NoIndexes specifies that none of the MongoDB indexes should be
 	// created. This speeds up initialization (useful for tests) but should
 	// never be set in production.
@@ -140,6 +164,37 @@ type ServerParams struct {
 	// If this is nil, a MongoDB backend will be used.
 	NewBlobBackend func(db *mgo.Database) blobstore.Backend
 
+	// BlobKeyring holds the master keys used to encrypt
+	// blob data. If it is nil, blobs are stored unencrypted.
+	BlobKeyring *blobstore.Keyring
+
+	// DeletedEntityRetention holds how long deleted charms and
+	// bundles are kept, and so can be restored, before they are
+	// purged by the blobstore garbage collector. If it's zero,
+	// a default of 30 days will be used.
+	DeletedEntityRetention time.Duration
+
+	// CompressBlobs holds whether new blobs are stored
+	// compressed. The hashes and sizes of blobs are always
+	// those of their uncompressed content.
+	CompressBlobs bool
+
+	// TempDir holds the directory in which temporary files
+	// holding large blobs are created. If it's empty, the
+	// default directory for temporary files is used.
+	TempDir string
+
+	// NewSecondaryBlobBackend optionally returns a blobstore
+	// backend that blobs are being migrated from. When it is
+	// set, blobs that are not found in the primary backend are
+	// read from the secondary one, and the server runs a worker
+	// that copies them to the primary backend.
+	NewSecondaryBlobBackend func(db *mgo.Database) blobstore.Backend
+
+	// BlobMigrationName holds the name under which the
+	// progress of the blob migration is recorded.
+	BlobMigrationName string
+
 	// DockerRegistryAddress contains the address of the docker
 	// registry associated with the charmstore.
 	DockerRegistryAddress string
@@ -186,6 +241,9 @@ func NewServer(db *mgo.Database, si *SearchIndex, config ServerParams, versions
 	if len(versions) == 0 {
 		return nil, errgo.Newf("charm store server must serve at least one version of the API")
 	}
+	if config.NewSecondaryBlobBackend != nil && config.BlobMigrationName == "" {
+		return nil, errgo.Newf("no blob migration name specified")
+	}
 	config.IdentityLocation = strings.TrimSuffix(config.IdentityLocation, "/")
 	config.TermsLocation = strings.TrimSuffix(config.TermsLocation, "/")
 	logger.Infof("identity discharge location: %s", config.IdentityLocation)
@@ -265,6 +323,15 @@ func NewServer(db *mgo.Database, si *SearchIndex, config ServerParams, versions
 	if config.RunBlobStoreGC {
 		srv.blobstoreGC = newBlobstoreGC(pool)
 	}
+	if config.RunBlobStoreScrubber {
+		srv.blobstoreScrubber = newBlobstoreScrubber(pool, config.BlobStoreScrubRate)
+	}
+	if config.RunScheduledPublisher {
+		srv.scheduledPublisher = newScheduledPublisher(pool)
+	}
+	if config.NewSecondaryBlobBackend != nil {
+		srv.blobstoreMigrator = newBlobstoreMigrator(pool, config.BlobMigrationName)
+	}
 	return srv, nil
 }
 
@@ -281,10 +348,13 @@ func prometheusHandler() http.Handler {
 }
 
 type Server struct {
-	pool        *Pool
-	mux         *router.ServeMux
-	handlers    []HTTPCloseHandler
-	blobstoreGC *blobstoreGC
+	pool               *Pool
+	mux                *router.ServeMux
+	handlers           []HTTPCloseHandler
+	blobstoreGC        *blobstoreGC
+	blobstoreScrubber  *blobstoreScrubber
+	blobstoreMigrator  *blobstoreMigrator
+	scheduledPublisher *scheduledPublisher
 }
 
 // ServeHTTP implements http.Handler.ServeHTTP.
@@ -300,6 +370,21 @@ func (s *Server) Close() {
 			logger.Errorf("failed to stop blobstore GC: %v", err)
 		}
 	}
+	if s.blobstoreScrubber != nil {
+		if err := worker.Stop(s.blobstoreScrubber); err != nil {
+			logger.Errorf("failed to stop blobstore scrubber: %v", err)
+		}
+	}
+	if s.blobstoreMigrator != nil {
+		if err := worker.Stop(s.blobstoreMigrator); err != nil {
+			logger.Errorf("failed to stop blobstore migrator: %v", err)
+		}
+	}
+	if s.scheduledPublisher != nil {
+		if err := worker.Stop(s.scheduledPublisher); err != nil {
+			logger.Errorf("failed to stop scheduled publisher: %v", err)
+		}
+	}
 	s.pool.Close()
 	for _, h := range s.handlers {
 		h.Close()
@@ -8,11 +8,14 @@ import (
 	"strings"
 	"time"
 
+	"github.com/juju/charmrepo/v6/csclient/params"
+	jc "github.com/juju/testing/checkers"
 	"github.com/juju/testing/httptesting"
 	gc "gopkg.in/check.v1"
 	errgo "gopkg.in/errgo.v1"
 	"gopkg.in/macaroon-bakery.v2-unstable/bakery"
 	"gopkg.in/macaroon-bakery.v2-unstable/bakery/mgostorage"
+	"gopkg.in/mgo.v2"
 	"gopkg.in/retry.v1"
 
 	"gopkg.in/juju/charmstore.v5/internal/blobstore"
@@ -40,6 +43,16 @@ func (s *ServerSuite) TestNewServerWithNoVersions(c *gc.C) {
 	c.Assert(h, gc.IsNil)
 }
 
+func (s *ServerSuite) TestNewServerWithNoBlobMigrationName(c *gc.C) {
+	params := serverParams
+	params.NewSecondaryBlobBackend = func(db *mgo.Database) blobstore.Backend {
+		return blobstore.NewMongoBackend(db, "entitystore")
+	}
+	h, err := NewServer(s.Session.DB("foo"), nil, params, nopAPI)
+	c.Assert(err, gc.ErrorMatches, `no blob migration name specified`)
+	c.Assert(h, gc.IsNil)
+}
+
 type versionResponse struct {
 	Version string
 	Path    string
@@ -260,6 +273,160 @@ func (s *ServerSuite) TestServerStartsBlobstoreGC(c *gc.C) {
 	r.Close()
 }
 
+func (s *ServerSuite) TestServerStartsBlobstoreScrubber(c *gc.C) {
+	store := s.newStore(c, "juju_test")
+	defer store.Close()
+
+	content := "some stuff"
+	err := store.BlobStore.Put(strings.NewReader(content), hashOfString(content), int64(len(content)))
+	c.Assert(err, gc.Equals, nil)
+
+	// Remove the blob's data from the backend behind the
+	// blob store's back.
+	db := s.Session.DB("juju_test")
+	var ref struct {
+		Name string
+	}
+	err = db.C("entitystore.blobref").FindId(hashOfString(content)).One(&ref)
+	c.Assert(err, gc.Equals, nil)
+	err = db.GridFS("entitystore").Remove(ref.Name)
+	c.Assert(err, gc.Equals, nil)
+
+	params := ServerParams{
+		AuthUsername:         "test-user",
+		AuthPassword:         "test-password",
+		IdentityLocation:     "http://0.1.2.3",
+		RunBlobStoreScrubber: true,
+	}
+	h, err := NewServer(db, nil, params, nopAPI)
+	c.Assert(err, gc.Equals, nil)
+	defer h.Close()
+
+	// The scrub runs immediately, but asynchronously.
+	attempt := retry.Regular{
+		Total: 1 * time.Second,
+		Delay: 50 * time.Millisecond,
+	}
+	var failures []blobstore.ScrubFailure
+	for a := attempt.Start(nil); len(failures) == 0 && a.Next(); {
+		failures, err = store.BlobStore.ScrubFailures()
+		c.Assert(err, gc.Equals, nil)
+	}
+	c.Assert(failures, gc.HasLen, 1)
+	c.Assert(failures[0].Hash, gc.Equals, hashOfString(content))
+	c.Assert(failures[0].Error, gc.Equals, "blob not found in backend")
+
+	// The failures are reported by the debug endpoint.
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:    h,
+		URL:        "/debug/blobscrub",
+		Username:   "test-user",
+		Password:   "test-password",
+		ExpectBody: failures,
+	})
+}
+
+func (s *ServerSuite) TestServerStartsScheduledPublisher(c *gc.C) {
+	store := s.newStore(c, "juju_test")
+	defer store.Close()
+
+	id := MustParseResolvedURL("~bob/precise/wordpress-0")
+	err := store.AddCharmWithArchive(id, storetesting.NewCharm(nil))
+	c.Assert(err, gc.Equals, nil)
+	_, err = store.SchedulePublish("bob", id, nil, []params.Channel{params.StableChannel}, time.Now().Add(-time.Minute))
+	c.Assert(err, gc.Equals, nil)
+
+	config := ServerParams{
+		AuthUsername:          "test-user",
+		AuthPassword:          "test-password",
+		IdentityLocation:      "http://0.1.2.3",
+		RunScheduledPublisher: true,
+	}
+	h, err := NewServer(s.Session.DB("juju_test"), nil, config, nopAPI)
+	c.Assert(err, gc.Equals, nil)
+	defer h.Close()
+
+	// The publication is made immediately, but asynchronously.
+	attempt := retry.Regular{
+		Total: 1 * time.Second,
+		Delay: 50 * time.Millisecond,
+	}
+	var docs []*mongodoc.ScheduledPublish
+	for a := attempt.Start(nil); a.Next(); {
+		docs, err = store.ScheduledPublishes(&id.URL)
+		c.Assert(err, gc.Equals, nil)
+		if len(docs) == 0 {
+			break
+		}
+	}
+	c.Assert(docs, gc.HasLen, 0)
+	entity, err := store.FindBestEntity(charm.MustParseURL("~bob/wordpress"), params.StableChannel, nil)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(entity.URL, jc.DeepEquals, &id.URL)
+}
+
+func (s *ServerSuite) TestServerStartsBlobstoreMigrator(c *gc.C) {
+	store := s.newStore(c, "juju_test")
+	defer store.Close()
+
+	content := "some stuff"
+	err := store.BlobStore.Put(strings.NewReader(content), hashOfString(content), int64(len(content)))
+	c.Assert(err, gc.Equals, nil)
+
+	root := c.MkDir()
+	db := s.Session.DB("juju_test")
+	params := ServerParams{
+		AuthUsername:     "test-user",
+		AuthPassword:     "test-password",
+		IdentityLocation: "http://0.1.2.3",
+		NewBlobBackend: func(*mgo.Database) blobstore.Backend {
+			return blobstore.NewFilesystemBackend(root)
+		},
+		NewSecondaryBlobBackend: func(db *mgo.Database) blobstore.Backend {
+			return blobstore.NewMongoBackend(db, "entitystore")
+		},
+		BlobMigrationName: "test",
+	}
+	h, err := NewServer(db, nil, params, nopAPI)
+	c.Assert(err, gc.Equals, nil)
+	defer h.Close()
+
+	// The migration runs immediately, but asynchronously.
+	attempt := retry.Regular{
+		Total: 1 * time.Second,
+		Delay: 50 * time.Millisecond,
+	}
+	var status blobstore.MigrationStatus
+	for a := attempt.Start(nil); !status.Complete && a.Next(); {
+		status, err = store.BlobStore.MigrationStatus("test")
+		if errgo.Cause(err) == blobstore.ErrNotFound {
+			continue
+		}
+		c.Assert(err, gc.Equals, nil)
+	}
+	c.Assert(status.Complete, gc.Equals, true)
+	c.Assert(status.Copied, gc.Equals, 1)
+
+	// The blob is now held in the primary backend.
+	var ref struct {
+		Name string
+	}
+	err = db.C("entitystore.blobref").FindId(hashOfString(content)).One(&ref)
+	c.Assert(err, gc.Equals, nil)
+	r, _, err := blobstore.NewFilesystemBackend(root).Get(ref.Name)
+	c.Assert(err, gc.Equals, nil)
+	r.Close()
+
+	// The status is reported by the debug endpoint.
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:    h,
+		URL:        "/debug/blobmigration",
+		Username:   "test-user",
+		Password:   "test-password",
+		ExpectBody: status,
+	})
+}
+
 func assertServesVersion(c *gc.C, h http.Handler, vers string) {
 	path := vers
 	if path != "" {
@@ -26,6 +26,7 @@ import (
 	"gopkg.in/juju/charmstore.v5/internal/blobstore"
 	"gopkg.in/juju/charmstore.v5/internal/cache"
 	"gopkg.in/juju/charmstore.v5/internal/charm"
+	"gopkg.in/juju/charmstore.v5/internal/entitycache"
 	"gopkg.in/juju/charmstore.v5/internal/mongodoc"
 	"gopkg.in/juju/charmstore.v5/internal/monitoring"
 	"gopkg.in/juju/charmstore.v5/internal/router"
@@ -48,6 +49,12 @@ type Pool struct {
 	bakery *bakery.Service
 	run    *parallel.Run
 
+	// embeddedSearch holds the embedded search index used
+	// when no elasticsearch index is configured. It is nil if
+	// ServerParams.SearchIndexDir is not set or if an elasticsearch
+	// index is used.
+	embeddedSearch *embeddedSearchIndex
+
 	// statsCache holds a cache of AggregatedCounts
 	// values, keyed by entity id. When the id has no
 	// revision, the counts apply to all revisions of the
@@ -87,7 +94,9 @@ const reqStoreCacheSize = 50
 const maxAsyncGoroutines = 50
 
 // NewPool returns a Pool that uses the given database
-// and search index. If bakeryParams is not nil,
+// and search index. If si is nil and config.SearchIndexDir
+// is set, an embedded search index stored in that directory
+// is used instead. If bakeryParams is not nil,
 // the Bakery field in the resulting Store will be set
 // to a new Service that stores macaroons in mongo.
 //
@@ -97,6 +106,9 @@ func NewPool(db *mgo.Database, si *SearchIndex, bakeryParams *bakery.NewServiceP
 	if config.StatsCacheMaxAge == 0 {
 		config.StatsCacheMaxAge = time.Hour
 	}
+	if config.DeletedEntityRetention == 0 {
+		config.DeletedEntityRetention = defaultDeletedEntityRetention
+	}
 	if config.NewBlobBackend == nil {
 		config.NewBlobBackend = func(db *mgo.Database) blobstore.Backend {
 			return blobstore.NewMongoBackend(db, "entitystore")
@@ -130,6 +142,16 @@ func NewPool(db *mgo.Database, si *SearchIndex, bakeryParams *bakery.NewServiceP
 		p.auditEncoder = json.NewEncoder(p.auditLogger)
 	}
 
+	populateSearch := false
+	if config.SearchIndexDir != "" && (si == nil || si.Database == nil) {
+		esi, created, err := newEmbeddedSearchIndex(config.SearchIndexDir)
+		if err != nil {
+			return nil, errgo.Notef(err, "cannot open embedded search index")
+		}
+		p.embeddedSearch = esi
+		populateSearch = created
+	}
+
 	store := p.Store()
 	defer store.Close()
 	if !config.NoIndexes {
@@ -140,6 +162,16 @@ func NewPool(db *mgo.Database, si *SearchIndex, bakeryParams *bakery.NewServiceP
 			return nil, errgo.Notef(err, "cannot ensure elasticsearch indexes")
 		}
 	}
+	if populateSearch {
+		// The embedded search index has just been created,
+		// so populate it from the current contents of the store.
+		if err := store.syncSearch(); err != nil {
+			return nil, errgo.Notef(err, "cannot populate embedded search index")
+		}
+		if err := p.embeddedSearch.setComplete(); err != nil {
+			return nil, errgo.Notef(err, "cannot populate embedded search index")
+		}
+	}
 	return p, nil
 }
 
@@ -205,6 +237,12 @@ func (p *Pool) newBlobStore(db StoreDatabase) *blobstore.Store {
 	if p.config.MaxUploadParts != 0 {
 		bs.MaxParts = p.config.MaxUploadParts
 	}
+	bs.Keyring = p.config.BlobKeyring
+	bs.Compress = p.config.CompressBlobs
+	bs.TempDir = p.config.TempDir
+	if p.config.NewSecondaryBlobBackend != nil {
+		bs.SecondaryBackend = p.config.NewSecondaryBlobBackend(db.Database)
+	}
 	return bs
 }
 
@@ -419,6 +457,21 @@ func (s *Store) ensureIndexes() error {
 	}, {
 		s.DB.DownloadCounts(),
 		mgo.Index{Key: []string{"expires"}, Sparse: true, ExpireAfter: time.Hour},
+	}, {
+		s.DB.ChannelHistory(),
+		mgo.Index{Key: []string{"baseurl", "channel", "-time"}},
+	}, {
+		s.DB.ScheduledPublishes(),
+		mgo.Index{Key: []string{"baseurl", "time"}},
+	}, {
+		s.DB.ScheduledPublishes(),
+		mgo.Index{Key: []string{"time"}},
+	}, {
+		s.DB.DeletedEntities(),
+		mgo.Index{Key: []string{"baseurl"}},
+	}, {
+		s.DB.DeletedEntities(),
+		mgo.Index{Key: []string{"deleted"}},
 	}}
 	for _, idx := range indexes {
 		err := idx.c.EnsureIndex(idx.i)
@@ -436,6 +489,35 @@ func (s *Store) ensureIndexes() error {
 // deleting all blobs that have not been referenced since
 // the given time.
 func (s *Store) BlobStoreGC(before time.Time) error {
+	refs, err := s.blobStoreRefs()
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	stats, err := s.BlobStore.GC(refs, before)
+	if err != nil {
+		return errgo.Notef(err, "blobstore GC failed")
+	}
+	monitoring.SetBlobStoreStats(stats)
+	return nil
+}
+
+// BlobStoreGCDryRun reports the blobs that BlobStoreGC would delete
+// if it was called with the same time, without deleting anything.
+func (s *Store) BlobStoreGCDryRun(before time.Time) (*blobstore.GCReport, error) {
+	refs, err := s.blobStoreRefs()
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	report, err := s.BlobStore.GCDryRun(refs, before)
+	if err != nil {
+		return nil, errgo.Notef(err, "blobstore GC dry run failed")
+	}
+	return report, nil
+}
+
+// blobStoreRefs returns the hashes of all the blobs
+// referred to by entities and resources.
+func (s *Store) blobStoreRefs() (*blobstore.Refs, error) {
 	// BEWARE: if this code does not add all the relevant blob
 	// hashes, they will be removed by the garbage collector!
 
@@ -443,11 +525,11 @@ func (s *Store) BlobStoreGC(before time.Time) error {
 	// measure of hash count.
 	entityCount, err := s.DB.Entities().Count()
 	if err != nil {
-		return errgo.Mask(err)
+		return nil, errgo.Mask(err)
 	}
 	resourceCount, err := s.DB.Resources().Count()
 	if err != nil {
-		return errgo.Mask(err)
+		return nil, errgo.Mask(err)
 	}
 	// Assume non-multipart resources, v5 entities that need conversion,
 	// and a 20% duplication rate,
@@ -461,13 +543,29 @@ func (s *Store) BlobStoreGC(before time.Time) error {
 	)).Iter()
 	var entity mongodoc.Entity
 	for iter.Next(&entity) {
+		refs.Add(entity.BlobHash, blobstore.ArchiveBlob)
 		if entity.PreV5BlobExtraHash != "" {
-			refs.Add(entity.PreV5BlobExtraHash)
+			refs.Add(entity.PreV5BlobExtraHash, blobstore.PreV5ArchiveBlob)
 		}
-		refs.Add(entity.BlobHash)
 	}
 	if err := iter.Err(); err != nil {
-		return errgo.Mask(err)
+		return nil, errgo.Mask(err)
+	}
+	// Deleted entities can still be restored, so
+	// their blobs must be kept too.
+	iter = s.DB.DeletedEntities().Find(nil).Select(bson.D{
+		{"entity.prev5blobextrahash", 1},
+		{"entity.blobhash", 1},
+	}).Iter()
+	var deleted mongodoc.DeletedEntity
+	for iter.Next(&deleted) {
+		refs.Add(deleted.Entity.BlobHash, blobstore.ArchiveBlob)
+		if deleted.Entity.PreV5BlobExtraHash != "" {
+			refs.Add(deleted.Entity.PreV5BlobExtraHash, blobstore.PreV5ArchiveBlob)
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return nil, errgo.Mask(err)
 	}
 	iter = s.DB.Resources().Find(nil).Select(FieldSelector(
 		"blobhash",
@@ -476,22 +574,17 @@ func (s *Store) BlobStoreGC(before time.Time) error {
 	var resource mongodoc.Resource
 	for iter.Next(&resource) {
 		if resource.BlobIndex == nil {
-			refs.Add(resource.BlobHash)
+			refs.Add(resource.BlobHash, blobstore.ResourceBlob)
 			continue
 		}
 		for _, hash := range resource.BlobIndex.Hashes {
-			refs.Add(hash)
+			refs.Add(hash, blobstore.MultipartPartBlob)
 		}
 	}
 	if err := iter.Err(); err != nil {
-		return errgo.Mask(err)
-	}
-	stats, err := s.BlobStore.GC(refs, before)
-	if err != nil {
-		return errgo.Notef(err, "blobstore GC failed")
+		return nil, errgo.Mask(err)
 	}
-	monitoring.SetBlobStoreStats(stats)
-	return nil
+	return refs, nil
 }
 
 // AddAudit adds the given entry to the audit log.
@@ -643,7 +736,26 @@ func (s *Store) FindEntities(url *charm.URL, fields map[string]int) ([]*mongodoc
 // If the URL does not contain a revision then the channel is searched
 // for the best match, here NoChannel will be treated as
 // params.StableChannel.
+//
+// If no entity is found and the URL's charm or bundle has been
+// transferred to another namespace (see TransferBaseEntity), the
+// entity is looked up in the new namespace instead.
 func (s *Store) FindBestEntity(url *charm.URL, channel params.Channel, fields map[string]int) (*mongodoc.Entity, error) {
+	entity, err := s.findBestEntity(url, channel, fields)
+	if errgo.Cause(err) != params.ErrNotFound {
+		return entity, err
+	}
+	newURL, rerr := s.redirectedURL(url)
+	if rerr != nil {
+		return nil, errgo.Mask(rerr)
+	}
+	if newURL == nil {
+		return nil, err
+	}
+	return s.findBestEntity(newURL, channel, fields)
+}
+
+func (s *Store) findBestEntity(url *charm.URL, channel params.Channel, fields map[string]int) (*mongodoc.Entity, error) {
 	if fields != nil {
 		// Make sure we have all the fields we need to make a decision.
 		// TODO this would be more efficient if we used bitmasks for field selection.
@@ -671,7 +783,7 @@ func (s *Store) FindBestEntity(url *charm.URL, channel params.Channel, fields ma
 		// If a channel was specified make sure the entity is in that channel.
 		// This is crucial because if we don't do this, then the user could choose
 		// to use any chosen set of ACLs against any entity.
-		if params.ValidChannels[channel] && channel != params.UnpublishedChannel && !entity.Published[channel] {
+		if ValidChannel(channel) && channel != params.UnpublishedChannel && !entity.Published[channel] {
 			return nil, errgo.WithCausef(nil, params.ErrNotFound, "%s not found in %s channel", url, channel)
 		}
 		return entity, nil
@@ -926,18 +1038,28 @@ func (s *Store) UpdateBaseEntity(url *router.ResolvedURL, update bson.D) error {
 var ErrPublishResourceMismatch = errgo.Newf("charm published with incorrect resources")
 
 // Publish assigns channels to the entity corresponding to the given URL.
-// An error is returned if no channels are provided. See params.ValidChannels
-// for the list of supported channels. The unpublished channel cannot
-// be provided.
+// An error is returned if no channels are provided. See ParseChannel
+// for the supported channels, which may be in any track. The
+// unpublished channel cannot be provided.
 //
 // If the given resources do not match those expected or they're not
 // found, an error with a ErrPublichResourceMismatch cause will be returned.
+//
+// Each publication is recorded in the channel history
+// (see ChannelHistory).
 func (s *Store) Publish(url *router.ResolvedURL, resources map[string]int, channels ...params.Channel) error {
+	return s.PublishAs("", url, resources, channels...)
+}
+
+// PublishAs is like Publish except that it records the given
+// user as the publisher in the channel history.
+func (s *Store) PublishAs(user string, url *router.ResolvedURL, resources map[string]int, channels ...params.Channel) error {
 	var updateSearch bool
 	// Throw away any channels that we don't like.
 	actualChannels := make([]params.Channel, 0, len(channels))
 	for _, c := range channels {
-		if !params.ValidChannels[c] || c == params.UnpublishedChannel {
+		c, err := ParseChannel(string(c))
+		if err != nil || c == params.UnpublishedChannel {
 			continue
 		}
 		actualChannels = append(actualChannels, c)
@@ -971,7 +1093,7 @@ func (s *Store) Publish(url *router.ResolvedURL, resources map[string]int, chann
 	// Update the entity's published channels.
 	update := make(bson.D, 0, len(channels)*(len(series)+1)) // ...ish.
 	for _, c := range channels {
-		update = append(update, bson.DocElem{"published." + string(c), true})
+		update = append(update, bson.DocElem{"published." + mongodoc.ChannelKey(c), true})
 	}
 	if err := s.UpdateEntity(url, bson.D{{"$set", update}}); err != nil {
 		return errgo.Mask(err, errgo.Is(params.ErrNotFound))
@@ -981,13 +1103,16 @@ func (s *Store) Publish(url *router.ResolvedURL, resources map[string]int, chann
 	update = update[:0]
 	for _, c := range channels {
 		for _, s := range series {
-			update = append(update, bson.DocElem{fmt.Sprintf("channelentities.%s.%s", c, s), entity.URL})
+			update = append(update, bson.DocElem{fmt.Sprintf("channelentities.%s.%s", mongodoc.ChannelKey(c), s), entity.URL})
 		}
-		update = append(update, bson.DocElem{fmt.Sprintf("channelresources.%s", c), resourceDocs})
+		update = append(update, bson.DocElem{fmt.Sprintf("channelresources.%s", mongodoc.ChannelKey(c)), resourceDocs})
 	}
 	if err := s.UpdateBaseEntity(url, bson.D{{"$set", update}}); err != nil {
 		return errgo.Mask(err)
 	}
+	if err := s.addChannelHistory(user, entity, series, resourceDocs, channels); err != nil {
+		return errgo.Mask(err)
+	}
 
 	if !updateSearch {
 		return nil
@@ -1228,11 +1353,14 @@ func (s *Store) SetPromulgated(url *router.ResolvedURL, promulgate bool) error {
 
 // SetPerms sets the ACL specified by which for the base entity with the
 // given id. The which parameter is in the form "channel.operation",
-// where channel is the string corresponding to one of the ValidChannels
+// where channel is a canonical channel name (see ParseChannel)
 // and operation is one of "read" or "write". If which does not specify a
 // channel then the unpublished ACL is updated.
 // This is only provided for testing.
 func (s *Store) SetPerms(id *charm.URL, which string, acl ...string) error {
+	if i := strings.LastIndex(which, "."); i != -1 {
+		which = mongodoc.ChannelKey(params.Channel(which[:i])) + which[i:]
+	}
 	return s.DB.BaseEntities().UpdateId(mongodoc.BaseURL(id), bson.D{{"$set",
 		bson.D{{"channelacls." + which, acl}},
 	}})
@@ -1304,13 +1432,16 @@ func (s *Store) AddLog(data *json.RawMessage, logLevel mongodoc.LogLevel, logTyp
 // the entity is the current published revision for any channel or the
 // last revision with the same base entity, it returns an error with an
 // ErrForbidden cause.
+//
+// The deleted entity is kept so that it can be restored with
+// RestoreEntity until it is removed by PurgeDeletedEntities.
 func (s *Store) DeleteEntity(id *router.ResolvedURL) error {
 	// Find all the entities that use the base URL of id so
 	// that we can refuse to delete the last reference to the
 	// base URL.
 	var entities []*mongodoc.Entity
 	err := s.DB.Entities().Find(bson.D{{"baseurl", mongodoc.BaseURL(&id.URL)}}).
-		Select(FieldSelector("blobhash", "prev5blobhash")).
+		Select(FieldSelector("blobhash", "prev5blobhash", "size")).
 		All(&entities)
 	if err != nil {
 		return errgo.Mask(err)
@@ -1349,6 +1480,11 @@ func (s *Store) DeleteEntity(id *router.ResolvedURL) error {
 		sort.Strings(published)
 		return errgo.WithCausef(nil, params.ErrForbidden, "cannot delete %q because it is the current revision in channels %s", &id.URL, published)
 	}
+	// Move the entity to the deleted entities collection so that
+	// it can be restored later if needed.
+	if err := s.trashEntity(id); err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
 	// Remove the entity.
 	if err := s.DB.Entities().RemoveId(&id.URL); err != nil {
 		if err == mgo.ErrNotFound {
@@ -1357,7 +1493,70 @@ func (s *Store) DeleteEntity(id *router.ResolvedURL) error {
 		}
 		return errgo.Mask(err, errgo.Is(params.ErrNotFound))
 	}
+	if err := s.releaseQuota(id.URL.User, entity.Size); err != nil {
+		logger.Errorf("cannot release quota for deleted entity: %v", err)
+	}
+	return nil
+}
 
+// DeleteBaseEntity deletes the charm or bundle with the given URL
+// entirely: all its revisions, published or not, all its resources, any
+// deleted revisions that could otherwise be restored, its search
+// documents and finally its base entity, which holds its channels and
+// permissions. The user, series and revision of url are ignored.
+//
+// Unlike DeleteEntity, this cannot be undone. If there is no such base
+// entity, it returns an error with a params.ErrNotFound cause.
+func (s *Store) DeleteBaseEntity(url *charm.URL) error {
+	baseURL := mongodoc.BaseURL(url)
+	if _, err := s.FindBaseEntity(baseURL, FieldSelector("_id")); err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	var entities []*mongodoc.Entity
+	err := s.DB.Entities().Find(bson.D{{"baseurl", baseURL}}).
+		Select(FieldSelector("supportedseries", "size")).
+		All(&entities)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	var resources []*mongodoc.Resource
+	if err := s.DB.Resources().Find(bson.D{{"baseurl", baseURL}}).Select(FieldSelector("size")).All(&resources); err != nil {
+		return errgo.Mask(err)
+	}
+	// Remove everything that refers to the base entity before
+	// the base entity itself, so that the deletion can be
+	// retried if it fails part way through.
+	if err := s.removeSearch(entities); err != nil {
+		return errgo.Notef(err, "cannot remove search documents for %q", baseURL)
+	}
+	if _, err := s.DB.Entities().RemoveAll(bson.D{{"baseurl", baseURL}}); err != nil {
+		return errgo.Notef(err, "cannot remove entities")
+	}
+	if _, err := s.DB.Resources().RemoveAll(bson.D{{"baseurl", baseURL}}); err != nil {
+		return errgo.Notef(err, "cannot remove resources")
+	}
+	if _, err := s.DB.DeletedEntities().RemoveAll(bson.D{{"baseurl", baseURL}}); err != nil {
+		return errgo.Notef(err, "cannot remove deleted entities")
+	}
+	if _, err := s.DB.ChannelHistory().RemoveAll(bson.D{{"baseurl", baseURL}}); err != nil {
+		return errgo.Notef(err, "cannot remove channel history")
+	}
+	if _, err := s.DB.ScheduledPublishes().RemoveAll(bson.D{{"baseurl", baseURL}}); err != nil {
+		return errgo.Notef(err, "cannot remove scheduled publications")
+	}
+	if err := s.DB.BaseEntities().RemoveId(baseURL); err != nil && err != mgo.ErrNotFound {
+		return errgo.Notef(err, "cannot remove base entity")
+	}
+	for _, e := range entities {
+		if err := s.releaseQuota(baseURL.User, e.Size); err != nil {
+			logger.Errorf("cannot release quota for deleted entity: %v", err)
+		}
+	}
+	for _, r := range resources {
+		if err := s.releaseQuota(baseURL.User, r.Size); err != nil {
+			logger.Errorf("cannot release quota for deleted resource: %v", err)
+		}
+	}
 	return nil
 }
 
@@ -1439,17 +1638,52 @@ func (s StoreDatabase) Users() *mgo.Collection {
 	return s.C("users")
 }
 
+// Quotas returns the Mongo collection where namespace storage
+// quotas and usage are stored.
+func (s StoreDatabase) Quotas() *mgo.Collection {
+	return s.C("quotas")
+}
+
+// DeletedEntities returns the Mongo collection where deleted
+// entities are kept until they are purged.
+func (s StoreDatabase) DeletedEntities() *mgo.Collection {
+	return s.C("deletedentities")
+}
+
+// ChannelHistory returns the Mongo collection where the
+// history of publications to channels is stored.
+func (s StoreDatabase) ChannelHistory() *mgo.Collection {
+	return s.C("channelhistory")
+}
+
+// Redirects returns the Mongo collection where redirects
+// from the old base URLs of transferred entities are stored.
+func (s StoreDatabase) Redirects() *mgo.Collection {
+	return s.C("redirects")
+}
+
+// ScheduledPublishes returns the Mongo collection where
+// publications scheduled for a later time are stored.
+func (s StoreDatabase) ScheduledPublishes() *mgo.Collection {
+	return s.C("scheduledpublishes")
+}
+
 // allCollections holds for each collection used by the charm store a
 // function returns that collection.
 var allCollections = []func(StoreDatabase) *mgo.Collection{
 	StoreDatabase.BaseEntities,
+	StoreDatabase.ChannelHistory,
+	StoreDatabase.DeletedEntities,
 	StoreDatabase.DownloadCounts,
 	StoreDatabase.Entities,
 	StoreDatabase.Logs,
 	StoreDatabase.Macaroons,
 	StoreDatabase.Migrations,
+	StoreDatabase.Quotas,
+	StoreDatabase.Redirects,
 	StoreDatabase.Resources,
 	StoreDatabase.Revisions,
+	StoreDatabase.ScheduledPublishes,
 	StoreDatabase.Users,
 }
 
@@ -1493,7 +1727,7 @@ func ReaderAtSeeker(r io.ReadSeeker) io.ReaderAt {
 // SearchQuery creates a new SearchQuery with the given parameters.
 func (s *Store) SearchQuery(sp SearchParams) *SearchQuery {
 	return &SearchQuery{
-		index:  s.ES,
+		engine: s.searchEngine(),
 		params: sp,
 	}
 }
@@ -1510,9 +1744,6 @@ func prepareList(sp SearchParams) (filters map[string]interface{}, err error) {
 	if len(sp.Text) > 0 {
 		return nil, errgo.New("text not allowed")
 	}
-	if sp.Limit > 0 {
-		return nil, errgo.New("limit not allowed")
-	}
 	if sp.Skip > 0 {
 		return nil, errgo.New("skip not allowed")
 	}
@@ -1564,6 +1795,9 @@ type ListQuery struct {
 	store   *Store
 	filters map[string]interface{}
 	sort    bson.D
+	limit   int
+	after   string
+	cursor  string
 }
 
 // ListQuery lists entities in the store that conform to the
@@ -1571,16 +1805,36 @@ type ListQuery struct {
 // that can be used to iterate through the list.
 //
 // Sort criteria in the search parameters are ignored - the
-// results are returned in arbitrary order.
+// results are returned in arbitrary order, unless a limit or
+// cursor is specified, in which case they are returned in a
+// stable order so that the whole list can be retrieved a page
+// at a time. The limit may be exceeded so that all the entries
+// for a charm or bundle in a series are returned in the same page.
 func (store *Store) ListQuery(sp SearchParams) (*ListQuery, error) {
 	filters, err := prepareList(sp)
 	if err != nil {
 		return nil, errgo.Mask(err)
 	}
-	return &ListQuery{
+	lq := &ListQuery{
 		store:   store,
 		filters: filters,
-	}, nil
+		limit:   sp.Limit,
+	}
+	if len(sp.After) > 0 {
+		if len(sp.After) != 1 || json.Unmarshal(sp.After[0], &lq.after) != nil || lq.after == "" {
+			return nil, errgo.New("cursor does not match list")
+		}
+	}
+	return lq, nil
+}
+
+// NextCursor returns a cursor that can be passed to
+// SearchParams.ParseCursor to list the entities following those
+// returned by the query, or the empty string if there are no more
+// entities. This will only be correct after the iteration has
+// completed successfully.
+func (lq *ListQuery) NextCursor() string {
+	return lq.cursor
 }
 
 // listIterGroupIDSpec holds the part of the list aggregration pipeline
@@ -1614,7 +1868,8 @@ var listIterGroupIDSpec = func() bson.Raw {
 	return raw
 }()
 
-func (lq *ListQuery) Iter(fields map[string]int) *mgo.Iter {
+// Iter returns an iterator over the entities in the list.
+func (lq *ListQuery) Iter(fields map[string]int) entitycache.StoreIter {
 	qfields := FieldSelector(
 		"promulgated-url",
 		"published",
@@ -1636,18 +1891,131 @@ func (lq *ListQuery) Iter(fields map[string]int) *mgo.Iter {
 		group = append(group, bson.DocElem{field, bson.D{{"$last", "$" + field}}})
 	}
 
-	project := make(bson.D, 0, len(qfields)+1)
+	project := make(bson.D, 0, len(qfields)+2)
 	project = append(project, bson.DocElem{"_id", "$url"})
+	project = append(project, bson.DocElem{"listkey", "$_id"})
 	for f := range qfields {
 		project = append(project, bson.DocElem{f, "$" + f})
 	}
 
-	return lq.store.DB.Entities().Pipe([]bson.D{
-		{{"$match", lq.filters}},
+	match := lq.filters
+	if lq.after != "" {
+		// Leave out the charms and bundles before the cursor
+		// before grouping, so that later pages don't group
+		// every entity. A base URL sorts in the same order as
+		// the group ids that start with it, because the space
+		// that follows it in a group id sorts before any
+		// character in a URL.
+		match = make(map[string]interface{}, len(lq.filters)+1)
+		for k, v := range lq.filters {
+			match[k] = v
+		}
+		match["baseurl"] = bson.D{{"$gte", listKeyBaseURL(lq.after)}}
+	}
+	pipeline := []bson.D{
+		{{"$match", match}},
 		{{"$sort", bson.D{{"user", 1}, {"name", 1}, {"revision", 1}}}},
 		{{"$group", group}},
-		{{"$project", project}},
-	}).Iter()
+	}
+	paginated := lq.limit > 0 || lq.after != ""
+	if paginated {
+		// Order the entries by their group id, which does not
+		// change when new revisions are added, so that each
+		// page continues where the last one stopped.
+		if lq.after != "" {
+			pipeline = append(pipeline, bson.D{{"$match", bson.D{{"_id", bson.D{{"$gt", lq.after}}}}}})
+		}
+		pipeline = append(pipeline, bson.D{{"$sort", bson.D{{"_id", 1}}}})
+	}
+	pipeline = append(pipeline, bson.D{{"$project", project}})
+	pipe := lq.store.DB.Entities().Pipe(pipeline)
+	if paginated {
+		pipe = pipe.AllowDiskUse()
+	}
+	lq.cursor = ""
+	return &listIter{
+		lq:   lq,
+		iter: pipe.Iter(),
+	}
+}
+
+// listIter iterates over the entries of a list query, stopping at
+// the end of a page if the query has a limit.
+type listIter struct {
+	lq   *ListQuery
+	iter *mgo.Iter
+	n    int
+	key  string
+	err  error
+}
+
+// Next implements entitycache.StoreIter.Next.
+func (i *listIter) Next(v interface{}) bool {
+	if i.err != nil {
+		return false
+	}
+	var doc bson.Raw
+	if !i.iter.Next(&doc) {
+		return false
+	}
+	var entry struct {
+		Key string `bson:"listkey"`
+	}
+	if err := doc.Unmarshal(&entry); err != nil {
+		i.err = errgo.Mask(err)
+		return false
+	}
+	if i.lq.limit > 0 && i.n >= i.lq.limit && listKeyPrefix(entry.Key) != listKeyPrefix(i.key) {
+		// The page is full. Continue the next page from the
+		// last entry, which is also the last entry for its
+		// charm or bundle.
+		i.lq.cursor, i.err = makeCursor([]string{i.key})
+		return false
+	}
+	if err := doc.Unmarshal(v); err != nil {
+		i.err = errgo.Mask(err)
+		return false
+	}
+	i.n++
+	i.key = entry.Key
+	return true
+}
+
+// Err implements entitycache.StoreIter.Err.
+func (i *listIter) Err() error {
+	if i.err != nil {
+		return i.err
+	}
+	return i.iter.Err()
+}
+
+// Close implements entitycache.StoreIter.Close.
+func (i *listIter) Close() error {
+	err := i.iter.Close()
+	if i.err != nil {
+		return i.err
+	}
+	return err
+}
+
+// listKeyPrefix returns the part of a list entry group id, as
+// produced by listIterGroupIDSpec, that identifies the charm or
+// bundle and its series without the channels it is published to.
+func listKeyPrefix(key string) string {
+	i := strings.LastIndex(key, " ")
+	if j := strings.Index(key[i+1:], "."); j >= 0 {
+		return key[:i+1+j]
+	}
+	return key
+}
+
+// listKeyBaseURL returns the base URL of the charm or bundle in the
+// given group id, as produced by listIterGroupIDSpec.
+func listKeyBaseURL(key string) string {
+	if i := strings.Index(key, " "); i >= 0 {
+		return key[:i]
+	}
+	return key
 }
 
 // SynchroniseElasticsearch creates new indexes in elasticsearch
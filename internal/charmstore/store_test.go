@@ -24,6 +24,7 @@ import (
 	jc "github.com/juju/testing/checkers"
 	gc "gopkg.in/check.v1"
 	"gopkg.in/errgo.v1"
+	"gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
 	"gopkg.in/natefinch/lumberjack.v2"
 
@@ -32,6 +33,7 @@ import (
 	"gopkg.in/juju/charmstore.v5/internal/blobstore"
 	"gopkg.in/juju/charmstore.v5/internal/charm"
 	"gopkg.in/juju/charmstore.v5/internal/mongodoc"
+	"gopkg.in/juju/charmstore.v5/internal/monitoring"
 	"gopkg.in/juju/charmstore.v5/internal/router"
 	"gopkg.in/juju/charmstore.v5/internal/storetesting"
 )
@@ -1098,6 +1100,8 @@ func (s *StoreSuite) TestCollections(c *gc.C) {
 	// Some collections don't have indexes so they are created only when used.
 	createdOnUse := map[string]bool{
 		"migrations": true,
+		"quotas":     true,
+		"redirects":  true,
 	}
 	// Check that all collections mentioned by Collections are actually created.
 	for _, coll := range colls {
@@ -4194,9 +4198,19 @@ func (s *StoreSuite) TestDeleteEntity(c *gc.C) {
 	_, err = store.FindEntity(url, nil)
 	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
 
-	// Run blobstore garbage collection and check that
-	// the blob and the pre-v5 compatibility blob have been
-	// removed.
+	// The blobs are kept while the entity can still be restored.
+	err = store.BlobStoreGC(time.Now())
+	c.Assert(err, gc.Equals, nil)
+	r, _, err := store.BlobStore.Open(entity.BlobHash, nil)
+	c.Assert(err, gc.Equals, nil)
+	r.Close()
+
+	// Purge the deleted entity, run blobstore garbage
+	// collection and check that the blob and the pre-v5
+	// compatibility blob have been removed.
+	n, err := store.PurgeDeletedEntities(time.Now())
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(n, gc.Equals, 1)
 	err = store.BlobStoreGC(time.Now())
 	c.Assert(err, gc.Equals, nil)
 
@@ -4245,6 +4259,62 @@ func (s *StoreSuite) TestDeleteEntityWithPublishedRevision(c *gc.C) {
 	c.Assert(err, gc.Equals, nil)
 }
 
+func (s *StoreSuite) TestDeleteBaseEntity(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+	id0 := MustParseResolvedURL("cs:~bob/" + storetesting.SearchSeries[0] + "/wordpress-0")
+	meta := storetesting.MetaWithResources(nil, "someResource")
+	err := store.AddCharmWithArchive(id0, storetesting.NewCharm(meta))
+	c.Assert(err, gc.Equals, nil)
+	id1 := MustParseResolvedURL("cs:~bob/" + storetesting.SearchSeries[1] + "/wordpress-1")
+	err = store.AddCharmWithArchive(id1, storetesting.NewCharm(meta))
+	c.Assert(err, gc.Equals, nil)
+	id2 := MustParseResolvedURL("cs:~bob/" + storetesting.SearchSeries[1] + "/wordpress-2")
+	err = store.AddCharmWithArchive(id2, storetesting.NewCharm(meta))
+	c.Assert(err, gc.Equals, nil)
+	blob := "0123456789"
+	_, err = store.UploadResource(id1, "someResource", -1, strings.NewReader(blob), hashOfString(blob), int64(len(blob)))
+	c.Assert(err, gc.Equals, nil)
+	err = store.Publish(id1, map[string]int{"someResource": 0}, params.StableChannel)
+	c.Assert(err, gc.Equals, nil)
+	err = store.DeleteEntity(id2)
+	c.Assert(err, gc.Equals, nil)
+
+	// A charm with a similar name is not affected.
+	other := MustParseResolvedURL("cs:~bob/" + storetesting.SearchSeries[0] + "/wordpress-other-0")
+	err = store.AddCharmWithArchive(other, storetesting.NewCharm(nil))
+	c.Assert(err, gc.Equals, nil)
+	otherEntity, err := store.FindEntity(other, FieldSelector("size"))
+	c.Assert(err, gc.Equals, nil)
+
+	err = store.DeleteBaseEntity(&id1.URL)
+	c.Assert(err, gc.Equals, nil)
+
+	baseURL := mongodoc.BaseURL(&id0.URL)
+	for _, coll := range []*mgo.Collection{
+		store.DB.Entities(),
+		store.DB.Resources(),
+		store.DB.DeletedEntities(),
+		store.DB.ChannelHistory(),
+	} {
+		n, err := coll.Find(bson.D{{"baseurl", baseURL}}).Count()
+		c.Assert(err, gc.Equals, nil)
+		c.Assert(n, gc.Equals, 0, gc.Commentf("%s", coll.Name))
+	}
+	_, err = store.FindBaseEntity(baseURL, nil)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+	_, err = store.FindEntity(other, nil)
+	c.Assert(err, gc.Equals, nil)
+
+	q, err := store.Quota("bob")
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(q.Bytes, gc.Equals, otherEntity.Size)
+	c.Assert(q.Revisions, gc.Equals, 1)
+
+	err = store.DeleteBaseEntity(&id1.URL)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+}
+
 func (s *StoreSuite) TestGC(c *gc.C) {
 	store := s.newStore(c, false)
 	defer store.Close()
@@ -4340,6 +4410,8 @@ func (s *StoreSuite) TestGC(c *gc.C) {
 	// Then remove an entity and a resource.
 	err = store.DeleteEntity(id1)
 	c.Assert(err, gc.Equals, nil)
+	_, err = store.PurgeDeletedEntities(time.Now())
+	c.Assert(err, gc.Equals, nil)
 	err = store.DB.Resources().Remove(bson.D{{
 		"baseurl", resource2.BaseURL,
 	}, {
@@ -4366,6 +4438,55 @@ func (s *StoreSuite) TestGC(c *gc.C) {
 	}
 }
 
+func (s *StoreSuite) TestGCDryRun(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+
+	id1 := router.MustNewResolvedURL("~charmers/"+storetesting.SearchSeries[0]+"/wordpress-1", -1)
+	err := store.AddCharmWithArchive(id1, storetesting.NewCharm(&charm.Meta{
+		Summary: "charm that will be deleted",
+	}))
+	c.Assert(err, gc.Equals, nil)
+	id2 := router.MustNewResolvedURL("~charmers/"+storetesting.SearchSeries[0]+"/wordpress-2", -1)
+	err = store.AddCharmWithArchive(id2, storetesting.NewCharm(&charm.Meta{
+		Summary: "charm that will not be deleted",
+	}))
+	c.Assert(err, gc.Equals, nil)
+
+	// Run the garbage collector so that the kinds
+	// of the blobs are recorded.
+	err = store.BlobStoreGC(time.Now())
+	c.Assert(err, gc.Equals, nil)
+
+	entity1, err := store.FindEntity(id1, nil)
+	c.Assert(err, gc.Equals, nil)
+	entity2, err := store.FindEntity(id2, nil)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(entity1.PreV5BlobExtraHash, gc.Equals, "")
+	err = store.DeleteEntity(id1)
+	c.Assert(err, gc.Equals, nil)
+	_, err = store.PurgeDeletedEntities(time.Now())
+	c.Assert(err, gc.Equals, nil)
+
+	report, err := store.BlobStoreGCDryRun(time.Now())
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(report.Garbage, gc.HasLen, 1)
+	c.Assert(report.Garbage[0].Hash, gc.Equals, entity1.BlobHash)
+	c.Assert(report.Garbage[0].Size, gc.Equals, entity1.Size)
+	c.Assert(report.Garbage[0].Reason, gc.Equals, "no longer referenced as archive")
+	c.Assert(report.Stats.Kinds, jc.DeepEquals, map[string]monitoring.BlobKindStats{
+		"archive": {
+			Count: 1,
+			Size:  entity2.Size,
+		},
+	})
+
+	// The dry run hasn't removed anything.
+	r, _, err := store.BlobStore.Open(entity1.BlobHash, nil)
+	c.Assert(err, gc.Equals, nil)
+	r.Close()
+}
+
 func urlStrings(urls []*charm.URL) []string {
 	urlStrs := make([]string, len(urls))
 	for i, url := range urls {
@@ -0,0 +1,345 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package charmstore // import "gopkg.in/juju/charmstore.v5/internal/charmstore"
+
+import (
+	"time"
+
+	"github.com/juju/charmrepo/v6/csclient/params"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+
+	"gopkg.in/juju/charmstore.v5/internal/charm"
+	"gopkg.in/juju/charmstore.v5/internal/mongodoc"
+)
+
+// TransferBaseEntity moves the charm or bundle with the given URL to
+// the namespace of the given user or group, and returns its new base
+// URL. All its revisions (including deleted revisions that can still
+// be restored), resources, permissions, published channels,
+// promulgation state and download counts are moved with it, and the
+// usage of both namespaces is updated. Any permissions held by the
+// old owner are given to the new owner instead. The quota of the new
+// namespace is not checked.
+//
+// A redirect is left from the old base URL, so that FindBestEntity will
+// find the charm or bundle when it's asked for an entity that is no
+// longer in the old namespace.
+//
+// If there is no such base entity, it returns an error with a
+// params.ErrNotFound cause. If there is already a charm or bundle with
+// the same name in the new namespace, it returns an error with a
+// params.ErrForbidden cause.
+func (s *Store) TransferBaseEntity(url *charm.URL, user string) (*charm.URL, error) {
+	oldBaseURL := mongodoc.BaseURL(url)
+	if oldBaseURL.User == "" {
+		return nil, errgo.Newf("cannot transfer promulgated URL %q", url)
+	}
+	if user == "" || user == oldBaseURL.User {
+		return nil, errgo.Newf("invalid new owner %q", user)
+	}
+	newBaseURL := withUser(oldBaseURL, user)
+	baseEntity, err := s.FindBaseEntity(oldBaseURL, nil)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	n, err := s.DB.Entities().Find(bson.D{{"baseurl", newBaseURL}}).Count()
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if n > 0 {
+		return nil, errgo.WithCausef(nil, params.ErrForbidden, "%q already exists", newBaseURL)
+	}
+	var entities []*mongodoc.Entity
+	if err := s.DB.Entities().Find(bson.D{{"baseurl", oldBaseURL}}).All(&entities); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	oldEntities := make([]*mongodoc.Entity, len(entities))
+	for i, e := range entities {
+		oldEntities[i] = &mongodoc.Entity{
+			URL:             e.URL,
+			SupportedSeries: e.SupportedSeries,
+		}
+	}
+
+	// Create the new base entity first, so that the
+	// moved entities always have a base entity.
+	newBaseEntity := *baseEntity
+	newBaseEntity.URL = newBaseURL
+	newBaseEntity.User = user
+	newBaseEntity.ChannelEntities = make(map[params.Channel]map[string]*charm.URL)
+	for ch, entities := range baseEntity.ChannelEntities {
+		newBaseEntity.ChannelEntities[ch] = make(map[string]*charm.URL)
+		for series, url := range entities {
+			newBaseEntity.ChannelEntities[ch][series] = withUser(url, user)
+		}
+	}
+	// The old owner's permissions pass to the new owner.
+	newBaseEntity.ChannelACLs = make(map[params.Channel]mongodoc.ACL)
+	for ch, acl := range baseEntity.ChannelACLs {
+		newBaseEntity.ChannelACLs[ch] = mongodoc.ACL{
+			Read:  replaceACLUser(acl.Read, oldBaseURL.User, user),
+			Write: replaceACLUser(acl.Write, oldBaseURL.User, user),
+		}
+	}
+	if err := s.DB.BaseEntities().Insert(&newBaseEntity); err != nil {
+		if mgo.IsDup(err) {
+			return nil, errgo.WithCausef(nil, params.ErrForbidden, "%q already exists", newBaseURL)
+		}
+		return nil, errgo.Notef(err, "cannot insert base entity")
+	}
+
+	// Each new entity is inserted before the old one is removed so
+	// that the entity is never lost. Promulgated URLs must be
+	// unique, so the promulgated URL is only set on the new entity
+	// once the old one has gone.
+	var size int64
+	for _, e := range entities {
+		oldURL := e.URL
+		promulgatedURL := e.PromulgatedURL
+		e.URL = withUser(e.URL, user)
+		e.BaseURL = newBaseURL
+		e.User = user
+		e.PromulgatedURL = nil
+		if err := s.DB.Entities().Insert(e); err != nil {
+			return nil, errgo.Notef(err, "cannot insert %q", e.URL)
+		}
+		if err := s.DB.Entities().RemoveId(oldURL); err != nil {
+			return nil, errgo.Notef(err, "cannot remove %q", oldURL)
+		}
+		if promulgatedURL != nil {
+			if err := s.DB.Entities().UpdateId(e.URL, bson.D{{
+				"$set", bson.D{{"promulgated-url", promulgatedURL}},
+			}}); err != nil {
+				return nil, errgo.Notef(err, "cannot set promulgated URL of %q", e.URL)
+			}
+		}
+		size += e.Size
+	}
+	var resources []*mongodoc.Resource
+	if err := s.DB.Resources().Find(bson.D{{"baseurl", oldBaseURL}}).Select(FieldSelector("size")).All(&resources); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if _, err := s.DB.Resources().UpdateAll(
+		bson.D{{"baseurl", oldBaseURL}},
+		bson.D{{"$set", bson.D{{"baseurl", newBaseURL}}}},
+	); err != nil {
+		return nil, errgo.Notef(err, "cannot move resources")
+	}
+	for _, r := range resources {
+		size += r.Size
+	}
+	if err := s.transferDeletedEntities(oldBaseURL, newBaseURL); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if err := s.transferRevisions(oldBaseURL, newBaseURL); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if err := s.transferChannelHistory(oldBaseURL, newBaseURL); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if err := s.transferScheduledPublishes(oldBaseURL, newBaseURL); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if err := s.copyDownloadCounts(oldEntities, user); err != nil {
+		return nil, errgo.Mask(err)
+	}
+
+	// Redirect the old base URL, and anything that
+	// redirected to it, to the new base URL.
+	if _, err := s.DB.Redirects().UpsertId(oldBaseURL, &mongodoc.Redirect{
+		URL:    oldBaseURL,
+		Target: newBaseURL,
+		Time:   time.Now(),
+	}); err != nil {
+		return nil, errgo.Notef(err, "cannot add redirect")
+	}
+	if _, err := s.DB.Redirects().UpdateAll(
+		bson.D{{"target", oldBaseURL}},
+		bson.D{{"$set", bson.D{{"target", newBaseURL}}}},
+	); err != nil {
+		return nil, errgo.Notef(err, "cannot update redirects")
+	}
+	if err := s.DB.Redirects().RemoveId(newBaseURL); err != nil && err != mgo.ErrNotFound {
+		return nil, errgo.Notef(err, "cannot remove redirect")
+	}
+	if err := s.DB.BaseEntities().RemoveId(oldBaseURL); err != nil && err != mgo.ErrNotFound {
+		return nil, errgo.Notef(err, "cannot remove base entity")
+	}
+	if err := s.moveQuotaUsage(oldBaseURL.User, user, size, len(entities)+len(resources)); err != nil {
+		logger.Errorf("cannot move quota usage: %v", err)
+	}
+	if err := s.removeSearch(oldEntities); err != nil {
+		return nil, errgo.Notef(err, "cannot remove search documents for %q", oldBaseURL)
+	}
+	if err := s.UpdateSearchBaseURL(newBaseURL); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return newBaseURL, nil
+}
+
+// transferDeletedEntities moves all the deleted entities with the
+// given base URL to the new base URL, so that they can still be
+// restored.
+func (s *Store) transferDeletedEntities(oldBaseURL, newBaseURL *charm.URL) error {
+	var docs []*mongodoc.DeletedEntity
+	if err := s.DB.DeletedEntities().Find(bson.D{{"baseurl", oldBaseURL}}).All(&docs); err != nil {
+		return errgo.Notef(err, "cannot get deleted entities")
+	}
+	for _, doc := range docs {
+		if err := s.DB.DeletedEntities().RemoveId(doc.URL); err != nil {
+			return errgo.Notef(err, "cannot remove deleted entity %q", doc.URL)
+		}
+		doc.URL = withUser(doc.URL, newBaseURL.User)
+		doc.BaseURL = newBaseURL
+		doc.Entity.URL = doc.URL
+		doc.Entity.BaseURL = newBaseURL
+		doc.Entity.User = newBaseURL.User
+		if _, err := s.DB.DeletedEntities().UpsertId(doc.URL, doc); err != nil {
+			return errgo.Notef(err, "cannot insert deleted entity %q", doc.URL)
+		}
+	}
+	return nil
+}
+
+// transferRevisions records the latest revisions of the given base URL
+// against the new base URL, so that new revisions uploaded to the new
+// base URL never reuse the revision number of a moved entity.
+func (s *Store) transferRevisions(oldBaseURL, newBaseURL *charm.URL) error {
+	var revs []mongodoc.LatestRevision
+	if err := s.DB.Revisions().Find(bson.D{{"baseurl", oldBaseURL}}).All(&revs); err != nil {
+		return errgo.Notef(err, "cannot get revisions")
+	}
+	for _, rev := range revs {
+		if err := s.addRevision(withUser(rev.URL, newBaseURL.User).WithRevision(rev.Revision)); err != nil {
+			return errgo.Mask(err)
+		}
+	}
+	return nil
+}
+
+// transferChannelHistory moves the channel history of the given base
+// URL to the new base URL.
+func (s *Store) transferChannelHistory(oldBaseURL, newBaseURL *charm.URL) error {
+	var docs []struct {
+		Id                           bson.ObjectId `bson:"_id"`
+		mongodoc.ChannelHistoryEntry `bson:",inline"`
+	}
+	if err := s.DB.ChannelHistory().Find(bson.D{{"baseurl", oldBaseURL}}).All(&docs); err != nil {
+		return errgo.Notef(err, "cannot get channel history")
+	}
+	for _, doc := range docs {
+		if err := s.DB.ChannelHistory().UpdateId(doc.Id, bson.D{{"$set", bson.D{
+			{"baseurl", newBaseURL},
+			{"url", withUser(doc.URL, newBaseURL.User)},
+		}}}); err != nil {
+			return errgo.Notef(err, "cannot update channel history")
+		}
+	}
+	return nil
+}
+
+// transferScheduledPublishes moves the pending scheduled publications
+// of the given base URL to the new base URL.
+func (s *Store) transferScheduledPublishes(oldBaseURL, newBaseURL *charm.URL) error {
+	var docs []*mongodoc.ScheduledPublish
+	if err := s.DB.ScheduledPublishes().Find(bson.D{{"baseurl", oldBaseURL}}).All(&docs); err != nil {
+		return errgo.Notef(err, "cannot get scheduled publications")
+	}
+	for _, doc := range docs {
+		if err := s.DB.ScheduledPublishes().UpdateId(doc.Id, bson.D{{"$set", bson.D{
+			{"baseurl", newBaseURL},
+			{"url", withUser(doc.URL, newBaseURL.User)},
+		}}}); err != nil && err != mgo.ErrNotFound {
+			return errgo.Notef(err, "cannot update scheduled publication")
+		}
+	}
+	return nil
+}
+
+// copyDownloadCounts adds the download counts of the given
+// entities to the counts of the same entities owned by the
+// given user.
+func (s *Store) copyDownloadCounts(entities []*mongodoc.Entity, user string) error {
+	newIDs := make(map[string]string)
+	ids := make([]string, 0, len(entities)*2)
+	for _, e := range entities {
+		for _, url := range []*charm.URL{e.URL, e.URL.WithRevision(-1)} {
+			id := url.String()
+			if _, ok := newIDs[id]; ok {
+				continue
+			}
+			newIDs[id] = withUser(url, user).String()
+			ids = append(ids, id)
+		}
+	}
+	iter := s.DB.DownloadCounts().Find(bson.D{{"id", bson.D{{"$in", ids}}}}).Iter()
+	var dc mongodoc.DownloadCount
+	for iter.Next(&dc) {
+		dc.ID = newIDs[dc.ID]
+		if err := s.incrementDownloadCount(dc); err != nil {
+			iter.Close()
+			return errgo.Notef(err, "cannot copy download count")
+		}
+	}
+	if err := iter.Close(); err != nil {
+		return errgo.Notef(err, "cannot get download counts")
+	}
+	return nil
+}
+
+// redirectedURL returns the URL that url should be redirected to
+// because its charm or bundle has been moved to a different namespace,
+// or nil if there is no redirect for url. A redirect is ignored once a
+// new charm or bundle has been uploaded with the old base URL.
+func (s *Store) redirectedURL(url *charm.URL) (*charm.URL, error) {
+	if url.User == "" {
+		return nil, nil
+	}
+	baseURL := mongodoc.BaseURL(url)
+	var redirect mongodoc.Redirect
+	if err := s.DB.Redirects().FindId(baseURL).One(&redirect); err != nil {
+		if err == mgo.ErrNotFound {
+			return nil, nil
+		}
+		return nil, errgo.Notef(err, "cannot get redirect")
+	}
+	n, err := s.DB.BaseEntities().FindId(baseURL).Count()
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if n > 0 {
+		return nil, nil
+	}
+	u := *url
+	u.User = redirect.Target.User
+	u.Name = redirect.Target.Name
+	return &u, nil
+}
+
+// replaceACLUser returns a copy of the given ACL entries with
+// oldUser replaced by newUser.
+func replaceACLUser(users []string, oldUser, newUser string) []string {
+	if users == nil {
+		return nil
+	}
+	replaced := make([]string, 0, len(users))
+	for _, u := range users {
+		if u == oldUser {
+			u = newUser
+		}
+		if !containsString(replaced, u) {
+			replaced = append(replaced, u)
+		}
+	}
+	return replaced
+}
+
+// withUser returns a copy of url with its user replaced.
+func withUser(url *charm.URL, user string) *charm.URL {
+	u := *url
+	u.User = user
+	return &u
+}
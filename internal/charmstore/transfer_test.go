@@ -0,0 +1,221 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package charmstore
+
+import (
+	"strings"
+
+	"github.com/juju/charmrepo/v6/csclient/params"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/mgo.v2/bson"
+
+	"gopkg.in/juju/charmstore.v5/internal/charm"
+	"gopkg.in/juju/charmstore.v5/internal/mongodoc"
+	"gopkg.in/juju/charmstore.v5/internal/router"
+	"gopkg.in/juju/charmstore.v5/internal/storetesting"
+)
+
+type transferSuite struct {
+	commonSuite
+}
+
+var _ = gc.Suite(&transferSuite{})
+
+func (s *transferSuite) TestTransferBaseEntity(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+	series := storetesting.SearchSeries[0]
+	meta := storetesting.MetaWithResources(&charm.Meta{
+		Series: []string{series},
+	}, "someResource")
+	id0 := MustParseResolvedURL("0 ~bob/" + series + "/wordpress-0")
+	err := store.AddCharmWithArchive(id0, storetesting.NewCharm(meta))
+	c.Assert(err, gc.Equals, nil)
+	id1 := MustParseResolvedURL("1 ~bob/" + series + "/wordpress-1")
+	err = store.AddCharmWithArchive(id1, storetesting.NewCharm(meta))
+	c.Assert(err, gc.Equals, nil)
+	id2 := MustParseResolvedURL("~bob/" + series + "/wordpress-2")
+	err = store.AddCharmWithArchive(id2, storetesting.NewCharm(meta))
+	c.Assert(err, gc.Equals, nil)
+	blob := "0123456789"
+	_, err = store.UploadResource(id1, "someResource", -1, strings.NewReader(blob), hashOfString(blob), int64(len(blob)))
+	c.Assert(err, gc.Equals, nil)
+	err = store.Publish(id1, map[string]int{"someResource": 0}, params.StableChannel)
+	c.Assert(err, gc.Equals, nil)
+	err = store.SetPerms(&id1.URL, "stable.read", "everyone")
+	c.Assert(err, gc.Equals, nil)
+	err = store.SetPromulgated(id1, true)
+	c.Assert(err, gc.Equals, nil)
+	err = store.IncrementDownloadCounts(id1)
+	c.Assert(err, gc.Equals, nil)
+	err = store.DeleteEntity(id2)
+	c.Assert(err, gc.Equals, nil)
+	oldBaseURL := mongodoc.BaseURL(&id1.URL)
+	oldBaseEntity, err := store.FindBaseEntity(oldBaseURL, nil)
+	c.Assert(err, gc.Equals, nil)
+	before, err := store.Quota("bob")
+	c.Assert(err, gc.Equals, nil)
+
+	newBaseURL, err := store.TransferBaseEntity(&id1.URL, "alice")
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(newBaseURL, jc.DeepEquals, charm.MustParseURL("cs:~alice/wordpress"))
+
+	// The base entity has moved with its permissions,
+	// channels and promulgation state, and the new owner
+	// has taken the place of the old one in its permissions.
+	_, err = store.FindBaseEntity(oldBaseURL, nil)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+	newBaseEntity, err := store.FindBaseEntity(newBaseURL, nil)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(newBaseEntity.User, gc.Equals, "alice")
+	expectACLs := make(map[params.Channel]mongodoc.ACL)
+	for _, ch := range params.OrderedChannels {
+		expectACLs[ch] = mongodoc.ACL{
+			Read:  []string{"alice"},
+			Write: []string{"alice"},
+		}
+	}
+	expectACLs[params.StableChannel] = mongodoc.ACL{
+		Read:  []string{"everyone"},
+		Write: []string{"alice"},
+	}
+	c.Assert(newBaseEntity.ChannelACLs, jc.DeepEquals, expectACLs)
+	c.Assert(newBaseEntity.ChannelResources, jc.DeepEquals, oldBaseEntity.ChannelResources)
+	c.Assert(newBaseEntity.Promulgated, gc.Equals, oldBaseEntity.Promulgated)
+	c.Assert(newBaseEntity.ChannelEntities, jc.DeepEquals, map[params.Channel]map[string]*charm.URL{
+		params.StableChannel: {
+			series: charm.MustParseURL("cs:~alice/" + series + "/wordpress-1"),
+		},
+	})
+
+	// The entities have moved and keep their promulgated URLs.
+	for _, id := range []*router.ResolvedURL{id0, id1} {
+		_, err := store.FindEntity(id, nil)
+		c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+		newId := *id
+		newId.URL.User = "alice"
+		e, err := store.FindEntity(&newId, nil)
+		c.Assert(err, gc.Equals, nil)
+		c.Assert(e.BaseURL, jc.DeepEquals, newBaseURL)
+		c.Assert(e.User, gc.Equals, "alice")
+		c.Assert(e.PromulgatedRevision, gc.Equals, id.PromulgatedRevision)
+	}
+	e, err := store.FindBestEntity(charm.MustParseURL("cs:wordpress"), params.StableChannel, nil)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(e.URL, jc.DeepEquals, charm.MustParseURL("cs:~alice/"+series+"/wordpress-1"))
+
+	// The resources have moved.
+	r, err := store.ResolveResource(MustParseResolvedURL("~alice/"+series+"/wordpress-1"), "someResource", -1, params.StableChannel)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(r.BaseURL, jc.DeepEquals, newBaseURL)
+
+	// The deleted revision can be restored in the new namespace.
+	docs, err := store.DeletedEntities(newBaseURL)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(docs, gc.HasLen, 1)
+	c.Assert(docs[0].URL, jc.DeepEquals, charm.MustParseURL("cs:~alice/"+series+"/wordpress-2"))
+	docs, err = store.DeletedEntities(oldBaseURL)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(docs, gc.HasLen, 0)
+
+	// The latest revision has been recorded for the new URL.
+	var rev mongodoc.LatestRevision
+	err = store.DB.Revisions().FindId(charm.MustParseURL("cs:~alice/" + series + "/wordpress")).One(&rev)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(rev.Revision, gc.Equals, 2)
+
+	// The channel history has moved.
+	history, err := store.ChannelHistory(newBaseURL, params.NoChannel, 0)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(history, gc.HasLen, 1)
+	c.Assert(history[0].URL, jc.DeepEquals, charm.MustParseURL("cs:~alice/"+series+"/wordpress-1"))
+	history, err = store.ChannelHistory(oldBaseURL, params.NoChannel, 0)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(history, gc.HasLen, 0)
+
+	// The download counts have been copied.
+	thisRevision, allRevisions, err := store.ArchiveDownloadCounts(charm.MustParseURL("cs:~alice/" + series + "/wordpress-1"))
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(thisRevision.Total, gc.Equals, int64(1))
+	c.Assert(allRevisions.Total, gc.Equals, int64(1))
+
+	// The usage has moved to the new namespace.
+	after, err := store.Quota("bob")
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(after.Bytes, gc.Equals, int64(0))
+	c.Assert(after.Revisions, gc.Equals, 0)
+	q, err := store.Quota("alice")
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(q.Bytes, gc.Equals, before.Bytes)
+	c.Assert(q.Revisions, gc.Equals, before.Revisions)
+}
+
+func (s *transferSuite) TestFindBestEntityFollowsRedirect(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+	id := MustParseResolvedURL("~bob/" + storetesting.SearchSeries[0] + "/wordpress-0")
+	err := store.AddCharmWithArchive(id, storetesting.NewCharm(nil))
+	c.Assert(err, gc.Equals, nil)
+	err = store.Publish(id, nil, params.StableChannel)
+	c.Assert(err, gc.Equals, nil)
+	_, err = store.TransferBaseEntity(&id.URL, "alice")
+	c.Assert(err, gc.Equals, nil)
+	_, err = store.TransferBaseEntity(charm.MustParseURL("~alice/wordpress"), "carol")
+	c.Assert(err, gc.Equals, nil)
+
+	expect := charm.MustParseURL("cs:~carol/" + storetesting.SearchSeries[0] + "/wordpress-0")
+	for _, url := range []string{
+		"~bob/wordpress",
+		"~bob/wordpress-0",
+		"~bob/" + storetesting.SearchSeries[0] + "/wordpress-0",
+		"~alice/wordpress",
+	} {
+		c.Logf("url %s", url)
+		e, err := store.FindBestEntity(charm.MustParseURL(url), params.StableChannel, FieldSelector("size"))
+		c.Assert(err, gc.Equals, nil)
+		c.Assert(e.URL, jc.DeepEquals, expect)
+	}
+	_, err = store.FindBestEntity(charm.MustParseURL("~bob/wordpress-1"), params.StableChannel, nil)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+
+	// Once a new charm is uploaded with the old name,
+	// the redirect is no longer followed.
+	newId := MustParseResolvedURL("~bob/" + storetesting.SearchSeries[0] + "/wordpress-1")
+	err = store.AddCharmWithArchive(newId, storetesting.NewCharm(nil))
+	c.Assert(err, gc.Equals, nil)
+	_, err = store.FindBestEntity(charm.MustParseURL("~bob/wordpress-0"), params.StableChannel, nil)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+}
+
+func (s *transferSuite) TestTransferBaseEntityErrors(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+	for _, id := range []string{
+		"~bob/" + storetesting.SearchSeries[0] + "/wordpress-0",
+		"~alice/" + storetesting.SearchSeries[0] + "/wordpress-0",
+	} {
+		err := store.AddCharmWithArchive(MustParseResolvedURL(id), storetesting.NewCharm(nil))
+		c.Assert(err, gc.Equals, nil)
+	}
+
+	_, err := store.TransferBaseEntity(charm.MustParseURL("~bob/wordpress"), "alice")
+	c.Assert(err, gc.ErrorMatches, `"cs:~alice/wordpress" already exists`)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrForbidden)
+
+	_, err = store.TransferBaseEntity(charm.MustParseURL("~bob/mysql"), "alice")
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+
+	_, err = store.TransferBaseEntity(charm.MustParseURL("wordpress"), "alice")
+	c.Assert(err, gc.ErrorMatches, `cannot transfer promulgated URL "cs:wordpress"`)
+
+	_, err = store.TransferBaseEntity(charm.MustParseURL("~bob/wordpress"), "bob")
+	c.Assert(err, gc.ErrorMatches, `invalid new owner "bob"`)
+
+	// Nothing has changed.
+	n, err := store.DB.Entities().Find(bson.D{{"user", "bob"}}).Count()
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(n, gc.Equals, 1)
+}
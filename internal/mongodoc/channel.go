@@ -0,0 +1,103 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package mongodoc // import "gopkg.in/juju/charmstore.v5/internal/mongodoc"
+
+import (
+	"reflect"
+	"strings"
+
+	"github.com/juju/charmrepo/v6/csclient/params"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/mgo.v2/bson"
+
+	"gopkg.in/juju/charmstore.v5/internal/charm"
+)
+
+var (
+	channelKeyEscaper   = strings.NewReplacer("%", "%25", ".", "%2E")
+	channelKeyUnescaper = strings.NewReplacer("%2E", ".", "%25", "%")
+)
+
+// ChannelKey returns the form of the given channel that is used as a
+// key in MongoDB documents, for example in the Published field of an
+// Entity. MongoDB keys cannot contain dots, so any dots in the track
+// name are escaped. Channels without dots are unchanged.
+func ChannelKey(ch params.Channel) string {
+	return escapeChannel(string(ch))
+}
+
+func escapeChannel(ch string) string {
+	return channelKeyEscaper.Replace(ch)
+}
+
+func unescapeChannel(key string) string {
+	return channelKeyUnescaper.Replace(key)
+}
+
+// GetBSON implements bson.Getter by escaping the channels
+// used as keys in the entity document.
+func (e Entity) GetBSON() (interface{}, error) {
+	type entity Entity
+	doc := entity(e)
+	doc.Published = mapChannelKeys(doc.Published, escapeChannel).(map[params.Channel]bool)
+	return &doc, nil
+}
+
+// SetBSON implements bson.Setter by unescaping the channels
+// used as keys in the entity document.
+func (e *Entity) SetBSON(raw bson.Raw) error {
+	type entity Entity
+	if err := raw.Unmarshal((*entity)(e)); err != nil {
+		return errgo.Mask(err)
+	}
+	e.Published = mapChannelKeys(e.Published, unescapeChannel).(map[params.Channel]bool)
+	return nil
+}
+
+// GetBSON implements bson.Getter by escaping the channels
+// used as keys in the base entity document.
+func (e BaseEntity) GetBSON() (interface{}, error) {
+	type baseEntity BaseEntity
+	doc := baseEntity(e)
+	doc.ChannelACLs = mapChannelKeys(doc.ChannelACLs, escapeChannel).(map[params.Channel]ACL)
+	doc.ChannelEntities = mapChannelKeys(doc.ChannelEntities, escapeChannel).(map[params.Channel]map[string]*charm.URL)
+	doc.ChannelResources = mapChannelKeys(doc.ChannelResources, escapeChannel).(map[params.Channel][]ResourceRevision)
+	return &doc, nil
+}
+
+// SetBSON implements bson.Setter by unescaping the channels
+// used as keys in the base entity document.
+func (e *BaseEntity) SetBSON(raw bson.Raw) error {
+	type baseEntity BaseEntity
+	if err := raw.Unmarshal((*baseEntity)(e)); err != nil {
+		return errgo.Mask(err)
+	}
+	e.ChannelACLs = mapChannelKeys(e.ChannelACLs, unescapeChannel).(map[params.Channel]ACL)
+	e.ChannelEntities = mapChannelKeys(e.ChannelEntities, unescapeChannel).(map[params.Channel]map[string]*charm.URL)
+	e.ChannelResources = mapChannelKeys(e.ChannelResources, unescapeChannel).(map[params.Channel][]ResourceRevision)
+	return nil
+}
+
+// mapChannelKeys returns a copy of m, which must be a map keyed by
+// params.Channel, with each key transformed by f. If f leaves all the
+// keys unchanged, m itself is returned.
+func mapChannelKeys(m interface{}, f func(string) string) interface{} {
+	v := reflect.ValueOf(m)
+	keys := v.MapKeys()
+	changed := false
+	for _, k := range keys {
+		if f(k.String()) != k.String() {
+			changed = true
+			break
+		}
+	}
+	if !changed {
+		return m
+	}
+	nv := reflect.MakeMap(v.Type())
+	for _, k := range keys {
+		nv.SetMapIndex(reflect.ValueOf(params.Channel(f(k.String()))), v.MapIndex(k))
+	}
+	return nv.Interface()
+}
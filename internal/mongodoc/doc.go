@@ -199,6 +199,28 @@ type BaseEntity struct {
 	// at present, this signifies that someone has taken over control from
 	// the ingester.
 	NoIngest bool `bson:",omitempty"`
+
+	// RetentionPolicy holds the policy that determines which
+	// revisions of the charm or bundle are deleted automatically.
+	// If it is nil, revisions are never deleted automatically.
+	RetentionPolicy *RetentionPolicy `bson:",omitempty" json:",omitempty"`
+}
+
+// RetentionPolicy holds the rules that determine which revisions of a
+// charm or bundle can be deleted automatically. A revision is kept if
+// any of the rules applies to it. Revisions that have ever been
+// published to the stable channel of any track and revisions that are
+// current in any channel are always kept.
+type RetentionPolicy struct {
+	// KeepUnpublished holds the number of most recently uploaded
+	// revisions that have never been published to the stable
+	// channel that are kept.
+	KeepUnpublished int `bson:",omitempty"`
+
+	// KeepFor holds how long revisions are kept after they have
+	// been uploaded. If it is zero, revisions are not kept because
+	// of their age.
+	KeepFor time.Duration `bson:",omitempty"`
 }
 
 // LatestRevision holds an entry in the revisions collection.
@@ -378,6 +400,122 @@ type DownloadCount struct {
 	Expires *time.Time `bson:"expires,omitempty"`
 }
 
+// Quota holds the storage quota and current storage usage of a
+// namespace - the user or group that owns a set of charms and
+// bundles. Both archives and resources count towards the quota.
+type Quota struct {
+	// Namespace holds the name of the user or group.
+	Namespace string `bson:"_id"`
+
+	// MaxBytes holds the maximum total size in bytes of all the
+	// archives and resources in the namespace. If it is zero,
+	// there is no limit.
+	MaxBytes int64 `bson:"maxbytes,omitempty"`
+
+	// MaxRevisions holds the maximum total number of entity
+	// and resource revisions in the namespace. If it is zero,
+	// there is no limit.
+	MaxRevisions int `bson:"maxrevisions,omitempty"`
+
+	// Bytes holds the total size of all the archives and
+	// resources currently stored in the namespace.
+	Bytes int64 `bson:"bytes"`
+
+	// Revisions holds the total number of entity and resource
+	// revisions currently stored in the namespace.
+	Revisions int `bson:"revisions"`
+}
+
+// DeletedEntity holds an entity that has been deleted. It is kept so
+// that the deletion can be undone until the retention period for
+// deleted entities has passed.
+type DeletedEntity struct {
+	// URL holds the fully specified URL of the deleted entity.
+	URL *charm.URL `bson:"_id"`
+
+	// BaseURL holds the base URL of the deleted entity.
+	BaseURL *charm.URL `bson:"baseurl"`
+
+	// Entity holds the entity document as it was
+	// when the entity was deleted.
+	Entity *Entity `bson:"entity"`
+
+	// Deleted holds the time that the entity was deleted.
+	Deleted time.Time `bson:"deleted"`
+}
+
+// ChannelHistoryEntry records the publication of an entity
+// to a channel.
+type ChannelHistoryEntry struct {
+	// BaseURL holds the base URL of the published entity.
+	BaseURL *charm.URL `bson:"baseurl"`
+
+	// Channel holds the channel that the entity was published to.
+	Channel params.Channel `bson:"channel"`
+
+	// URL holds the URL of the published entity.
+	URL *charm.URL `bson:"url"`
+
+	// Series holds the series that the entity was
+	// published for.
+	Series []string `bson:"series"`
+
+	// Resources holds the resource revisions that were
+	// published with the entity.
+	Resources []ResourceRevision `bson:"resources,omitempty"`
+
+	// User holds the name of the user that published
+	// the entity, if known.
+	User string `bson:"user,omitempty"`
+
+	// Time holds the time that the entity was published.
+	Time time.Time `bson:"time"`
+}
+
+// Redirect records that a charm or bundle has been moved to
+// another namespace, so that requests for its old base URL
+// can be redirected to the new one.
+type Redirect struct {
+	// URL holds the old base URL of the charm or bundle.
+	URL *charm.URL `bson:"_id"`
+
+	// Target holds the base URL that the
+	// charm or bundle has been moved to.
+	Target *charm.URL `bson:"target"`
+
+	// Time holds the time that the charm or bundle was moved.
+	Time time.Time `bson:"time"`
+}
+
+// ScheduledPublish records a publication of an entity
+// that will be made at a later time.
+type ScheduledPublish struct {
+	// Id holds the unique id of the scheduled publication.
+	Id bson.ObjectId `bson:"_id"`
+
+	// BaseURL holds the base URL of the entity.
+	BaseURL *charm.URL `bson:"baseurl"`
+
+	// URL holds the URL of the entity to publish.
+	URL *charm.URL `bson:"url"`
+
+	// Channels holds the channels that the
+	// entity will be published to.
+	Channels []params.Channel `bson:"channels"`
+
+	// Resources holds the resource revisions that
+	// will be published with the entity.
+	Resources []ResourceRevision `bson:"resources,omitempty"`
+
+	// User holds the name of the user that
+	// scheduled the publication, if known.
+	User string `bson:"user,omitempty"`
+
+	// Time holds the time at which the
+	// entity is due to be published.
+	Time time.Time `bson:"time"`
+}
+
 // User stores user information for authorization
 type User struct {
 	// Username is the user identity to be authorized by the Store
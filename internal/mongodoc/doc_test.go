@@ -56,6 +56,56 @@ func (s *DocSuite) TestIntBoolSetBSONInvalidValue(c *gc.C) {
 	c.Assert(err, gc.ErrorMatches, `invalid value 2`)
 }
 
+func (s *DocSuite) TestEntityChannelKeys(c *gc.C) {
+	e := &mongodoc.Entity{
+		URL: charm.MustParseURL("cs:~bob/trusty/wordpress-1"),
+		Published: map[params.Channel]bool{
+			params.StableChannel: true,
+			"1.x/edge":           true,
+		},
+	}
+	data, err := bson.Marshal(e)
+	c.Assert(err, gc.Equals, nil)
+	var doc struct {
+		Published map[string]bool
+	}
+	err = bson.Unmarshal(data, &doc)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(doc.Published, jc.DeepEquals, map[string]bool{
+		"stable":     true,
+		"1%2Ex/edge": true,
+	})
+	var e1 mongodoc.Entity
+	err = bson.Unmarshal(data, &e1)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(e1.Published, jc.DeepEquals, e.Published)
+}
+
+func (s *DocSuite) TestBaseEntityChannelKeys(c *gc.C) {
+	url := charm.MustParseURL("cs:~bob/trusty/wordpress-1")
+	e := &mongodoc.BaseEntity{
+		URL: mongodoc.BaseURL(url),
+		ChannelACLs: map[params.Channel]mongodoc.ACL{
+			params.StableChannel: {Read: []string{"everyone"}},
+			"1.x/stable":         {Read: []string{"bob"}},
+		},
+		ChannelEntities: map[params.Channel]map[string]*charm.URL{
+			"1.x/stable": {"trusty": url},
+		},
+		ChannelResources: map[params.Channel][]mongodoc.ResourceRevision{
+			"1.x/stable": {{Name: "someResource", Revision: 2}},
+		},
+	}
+	data, err := bson.Marshal(e)
+	c.Assert(err, gc.Equals, nil)
+	var e1 mongodoc.BaseEntity
+	err = bson.Unmarshal(data, &e1)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(e1.ChannelACLs, jc.DeepEquals, e.ChannelACLs)
+	c.Assert(e1.ChannelEntities, jc.DeepEquals, e.ChannelEntities)
+	c.Assert(e1.ChannelResources, jc.DeepEquals, e.ChannelResources)
+}
+
 var preferredURLTests = []struct {
 	entity         *mongodoc.Entity
 	usePromulgated bool
@@ -0,0 +1,20 @@
+package monitoring
+
+// BlobCacheHit records that a blob read was served
+// from the local blob cache.
+func BlobCacheHit() {
+	blobCacheHits.Inc()
+}
+
+// BlobCacheMiss records that a blob read could not be
+// served from the local blob cache.
+func BlobCacheMiss() {
+	blobCacheMisses.Inc()
+}
+
+// SetBlobCacheSize records the number of blobs and their total
+// size in bytes currently held in the local blob cache.
+func SetBlobCacheSize(count int, size int64) {
+	blobCacheCount.Set(float64(count))
+	blobCacheSize.Set(float64(size))
+}
@@ -57,6 +57,12 @@ func NewBlobstoreGCDuration() *Duration {
 	return newDuration(blobstoreGCDuration)
 }
 
+// NewBlobstoreScrubDuration returns a new Duration to be used for
+// measuring the time taken to scrub the blob store.
+func NewBlobstoreScrubDuration() *Duration {
+	return newDuration(blobstoreScrubDuration)
+}
+
 // Done observes the duration on a Duration as a metric.
 // It should only be called once.
 func (d *Duration) Done() {
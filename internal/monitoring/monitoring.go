@@ -57,6 +57,76 @@ var (
 		Help:      "The mean stored blob size",
 	})
 
+	blobKindCount = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "charmstore",
+		Subsystem: "archive",
+		Name:      "blob_kind_count",
+		Help:      "The number of stored blobs of each kind.",
+	}, []string{"kind"})
+
+	blobKindSize = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "charmstore",
+		Subsystem: "archive",
+		Name:      "blob_kind_size",
+		Help:      "The total size in bytes of the stored blobs of each kind.",
+	}, []string{"kind"})
+
+	blobstoreScrubDuration = prometheus.NewSummary(prometheus.SummaryOpts{
+		Namespace: "charmstore",
+		Subsystem: "archive",
+		Name:      "blobstore_scrub_duration",
+		Help:      "The processing duration of a blob store scrub in seconds",
+	})
+
+	blobScrubChecked = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "charmstore",
+		Subsystem: "archive",
+		Name:      "blob_scrub_checked",
+		Help:      "The number of blobs checked by the last blob store scrub.",
+	})
+
+	blobScrubCheckedBytes = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "charmstore",
+		Subsystem: "archive",
+		Name:      "blob_scrub_checked_bytes",
+		Help:      "The number of bytes read by the last blob store scrub.",
+	})
+
+	blobScrubFailures = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "charmstore",
+		Subsystem: "archive",
+		Name:      "blob_scrub_failures",
+		Help:      "The number of blobs that failed verification in the last blob store scrub.",
+	})
+
+	blobCacheHits = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "charmstore",
+		Subsystem: "archive",
+		Name:      "blob_cache_hits",
+		Help:      "The number of blob reads served from the local blob cache.",
+	})
+
+	blobCacheMisses = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "charmstore",
+		Subsystem: "archive",
+		Name:      "blob_cache_misses",
+		Help:      "The number of blob reads that were not found in the local blob cache.",
+	})
+
+	blobCacheSize = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "charmstore",
+		Subsystem: "archive",
+		Name:      "blob_cache_size",
+		Help:      "The total size in bytes of the blobs held in the local blob cache.",
+	})
+
+	blobCacheCount = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "charmstore",
+		Subsystem: "archive",
+		Name:      "blob_cache_count",
+		Help:      "The number of blobs held in the local blob cache.",
+	})
+
 	esSyncing = prometheus.NewGauge(prometheus.GaugeOpts{
 		Namespace: "charmstore",
 		Subsystem: "elastic_search",
@@ -68,19 +138,53 @@ var (
 // BlobStats holds statistics about blobs in the blob store.
 type BlobStats struct {
 	// Count holds the total number of blobs stored.
-	Count int
+	Count int `json:"count"`
 	// MaxSize holds the size of the largest blob.
-	MaxSize int64
+	MaxSize int64 `json:"max-size"`
 	// MeanSize holds the average blob size.
-	MeanSize int64
-	// TODO add counts/sizes for different
-	// kinds of blob?
+	MeanSize int64 `json:"mean-size"`
+	// Kinds holds statistics for each kind of blob,
+	// keyed by kind.
+	Kinds map[string]BlobKindStats `json:"kinds"`
+}
+
+// BlobKindStats holds statistics about the blobs
+// of a particular kind.
+type BlobKindStats struct {
+	// Count holds the number of blobs of the kind.
+	Count int `json:"count"`
+	// Size holds the total size of the blobs of the kind.
+	Size int64 `json:"size"`
 }
 
 func SetBlobStoreStats(s BlobStats) {
 	blobCount.Set(float64(s.Count))
 	maxBlobSize.Set(float64(s.MaxSize))
 	meanBlobSize.Set(float64(s.MeanSize))
+	blobKindCount.Reset()
+	blobKindSize.Reset()
+	for kind, ks := range s.Kinds {
+		blobKindCount.WithLabelValues(kind).Set(float64(ks.Count))
+		blobKindSize.WithLabelValues(kind).Set(float64(ks.Size))
+	}
+}
+
+// BlobScrubStats holds statistics about a blob store scrub.
+type BlobScrubStats struct {
+	// Checked holds the number of blobs checked.
+	Checked int
+	// CheckedBytes holds the total number of bytes read.
+	CheckedBytes int64
+	// Failed holds the number of blobs that failed verification.
+	Failed int
+}
+
+// SetBlobScrubStats sets the blob scrub metrics
+// from the results of a completed scrub.
+func SetBlobScrubStats(s BlobScrubStats) {
+	blobScrubChecked.Set(float64(s.Checked))
+	blobScrubCheckedBytes.Set(float64(s.CheckedBytes))
+	blobScrubFailures.Set(float64(s.Failed))
 }
 
 func init() {
@@ -91,6 +195,16 @@ func init() {
 	prometheus.MustRegister(blobCount)
 	prometheus.MustRegister(maxBlobSize)
 	prometheus.MustRegister(meanBlobSize)
+	prometheus.MustRegister(blobKindCount)
+	prometheus.MustRegister(blobKindSize)
+	prometheus.MustRegister(blobstoreScrubDuration)
+	prometheus.MustRegister(blobScrubChecked)
+	prometheus.MustRegister(blobScrubCheckedBytes)
+	prometheus.MustRegister(blobScrubFailures)
+	prometheus.MustRegister(blobCacheHits)
+	prometheus.MustRegister(blobCacheMisses)
+	prometheus.MustRegister(blobCacheSize)
+	prometheus.MustRegister(blobCacheCount)
 	prometheus.MustRegister(esSyncing)
 	prometheus.MustRegister(mgomonitor.NewCollector("charmstore"))
 }
@@ -24,6 +24,11 @@ var logger = loggo.GetLogger("charmstore.internal.router")
 // WriteError can be used to write an error response.
 var WriteError = errorToResp.WriteError
 
+// ErrQuotaExceeded is the error code used when an upload would take
+// a user or group over its storage quota. It is not defined in the
+// params package because it is specific to this charm store.
+const ErrQuotaExceeded params.ErrorCode = "quota exceeded"
+
 // JSONHandler represents a handler that returns a JSON value.
 // The provided header can be used to set response headers.
 type JSONHandler func(http.Header, *http.Request) (interface{}, error)
@@ -84,7 +89,8 @@ func errorToResp1(err error) (int, interface{}) {
 		status = http.StatusBadRequest
 	case params.ErrForbidden,
 		params.ErrEntityIdNotAllowed,
-		params.ErrReadOnly:
+		params.ErrReadOnly,
+		ErrQuotaExceeded:
 		status = http.StatusForbidden
 	case params.ErrUnauthorized:
 		status = http.StatusUnauthorized
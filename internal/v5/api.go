@@ -11,6 +11,7 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -172,10 +173,14 @@ func (h *Handler) NewReqHandler(req *http.Request) (*ReqHandler, error) {
 	// Validate all the values for channel, even though
 	// most endpoints will only ever use the first one.
 	// PUT to an archive is the notable exception.
-	for _, ch := range req.Form["channel"] {
-		if !params.ValidChannels[params.Channel(ch)] {
+	// Channels in the default track are converted to
+	// their canonical form, so "latest/stable" means "stable".
+	for i, ch := range req.Form["channel"] {
+		c, err := charmstore.ParseChannel(ch)
+		if err != nil {
 			return nil, badRequestf(nil, "invalid channel %q specified in request", ch)
 		}
+		req.Form["channel"][i] = string(c)
 	}
 	store, err := h.Pool.RequestStore()
 	if err != nil {
@@ -212,6 +217,7 @@ func RouterHandlers(h *ReqHandler) *router.Handlers {
 			"list":                 router.HandleJSON(h.serveList),
 			"log":                  router.HandleErrors(h.serveLog),
 			"logout":               http.HandlerFunc(logout),
+			"quota/":               router.HandleJSON(h.serveQuota),
 			"search":               router.HandleJSON(h.serveSearch),
 			"search/interesting":   http.HandlerFunc(h.serveSearchInteresting),
 			"set-auth-cookie":      router.HandleErrors(h.serveSetAuthCookie),
@@ -226,14 +232,22 @@ func RouterHandlers(h *ReqHandler) *router.Handlers {
 			"users/":               router.HandleJSON(h.serveUsers),
 		},
 		Id: map[string]router.IdHandler{
+			"all":                         h.serveAll,
 			"archive":                     h.serveArchive,
 			"archive/":                    resolveId(authId(h.serveArchiveFile), "blobhash", "blobhash"),
+			"deleted":                     h.serveDeleted,
 			"diagram.svg":                 resolveId(authId(h.serveDiagram), "bundledata"),
 			"expand-id":                   resolveId(authId(h.serveExpandId)),
 			"icon.svg":                    resolveId(authId(h.serveIcon), "contents", "blobhash"),
 			"publish":                     resolveId(h.servePublish),
 			"promulgate":                  resolveId(h.servePromulgate),
 			"readme":                      resolveId(authId(h.serveReadMe), "contents", "blobhash"),
+			"restore":                     h.serveRestore,
+			"retention-preview":           h.serveRetentionPreview,
+			"rollback":                    resolveId(h.serveRollback),
+			"schedule-publish":            resolveId(h.serveSchedulePublish),
+			"schedule-publish/":           h.serveCancelScheduledPublish,
+			"transfer":                    h.serveTransfer,
 			"resource/":                   reqBodyReadHandler(resolveId(authId(h.serveResources), "charmmeta")),
 			"docker-resource-upload-info": resolveId(h.serveDockerResourceUploadInfo, "charmmeta"),
 			"allperms":                    h.serveAllPerms,
@@ -247,6 +261,7 @@ func RouterHandlers(h *ReqHandler) *router.Handlers {
 			"bundle-unit-count":    h.EntityHandler(h.metaBundleUnitCount, "bundleunitcount"),
 			"can-ingest":           h.baseEntityHandler(h.metaCanIngest, "noingest"),
 			"can-write":            h.baseEntityHandler(h.metaCanWrite),
+			"channel-history":      h.baseEntityHandler(h.metaChannelHistory, "_id"),
 			"charm-actions":        h.EntityHandler(h.metaCharmActions, "charmactions"),
 			"charm-config":         h.EntityHandler(h.metaCharmConfig, "charmconfig"),
 			"charm-metadata":       h.EntityHandler(h.metaCharmMetadata, "charmmeta"),
@@ -272,28 +287,30 @@ func RouterHandlers(h *ReqHandler) *router.Handlers {
 				h.putMetaExtraInfoWithKey,
 				"extrainfo",
 			),
-			"hash256":          h.EntityHandler(h.metaHash256, "blobhash256"),
-			"hash":             h.EntityHandler(h.metaHash, "blobhash"),
-			"id":               h.EntityHandler(h.metaId, "_id"),
-			"id-name":          h.EntityHandler(h.metaIdName, "_id"),
-			"id-revision":      h.EntityHandler(h.metaIdRevision, "_id"),
-			"id-series":        h.EntityHandler(h.metaIdSeries, "_id"),
-			"id-user":          h.EntityHandler(h.metaIdUser, "_id"),
-			"manifest":         h.EntityHandler(h.metaManifest, "blobhash"),
-			"owner":            h.EntityHandler(h.metaOwner, "_id"),
-			"perm":             h.puttableBaseEntityHandler(h.metaPerm, h.putMetaPerm, "channelacls"),
-			"perm/":            h.puttableBaseEntityHandler(h.metaPermWithKey, h.putMetaPermWithKey, "channelacls"),
-			"promulgated":      h.baseEntityHandler(h.metaPromulgated, "promulgated"),
-			"promulgated-id":   h.EntityHandler(h.metaPromulgatedId, "_id", "promulgated-url"),
-			"published":        h.EntityHandler(h.metaPublished, "published"),
-			"resources":        h.EntityHandler(h.metaResources, "charmmeta"),
-			"resources/":       h.EntityHandler(h.metaResourcesSingle, "charmmeta"),
-			"revision-info":    router.SingleIncludeHandler(h.metaRevisionInfo),
-			"stats":            h.EntityHandler(h.metaStats, "supportedseries"),
-			"supported-series": h.EntityHandler(h.metaSupportedSeries, "supportedseries"),
-			"tags":             h.EntityHandler(h.metaTags, "charmmeta", "bundledata"),
-			"terms":            h.EntityHandler(h.metaTerms, "charmmeta"),
-			"unpromulgated-id": h.EntityHandler(h.metaUnpromulgatedId, "_id"),
+			"hash256":             h.EntityHandler(h.metaHash256, "blobhash256"),
+			"hash":                h.EntityHandler(h.metaHash, "blobhash"),
+			"id":                  h.EntityHandler(h.metaId, "_id"),
+			"id-name":             h.EntityHandler(h.metaIdName, "_id"),
+			"id-revision":         h.EntityHandler(h.metaIdRevision, "_id"),
+			"id-series":           h.EntityHandler(h.metaIdSeries, "_id"),
+			"id-user":             h.EntityHandler(h.metaIdUser, "_id"),
+			"manifest":            h.EntityHandler(h.metaManifest, "blobhash"),
+			"owner":               h.EntityHandler(h.metaOwner, "_id"),
+			"perm":                h.puttableBaseEntityHandler(h.metaPerm, h.putMetaPerm, "channelacls"),
+			"perm/":               h.puttableBaseEntityHandler(h.metaPermWithKey, h.putMetaPermWithKey, "channelacls"),
+			"promulgated":         h.baseEntityHandler(h.metaPromulgated, "promulgated"),
+			"promulgated-id":      h.EntityHandler(h.metaPromulgatedId, "_id", "promulgated-url"),
+			"published":           h.EntityHandler(h.metaPublished, "published"),
+			"resources":           h.EntityHandler(h.metaResources, "charmmeta"),
+			"resources/":          h.EntityHandler(h.metaResourcesSingle, "charmmeta"),
+			"retention-policy":    h.puttableBaseEntityHandler(h.metaRetentionPolicy, h.putMetaRetentionPolicy, "retentionpolicy"),
+			"revision-info":       router.SingleIncludeHandler(h.metaRevisionInfo),
+			"scheduled-publishes": h.baseEntityHandler(h.metaScheduledPublishes, "_id"),
+			"stats":               h.EntityHandler(h.metaStats, "supportedseries"),
+			"supported-series":    h.EntityHandler(h.metaSupportedSeries, "supportedseries"),
+			"tags":                h.EntityHandler(h.metaTags, "charmmeta", "bundledata"),
+			"terms":               h.EntityHandler(h.metaTerms, "charmmeta"),
+			"unpromulgated-id":    h.EntityHandler(h.metaUnpromulgatedId, "_id"),
 
 			// endpoints not yet implemented:
 			// "color": router.SingleIncludeHandler(h.metaColor),
@@ -1063,7 +1080,7 @@ func (h *ReqHandler) metaPerm(entity *mongodoc.BaseEntity, id *router.ResolvedUR
 	if err != nil {
 		return nil, errgo.Mask(err)
 	}
-	acls, err := h.visibleACL(req, entity.ChannelACLs[ch])
+	acls, err := h.visibleACL(req, charmstore.ChannelACL(entity, ch))
 	if err != nil {
 		return nil, errgo.Mask(err)
 	}
@@ -1087,7 +1104,7 @@ func (h *ReqHandler) putMetaPerm(id *router.ResolvedURL, path string, val *json.
 	// TODO use only one UpdateField operation?
 	// Do not allow empty ACLs that could be send by previous bugged clients.
 	if len(perms.Read) > 0 {
-		updater.UpdateField(string("channelacls."+ch+".read"), perms.Read, &audit.Entry{
+		updater.UpdateField("channelacls."+mongodoc.ChannelKey(ch)+".read", perms.Read, &audit.Entry{
 			Op:     audit.OpSetPerm,
 			Entity: &id.URL,
 			ACL: &audit.ACL{
@@ -1096,7 +1113,7 @@ func (h *ReqHandler) putMetaPerm(id *router.ResolvedURL, path string, val *json.
 		})
 	}
 	if len(perms.Write) > 0 {
-		updater.UpdateField(string("channelacls."+ch+".write"), perms.Write, &audit.Entry{
+		updater.UpdateField("channelacls."+mongodoc.ChannelKey(ch)+".write", perms.Write, &audit.Entry{
 			Op:     audit.OpSetPerm,
 			Entity: &id.URL,
 			ACL: &audit.ACL{
@@ -1145,7 +1162,7 @@ func (h *ReqHandler) metaPermWithKey(entity *mongodoc.BaseEntity, id *router.Res
 	if err != nil {
 		return nil, errgo.Mask(err)
 	}
-	acls, err := h.visibleACL(req, entity.ChannelACLs[ch])
+	acls, err := h.visibleACL(req, charmstore.ChannelACL(entity, ch))
 	if err != nil {
 		return nil, errgo.Mask(err)
 	}
@@ -1211,7 +1228,7 @@ func (h *ReqHandler) putMetaPermWithKey(id *router.ResolvedURL, path string, val
 	}
 	switch path {
 	case "/read":
-		updater.UpdateField(string("channelacls."+ch+".read"), perms, &audit.Entry{
+		updater.UpdateField("channelacls."+mongodoc.ChannelKey(ch)+".read", perms, &audit.Entry{
 			Op:     audit.OpSetPerm,
 			Entity: &id.URL,
 			ACL: &audit.ACL{
@@ -1221,7 +1238,7 @@ func (h *ReqHandler) putMetaPermWithKey(id *router.ResolvedURL, path string, val
 		updater.UpdateSearch()
 		return nil
 	case "/write":
-		updater.UpdateField(string("channelacls."+ch+".write"), perms, &audit.Entry{
+		updater.UpdateField("channelacls."+mongodoc.ChannelKey(ch)+".write", perms, &audit.Entry{
 			Op:     audit.OpSetPerm,
 			Entity: &id.URL,
 			ACL: &audit.ACL{
@@ -1259,11 +1276,25 @@ func (h *ReqHandler) metaPublished(entity *mongodoc.Entity, id *router.ResolvedU
 			Current: current,
 		}
 	}
-	// Reorder results by stability level.
+	// Reorder results by track, starting with the default track,
+	// and then by stability level.
+	var tracks []string
+	for channel := range results {
+		if track, _ := charmstore.ChannelTrack(channel); track != charmstore.DefaultTrack {
+			tracks = append(tracks, track)
+		}
+	}
+	sort.Strings(tracks)
+	tracks = append([]string{charmstore.DefaultTrack}, tracks...)
 	info := make([]params.PublishedInfo, 0, len(results))
-	for _, channel := range params.OrderedChannels {
-		if result, ok := results[channel]; ok {
-			info = append(info, result)
+	for i, track := range tracks {
+		if i > 0 && track == tracks[i-1] {
+			continue
+		}
+		for _, risk := range params.OrderedChannels {
+			if result, ok := results[charmstore.TrackChannel(track, risk)]; ok {
+				info = append(info, result)
+			}
 		}
 	}
 	return &params.PublishedResponse{
@@ -1538,7 +1569,7 @@ func (h *ReqHandler) serveAllPerms(id *charm.URL, w http.ResponseWriter, req *ht
 	_, err = h.authorize(authorizeParams{
 		req: req,
 		acls: []mongodoc.ACL{
-			baseEntity.ChannelACLs[channel],
+			charmstore.ChannelACL(baseEntity, channel),
 		},
 		ops: []string{OpReadWithNoTerms},
 	})
@@ -1576,16 +1607,18 @@ func (h *ReqHandler) servePublish(id *router.ResolvedURL, w http.ResponseWriter,
 	if len(chans) == 0 {
 		return badRequestf(nil, "no channels provided")
 	}
-	for _, c := range chans {
+	for i, c := range chans {
 		if c == params.NoChannel {
 			return badRequestf(nil, "cannot publish to an empty channel")
 		}
-		if !params.ValidChannels[c] {
+		canon, err := charmstore.ParseChannel(string(c))
+		if err != nil {
 			return badRequestf(nil, "unrecognized channel %q", c)
 		}
-		if c == params.UnpublishedChannel {
+		if canon == params.UnpublishedChannel {
 			return badRequestf(nil, "cannot publish to the unpublished channel")
 		}
+		chans[i] = canon
 	}
 
 	// Retrieve the base entity so that we can check permissions.
@@ -1598,7 +1631,7 @@ func (h *ReqHandler) servePublish(id *router.ResolvedURL, w http.ResponseWriter,
 	// on all the channels being published to.
 	acls := make([]mongodoc.ACL, 0, len(chans))
 	for _, c := range chans {
-		acls = append(acls, baseEntity.ChannelACLs[c])
+		acls = append(acls, charmstore.ChannelACL(baseEntity, c))
 	}
 	if _, err := h.authorize(authorizeParams{
 		req:              req,
@@ -1610,7 +1643,7 @@ func (h *ReqHandler) servePublish(id *router.ResolvedURL, w http.ResponseWriter,
 		return errgo.Mask(err, errgo.Any)
 	}
 
-	if err := h.Store.Publish(id, publish.Resources, chans...); err != nil {
+	if err := h.Store.PublishAs(h.auth.Username, id, publish.Resources, chans...); err != nil {
 		if errgo.Cause(err) == charmstore.ErrPublishResourceMismatch {
 			return errgo.WithCausef(err, params.ErrBadRequest, "")
 		}
@@ -566,6 +566,87 @@ var metaEndpoints = []metaEndpoint{{
 	assertCheckData: func(c *gc.C, data interface{}) {
 		c.Assert(data, gc.Equals, params.PromulgatedResponse{Promulgated: false})
 	},
+}, {
+	name: "channel-history",
+	get: func(store *charmstore.Store, url *router.ResolvedURL) (interface{}, error) {
+		entries, err := store.ChannelHistory(&url.URL, params.NoChannel, 0)
+		if err != nil {
+			return nil, err
+		}
+		if len(entries) == 0 {
+			return nil, nil
+		}
+		resp := make([]v5.ChannelHistoryEntry, len(entries))
+		for i, e := range entries {
+			resp[i] = v5.ChannelHistoryEntry{
+				Channel: e.Channel,
+				Id:      e.URL,
+				User:    e.User,
+				Time:    e.Time,
+			}
+			for _, r := range e.Resources {
+				if resp[i].Resources == nil {
+					resp[i].Resources = make(map[string]int)
+				}
+				resp[i].Resources[r.Name] = r.Revision
+			}
+		}
+		return resp, nil
+	},
+	checkURL: newResolvedURL("cs:~charmers/precise/wordpress-23", 23),
+	assertCheckData: func(c *gc.C, data interface{}) {
+		entries := data.([]v5.ChannelHistoryEntry)
+		c.Assert(entries, gc.HasLen, 1)
+		c.Assert(entries[0].Channel, gc.Equals, params.StableChannel)
+		c.Assert(entries[0].Id, jc.DeepEquals, charm.MustParseURL("cs:~charmers/precise/wordpress-23"))
+	},
+}, {
+	name: "retention-policy",
+	get: func(store *charmstore.Store, url *router.ResolvedURL) (interface{}, error) {
+		e, err := store.FindBaseEntity(&url.URL, nil)
+		if err != nil {
+			return nil, err
+		}
+		if e.RetentionPolicy == nil {
+			return nil, nil
+		}
+		return &v5.RetentionPolicy{
+			KeepUnpublished: e.RetentionPolicy.KeepUnpublished,
+		}, nil
+	},
+	checkURL: newResolvedURL("cs:~charmers/precise/wordpress-23", 23),
+	assertCheckData: func(c *gc.C, data interface{}) {
+		c.Assert(data, jc.DeepEquals, &v5.RetentionPolicy{KeepUnpublished: 5})
+	},
+}, {
+	name: "scheduled-publishes",
+	get: func(store *charmstore.Store, url *router.ResolvedURL) (interface{}, error) {
+		docs, err := store.ScheduledPublishes(&url.URL)
+		if err != nil {
+			return nil, err
+		}
+		if len(docs) == 0 {
+			return nil, nil
+		}
+		resp := make([]v5.ScheduledPublish, len(docs))
+		for i, doc := range docs {
+			resp[i] = v5.ScheduledPublish{
+				Id:       doc.Id.Hex(),
+				Entity:   doc.URL,
+				Channels: doc.Channels,
+				User:     doc.User,
+				Time:     doc.Time,
+			}
+		}
+		return resp, nil
+	},
+	checkURL: newResolvedURL("cs:~charmers/precise/wordpress-23", 23),
+	assertCheckData: func(c *gc.C, data interface{}) {
+		schedules := data.([]v5.ScheduledPublish)
+		c.Assert(schedules, gc.HasLen, 1)
+		c.Assert(schedules[0].Entity, jc.DeepEquals, charm.MustParseURL("cs:~charmers/precise/wordpress-23"))
+		c.Assert(schedules[0].Channels, jc.DeepEquals, []params.Channel{params.EdgeChannel})
+	},
 }, {
 	name: "can-ingest",
 	get: func(store *charmstore.Store, url *router.ResolvedURL) (interface{}, error) {
@@ -723,6 +804,7 @@ var metaEndpoints = []metaEndpoint{{
 // test data getters correspond with reality.
 func (s *APISuite) TestEndpointGet(c *gc.C) {
 	s.addTestEntities(c)
+	s.addTestRetentionPolicy(c)
 	for i, ep := range metaEndpoints {
 		c.Logf("test %d: %s\n", i, ep.name)
 		data, err := ep.get(s.store, ep.checkURL)
@@ -801,9 +883,21 @@ func (s *APISuite) addTestEntities(c *gc.C) []*router.ResolvedURL {
 		s.assertPutAsAdmin(c, key, "value "+e.URL.String())
 		s.assertPutAsAdmin(c, commonkey, "value "+e.URL.String())
 	}
+	// Schedule a publication of the stock charm.
+	_, err := s.store.SchedulePublish("charmers", testEntities[0], nil, []params.Channel{params.EdgeChannel}, time.Now().Add(24*time.Hour))
+	c.Assert(err, gc.Equals, nil)
 	return testEntities
 }
 
+// addTestRetentionPolicy sets a retention policy on the stock
+// charm added by addTestEntities, so that the retention-policy
+// endpoint has some data to return.
+func (s *APISuite) addTestRetentionPolicy(c *gc.C) {
+	s.assertPutAsAdmin(c, "~charmers/precise/wordpress-23/meta/retention-policy", v5.RetentionPolicy{
+		KeepUnpublished: 5,
+	})
+}
+
 func (s *APISuite) TestMetaEndpointsSingle(c *gc.C) {
 	s.idmServer.SetDefaultUser("charmers")
 	// Force a user authentication so that the test is more deterministic later.
@@ -818,6 +912,7 @@ func (s *APISuite) TestMetaEndpointsSingle(c *gc.C) {
 		},
 	})
 	urls := s.addTestEntities(c)
+	s.addTestRetentionPolicy(c)
 	for i, ep := range metaEndpoints {
 		c.Logf("test %d. %s", i, ep.name)
 		tested := false
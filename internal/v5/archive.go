@@ -5,13 +5,16 @@ package v5 // import "gopkg.in/juju/charmstore.v5/internal/v5"
 
 import (
 	stdzip "archive/zip"
+	"crypto/sha256"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"mime"
 	"net/http"
+	"path"
 	"path/filepath"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/juju/charmrepo/v6/csclient/params"
@@ -19,6 +22,7 @@ import (
 	"gopkg.in/httprequest.v1"
 	"gopkg.in/mgo.v2/bson"
 
+	"gopkg.in/juju/charmstore.v5/audit"
 	"gopkg.in/juju/charmstore.v5/internal/charm"
 	"gopkg.in/juju/charmstore.v5/internal/charmstore"
 	"gopkg.in/juju/charmstore.v5/internal/mongodoc"
@@ -132,7 +136,7 @@ func (h *ReqHandler) SendEntityArchive(id *router.ResolvedURL, w http.ResponseWr
 	}
 	// TODO(rog) should we set connection=close here?
 	// See https://codereview.appspot.com/5958045
-	serveContent(w, req, blob.Size, blob)
+	serveContent(w, req, "archive.zip", blob.ModTime, blob.Hash, blob)
 }
 
 func (h *ReqHandler) serveDeleteArchive(id *router.ResolvedURL, w http.ResponseWriter, req *http.Request) error {
@@ -142,6 +146,10 @@ func (h *ReqHandler) serveDeleteArchive(id *router.ResolvedURL, w http.ResponseW
 	if err := h.Store.DeleteEntity(id); err != nil {
 		return errgo.NoteMask(err, fmt.Sprintf("cannot delete %q", id.PreferredURL()), errgo.Is(params.ErrNotFound), errgo.Is(params.ErrForbidden))
 	}
+	h.addAudit(audit.Entry{
+		Op:     audit.OpDelete,
+		Entity: &id.URL,
+	})
 	return nil
 }
 
@@ -186,6 +194,7 @@ func (h *ReqHandler) servePostArchive(id *charm.URL, w http.ResponseWriter, req
 			errgo.Is(params.ErrDuplicateUpload),
 			errgo.Is(params.ErrEntityIdNotAllowed),
 			errgo.Is(params.ErrInvalidEntity),
+			errgo.Is(router.ErrQuotaExceeded),
 		)
 	}
 	if ingesting, _ := router.ParseBool(req.Form.Get("ingest")); !ingesting {
@@ -229,7 +238,7 @@ func (h *ReqHandler) servePutArchive(id *charm.URL, w http.ResponseWriter, req *
 	var chans []params.Channel
 	for _, c := range req.Form["channel"] {
 		c := params.Channel(c)
-		if !params.ValidChannels[c] || c == params.UnpublishedChannel {
+		if !charmstore.ValidChannel(c) || c == params.UnpublishedChannel {
 			return badRequestf(nil, "cannot put entity into channel %q", c)
 		}
 		chans = append(chans, c)
@@ -272,6 +281,7 @@ func (h *ReqHandler) servePutArchive(id *charm.URL, w http.ResponseWriter, req *
 			errgo.Is(params.ErrDuplicateUpload),
 			errgo.Is(params.ErrEntityIdNotAllowed),
 			errgo.Is(params.ErrInvalidEntity),
+			errgo.Is(router.ErrQuotaExceeded),
 		)
 	}
 	return httprequest.WriteJSON(w, http.StatusOK, &params.ArchiveUploadResponse{
@@ -314,7 +324,7 @@ func (h *ReqHandler) serveArchiveFile(id *router.ResolvedURL, w http.ResponseWri
 // The blob should be associated with the entity
 // with the given id.
 func (h *ReqHandler) ServeBlobFile(w http.ResponseWriter, req *http.Request, id *router.ResolvedURL, blob *charmstore.Blob) error {
-	r, size, err := h.Store.OpenBlobFile(blob, req.URL.Path)
+	r, _, err := h.Store.OpenBlobFile(blob, req.URL.Path)
 	if err != nil {
 		return errgo.Mask(err, errgo.Is(params.ErrNotFound), errgo.Is(params.ErrForbidden))
 	}
@@ -323,13 +333,18 @@ func (h *ReqHandler) ServeBlobFile(w http.ResponseWriter, req *http.Request, id
 	if ctype != "" {
 		w.Header().Set("Content-Type", ctype)
 	}
-	w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
 	setArchiveCacheControl(w.Header(), h.isPublic(id))
-	w.WriteHeader(http.StatusOK)
-	io.Copy(w, r)
+	serveContent(w, req, path.Base(req.URL.Path), blob.ModTime, blobFileETag(blob, req.URL.Path), r)
 	return nil
 }
 
+// blobFileETag returns the entity tag for the file with the given path
+// within the given blob.
+func blobFileETag(blob *charmstore.Blob, filePath string) string {
+	sum := sha256.Sum256([]byte(blob.Hash + "/" + strings.TrimPrefix(path.Clean(filePath), "/")))
+	return fmt.Sprintf("%x", sum)
+}
+
 func (h *ReqHandler) isPublic(id *router.ResolvedURL) bool {
 	acls, _ := h.entityACLs(id)
 	for _, p := range acls.Read {
@@ -13,6 +13,8 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"mime"
+	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
@@ -107,6 +109,93 @@ func (s *ArchiveSuite) TestGet(c *gc.C) {
 	assertCacheControl(c, rec.Header(), true)
 }
 
+func (s *ArchiveSuite) TestGetConditional(c *gc.C) {
+	id := newResolvedURL("cs:~charmers/precise/wordpress-0", -1)
+	ch := storetesting.NewCharm(nil)
+	s.addPublicCharm(c, ch, id)
+	archiveURL := storeURL("~charmers/precise/wordpress-0/archive")
+
+	rec := httptesting.DoRequest(c, httptesting.DoRequestParams{
+		Handler: s.srv,
+		URL:     archiveURL,
+	})
+	c.Assert(rec.Code, gc.Equals, http.StatusOK)
+	etag := rec.Header().Get("Etag")
+	c.Assert(etag, gc.Equals, `"`+hashOfBytes(ch.Bytes())+`"`)
+	lastModified := rec.Header().Get("Last-Modified")
+	c.Assert(lastModified, gc.Not(gc.Equals), "")
+
+	// The archive is not sent again if the client already has it.
+	for _, header := range []http.Header{
+		{"If-None-Match": {etag}},
+		{"If-Modified-Since": {lastModified}},
+	} {
+		rec = httptesting.DoRequest(c, httptesting.DoRequestParams{
+			Handler: s.srv,
+			URL:     archiveURL,
+			Header:  header,
+		})
+		c.Assert(rec.Code, gc.Equals, http.StatusNotModified, gc.Commentf("header %v", header))
+		c.Assert(rec.Body.Len(), gc.Equals, 0)
+	}
+	rec = httptesting.DoRequest(c, httptesting.DoRequestParams{
+		Handler: s.srv,
+		URL:     archiveURL,
+		Header:  http.Header{"If-None-Match": {`"other"`}},
+	})
+	c.Assert(rec.Code, gc.Equals, http.StatusOK)
+	c.Assert(rec.Body.Bytes(), gc.DeepEquals, ch.Bytes())
+
+	// An interrupted download can be resumed if the
+	// archive has not changed.
+	rec = httptesting.DoRequest(c, httptesting.DoRequestParams{
+		Handler: s.srv,
+		URL:     archiveURL,
+		Header: http.Header{
+			"Range":    {"bytes=100-"},
+			"If-Range": {etag},
+		},
+	})
+	c.Assert(rec.Code, gc.Equals, http.StatusPartialContent)
+	c.Assert(rec.Body.Bytes(), gc.DeepEquals, ch.Bytes()[100:])
+	rec = httptesting.DoRequest(c, httptesting.DoRequestParams{
+		Handler: s.srv,
+		URL:     archiveURL,
+		Header: http.Header{
+			"Range":    {"bytes=100-"},
+			"If-Range": {`"other"`},
+		},
+	})
+	c.Assert(rec.Code, gc.Equals, http.StatusOK)
+	c.Assert(rec.Body.Bytes(), gc.DeepEquals, ch.Bytes())
+}
+
+func (s *ArchiveSuite) TestGetMultipleRanges(c *gc.C) {
+	id := newResolvedURL("cs:~charmers/precise/wordpress-0", -1)
+	ch := storetesting.NewCharm(nil)
+	s.addPublicCharm(c, ch, id)
+
+	rec := httptesting.DoRequest(c, httptesting.DoRequestParams{
+		Handler: s.srv,
+		URL:     storeURL("~charmers/precise/wordpress-0/archive"),
+		Header:  http.Header{"Range": {"bytes=0-9,20-29"}},
+	})
+	c.Assert(rec.Code, gc.Equals, http.StatusPartialContent)
+	mediaType, mparams, err := mime.ParseMediaType(rec.Header().Get("Content-Type"))
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(mediaType, gc.Equals, "multipart/byteranges")
+	mr := multipart.NewReader(rec.Body, mparams["boundary"])
+	for _, r := range [][2]int{{0, 10}, {20, 30}} {
+		part, err := mr.NextPart()
+		c.Assert(err, gc.Equals, nil)
+		data, err := ioutil.ReadAll(part)
+		c.Assert(err, gc.Equals, nil)
+		c.Assert(data, gc.DeepEquals, ch.Bytes()[r[0]:r[1]])
+	}
+	_, err = mr.NextPart()
+	c.Assert(err, gc.Equals, io.EOF)
+}
+
 func (s *ArchiveSuite) TestGetWithPartialId(c *gc.C) {
 	id := newResolvedURL("cs:~charmers/precise/wordpress-0", -1)
 	ch := storetesting.NewCharm(nil)
@@ -1164,6 +1253,53 @@ func (s *ArchiveSuite) TestArchiveFileGet(c *gc.C) {
 	s.assertArchiveFileContents(c, zipFile, "~charmers/utopic/all-hooks-0/archive/hooks/install")
 }
 
+func (s *ArchiveSuite) TestArchiveFileGetRangeAndConditional(c *gc.C) {
+	ch := storetesting.Charms.CharmArchive(c.MkDir(), "all-hooks")
+	id := newResolvedURL("cs:~charmers/utopic/all-hooks-0", 0)
+	s.addPublicCharm(c, ch, id)
+	zipFile, err := zip.OpenReader(ch.Path)
+	c.Assert(err, gc.Equals, nil)
+	defer zipFile.Close()
+	var expectBytes []byte
+	for _, file := range zipFile.File {
+		if file.Name == "metadata.yaml" {
+			r, err := file.Open()
+			c.Assert(err, gc.Equals, nil)
+			expectBytes, err = ioutil.ReadAll(r)
+			r.Close()
+			c.Assert(err, gc.Equals, nil)
+		}
+	}
+	c.Assert(len(expectBytes) > 20, gc.Equals, true)
+	fileURL := storeURL("~charmers/utopic/all-hooks-0/archive/metadata.yaml")
+
+	rec := httptesting.DoRequest(c, httptesting.DoRequestParams{
+		Handler: s.srv,
+		URL:     fileURL,
+		Header:  http.Header{"Range": {"bytes=10-19"}},
+	})
+	c.Assert(rec.Code, gc.Equals, http.StatusPartialContent)
+	c.Assert(rec.Body.Bytes(), gc.DeepEquals, expectBytes[10:20])
+	etag := rec.Header().Get("Etag")
+	c.Assert(etag, gc.Matches, `"[0-9a-f]+"`)
+
+	rec = httptesting.DoRequest(c, httptesting.DoRequestParams{
+		Handler: s.srv,
+		URL:     fileURL,
+		Header:  http.Header{"If-None-Match": {etag}},
+	})
+	c.Assert(rec.Code, gc.Equals, http.StatusNotModified)
+
+	// Other files in the same archive have different entity tags.
+	rec = httptesting.DoRequest(c, httptesting.DoRequestParams{
+		Handler: s.srv,
+		URL:     storeURL("~charmers/utopic/all-hooks-0/archive/hooks/install"),
+		Header:  http.Header{"If-None-Match": {etag}},
+	})
+	c.Assert(rec.Code, gc.Equals, http.StatusOK)
+	c.Assert(rec.Header().Get("Etag"), gc.Not(gc.Equals), etag)
+}
+
 // assertArchiveFileContents checks that the response returned by the
 // serveArchiveFile endpoint is correct for the given archive and URL path.
 func (s *ArchiveSuite) assertArchiveFileContents(c *gc.C, zipFile *zip.ReadCloser, path string) {
@@ -488,7 +488,7 @@ func (h *ReqHandler) entityACLs(id *router.ResolvedURL) (mongodoc.ACL, error) {
 	if err != nil {
 		return mongodoc.ACL{}, errgo.Notef(err, "cannot retrieve base entity %q for authorization", id)
 	}
-	return baseEntity.ChannelACLs[ch], nil
+	return charmstore.ChannelACL(baseEntity, ch), nil
 }
 
 // entitiesRequiredTerms returns the set of terms that the user must have
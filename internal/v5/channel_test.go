@@ -0,0 +1,136 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package v5_test
+
+import (
+	"net/http"
+
+	"github.com/juju/charmrepo/v6/csclient/params"
+	jc "github.com/juju/testing/checkers"
+	"github.com/juju/testing/httptesting"
+	gc "gopkg.in/check.v1"
+
+	"gopkg.in/juju/charmstore.v5/internal/mongodoc"
+	"gopkg.in/juju/charmstore.v5/internal/storetesting"
+)
+
+func (s *APISuite) TestPublishToTrack(c *gc.C) {
+	s.idmServer.SetDefaultUser("bob")
+	id0 := newResolvedURL("cs:~bob/precise/wordpress-0", -1)
+	err := s.store.AddCharmWithArchive(id0, storetesting.NewCharm(nil))
+	c.Assert(err, gc.Equals, nil)
+	err = s.store.Publish(id0, nil, params.StableChannel)
+	c.Assert(err, gc.Equals, nil)
+	id1 := newResolvedURL("cs:~bob/precise/wordpress-1", -1)
+	err = s.store.AddCharmWithArchive(id1, storetesting.NewCharm(nil))
+	c.Assert(err, gc.Equals, nil)
+
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler: s.srv,
+		Method:  "PUT",
+		URL:     storeURL("~bob/precise/wordpress-1/publish"),
+		Do:      bakeryDo(nil),
+		JSONBody: params.PublishRequest{
+			Channels: []params.Channel{"1/stable", "latest/edge"},
+		},
+	})
+
+	for i, test := range []struct {
+		query  string
+		expect int
+	}{
+		{"", 0},
+		{"?channel=stable", 0},
+		{"?channel=latest/stable", 0},
+		{"?channel=edge", 1},
+		{"?channel=1/stable", 1},
+	} {
+		c.Logf("test %d: %q", i, test.query)
+		s.assertGet(c, "~bob/precise/wordpress/meta/id-revision"+test.query, params.IdRevisionResponse{
+			Revision: test.expect,
+		})
+	}
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:      s.srv,
+		URL:          storeURL("~bob/precise/wordpress/meta/id-revision?channel=1/edge"),
+		Do:           bakeryDo(nil),
+		ExpectStatus: http.StatusNotFound,
+		ExpectBody: params.Error{
+			Code:    params.ErrNotFound,
+			Message: "no matching charm or bundle for cs:~bob/precise/wordpress",
+		},
+	})
+
+	s.assertGet(c, "~bob/precise/wordpress-1/meta/published?channel=unpublished", params.PublishedResponse{
+		Info: []params.PublishedInfo{{
+			Channel: params.EdgeChannel,
+			Current: true,
+		}, {
+			Channel: "1/stable",
+			Current: true,
+		}},
+	})
+}
+
+func (s *APISuite) TestPublishToInvalidTrack(c *gc.C) {
+	s.idmServer.SetDefaultUser("bob")
+	id := newResolvedURL("cs:~bob/precise/wordpress-0", -1)
+	err := s.store.AddCharmWithArchive(id, storetesting.NewCharm(nil))
+	c.Assert(err, gc.Equals, nil)
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler: s.srv,
+		Method:  "PUT",
+		URL:     storeURL("~bob/precise/wordpress-0/publish"),
+		Do:      bakeryDo(nil),
+		JSONBody: params.PublishRequest{
+			Channels: []params.Channel{"1_x/stable"},
+		},
+		ExpectStatus: http.StatusBadRequest,
+		ExpectBody: params.Error{
+			Code:    params.ErrBadRequest,
+			Message: `unrecognized channel "1_x/stable"`,
+		},
+	})
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:      s.srv,
+		URL:          storeURL("~bob/precise/wordpress/meta/id-revision?channel=1/unpublished"),
+		Do:           bakeryDo(nil),
+		ExpectStatus: http.StatusBadRequest,
+		ExpectBody: params.Error{
+			Code:    params.ErrBadRequest,
+			Message: `invalid channel "1/unpublished" specified in request`,
+		},
+	})
+}
+
+func (s *APISuite) TestTrackChannelPerms(c *gc.C) {
+	s.idmServer.SetDefaultUser("bob")
+	id := newResolvedURL("cs:~bob/precise/wordpress-0", -1)
+	err := s.store.AddCharmWithArchive(id, storetesting.NewCharm(nil))
+	c.Assert(err, gc.Equals, nil)
+	err = s.store.Publish(id, nil, "1/stable")
+	c.Assert(err, gc.Equals, nil)
+
+	// Without explicit permissions, the track channel
+	// uses the permissions of the default track.
+	s.assertGet(c, "~bob/precise/wordpress/meta/perm?channel=1/stable", params.PermResponse{
+		Read:  []string{"bob"},
+		Write: []string{"bob"},
+	})
+
+	s.assertPut(c, "~bob/precise/wordpress/meta/perm/read?channel=1/stable", []string{params.Everyone})
+	baseEntity, err := s.store.FindBaseEntity(&id.URL, nil)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(baseEntity.ChannelACLs["1/stable"], jc.DeepEquals, mongodoc.ACL{
+		Read: []string{params.Everyone},
+	})
+	s.assertGet(c, "~bob/precise/wordpress/meta/perm?channel=1/stable", params.PermResponse{
+		Read:  []string{params.Everyone},
+		Write: []string{"bob"},
+	})
+	s.assertGet(c, "~bob/precise/wordpress/meta/perm?channel=stable", params.PermResponse{
+		Read:  []string{"bob"},
+		Write: []string{"bob"},
+	})
+}
@@ -0,0 +1,132 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package v5 // import "gopkg.in/juju/charmstore.v5/internal/v5"
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/juju/charmrepo/v6/csclient/params"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/httprequest.v1"
+
+	"gopkg.in/juju/charmstore.v5/internal/charm"
+	"gopkg.in/juju/charmstore.v5/internal/charmstore"
+	"gopkg.in/juju/charmstore.v5/internal/mongodoc"
+	"gopkg.in/juju/charmstore.v5/internal/router"
+)
+
+// ChannelHistoryEntry holds an entry in the publication history of a
+// charm or bundle as returned by the meta/channel-history endpoint.
+type ChannelHistoryEntry struct {
+	// Channel holds the channel that the entity was published to.
+	Channel params.Channel
+
+	// Id holds the id of the published entity.
+	Id *charm.URL
+
+	// Resources holds the revisions of the resources
+	// that were published with the entity.
+	Resources map[string]int `json:",omitempty"`
+
+	// User holds the user that published the entity, if known.
+	User string `json:",omitempty"`
+
+	// Time holds the time that the entity was published.
+	Time time.Time
+}
+
+// RollbackRequest holds the body of a rollback request.
+type RollbackRequest struct {
+	// Channel holds the channel to roll back.
+	Channel params.Channel
+}
+
+// RollbackResponse holds the response to a rollback request.
+type RollbackResponse struct {
+	// Id holds the id of the entity that is now
+	// published to the channel.
+	Id *charm.URL
+}
+
+// newChannelHistoryEntry returns the representation of the
+// given channel history document used by the meta/channel-history
+// endpoint.
+func newChannelHistoryEntry(e *mongodoc.ChannelHistoryEntry) ChannelHistoryEntry {
+	entry := ChannelHistoryEntry{
+		Channel: e.Channel,
+		Id:      e.URL,
+		User:    e.User,
+		Time:    e.Time,
+	}
+	if len(e.Resources) > 0 {
+		entry.Resources = make(map[string]int, len(e.Resources))
+		for _, r := range e.Resources {
+			entry.Resources[r.Name] = r.Revision
+		}
+	}
+	return entry
+}
+
+// GET id/meta/channel-history
+// https://github.com/juju/charmstore/blob/v5/docs/API.md#get-idmetachannel-history
+func (h *ReqHandler) metaChannelHistory(entity *mongodoc.BaseEntity, id *router.ResolvedURL, path string, flags url.Values, req *http.Request) (interface{}, error) {
+	entries, err := h.Store.ChannelHistory(entity.URL, params.NoChannel, 0)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if len(entries) == 0 {
+		return nil, nil
+	}
+	resp := make([]ChannelHistoryEntry, len(entries))
+	for i, e := range entries {
+		resp[i] = newChannelHistoryEntry(e)
+	}
+	return resp, nil
+}
+
+// POST id/rollback
+// https://github.com/juju/charmstore/blob/v5/docs/API.md#post-idrollback
+func (h *ReqHandler) serveRollback(id *router.ResolvedURL, w http.ResponseWriter, req *http.Request) error {
+	if req.Method != "POST" {
+		return errgo.WithCausef(nil, params.ErrMethodNotAllowed, "%s not allowed", req.Method)
+	}
+	var rollback RollbackRequest
+	if err := json.NewDecoder(req.Body).Decode(&rollback); err != nil {
+		return badRequestf(err, "cannot unmarshal rollback request")
+	}
+	if rollback.Channel == params.NoChannel {
+		return badRequestf(nil, "no channel provided")
+	}
+	ch, err := charmstore.ParseChannel(string(rollback.Channel))
+	if err != nil {
+		return badRequestf(nil, "unrecognized channel %q", rollback.Channel)
+	}
+	if ch == params.UnpublishedChannel {
+		return badRequestf(nil, "cannot roll back the unpublished channel")
+	}
+	baseEntity, err := h.Cache.BaseEntity(&id.URL, charmstore.FieldSelector("channelacls"))
+	if err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	if _, err := h.authorize(authorizeParams{
+		req:  req,
+		acls: []mongodoc.ACL{charmstore.ChannelACL(baseEntity, ch)},
+		ops:  []string{OpWrite},
+	}); err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	rid, err := h.Store.RollbackChannel(h.auth.Username, &id.URL, ch)
+	if err != nil {
+		if errgo.Cause(err) == charmstore.ErrPublishResourceMismatch {
+			return errgo.WithCausef(err, params.ErrBadRequest, "")
+		}
+		return errgo.NoteMask(err, "cannot roll back "+string(ch)+" channel", errgo.Is(params.ErrNotFound))
+	}
+	return httprequest.WriteJSON(w, http.StatusOK, &RollbackResponse{
+		Id: &rid.URL,
+	})
+}
@@ -0,0 +1,192 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package v5_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/juju/charmrepo/v6/csclient/params"
+	jc "github.com/juju/testing/checkers"
+	"github.com/juju/testing/httptesting"
+	gc "gopkg.in/check.v1"
+
+	"gopkg.in/juju/charmstore.v5/internal/charm"
+	"gopkg.in/juju/charmstore.v5/internal/storetesting"
+	"gopkg.in/juju/charmstore.v5/internal/v5"
+)
+
+func (s *APISuite) TestChannelHistoryAndRollback(c *gc.C) {
+	s.idmServer.SetDefaultUser("bob")
+	meta := storetesting.MetaWithResources(nil, "someResource")
+	id0 := newResolvedURL("cs:~bob/precise/wordpress-0", -1)
+	err := s.store.AddCharmWithArchive(id0, storetesting.NewCharm(meta))
+	c.Assert(err, gc.Equals, nil)
+	s.uploadResource(c, id0, "someResource", "stuff 0")
+	s.uploadResource(c, id0, "someResource", "stuff 1")
+	err = s.store.Publish(id0, map[string]int{"someResource": 0}, params.StableChannel)
+	c.Assert(err, gc.Equals, nil)
+	id1 := newResolvedURL("cs:~bob/precise/wordpress-1", -1)
+	err = s.store.AddCharmWithArchive(id1, storetesting.NewCharm(meta))
+	c.Assert(err, gc.Equals, nil)
+
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler: s.srv,
+		Method:  "PUT",
+		URL:     storeURL("~bob/precise/wordpress-1/publish"),
+		Do:      bakeryDo(nil),
+		JSONBody: params.PublishRequest{
+			Resources: map[string]int{
+				"someResource": 1,
+			},
+			Channels: []params.Channel{params.StableChannel},
+		},
+	})
+
+	history := s.getChannelHistory(c, "~bob/wordpress")
+	c.Assert(history, gc.HasLen, 2)
+	for _, e := range history {
+		c.Assert(e.Time, jc.TimeBetween(time.Now().Add(-time.Minute), time.Now()))
+	}
+	c.Assert(history[0].Channel, gc.Equals, params.StableChannel)
+	c.Assert(history[0].Id, jc.DeepEquals, &id1.URL)
+	c.Assert(history[0].Resources, jc.DeepEquals, map[string]int{"someResource": 1})
+	c.Assert(history[0].User, gc.Equals, "bob")
+	c.Assert(history[1].Id, jc.DeepEquals, &id0.URL)
+	c.Assert(history[1].Resources, jc.DeepEquals, map[string]int{"someResource": 0})
+	c.Assert(history[1].User, gc.Equals, "")
+
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler: s.srv,
+		Method:  "POST",
+		URL:     storeURL("~bob/wordpress/rollback"),
+		Do:      bakeryDo(nil),
+		JSONBody: v5.RollbackRequest{
+			Channel: params.StableChannel,
+		},
+		ExpectBody: v5.RollbackResponse{
+			Id: charm.MustParseURL("cs:~bob/precise/wordpress-0"),
+		},
+	})
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler: s.srv,
+		URL:     storeURL("~bob/wordpress/meta/id-revision?channel=stable"),
+		Do:      bakeryDo(nil),
+		ExpectBody: params.IdRevisionResponse{
+			Revision: 0,
+		},
+	})
+	history = s.getChannelHistory(c, "~bob/wordpress")
+	c.Assert(history, gc.HasLen, 3)
+	c.Assert(history[0].Id, jc.DeepEquals, &id0.URL)
+	c.Assert(history[0].Resources, jc.DeepEquals, map[string]int{"someResource": 0})
+	c.Assert(history[0].User, gc.Equals, "bob")
+}
+
+func (s *APISuite) getChannelHistory(c *gc.C, id string) []v5.ChannelHistoryEntry {
+	var history []v5.ChannelHistoryEntry
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler: s.srv,
+		URL:     storeURL(id + "/meta/channel-history"),
+		Do:      bakeryDo(nil),
+		ExpectBody: httptesting.BodyAsserter(func(c *gc.C, m json.RawMessage) {
+			err := json.Unmarshal(m, &history)
+			c.Assert(err, gc.Equals, nil)
+		}),
+	})
+	return history
+}
+
+var rollbackErrorTests = []struct {
+	about        string
+	method       string
+	url          string
+	channel      params.Channel
+	asUser       string
+	expectStatus int
+	expectBody   params.Error
+}{{
+	about:        "wrong method",
+	method:       "GET",
+	url:          "~bob/wordpress/rollback",
+	asUser:       "bob",
+	expectStatus: http.StatusMethodNotAllowed,
+	expectBody: params.Error{
+		Code:    params.ErrMethodNotAllowed,
+		Message: "GET not allowed",
+	},
+}, {
+	about:        "no channel",
+	method:       "POST",
+	url:          "~bob/wordpress/rollback",
+	asUser:       "bob",
+	expectStatus: http.StatusBadRequest,
+	expectBody: params.Error{
+		Code:    params.ErrBadRequest,
+		Message: "no channel provided",
+	},
+}, {
+	about:        "unrecognized channel",
+	method:       "POST",
+	url:          "~bob/wordpress/rollback",
+	channel:      "bad",
+	asUser:       "bob",
+	expectStatus: http.StatusBadRequest,
+	expectBody: params.Error{
+		Code:    params.ErrBadRequest,
+		Message: `unrecognized channel "bad"`,
+	},
+}, {
+	about:        "unpublished channel",
+	method:       "POST",
+	url:          "~bob/wordpress/rollback",
+	channel:      params.UnpublishedChannel,
+	asUser:       "bob",
+	expectStatus: http.StatusBadRequest,
+	expectBody: params.Error{
+		Code:    params.ErrBadRequest,
+		Message: "cannot roll back the unpublished channel",
+	},
+}, {
+	about:        "no previous publication",
+	method:       "POST",
+	url:          "~bob/wordpress/rollback",
+	channel:      params.StableChannel,
+	asUser:       "bob",
+	expectStatus: http.StatusNotFound,
+	expectBody: params.Error{
+		Code:    params.ErrNotFound,
+		Message: "cannot roll back stable channel: no previous publication to stable channel",
+	},
+}, {
+	about:        "no write access",
+	method:       "POST",
+	url:          "~bob/wordpress/rollback",
+	channel:      params.StableChannel,
+	asUser:       "alice",
+	expectStatus: http.StatusUnauthorized,
+	expectBody: params.Error{
+		Code:    params.ErrUnauthorized,
+		Message: `access denied for user "alice"`,
+	},
+}}
+
+func (s *APISuite) TestRollbackErrors(c *gc.C) {
+	s.addPublicCharm(c, storetesting.NewCharm(nil), newResolvedURL("~bob/precise/wordpress-0", -1))
+	for i, test := range rollbackErrorTests {
+		c.Logf("test %d: %s", i, test.about)
+		httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+			Handler: s.srv,
+			Method:  test.method,
+			URL:     storeURL(test.url),
+			Do:      bakeryDo(s.idmServer.Client(test.asUser)),
+			JSONBody: v5.RollbackRequest{
+				Channel: test.channel,
+			},
+			ExpectStatus: test.expectStatus,
+			ExpectBody:   test.expectBody,
+		})
+	}
+}
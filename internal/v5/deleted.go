@@ -0,0 +1,139 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package v5 // import "gopkg.in/juju/charmstore.v5/internal/v5"
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/juju/charmrepo/v6/csclient/params"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/httprequest.v1"
+
+	"gopkg.in/juju/charmstore.v5/audit"
+	"gopkg.in/juju/charmstore.v5/internal/charm"
+	"gopkg.in/juju/charmstore.v5/internal/charmstore"
+	"gopkg.in/juju/charmstore.v5/internal/mongodoc"
+	"gopkg.in/juju/charmstore.v5/internal/router"
+)
+
+// DeletedEntity holds information about a deleted charm or
+// bundle revision as returned by the deleted endpoint.
+type DeletedEntity struct {
+	// Id holds the id of the deleted entity.
+	Id *charm.URL
+
+	// Deleted holds the time that the entity was deleted.
+	Deleted time.Time
+
+	// Expires holds the time after which the entity
+	// will be purged and can no longer be restored.
+	Expires time.Time
+}
+
+// GET id/deleted
+// https://github.com/juju/charmstore/blob/v5/docs/API.md#get-iddeleted
+func (h *ReqHandler) serveDeleted(id *charm.URL, w http.ResponseWriter, req *http.Request) error {
+	if req.Method != "GET" {
+		return errgo.WithCausef(nil, params.ErrMethodNotAllowed, "%s not allowed", req.Method)
+	}
+	if id.Revision != -1 {
+		return badRequestf(nil, "cannot specify revision in charm id for deleted request")
+	}
+	if err := h.authorizeUpload(id, req); err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	docs, err := h.Store.DeletedEntities(mongodoc.BaseURL(id))
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	retention := h.Store.DeletedEntityRetention()
+	resp := make([]DeletedEntity, 0, len(docs))
+	for _, doc := range docs {
+		if id.Series != "" && doc.URL.Series != id.Series {
+			continue
+		}
+		resp = append(resp, DeletedEntity{
+			Id:      doc.URL,
+			Deleted: doc.Deleted,
+			Expires: doc.Deleted.Add(retention),
+		})
+	}
+	return httprequest.WriteJSON(w, http.StatusOK, resp)
+}
+
+// POST id/restore
+// https://github.com/juju/charmstore/blob/v5/docs/API.md#post-idrestore
+func (h *ReqHandler) serveRestore(id *charm.URL, w http.ResponseWriter, req *http.Request) error {
+	if req.Method != "POST" {
+		return errgo.WithCausef(nil, params.ErrMethodNotAllowed, "%s not allowed", req.Method)
+	}
+	if id.Revision == -1 {
+		return badRequestf(nil, "revision not specified")
+	}
+	if err := h.authorizeUpload(id, req); err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	rid, err := h.Store.RestoreEntity(id)
+	if err != nil {
+		return errgo.NoteMask(err, "cannot restore "+id.String(),
+			errgo.Is(params.ErrNotFound),
+			errgo.Is(params.ErrDuplicateUpload),
+			errgo.Is(router.ErrQuotaExceeded),
+		)
+	}
+	h.addAudit(audit.Entry{
+		Op:     audit.OpRestore,
+		Entity: &rid.URL,
+	})
+	return httprequest.WriteJSON(w, http.StatusOK, &params.ArchiveUploadResponse{
+		Id:            &rid.URL,
+		PromulgatedId: rid.PromulgatedURL(),
+	})
+}
+
+// DELETE id/all
+// https://github.com/juju/charmstore/blob/v5/docs/API.md#delete-idall
+func (h *ReqHandler) serveAll(id *charm.URL, w http.ResponseWriter, req *http.Request) error {
+	if req.Method != "DELETE" {
+		return errgo.WithCausef(nil, params.ErrMethodNotAllowed, "%s not allowed", req.Method)
+	}
+	if id.User == "" {
+		return badRequestf(nil, "user not specified")
+	}
+	if id.Series != "" {
+		return badRequestf(nil, "series specified, but should not be specified")
+	}
+	if id.Revision != -1 {
+		return badRequestf(nil, "revision specified, but should not be specified")
+	}
+	baseEntity, err := h.Cache.BaseEntity(id, charmstore.FieldSelector("channelacls"))
+	if errgo.Cause(err) == params.ErrNotFound {
+		return errgo.WithCausef(nil, params.ErrNotFound, "no matching charm or bundle for %s", id)
+	}
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	// Deleting the charm or bundle affects all its channels,
+	// so the user must be able to write to all of them.
+	acls := make([]mongodoc.ACL, 0, len(baseEntity.ChannelACLs))
+	for _, acl := range baseEntity.ChannelACLs {
+		acls = append(acls, acl)
+	}
+	if _, err := h.authorize(authorizeParams{
+		req:  req,
+		acls: acls,
+		ops:  []string{OpWrite},
+	}); err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	if err := h.Store.DeleteBaseEntity(id); err != nil {
+		return errgo.NoteMask(err, "cannot delete "+id.String(), errgo.Is(params.ErrNotFound))
+	}
+	h.addAudit(audit.Entry{
+		Op:     audit.OpDeleteAll,
+		Entity: baseEntity.URL,
+	})
+	return nil
+}
@@ -0,0 +1,359 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package v5_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/juju/charmrepo/v6/csclient/params"
+	jc "github.com/juju/testing/checkers"
+	"github.com/juju/testing/httptesting"
+	gc "gopkg.in/check.v1"
+
+	"gopkg.in/juju/charmstore.v5/audit"
+	"gopkg.in/juju/charmstore.v5/internal/charm"
+	"gopkg.in/juju/charmstore.v5/internal/storetesting"
+	"gopkg.in/juju/charmstore.v5/internal/v5"
+)
+
+func (s *APISuite) TestDeleteAndRestore(c *gc.C) {
+	id, _ := s.addPublicCharm(c, storetesting.NewCharm(nil), newResolvedURL("~charmers/utopic/mysql-42", -1))
+	s.addPublicCharm(c, storetesting.NewCharm(nil), newResolvedURL("~charmers/utopic/mysql-43", -1))
+
+	var auditEntries []audit.Entry
+	s.PatchValue(v5.TestAddAuditCallback, func(e audit.Entry) {
+		auditEntries = append(auditEntries, e)
+	})
+
+	s.doAsUser("charmers", func() {
+		httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+			Handler: s.srv,
+			Do:      bakeryDo(nil),
+			URL:     storeURL("~charmers/utopic/mysql-42/archive"),
+			Method:  "DELETE",
+		})
+	})
+	c.Assert(auditEntries, jc.DeepEquals, []audit.Entry{{
+		User:   "charmers",
+		Op:     audit.OpDelete,
+		Entity: &id.URL,
+	}})
+	auditEntries = nil
+
+	// The deleted entity is no longer visible.
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:      s.srv,
+		URL:          storeURL("~charmers/utopic/mysql-42/meta/id"),
+		ExpectStatus: http.StatusNotFound,
+		ExpectBody: params.Error{
+			Code:    params.ErrNotFound,
+			Message: `no matching charm or bundle for cs:~charmers/utopic/mysql-42`,
+		},
+	})
+
+	// It is listed as deleted.
+	var deleted []v5.DeletedEntity
+	s.doAsUser("charmers", func() {
+		httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+			Handler: s.srv,
+			Do:      bakeryDo(nil),
+			URL:     storeURL("~charmers/mysql/deleted"),
+			ExpectBody: httptesting.BodyAsserter(func(c *gc.C, m json.RawMessage) {
+				err := json.Unmarshal(m, &deleted)
+				c.Assert(err, gc.Equals, nil)
+			}),
+		})
+	})
+	c.Assert(deleted, gc.HasLen, 1)
+	c.Assert(deleted[0].Id, jc.DeepEquals, &id.URL)
+	c.Assert(deleted[0].Deleted, jc.TimeBetween(time.Now().Add(-time.Minute), time.Now()))
+	c.Assert(deleted[0].Expires.Sub(deleted[0].Deleted), gc.Equals, s.store.DeletedEntityRetention())
+
+	// Restore it.
+	s.doAsUser("charmers", func() {
+		httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+			Handler: s.srv,
+			Do:      bakeryDo(nil),
+			URL:     storeURL("~charmers/utopic/mysql-42/restore"),
+			Method:  "POST",
+			ExpectBody: params.ArchiveUploadResponse{
+				Id: &id.URL,
+			},
+		})
+	})
+	c.Assert(auditEntries, jc.DeepEquals, []audit.Entry{{
+		User:   "charmers",
+		Op:     audit.OpRestore,
+		Entity: &id.URL,
+	}})
+
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler: s.srv,
+		URL:     storeURL("~charmers/utopic/mysql-42/meta/id-revision"),
+		ExpectBody: params.IdRevisionResponse{
+			Revision: 42,
+		},
+	})
+	s.doAsUser("charmers", func() {
+		httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+			Handler:    s.srv,
+			Do:         bakeryDo(nil),
+			URL:        storeURL("~charmers/mysql/deleted"),
+			ExpectBody: []v5.DeletedEntity{},
+		})
+	})
+}
+
+func (s *APISuite) TestDeletedWithSeries(c *gc.C) {
+	for _, id := range []string{"~charmers/trusty/mysql-0", "~charmers/trusty/mysql-1", "~charmers/utopic/mysql-2", "~charmers/utopic/mysql-3"} {
+		err := s.store.AddCharmWithArchive(newResolvedURL(id, -1), storetesting.NewCharm(nil))
+		c.Assert(err, gc.Equals, nil)
+	}
+	for _, id := range []string{"~charmers/trusty/mysql-0", "~charmers/utopic/mysql-2"} {
+		err := s.store.DeleteEntity(newResolvedURL(id, -1))
+		c.Assert(err, gc.Equals, nil)
+	}
+	var deleted []v5.DeletedEntity
+	s.doAsUser("charmers", func() {
+		httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+			Handler: s.srv,
+			Do:      bakeryDo(nil),
+			URL:     storeURL("~charmers/utopic/mysql/deleted"),
+			ExpectBody: httptesting.BodyAsserter(func(c *gc.C, m json.RawMessage) {
+				err := json.Unmarshal(m, &deleted)
+				c.Assert(err, gc.Equals, nil)
+			}),
+		})
+	})
+	c.Assert(deleted, gc.HasLen, 1)
+	c.Assert(deleted[0].Id, jc.DeepEquals, charm.MustParseURL("~charmers/utopic/mysql-2"))
+}
+
+var deletedErrorTests = []struct {
+	about        string
+	method       string
+	url          string
+	asUser       string
+	expectStatus int
+	expectBody   params.Error
+}{{
+	about:        "deleted with revision",
+	method:       "GET",
+	url:          "~charmers/utopic/mysql-42/deleted",
+	asUser:       "charmers",
+	expectStatus: http.StatusBadRequest,
+	expectBody: params.Error{
+		Code:    params.ErrBadRequest,
+		Message: "cannot specify revision in charm id for deleted request",
+	},
+}, {
+	about:        "deleted with wrong method",
+	method:       "POST",
+	url:          "~charmers/mysql/deleted",
+	asUser:       "charmers",
+	expectStatus: http.StatusMethodNotAllowed,
+	expectBody: params.Error{
+		Code:    params.ErrMethodNotAllowed,
+		Message: "POST not allowed",
+	},
+}, {
+	about:        "deleted by unauthorized user",
+	method:       "GET",
+	url:          "~charmers/mysql/deleted",
+	asUser:       "bob",
+	expectStatus: http.StatusUnauthorized,
+	expectBody: params.Error{
+		Code:    params.ErrUnauthorized,
+		Message: `access denied for user "bob"`,
+	},
+}, {
+	about:        "restore without revision",
+	method:       "POST",
+	url:          "~charmers/utopic/mysql/restore",
+	asUser:       "charmers",
+	expectStatus: http.StatusBadRequest,
+	expectBody: params.Error{
+		Code:    params.ErrBadRequest,
+		Message: "revision not specified",
+	},
+}, {
+	about:        "restore with wrong method",
+	method:       "GET",
+	url:          "~charmers/utopic/mysql-42/restore",
+	asUser:       "charmers",
+	expectStatus: http.StatusMethodNotAllowed,
+	expectBody: params.Error{
+		Code:    params.ErrMethodNotAllowed,
+		Message: "GET not allowed",
+	},
+}, {
+	about:        "restore by unauthorized user",
+	method:       "POST",
+	url:          "~charmers/utopic/mysql-42/restore",
+	asUser:       "bob",
+	expectStatus: http.StatusUnauthorized,
+	expectBody: params.Error{
+		Code:    params.ErrUnauthorized,
+		Message: `access denied for user "bob"`,
+	},
+}, {
+	about:        "restore entity that has not been deleted",
+	method:       "POST",
+	url:          "~charmers/utopic/mysql-43/restore",
+	asUser:       "charmers",
+	expectStatus: http.StatusNotFound,
+	expectBody: params.Error{
+		Code:    params.ErrNotFound,
+		Message: `cannot restore cs:~charmers/utopic/mysql-43: deleted entity "cs:~charmers/utopic/mysql-43" not found`,
+	},
+}}
+
+func (s *APISuite) TestDeletedErrors(c *gc.C) {
+	s.addPublicCharm(c, storetesting.NewCharm(nil), newResolvedURL("~charmers/utopic/mysql-42", -1))
+	s.addPublicCharm(c, storetesting.NewCharm(nil), newResolvedURL("~charmers/utopic/mysql-43", -1))
+	err := s.store.DeleteEntity(newResolvedURL("~charmers/utopic/mysql-42", -1))
+	c.Assert(err, gc.Equals, nil)
+	for i, test := range deletedErrorTests {
+		c.Logf("test %d: %s", i, test.about)
+		httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+			Handler:      s.srv,
+			Do:           bakeryDo(s.idmServer.Client(test.asUser)),
+			Method:       test.method,
+			URL:          storeURL(test.url),
+			ExpectStatus: test.expectStatus,
+			ExpectBody:   test.expectBody,
+		})
+	}
+}
+
+func (s *APISuite) TestDeleteAll(c *gc.C) {
+	s.addPublicCharm(c, storetesting.NewCharm(nil), newResolvedURL("~charmers/utopic/mysql-42", -1))
+	s.addPublicCharm(c, storetesting.NewCharm(nil), newResolvedURL("~charmers/trusty/mysql-43", -1))
+
+	var auditEntries []audit.Entry
+	s.PatchValue(v5.TestAddAuditCallback, func(e audit.Entry) {
+		auditEntries = append(auditEntries, e)
+	})
+	s.doAsUser("charmers", func() {
+		httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+			Handler: s.srv,
+			Do:      bakeryDo(nil),
+			URL:     storeURL("~charmers/mysql/all"),
+			Method:  "DELETE",
+		})
+	})
+	c.Assert(auditEntries, jc.DeepEquals, []audit.Entry{{
+		User:   "charmers",
+		Op:     audit.OpDeleteAll,
+		Entity: charm.MustParseURL("~charmers/mysql"),
+	}})
+
+	for _, id := range []string{"~charmers/utopic/mysql-42", "~charmers/trusty/mysql-43", "~charmers/mysql"} {
+		httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+			Handler:      s.srv,
+			URL:          storeURL(id + "/meta/id"),
+			ExpectStatus: http.StatusNotFound,
+			ExpectBody: params.Error{
+				Code:    params.ErrNotFound,
+				Message: `no matching charm or bundle for cs:` + id,
+			},
+		})
+	}
+	n, err := s.store.DB.BaseEntities().FindId(charm.MustParseURL("~charmers/mysql")).Count()
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(n, gc.Equals, 0)
+}
+
+var deleteAllErrorTests = []struct {
+	about        string
+	method       string
+	url          string
+	asUser       string
+	expectStatus int
+	expectBody   params.Error
+}{{
+	about:        "wrong method",
+	method:       "GET",
+	url:          "~charmers/mysql/all",
+	asUser:       "charmers",
+	expectStatus: http.StatusMethodNotAllowed,
+	expectBody: params.Error{
+		Code:    params.ErrMethodNotAllowed,
+		Message: "GET not allowed",
+	},
+}, {
+	about:        "no user",
+	method:       "DELETE",
+	url:          "mysql/all",
+	asUser:       "charmers",
+	expectStatus: http.StatusBadRequest,
+	expectBody: params.Error{
+		Code:    params.ErrBadRequest,
+		Message: "user not specified",
+	},
+}, {
+	about:        "series specified",
+	method:       "DELETE",
+	url:          "~charmers/utopic/mysql/all",
+	asUser:       "charmers",
+	expectStatus: http.StatusBadRequest,
+	expectBody: params.Error{
+		Code:    params.ErrBadRequest,
+		Message: "series specified, but should not be specified",
+	},
+}, {
+	about:        "revision specified",
+	method:       "DELETE",
+	url:          "~charmers/mysql-42/all",
+	asUser:       "charmers",
+	expectStatus: http.StatusBadRequest,
+	expectBody: params.Error{
+		Code:    params.ErrBadRequest,
+		Message: "revision specified, but should not be specified",
+	},
+}, {
+	about:        "not found",
+	method:       "DELETE",
+	url:          "~charmers/nothing/all",
+	asUser:       "charmers",
+	expectStatus: http.StatusNotFound,
+	expectBody: params.Error{
+		Code:    params.ErrNotFound,
+		Message: `no matching charm or bundle for cs:~charmers/nothing`,
+	},
+}, {
+	about:        "no write access to all channels",
+	method:       "DELETE",
+	url:          "~charmers/mysql/all",
+	asUser:       "bob",
+	expectStatus: http.StatusUnauthorized,
+	expectBody: params.Error{
+		Code:    params.ErrUnauthorized,
+		Message: `access denied for user "bob"`,
+	},
+}}
+
+func (s *APISuite) TestDeleteAllErrors(c *gc.C) {
+	id, _ := s.addPublicCharm(c, storetesting.NewCharm(nil), newResolvedURL("~charmers/utopic/mysql-42", -1))
+	// Bob can write to the unpublished channel but not
+	// to the stable channel.
+	err := s.store.SetPerms(&id.URL, "unpublished.write", "charmers", "bob")
+	c.Assert(err, gc.Equals, nil)
+	for i, test := range deleteAllErrorTests {
+		c.Logf("test %d: %s", i, test.about)
+		httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+			Handler:      s.srv,
+			Do:           bakeryDo(s.idmServer.Client(test.asUser)),
+			Method:       test.method,
+			URL:          storeURL(test.url),
+			ExpectStatus: test.expectStatus,
+			ExpectBody:   test.expectBody,
+		})
+	}
+	// Nothing has been deleted.
+	_, err = s.store.FindEntity(id, nil)
+	c.Assert(err, gc.Equals, nil)
+}
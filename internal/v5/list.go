@@ -17,7 +17,18 @@ import (
 	"gopkg.in/juju/charmstore.v5/internal/mongodoc"
 )
 
-// GET list[?filter=value…][&include=meta][&sort=field[+dir]]
+// ListResponse holds the response from a list request. It extends
+// params.ListResponse with the cursor for the next page of results.
+type ListResponse struct {
+	params.ListResponse
+
+	// NextCursor holds a cursor that can be passed as the cursor
+	// parameter of the same list request to retrieve the next page
+	// of results. It is omitted when there are no more results.
+	NextCursor string `json:",omitempty"`
+}
+
+// GET list[?filter=value…][&include=meta][&sort=field[+dir]|&limit=limit[&cursor=cursor]]
 // https://github.com/juju/charmstore/blob/v4/docs/API.md#get-list
 func (h *ReqHandler) serveList(_ http.Header, req *http.Request) (interface{}, error) {
 	sp, err := ParseSearchParams(req)
@@ -25,6 +36,11 @@ func (h *ReqHandler) serveList(_ http.Header, req *http.Request) (interface{}, e
 	if err != nil {
 		return nil, err
 	}
+	if len(sp.Sort) > 0 && (sp.Limit > 0 || len(sp.After) > 0) {
+		// Pages are returned in a fixed order, so
+		// they cannot be sorted.
+		return nil, badRequestf(nil, "cannot sort a paginated list")
+	}
 	h.WillIncludeMetadata(sp.Include)
 	less, err := entityResultLess(sp.Sort)
 	if err != nil {
@@ -50,8 +66,11 @@ func (h *ReqHandler) serveList(_ http.Header, req *http.Request) (interface{}, e
 		less:    less,
 		results: r,
 	})
-	return params.ListResponse{
-		Results: uniqueEntityResults(r),
+	return ListResponse{
+		ListResponse: params.ListResponse{
+			Results: uniqueEntityResults(r),
+		},
+		NextCursor: lq.NextCursor(),
 	}, nil
 }
 
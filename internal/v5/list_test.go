@@ -6,7 +6,9 @@ package v5_test
 import (
 	"bytes"
 	"encoding/json"
+	"fmt"
 	"net/http"
+	"sort"
 	"strings"
 
 	"github.com/juju/charmrepo/v6/csclient/params"
@@ -24,6 +26,7 @@ import (
 	"gopkg.in/juju/charmstore.v5/internal/charmstore"
 	"gopkg.in/juju/charmstore.v5/internal/router"
 	"gopkg.in/juju/charmstore.v5/internal/storetesting"
+	"gopkg.in/juju/charmstore.v5/internal/v5"
 )
 
 type ListSuite struct {
@@ -411,6 +414,80 @@ func (s *ListSuite) TestSortUnsupportedListField(c *gc.C) {
 	c.Assert(e.Message, gc.Equals, "invalid sort field: unrecognized sort parameter \"text\"")
 }
 
+func (s *ListSuite) TestPaginatedList(c *gc.C) {
+	s.addCharmsToStore(c)
+	want := []string{
+		"cs:bundle/wordpress-simple-4",
+		"cs:precise/wordpress-23",
+		"cs:trusty/mysql-7",
+		"cs:~foo/trusty/varnish-1",
+	}
+	sort.Strings(want)
+	for _, limit := range []int{1, 3, 10} {
+		c.Logf("limit %d", limit)
+		var got []string
+		cursor := ""
+		for pages := 0; ; pages++ {
+			c.Assert(pages < 10, gc.Equals, true, gc.Commentf("too many pages"))
+			query := fmt.Sprintf("list?limit=%d", limit)
+			if cursor != "" {
+				query += "&cursor=" + cursor
+			}
+			rec := httptesting.DoRequest(c, httptesting.DoRequestParams{
+				Handler: s.srv,
+				URL:     storeURL(query),
+			})
+			c.Assert(rec.Code, gc.Equals, http.StatusOK, gc.Commentf("body: %s", rec.Body.Bytes()))
+			var lr v5.ListResponse
+			err := json.Unmarshal(rec.Body.Bytes(), &lr)
+			c.Assert(err, gc.Equals, nil)
+			c.Assert(len(lr.Results) <= limit, gc.Equals, true)
+			for _, r := range lr.Results {
+				got = append(got, r.Id.String())
+			}
+			if lr.NextCursor == "" {
+				break
+			}
+			cursor = lr.NextCursor
+		}
+		sort.Strings(got)
+		c.Assert(got, jc.DeepEquals, want)
+	}
+}
+
+var listPaginationErrorTests = []struct {
+	about       string
+	query       string
+	expectError string
+}{{
+	about:       "sort with limit",
+	query:       "limit=2&sort=name",
+	expectError: "cannot sort a paginated list",
+}, {
+	about:       "invalid cursor",
+	query:       "cursor=bad",
+	expectError: `invalid cursor parameter: invalid cursor "bad"`,
+}, {
+	about:       "skip with cursor",
+	query:       "skip=1&cursor=WyJ4Il0",
+	expectError: "cannot specify both skip and cursor",
+}}
+
+func (s *ListSuite) TestPaginationErrors(c *gc.C) {
+	for i, test := range listPaginationErrorTests {
+		c.Logf("test %d: %s", i, test.about)
+		httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+			Handler:      s.srv,
+			URL:          storeURL("list?" + test.query),
+			ExpectStatus: http.StatusBadRequest,
+			ExpectBody: params.Error{
+				Code:    params.ErrBadRequest,
+				Message: test.expectError,
+			},
+		})
+	}
+}
+
 func (s *ListSuite) TestGetLatestRevisionOnly(c *gc.C) {
 	s.addCharmsToStore(c)
 	id := newResolvedURL("cs:~charmers/precise/wordpress-24", 24)
@@ -0,0 +1,69 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package v5 // import "gopkg.in/juju/charmstore.v5/internal/v5"
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/juju/charmrepo/v6/csclient/params"
+	"gopkg.in/errgo.v1"
+)
+
+// Quota holds the storage quota and current storage usage of a
+// namespace as used by the quota endpoint.
+type Quota struct {
+	// Namespace holds the name of the user or group.
+	Namespace string `json:"Namespace"`
+
+	// MaxBytes and MaxRevisions hold the limits on the total
+	// size and number of revisions of the archives and resources
+	// in the namespace. Limits with a zero value are not enforced.
+	MaxBytes     int64 `json:"MaxBytes"`
+	MaxRevisions int   `json:"MaxRevisions"`
+
+	// Bytes and Revisions hold the current usage.
+	Bytes     int64 `json:"Bytes"`
+	Revisions int   `json:"Revisions"`
+}
+
+// GET /quota/namespace or PUT /quota/namespace
+func (h *ReqHandler) serveQuota(_ http.Header, req *http.Request) (interface{}, error) {
+	if err := h.authenticateAdmin(req); err != nil {
+		return nil, errgo.Mask(err, errgo.Any)
+	}
+	namespace := strings.TrimPrefix(req.URL.Path, "/")
+	if namespace == "" || strings.Contains(namespace, "/") {
+		return nil, errgo.WithCausef(nil, params.ErrNotFound, "")
+	}
+	switch req.Method {
+	case "GET":
+		q, err := h.Store.Quota(namespace)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		return &Quota{
+			Namespace:    q.Namespace,
+			MaxBytes:     q.MaxBytes,
+			MaxRevisions: q.MaxRevisions,
+			Bytes:        q.Bytes,
+			Revisions:    q.Revisions,
+		}, nil
+	case "PUT":
+		var q Quota
+		if err := json.NewDecoder(req.Body).Decode(&q); err != nil {
+			return nil, badRequestf(err, "cannot unmarshal quota")
+		}
+		if q.MaxBytes < 0 || q.MaxRevisions < 0 {
+			return nil, badRequestf(nil, "negative quota limit")
+		}
+		if err := h.Store.SetQuota(namespace, q.MaxBytes, q.MaxRevisions); err != nil {
+			return nil, errgo.Mask(err)
+		}
+		return nil, nil
+	default:
+		return nil, errgo.WithCausef(nil, params.ErrMethodNotAllowed, "%s not allowed", req.Method)
+	}
+}
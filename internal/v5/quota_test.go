@@ -0,0 +1,97 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package v5_test
+
+import (
+	"net/http"
+
+	"github.com/juju/charmrepo/v6/csclient/params"
+	"github.com/juju/testing/httptesting"
+	gc "gopkg.in/check.v1"
+
+	"gopkg.in/juju/charmstore.v5/internal/charm"
+	"gopkg.in/juju/charmstore.v5/internal/router"
+	v5 "gopkg.in/juju/charmstore.v5/internal/v5"
+)
+
+func (s *APISuite) TestGetQuotaNotSet(c *gc.C) {
+	s.assertGetAsAdmin(c, "quota/bob", v5.Quota{
+		Namespace: "bob",
+	})
+}
+
+func (s *APISuite) TestSetQuota(c *gc.C) {
+	s.assertPutAsAdmin(c, "quota/bob", v5.Quota{
+		MaxBytes:     5000,
+		MaxRevisions: 5,
+	})
+	s.assertGetAsAdmin(c, "quota/bob", v5.Quota{
+		Namespace:    "bob",
+		MaxBytes:     5000,
+		MaxRevisions: 5,
+	})
+}
+
+func (s *APISuite) TestSetQuotaNegative(c *gc.C) {
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:  s.srv,
+		Method:   "PUT",
+		URL:      storeURL("quota/bob"),
+		Username: testUsername,
+		Password: testPassword,
+		JSONBody: v5.Quota{
+			MaxBytes: -1,
+		},
+		ExpectStatus: http.StatusBadRequest,
+		ExpectBody: params.Error{
+			Code:    params.ErrBadRequest,
+			Message: "negative quota limit",
+		},
+	})
+}
+
+func (s *APISuite) TestQuotaNotAdmin(c *gc.C) {
+	for _, method := range []string{"GET", "PUT"} {
+		rec := httptesting.DoRequest(c, httptesting.DoRequestParams{
+			Handler: s.srv,
+			Method:  method,
+			Do:      bakeryDo(s.idmServer.Client("bob")),
+			URL:     storeURL("quota/bob"),
+		})
+		c.Assert(rec.Code, gc.Equals, http.StatusUnauthorized, gc.Commentf("body: %s", rec.Body))
+	}
+}
+
+func (s *APISuite) TestQuotaNotFound(c *gc.C) {
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:      s.srv,
+		URL:          storeURL("quota/bob/foo"),
+		Username:     testUsername,
+		Password:     testPassword,
+		ExpectStatus: http.StatusNotFound,
+		ExpectBody: params.Error{
+			Code:    params.ErrNotFound,
+			Message: "not found",
+		},
+	})
+}
+
+func (s *ArchiveSuite) TestPostCharmQuotaExceeded(c *gc.C) {
+	err := s.store.SetQuota("charmers", 0, 1)
+	c.Assert(err, gc.Equals, nil)
+	s.assertUploadCharm(c, "POST", newResolvedURL("~charmers/precise/wordpress-0", -1), "wordpress", nil)
+	s.assertUploadCharmError(
+		c,
+		"POST",
+		charm.MustParseURL("~charmers/precise/wordpress-1"),
+		nil,
+		"mysql",
+		nil,
+		http.StatusForbidden,
+		params.Error{
+			Code:    router.ErrQuotaExceeded,
+			Message: `revision quota for "charmers" exceeded (1 of 1 revisions used)`,
+		},
+	)
+}
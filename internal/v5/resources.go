@@ -113,10 +113,13 @@ func (h *ReqHandler) serveDownloadResourceFile(id *router.ResolvedURL, r *mongod
 	header := w.Header()
 	setArchiveCacheControl(w.Header(), h.isPublic(id))
 	header.Set(params.ContentHashHeader, blob.Hash)
+	// Resources are opaque blobs, so don't let serveContent
+	// try to guess their content type.
+	header.Set("Content-Type", "application/octet-stream")
 
 	// TODO(rog) should we set connection=close here?
 	// See https://codereview.appspot.com/5958045
-	serveContent(w, req, blob.Size, blob)
+	serveContent(w, req, r.Name, blob.ModTime, blob.Hash, blob)
 	return nil
 }
 
@@ -220,12 +223,15 @@ func (h *ReqHandler) serveUploadResource(id *router.ResolvedURL, w http.Response
 	}
 	var rdoc *mongodoc.Resource
 	if uploadId != "" {
+		if err := h.checkUploadCreator(h.auth, uploadId); err != nil {
+			return errgo.Mask(err, errgo.Is(params.ErrNotFound))
+		}
 		rdoc, err = h.Store.AddResourceWithUploadId(id, rid.Name, rid.Revision, uploadId)
 	} else {
 		rdoc, err = h.Store.UploadResource(id, rid.Name, rid.Revision, req.Body, hash, req.ContentLength)
 	}
 	if err != nil {
-		return errgo.Mask(err)
+		return errgo.Mask(err, errgo.Is(router.ErrQuotaExceeded))
 	}
 	return httprequest.WriteJSON(w, http.StatusOK, &params.ResourceUploadResponse{
 		Revision: rdoc.Revision,
@@ -254,7 +260,7 @@ func (h *ReqHandler) serveUploadDockerResource(id *router.ResolvedURL, rid mongo
 	// TODO check that ImageName parses as a valid docker resource
 	rdoc, err := h.Store.AddDockerResource(id, rid.Name, rid.Revision, p.ImageName, p.Digest)
 	if err != nil {
-		return errgo.Mask(err)
+		return errgo.Mask(err, errgo.Is(router.ErrQuotaExceeded))
 	}
 	return httprequest.WriteJSON(w, http.StatusOK, &params.ResourceUploadResponse{
 		Revision: rdoc.Revision,
@@ -824,6 +824,33 @@ func (s *ResourceSuite) TestDownloadPrivateCharmResource(c *gc.C) {
 	assertCacheControl(c, resp.Header(), false)
 }
 
+func (s *ResourceSuite) TestDownloadResourceRangeAndConditional(c *gc.C) {
+	id := newResolvedURL("~charmers/precise/wordpress-0", -1)
+	s.addPublicCharm(c, storetesting.NewCharm(storetesting.MetaWithResources(nil, "someResource")), id)
+	content := "0123456789abcdefghij"
+	s.uploadResource(c, id, "someResource", content)
+	resourceURL := storeURL(id.URL.Path() + "/resource/someResource/0")
+
+	rec := httptesting.DoRequest(c, httptesting.DoRequestParams{
+		Handler: s.srv,
+		URL:     resourceURL,
+		Header:  http.Header{"Range": {"bytes=10-"}},
+	})
+	c.Assert(rec.Code, gc.Equals, http.StatusPartialContent)
+	c.Assert(rec.Body.String(), gc.Equals, content[10:])
+	c.Assert(rec.Header().Get("Content-Range"), gc.Equals, "bytes 10-19/20")
+	c.Assert(rec.Header().Get("Content-Type"), gc.Equals, "application/octet-stream")
+	c.Assert(rec.Header().Get("Etag"), gc.Equals, `"`+hashOfString(content)+`"`)
+
+	rec = httptesting.DoRequest(c, httptesting.DoRequestParams{
+		Handler: s.srv,
+		URL:     resourceURL,
+		Header:  http.Header{"If-None-Match": {`"` + hashOfString(content) + `"`}},
+	})
+	c.Assert(rec.Code, gc.Equals, http.StatusNotModified)
+	c.Assert(rec.Body.Len(), gc.Equals, 0)
+}
+
 func (s *ResourceSuite) TestMetaResourcesWithNoResources(c *gc.C) {
 	id := newResolvedURL("~charmers/precise/wordpress-0", 0)
 	s.addPublicCharmFromRepo(c, "wordpress", id)
@@ -0,0 +1,115 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package v5 // import "gopkg.in/juju/charmstore.v5/internal/v5"
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/juju/charmrepo/v6/csclient/params"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/httprequest.v1"
+
+	"gopkg.in/juju/charmstore.v5/internal/charm"
+	"gopkg.in/juju/charmstore.v5/internal/mongodoc"
+	"gopkg.in/juju/charmstore.v5/internal/router"
+)
+
+// RetentionPolicy holds the retention policy of a charm or bundle as
+// used by the meta/retention-policy endpoint.
+type RetentionPolicy struct {
+	// KeepUnpublished holds the number of most recently uploaded
+	// revisions that have never been published to the stable
+	// channel that are kept.
+	KeepUnpublished int `json:",omitempty"`
+
+	// KeepFor holds how long revisions are kept after they have
+	// been uploaded, in the format accepted by time.ParseDuration
+	// (for example "720h").
+	KeepFor string `json:",omitempty"`
+}
+
+// GET id/meta/retention-policy
+// https://github.com/juju/charmstore/blob/v5/docs/API.md#get-idmetaretention-policy
+func (h *ReqHandler) metaRetentionPolicy(entity *mongodoc.BaseEntity, id *router.ResolvedURL, path string, flags url.Values, req *http.Request) (interface{}, error) {
+	p := entity.RetentionPolicy
+	if p == nil {
+		return nil, nil
+	}
+	resp := &RetentionPolicy{
+		KeepUnpublished: p.KeepUnpublished,
+	}
+	if p.KeepFor > 0 {
+		resp.KeepFor = p.KeepFor.String()
+	}
+	return resp, nil
+}
+
+// PUT id/meta/retention-policy
+// https://github.com/juju/charmstore/blob/v5/docs/API.md#put-idmetaretention-policy
+func (h *ReqHandler) putMetaRetentionPolicy(id *router.ResolvedURL, path string, val *json.RawMessage, updater *router.FieldUpdater, req *http.Request) error {
+	// If the user puts null, we treat that as if they want to
+	// remove the retention policy.
+	if val == nil || bytes.Equal(*val, nullBytes) {
+		updater.UpdateField("retentionpolicy", nil, nil)
+		return nil
+	}
+	var p RetentionPolicy
+	if err := json.Unmarshal(*val, &p); err != nil {
+		return badRequestf(err, "cannot unmarshal retention policy")
+	}
+	policy := mongodoc.RetentionPolicy{
+		KeepUnpublished: p.KeepUnpublished,
+	}
+	if p.KeepFor != "" {
+		d, err := time.ParseDuration(p.KeepFor)
+		if err != nil {
+			return badRequestf(err, "invalid KeepFor duration")
+		}
+		policy.KeepFor = d
+	}
+	if policy.KeepUnpublished < 0 || policy.KeepFor < 0 {
+		return badRequestf(nil, "negative retention policy value")
+	}
+	if policy.KeepUnpublished == 0 && policy.KeepFor == 0 {
+		return badRequestf(nil, "retention policy must specify KeepUnpublished or KeepFor")
+	}
+	updater.UpdateField("retentionpolicy", &policy, nil)
+	return nil
+}
+
+// GET id/retention-preview
+// https://github.com/juju/charmstore/blob/v5/docs/API.md#get-idretention-preview
+func (h *ReqHandler) serveRetentionPreview(id *charm.URL, w http.ResponseWriter, req *http.Request) error {
+	if req.Method != "GET" {
+		return errgo.WithCausef(nil, params.ErrMethodNotAllowed, "%s not allowed", req.Method)
+	}
+	if id.User == "" {
+		return badRequestf(nil, "user not specified")
+	}
+	if id.Revision != -1 {
+		return badRequestf(nil, "revision specified, but should not be specified")
+	}
+	if err := h.authorizeUpload(id, req); err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	expired, err := h.Store.ExpiredRevisions(id, time.Now())
+	if errgo.Cause(err) == params.ErrNotFound {
+		return errgo.WithCausef(nil, params.ErrNotFound, "no matching charm or bundle for %s", id)
+	}
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	resp := make([]*charm.URL, 0, len(expired))
+	for _, rid := range expired {
+		if id.Series != "" && rid.URL.Series != id.Series {
+			continue
+		}
+		resp = append(resp, &rid.URL)
+	}
+	return httprequest.WriteJSON(w, http.StatusOK, resp)
+}
@@ -0,0 +1,190 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package v5_test
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/juju/charmrepo/v6/csclient/params"
+	jc "github.com/juju/testing/checkers"
+	"github.com/juju/testing/httptesting"
+	gc "gopkg.in/check.v1"
+
+	"gopkg.in/juju/charmstore.v5/internal/charm"
+	"gopkg.in/juju/charmstore.v5/internal/mongodoc"
+	"gopkg.in/juju/charmstore.v5/internal/storetesting"
+	"gopkg.in/juju/charmstore.v5/internal/v5"
+)
+
+func (s *APISuite) TestRetentionPolicy(c *gc.C) {
+	id, _ := s.addPublicCharm(c, storetesting.NewCharm(nil), newResolvedURL("~charmers/utopic/mysql-42", -1))
+	s.assertNoRetentionPolicy(c, "~charmers/mysql")
+
+	s.assertPutAsAdmin(c, "~charmers/mysql/meta/retention-policy", v5.RetentionPolicy{
+		KeepUnpublished: 3,
+		KeepFor:         "72h",
+	})
+	s.assertGet(c, "~charmers/mysql/meta/retention-policy", v5.RetentionPolicy{
+		KeepUnpublished: 3,
+		KeepFor:         "72h0m0s",
+	})
+	e, err := s.store.FindBaseEntity(&id.URL, nil)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(e.RetentionPolicy, jc.DeepEquals, &mongodoc.RetentionPolicy{
+		KeepUnpublished: 3,
+		KeepFor:         72 * time.Hour,
+	})
+
+	// Putting null removes the policy.
+	s.assertPutAsAdmin(c, "~charmers/mysql/meta/retention-policy", nil)
+	s.assertNoRetentionPolicy(c, "~charmers/mysql")
+	e, err = s.store.FindBaseEntity(&id.URL, nil)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(e.RetentionPolicy, gc.IsNil)
+}
+
+func (s *APISuite) assertNoRetentionPolicy(c *gc.C, id string) {
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:      s.srv,
+		URL:          storeURL(id + "/meta/retention-policy"),
+		ExpectStatus: http.StatusNotFound,
+		ExpectBody: params.Error{
+			Code:    params.ErrMetadataNotFound,
+			Message: params.ErrMetadataNotFound.Error(),
+		},
+	})
+}
+
+var putRetentionPolicyErrorTests = []struct {
+	about         string
+	policy        v5.RetentionPolicy
+	expectMessage string
+}{{
+	about:         "empty policy",
+	expectMessage: "retention policy must specify KeepUnpublished or KeepFor",
+}, {
+	about: "negative count",
+	policy: v5.RetentionPolicy{
+		KeepUnpublished: -1,
+	},
+	expectMessage: "negative retention policy value",
+}, {
+	about: "negative duration",
+	policy: v5.RetentionPolicy{
+		KeepFor: "-1h",
+	},
+	expectMessage: "negative retention policy value",
+}}
+
+func (s *APISuite) TestPutRetentionPolicyErrors(c *gc.C) {
+	s.addPublicCharm(c, storetesting.NewCharm(nil), newResolvedURL("~charmers/utopic/mysql-42", -1))
+	for i, test := range putRetentionPolicyErrorTests {
+		c.Logf("test %d: %s", i, test.about)
+		httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+			Handler:      s.srv,
+			Method:       "PUT",
+			URL:          storeURL("~charmers/mysql/meta/retention-policy"),
+			Username:     testUsername,
+			Password:     testPassword,
+			JSONBody:     test.policy,
+			ExpectStatus: http.StatusBadRequest,
+			ExpectBody: params.Error{
+				Code:    params.ErrBadRequest,
+				Message: test.expectMessage,
+			},
+		})
+	}
+}
+
+func (s *APISuite) TestRetentionPreview(c *gc.C) {
+	s.addPublicCharm(c, storetesting.NewCharm(nil), newResolvedURL("~charmers/utopic/mysql-40", -1))
+	for _, id := range []string{"~charmers/utopic/mysql-41", "~charmers/utopic/mysql-42", "~charmers/utopic/mysql-43"} {
+		err := s.store.AddCharmWithArchive(newResolvedURL(id, -1), storetesting.NewCharm(nil))
+		c.Assert(err, gc.Equals, nil)
+	}
+	// With no policy, nothing would be deleted.
+	s.assertRetentionPreview(c, "~charmers/mysql", []*charm.URL{})
+
+	err := s.store.SetRetentionPolicy(charm.MustParseURL("~charmers/mysql"), &mongodoc.RetentionPolicy{
+		KeepUnpublished: 1,
+	})
+	c.Assert(err, gc.Equals, nil)
+	expect := []*charm.URL{
+		charm.MustParseURL("cs:~charmers/utopic/mysql-42"),
+		charm.MustParseURL("cs:~charmers/utopic/mysql-41"),
+	}
+	s.assertRetentionPreview(c, "~charmers/mysql", expect)
+	s.assertRetentionPreview(c, "~charmers/utopic/mysql", expect)
+	s.assertRetentionPreview(c, "~charmers/trusty/mysql", []*charm.URL{})
+
+	// The preview does not delete anything.
+	for _, url := range expect {
+		_, err := s.store.FindEntity(newResolvedURL(url.String(), -1), nil)
+		c.Assert(err, gc.Equals, nil)
+	}
+}
+
+func (s *APISuite) assertRetentionPreview(c *gc.C, id string, expect []*charm.URL) {
+	s.doAsUser("charmers", func() {
+		httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+			Handler:    s.srv,
+			Do:         bakeryDo(nil),
+			URL:        storeURL(id + "/retention-preview"),
+			ExpectBody: expect,
+		})
+	})
+}
+
+var retentionPreviewErrorTests = []struct {
+	about        string
+	method       string
+	url          string
+	expectStatus int
+	expectBody   params.Error
+}{{
+	about:        "wrong method",
+	method:       "POST",
+	url:          "~charmers/mysql/retention-preview",
+	expectStatus: http.StatusMethodNotAllowed,
+	expectBody: params.Error{
+		Code:    params.ErrMethodNotAllowed,
+		Message: "POST not allowed",
+	},
+}, {
+	about:        "no user",
+	method:       "GET",
+	url:          "mysql/retention-preview",
+	expectStatus: http.StatusBadRequest,
+	expectBody: params.Error{
+		Code:    params.ErrBadRequest,
+		Message: "user not specified",
+	},
+}, {
+	about:        "revision specified",
+	method:       "GET",
+	url:          "~charmers/mysql-42/retention-preview",
+	expectStatus: http.StatusBadRequest,
+	expectBody: params.Error{
+		Code:    params.ErrBadRequest,
+		Message: "revision specified, but should not be specified",
+	},
+}}
+
+func (s *APISuite) TestRetentionPreviewErrors(c *gc.C) {
+	s.addPublicCharm(c, storetesting.NewCharm(nil), newResolvedURL("~charmers/utopic/mysql-42", -1))
+	for i, test := range retentionPreviewErrorTests {
+		c.Logf("test %d: %s", i, test.about)
+		s.doAsUser("charmers", func() {
+			httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+				Handler:      s.srv,
+				Do:           bakeryDo(nil),
+				Method:       test.method,
+				URL:          storeURL(test.url),
+				ExpectStatus: test.expectStatus,
+				ExpectBody:   test.expectBody,
+			})
+		})
+	}
+}
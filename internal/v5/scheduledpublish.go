@@ -0,0 +1,227 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package v5 // import "gopkg.in/juju/charmstore.v5/internal/v5"
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/juju/charmrepo/v6/csclient/params"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/httprequest.v1"
+
+	"gopkg.in/juju/charmstore.v5/internal/charm"
+	"gopkg.in/juju/charmstore.v5/internal/charmstore"
+	"gopkg.in/juju/charmstore.v5/internal/mongodoc"
+	"gopkg.in/juju/charmstore.v5/internal/router"
+)
+
+// SchedulePublishRequest holds the body of a schedule-publish request.
+type SchedulePublishRequest struct {
+	// Resources holds the resource revisions to publish
+	// with the entity, as in a publish request.
+	Resources map[string]int `json:",omitempty"`
+
+	// Stages holds the publications to schedule. Each stage is
+	// scheduled separately, so that an entity can be published
+	// progressively, for instance to the candidate channel first
+	// and to the stable channel a week later.
+	Stages []PublishStage
+}
+
+// PublishStage holds one stage of a scheduled publication.
+type PublishStage struct {
+	// Channels holds the channels to publish to.
+	Channels []params.Channel
+
+	// Time holds the time at which to publish.
+	Time time.Time
+}
+
+// ScheduledPublish holds a pending scheduled publication as returned
+// by the schedule-publish and meta/scheduled-publishes endpoints.
+type ScheduledPublish struct {
+	// Id holds the id of the scheduled publication,
+	// which can be used to cancel it.
+	Id string
+
+	// Entity holds the id of the entity to publish.
+	Entity *charm.URL
+
+	// Channels holds the channels that the
+	// entity will be published to.
+	Channels []params.Channel
+
+	// Resources holds the revisions of the resources
+	// that will be published with the entity.
+	Resources map[string]int `json:",omitempty"`
+
+	// User holds the user that scheduled the publication, if known.
+	User string `json:",omitempty"`
+
+	// Time holds the time at which the entity will be published.
+	Time time.Time
+}
+
+// newScheduledPublish returns the representation of the given
+// scheduled publication document used by the API.
+func newScheduledPublish(doc *mongodoc.ScheduledPublish) ScheduledPublish {
+	sp := ScheduledPublish{
+		Id:       doc.Id.Hex(),
+		Entity:   doc.URL,
+		Channels: doc.Channels,
+		User:     doc.User,
+		Time:     doc.Time,
+	}
+	if len(doc.Resources) > 0 {
+		sp.Resources = make(map[string]int, len(doc.Resources))
+		for _, r := range doc.Resources {
+			sp.Resources[r.Name] = r.Revision
+		}
+	}
+	return sp
+}
+
+// GET id/meta/scheduled-publishes
+// https://github.com/juju/charmstore/blob/v5/docs/API.md#get-idmetascheduled-publishes
+func (h *ReqHandler) metaScheduledPublishes(entity *mongodoc.BaseEntity, id *router.ResolvedURL, path string, flags url.Values, req *http.Request) (interface{}, error) {
+	docs, err := h.Store.ScheduledPublishes(entity.URL)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if len(docs) == 0 {
+		return nil, nil
+	}
+	resp := make([]ScheduledPublish, len(docs))
+	for i, doc := range docs {
+		resp[i] = newScheduledPublish(doc)
+	}
+	return resp, nil
+}
+
+// POST id/schedule-publish
+// https://github.com/juju/charmstore/blob/v5/docs/API.md#post-idschedule-publish
+func (h *ReqHandler) serveSchedulePublish(id *router.ResolvedURL, w http.ResponseWriter, req *http.Request) error {
+	if req.Method != "POST" {
+		return errgo.WithCausef(nil, params.ErrMethodNotAllowed, "%s not allowed", req.Method)
+	}
+	var schedule SchedulePublishRequest
+	if err := json.NewDecoder(req.Body).Decode(&schedule); err != nil {
+		return badRequestf(err, "cannot unmarshal schedule-publish request")
+	}
+	if len(schedule.Stages) == 0 {
+		return badRequestf(nil, "no stages provided")
+	}
+	var chans []params.Channel
+	for i, stage := range schedule.Stages {
+		if len(stage.Channels) == 0 {
+			return badRequestf(nil, "no channels provided in stage %d", i)
+		}
+		if stage.Time.IsZero() {
+			return badRequestf(nil, "no time provided in stage %d", i)
+		}
+		for j, c := range stage.Channels {
+			canon, err := charmstore.ParseChannel(string(c))
+			if err != nil {
+				return badRequestf(nil, "unrecognized channel %q", c)
+			}
+			if canon == params.UnpublishedChannel {
+				return badRequestf(nil, "cannot publish to the unpublished channel")
+			}
+			stage.Channels[j] = canon
+			chans = append(chans, canon)
+		}
+	}
+
+	// Users must have write permissions on the ACLs
+	// on all the channels being published to.
+	baseEntity, err := h.Cache.BaseEntity(&id.URL, charmstore.FieldSelector("channelacls"))
+	if err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	acls := make([]mongodoc.ACL, 0, len(chans))
+	for _, c := range chans {
+		acls = append(acls, charmstore.ChannelACL(baseEntity, c))
+	}
+	if _, err := h.authorize(authorizeParams{
+		req:              req,
+		acls:             acls,
+		entityIds:        []*router.ResolvedURL{id},
+		ignoreEntityACLs: true,
+		ops:              []string{OpWrite},
+	}); err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+
+	stages := make([]charmstore.ScheduleStage, len(schedule.Stages))
+	for i, stage := range schedule.Stages {
+		stages[i] = charmstore.ScheduleStage{
+			Channels: stage.Channels,
+			Time:     stage.Time,
+		}
+	}
+	docs, err := h.Store.ScheduleStagedPublish(h.auth.Username, id, schedule.Resources, stages)
+	if err != nil {
+		if errgo.Cause(err) == charmstore.ErrPublishResourceMismatch {
+			return errgo.WithCausef(err, params.ErrBadRequest, "")
+		}
+		return errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	resp := make([]ScheduledPublish, len(docs))
+	for i, doc := range docs {
+		resp[i] = newScheduledPublish(doc)
+	}
+	return httprequest.WriteJSON(w, http.StatusOK, resp)
+}
+
+// DELETE id/schedule-publish/scheduleid
+// https://github.com/juju/charmstore/blob/v5/docs/API.md#delete-idschedule-publishscheduleid
+func (h *ReqHandler) serveCancelScheduledPublish(id *charm.URL, w http.ResponseWriter, req *http.Request) error {
+	if req.Method != "DELETE" {
+		return errgo.WithCausef(nil, params.ErrMethodNotAllowed, "%s not allowed", req.Method)
+	}
+	if id.User == "" {
+		return badRequestf(nil, "user not specified")
+	}
+	scheduleId := strings.TrimPrefix(req.URL.Path, "/")
+	docs, err := h.Store.ScheduledPublishes(id)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	var doc *mongodoc.ScheduledPublish
+	for _, d := range docs {
+		if d.Id.Hex() == scheduleId {
+			doc = d
+			break
+		}
+	}
+	if doc == nil {
+		return errgo.WithCausef(nil, params.ErrNotFound, "scheduled publication %q not found", scheduleId)
+	}
+
+	// Users must have write permissions on the ACLs on
+	// all the channels that would have been published to.
+	baseEntity, err := h.Cache.BaseEntity(id, charmstore.FieldSelector("channelacls"))
+	if err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	acls := make([]mongodoc.ACL, 0, len(doc.Channels))
+	for _, c := range doc.Channels {
+		acls = append(acls, charmstore.ChannelACL(baseEntity, c))
+	}
+	if _, err := h.authorize(authorizeParams{
+		req:  req,
+		acls: acls,
+		ops:  []string{OpWrite},
+	}); err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	if err := h.Store.CancelScheduledPublish(id, scheduleId); err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	return nil
+}
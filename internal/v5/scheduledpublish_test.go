@@ -0,0 +1,278 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package v5_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/juju/charmrepo/v6/csclient/params"
+	jc "github.com/juju/testing/checkers"
+	"github.com/juju/testing/httptesting"
+	gc "gopkg.in/check.v1"
+
+	"gopkg.in/juju/charmstore.v5/internal/charm"
+	"gopkg.in/juju/charmstore.v5/internal/storetesting"
+	"gopkg.in/juju/charmstore.v5/internal/v5"
+)
+
+func (s *APISuite) TestSchedulePublish(c *gc.C) {
+	s.idmServer.SetDefaultUser("bob")
+	meta := storetesting.MetaWithResources(nil, "someResource")
+	id := newResolvedURL("cs:~bob/precise/wordpress-0", -1)
+	err := s.store.AddCharmWithArchive(id, storetesting.NewCharm(meta))
+	c.Assert(err, gc.Equals, nil)
+	s.uploadResource(c, id, "someResource", "stuff 0")
+
+	t0 := time.Now().Add(time.Hour).UTC().Truncate(time.Millisecond)
+	t1 := t0.Add(24 * time.Hour)
+	resp := httptesting.DoRequest(c, httptesting.DoRequestParams{
+		Handler: s.srv,
+		Method:  "POST",
+		URL:     storeURL("~bob/precise/wordpress-0/schedule-publish"),
+		Do:      bakeryDo(nil),
+		JSONBody: v5.SchedulePublishRequest{
+			Resources: map[string]int{
+				"someResource": 0,
+			},
+			Stages: []v5.PublishStage{{
+				Channels: []params.Channel{params.CandidateChannel},
+				Time:     t0,
+			}, {
+				Channels: []params.Channel{"latest/stable", "2/stable"},
+				Time:     t1,
+			}},
+		},
+	})
+	c.Assert(resp.Code, gc.Equals, http.StatusOK, gc.Commentf("body: %s", resp.Body.Bytes()))
+	var scheduled []v5.ScheduledPublish
+	err = json.Unmarshal(resp.Body.Bytes(), &scheduled)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(scheduled, gc.HasLen, 2)
+	for i, sp := range scheduled {
+		c.Assert(sp.Id, gc.Not(gc.Equals), "")
+		c.Assert(sp.Entity, jc.DeepEquals, &id.URL)
+		c.Assert(sp.Resources, jc.DeepEquals, map[string]int{"someResource": 0})
+		c.Assert(sp.User, gc.Equals, "bob")
+		c.Assert(sp.Time.Equal([]time.Time{t0, t1}[i]), gc.Equals, true)
+	}
+	c.Assert(scheduled[0].Channels, jc.DeepEquals, []params.Channel{params.CandidateChannel})
+	c.Assert(scheduled[1].Channels, jc.DeepEquals, []params.Channel{params.StableChannel, "2/stable"})
+
+	// The pending publications are listed by the meta endpoint.
+	var listed []v5.ScheduledPublish
+	resp = httptesting.DoRequest(c, httptesting.DoRequestParams{
+		Handler: s.srv,
+		URL:     storeURL("~bob/wordpress/meta/scheduled-publishes?channel=unpublished"),
+		Do:      bakeryDo(nil),
+	})
+	c.Assert(resp.Code, gc.Equals, http.StatusOK, gc.Commentf("body: %s", resp.Body.Bytes()))
+	err = json.Unmarshal(resp.Body.Bytes(), &listed)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(listed, gc.HasLen, 2)
+	for i := range listed {
+		c.Assert(listed[i].Time.Equal(scheduled[i].Time), gc.Equals, true)
+		listed[i].Time = scheduled[i].Time
+	}
+	c.Assert(listed, jc.DeepEquals, scheduled)
+
+	// Cancel the first one.
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler: s.srv,
+		Method:  "DELETE",
+		URL:     storeURL("~bob/wordpress/schedule-publish/" + scheduled[0].Id),
+		Do:      bakeryDo(nil),
+	})
+	docs, err := s.store.ScheduledPublishes(&id.URL)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(docs, gc.HasLen, 1)
+	c.Assert(docs[0].Id.Hex(), gc.Equals, scheduled[1].Id)
+
+	// Cancelling it again fails.
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:      s.srv,
+		Method:       "DELETE",
+		URL:          storeURL("~bob/wordpress/schedule-publish/" + scheduled[0].Id),
+		Do:           bakeryDo(nil),
+		ExpectStatus: http.StatusNotFound,
+		ExpectBody: params.Error{
+			Code:    params.ErrNotFound,
+			Message: `scheduled publication "` + scheduled[0].Id + `" not found`,
+		},
+	})
+}
+
+var schedulePublishErrorsTests = []struct {
+	about        string
+	body         v5.SchedulePublishRequest
+	expectStatus int
+	expectBody   params.Error
+}{{
+	about:        "no stages",
+	expectStatus: http.StatusBadRequest,
+	expectBody: params.Error{
+		Code:    params.ErrBadRequest,
+		Message: "no stages provided",
+	},
+}, {
+	about: "no channels",
+	body: v5.SchedulePublishRequest{
+		Stages: []v5.PublishStage{{
+			Time: time.Now(),
+		}},
+	},
+	expectStatus: http.StatusBadRequest,
+	expectBody: params.Error{
+		Code:    params.ErrBadRequest,
+		Message: "no channels provided in stage 0",
+	},
+}, {
+	about: "no time",
+	body: v5.SchedulePublishRequest{
+		Stages: []v5.PublishStage{{
+			Channels: []params.Channel{params.StableChannel},
+			Time:     time.Now(),
+		}, {
+			Channels: []params.Channel{params.StableChannel},
+		}},
+	},
+	expectStatus: http.StatusBadRequest,
+	expectBody: params.Error{
+		Code:    params.ErrBadRequest,
+		Message: "no time provided in stage 1",
+	},
+}, {
+	about: "invalid channel",
+	body: v5.SchedulePublishRequest{
+		Stages: []v5.PublishStage{{
+			Channels: []params.Channel{"bad"},
+			Time:     time.Now(),
+		}},
+	},
+	expectStatus: http.StatusBadRequest,
+	expectBody: params.Error{
+		Code:    params.ErrBadRequest,
+		Message: `unrecognized channel "bad"`,
+	},
+}, {
+	about: "unpublished channel",
+	body: v5.SchedulePublishRequest{
+		Stages: []v5.PublishStage{{
+			Channels: []params.Channel{params.UnpublishedChannel},
+			Time:     time.Now(),
+		}},
+	},
+	expectStatus: http.StatusBadRequest,
+	expectBody: params.Error{
+		Code:    params.ErrBadRequest,
+		Message: "cannot publish to the unpublished channel",
+	},
+}, {
+	about: "missing resources",
+	body: v5.SchedulePublishRequest{
+		Stages: []v5.PublishStage{{
+			Channels: []params.Channel{params.StableChannel},
+			Time:     time.Now(),
+		}},
+	},
+	expectStatus: http.StatusBadRequest,
+	expectBody: params.Error{
+		Code:    params.ErrBadRequest,
+		Message: "resources are missing from publish request: someResource",
+	},
+}}
+
+func (s *APISuite) TestSchedulePublishErrors(c *gc.C) {
+	s.idmServer.SetDefaultUser("bob")
+	id := newResolvedURL("cs:~bob/precise/wordpress-0", -1)
+	err := s.store.AddCharmWithArchive(id, storetesting.NewCharm(storetesting.MetaWithResources(nil, "someResource")))
+	c.Assert(err, gc.Equals, nil)
+	for i, test := range schedulePublishErrorsTests {
+		c.Logf("test %d: %s", i, test.about)
+		httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+			Handler:      s.srv,
+			Method:       "POST",
+			URL:          storeURL("~bob/precise/wordpress-0/schedule-publish"),
+			Do:           bakeryDo(nil),
+			JSONBody:     test.body,
+			ExpectStatus: test.expectStatus,
+			ExpectBody:   test.expectBody,
+		})
+	}
+	docs, err := s.store.ScheduledPublishes(&id.URL)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(docs, gc.HasLen, 0)
+}
+
+func (s *APISuite) TestSchedulePublishAuthorization(c *gc.C) {
+	s.idmServer.SetDefaultUser("bob")
+	id := newResolvedURL("cs:~bob/precise/wordpress-0", -1)
+	err := s.store.AddCharmWithArchive(id, storetesting.NewCharm(nil))
+	c.Assert(err, gc.Equals, nil)
+	err = s.store.SetPerms(&id.URL, "stable.write", "alice")
+	c.Assert(err, gc.Equals, nil)
+	doc, err := s.store.SchedulePublish("alice", id, nil, []params.Channel{params.StableChannel}, time.Now().Add(time.Hour))
+	c.Assert(err, gc.Equals, nil)
+
+	// Bob can no longer write to the stable channel.
+	s.assertPostIsUnauthorized(c, "~bob/precise/wordpress-0/schedule-publish", v5.SchedulePublishRequest{
+		Stages: []v5.PublishStage{{
+			Channels: []params.Channel{params.EdgeChannel, params.StableChannel},
+			Time:     time.Now(),
+		}},
+	})
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:      s.srv,
+		Method:       "DELETE",
+		URL:          storeURL("~bob/wordpress/schedule-publish/" + doc.Id.Hex()),
+		Do:           bakeryDo(nil),
+		ExpectStatus: http.StatusUnauthorized,
+		ExpectBody: params.Error{
+			Code:    params.ErrUnauthorized,
+			Message: `access denied for user "bob"`,
+		},
+	})
+	docs, err := s.store.ScheduledPublishes(&id.URL)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(docs, gc.HasLen, 1)
+
+	// The edge channel is still writable.
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler: s.srv,
+		Method:  "POST",
+		URL:     storeURL("~bob/precise/wordpress-0/schedule-publish"),
+		Do:      bakeryDo(nil),
+		JSONBody: v5.SchedulePublishRequest{
+			Stages: []v5.PublishStage{{
+				Channels: []params.Channel{params.EdgeChannel},
+				Time:     time.Now(),
+			}},
+		},
+		ExpectBody: httptesting.BodyAsserter(func(c *gc.C, body json.RawMessage) {
+			var scheduled []v5.ScheduledPublish
+			err := json.Unmarshal(body, &scheduled)
+			c.Assert(err, gc.Equals, nil)
+			c.Assert(scheduled, gc.HasLen, 1)
+			c.Assert(scheduled[0].Entity, jc.DeepEquals, charm.MustParseURL("cs:~bob/precise/wordpress-0"))
+		}),
+	})
+}
+
+// assertPostIsUnauthorized asserts that a POST to the given URL with
+// the given JSON body is refused because the user is not authorized.
+func (s *APISuite) assertPostIsUnauthorized(c *gc.C, url string, body interface{}) {
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:      s.srv,
+		Method:       "POST",
+		URL:          storeURL(url),
+		Do:           bakeryDo(nil),
+		JSONBody:     body,
+		ExpectStatus: http.StatusUnauthorized,
+		ExpectBody: params.Error{
+			Code:    params.ErrUnauthorized,
+			Message: `access denied for user "bob"`,
+		},
+	})
+}
@@ -18,7 +18,28 @@ import (
 
 const maxConcurrency = 20
 
-// GET search[?text=text][&autocomplete=1][&filter=value…][&limit=limit][&include=meta][&skip=count][&sort=field[+dir]]
+// SearchResponse holds the response from a search request. It
+// extends params.SearchResponse with the facet counts requested
+// with the facets parameter, the suggestions made by a fuzzy
+// search and the cursor for the next page of results.
+type SearchResponse struct {
+	params.SearchResponse
+
+	// Facets holds the counts of the values of each requested
+	// facet over all the matching results, keyed by facet name.
+	Facets map[string][]charmstore.FacetCount `json:",omitempty"`
+
+	// Suggestions holds the names suggested as corrections for
+	// the search text when nothing matched it exactly.
+	Suggestions []string `json:",omitempty"`
+
+	// NextCursor holds a cursor that can be passed as the cursor
+	// parameter of the same search to retrieve the next page of
+	// results. It is omitted when there are no more results.
+	NextCursor string `json:",omitempty"`
+}
+
+// GET search[?text=text][&autocomplete=1][&fuzzy=0][&filter=value…][&limit=limit][&include=meta][&skip=count|&cursor=cursor][&sort=field[+dir]][&facets=facet[,facet…]]
 // https://github.com/juju/charmstore/blob/v4/docs/API.md#get-search
 func (h *ReqHandler) serveSearch(_ http.Header, req *http.Request) (interface{}, error) {
 	sp, err := ParseSearchParams(req)
@@ -56,16 +77,21 @@ func (h *ReqHandler) Search(sp charmstore.SearchParams, req *http.Request) (inte
 		entities = append(entities, iter.Entity())
 	}
 	if iter.Err() != nil {
-		return nil, errgo.Notef(iter.Err(), "error performing search")
+		return nil, errgo.NoteMask(iter.Err(), "error performing search", errgo.Is(params.ErrBadRequest))
 	}
 	results, err := h.getMetadataForEntities(entities, sp.Include, req, nil)
 	if err != nil {
 		return nil, errgo.Notef(err, "cannot get metadata")
 	}
-	return params.SearchResponse{
-		SearchTime: query.Duration(),
-		Total:      query.Total(),
-		Results:    results,
+	return SearchResponse{
+		SearchResponse: params.SearchResponse{
+			SearchTime: query.Duration(),
+			Total:      query.Total(),
+			Results:    results,
+		},
+		Facets:      query.Facets(),
+		Suggestions: query.Suggestions(),
+		NextCursor:  query.NextCursor(),
 	}, nil
 }
 
@@ -79,6 +105,7 @@ func (h *ReqHandler) serveSearchInteresting(w http.ResponseWriter, req *http.Req
 func ParseSearchParams(req *http.Request) (charmstore.SearchParams, error) {
 	sp := charmstore.SearchParams{}
 	sp.AutoComplete = true
+	fuzzy := true
 	var err error
 	for k, v := range req.Form {
 		switch k {
@@ -89,6 +116,11 @@ func ParseSearchParams(req *http.Request) (charmstore.SearchParams, error) {
 			if err != nil {
 				return charmstore.SearchParams{}, badRequestf(err, "invalid autocomplete parameter")
 			}
+		case "fuzzy":
+			fuzzy, err = router.ParseBool(v[0])
+			if err != nil {
+				return charmstore.SearchParams{}, badRequestf(err, "invalid fuzzy parameter")
+			}
 		case "limit":
 			sp.Limit, err = strconv.Atoi(v[0])
 			if err != nil {
@@ -103,7 +135,7 @@ func ParseSearchParams(req *http.Request) (charmstore.SearchParams, error) {
 					sp.Include = append(sp.Include, s)
 				}
 			}
-		case "description", "name", "owner", "provides", "requires", "series", "summary", "tags", "type":
+		case "actions", "config", "description", "devices", "name", "owner", "provides", "requires", "resources", "resource-types", "series", "storage", "summary", "tags", "type":
 			if sp.Filters == nil {
 				sp.Filters = make(map[string][]string)
 			}
@@ -134,9 +166,24 @@ func ParseSearchParams(req *http.Request) (charmstore.SearchParams, error) {
 			if err != nil {
 				return charmstore.SearchParams{}, badRequestf(err, "invalid sort field")
 			}
+		case "cursor":
+			err = sp.ParseCursor(v[0])
+			if err != nil {
+				return charmstore.SearchParams{}, badRequestf(err, "invalid cursor parameter")
+			}
+		case "facets":
+			err = sp.ParseFacets(v...)
+			if err != nil {
+				return charmstore.SearchParams{}, badRequestf(err, "invalid facets parameter")
+			}
 		default:
 			return charmstore.SearchParams{}, badRequestf(nil, "invalid parameter: %s", k)
 		}
 	}
+	if sp.Skip > 0 && len(sp.After) > 0 {
+		return charmstore.SearchParams{}, badRequestf(nil, "cannot specify both skip and cursor")
+	}
+	// Fuzzy matching only applies to text searches.
+	sp.Fuzzy = fuzzy && sp.Text != ""
 	return sp, nil
 }
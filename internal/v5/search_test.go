@@ -76,9 +76,24 @@ func (s *SearchSuite) TestParseSearchParams(c *gc.C) {
 	}, {
 		about: "text search",
 		query: "text=test&autocomplete=0",
+		expectParams: charmstore.SearchParams{
+			Text:  "test",
+			Fuzzy: true,
+		},
+	}, {
+		about: "text search with fuzzy=0",
+		query: "text=test&fuzzy=0&autocomplete=0",
 		expectParams: charmstore.SearchParams{
 			Text: "test",
 		},
+	}, {
+		about:        "fuzzy=1 without text",
+		query:        "fuzzy=1&autocomplete=0",
+		expectParams: charmstore.SearchParams{},
+	}, {
+		about:       "invalid fuzzy",
+		query:       "fuzzy=yes",
+		expectError: `invalid fuzzy parameter: unexpected bool value "yes" \(must be "0" or "1"\)`,
 	}, {
 		about: "autocomplete=0",
 		query: "autocomplete=0",
@@ -191,6 +206,19 @@ func (s *SearchSuite) TestParseSearchParams(c *gc.C) {
 				"type": {"text"},
 			},
 		},
+	}, {
+		about: "charm field filters",
+		query: "config=port&actions=backup&resources=snap&resource-types=file&storage=data&devices=gpu&autocomplete=0",
+		expectParams: charmstore.SearchParams{
+			Filters: map[string][]string{
+				"config":         {"port"},
+				"actions":        {"backup"},
+				"resources":      {"snap"},
+				"resource-types": {"file"},
+				"storage":        {"data"},
+				"devices":        {"gpu"},
+			},
+		},
 	}, {
 		about: "many filters",
 		query: "name=name&owner=owner&series=series1&series=series2&autocomplete=0",
@@ -231,6 +259,30 @@ func (s *SearchSuite) TestParseSearchParams(c *gc.C) {
 		about:       "promulgated filter - bad",
 		query:       "promulgated=bad",
 		expectError: `invalid promulgated filter parameter: unexpected bool value "bad" \(must be "0" or "1"\)`,
+	}, {
+		about: "facets",
+		query: "facets=series,owner&facets=tags&autocomplete=0",
+		expectParams: charmstore.SearchParams{
+			Facets: []string{"series", "owner", "tags"},
+		},
+	}, {
+		about: "cursor",
+		query: "cursor=WyJ4Il0&autocomplete=0",
+		expectParams: charmstore.SearchParams{
+			After: []json.RawMessage{json.RawMessage(`"x"`)},
+		},
+	}, {
+		about:       "invalid cursor",
+		query:       "cursor=W10",
+		expectError: `invalid cursor parameter: invalid cursor "W10"`,
+	}, {
+		about:       "skip with cursor",
+		query:       "skip=10&cursor=WyJ4Il0",
+		expectError: "cannot specify both skip and cursor",
+	}, {
+		about:       "unknown facet",
+		query:       "facets=series,bad",
+		expectError: `invalid facets parameter: unrecognized facet "bad"`,
 	}}
 	for i, test := range tests {
 		c.Logf("test %d. %s", i, test.about)
@@ -800,6 +852,87 @@ func (s *SearchSuite) TestSortUnsupportedField(c *gc.C) {
 	c.Assert(e.Message, gc.Equals, "invalid sort field: unrecognized sort parameter \"foo\"")
 }
 
+func (s *SearchSuite) TestSearchFacets(c *gc.C) {
+	rec := httptesting.DoRequest(c, httptesting.DoRequestParams{
+		Handler: s.srv,
+		URL:     storeURL("search?facets=type,owner&limit=1"),
+	})
+	c.Assert(rec.Code, gc.Equals, http.StatusOK)
+	var sr v5.SearchResponse
+	err := json.Unmarshal(rec.Body.Bytes(), &sr)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(sr.Results, gc.HasLen, 1)
+	c.Assert(sr.Total, gc.Equals, 7)
+	c.Assert(sr.Facets, jc.DeepEquals, map[string][]charmstore.FacetCount{
+		"owner": {
+			{Value: "charmers", Count: 4},
+			{Value: "cf-charmers", Count: 1},
+			{Value: "foo", Count: 1},
+			{Value: "openstack-charmers", Count: 1},
+		},
+		"type": {
+			{Value: "charm", Count: 6},
+			{Value: "bundle", Count: 1},
+		},
+	})
+}
+
+func (s *SearchSuite) TestSearchFacetsWithUserInGroups(c *gc.C) {
+	s.idmServer.AddUser("bob", "test-user")
+	rec := httptesting.DoRequest(c, httptesting.DoRequestParams{
+		Handler: s.srv,
+		URL:     storeURL("search?facets=owner&owner=charmers"),
+		Do:      bakeryDo(s.login("bob")),
+	})
+	c.Assert(rec.Code, gc.Equals, http.StatusOK)
+	var sr v5.SearchResponse
+	err := json.Unmarshal(rec.Body.Bytes(), &sr)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(sr.Facets, jc.DeepEquals, map[string][]charmstore.FacetCount{
+		"owner": {{Value: "charmers", Count: 5}},
+	})
+}
+
+func (s *SearchSuite) TestSearchWithoutFacets(c *gc.C) {
+	rec := httptesting.DoRequest(c, httptesting.DoRequestParams{
+		Handler: s.srv,
+		URL:     storeURL("search"),
+	})
+	c.Assert(rec.Code, gc.Equals, http.StatusOK)
+	var resp map[string]json.RawMessage
+	err := json.Unmarshal(rec.Body.Bytes(), &resp)
+	c.Assert(err, gc.Equals, nil)
+	_, ok := resp["Facets"]
+	c.Assert(ok, gc.Equals, false)
+}
+
+func (s *SearchSuite) TestFuzzySearch(c *gc.C) {
+	rec := httptesting.DoRequest(c, httptesting.DoRequestParams{
+		Handler: s.srv,
+		URL:     storeURL("search?text=wordpres&autocomplete=0"),
+	})
+	c.Assert(rec.Code, gc.Equals, http.StatusOK)
+	var sr v5.SearchResponse
+	err := json.Unmarshal(rec.Body.Bytes(), &sr)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(sr.Total, gc.Equals, 2)
+	c.Assert(sr.Suggestions, jc.DeepEquals, []string{"wordpress"})
+}
+
+func (s *SearchSuite) TestFuzzySearchDisabled(c *gc.C) {
+	rec := httptesting.DoRequest(c, httptesting.DoRequestParams{
+		Handler: s.srv,
+		URL:     storeURL("search?text=wordpres&autocomplete=0&fuzzy=0"),
+	})
+	c.Assert(rec.Code, gc.Equals, http.StatusOK)
+	var resp map[string]json.RawMessage
+	err := json.Unmarshal(rec.Body.Bytes(), &resp)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(string(resp["Total"]), gc.Equals, "0")
+	_, ok := resp["Suggestions"]
+	c.Assert(ok, gc.Equals, false)
+}
+
 func (s *SearchSuite) TestDownloadsBoost(c *gc.C) {
 	charmDownloads := map[string]int{
 		"mysql":     0,
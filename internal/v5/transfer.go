@@ -0,0 +1,77 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package v5 // import "gopkg.in/juju/charmstore.v5/internal/v5"
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/juju/charmrepo/v6/csclient/params"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/httprequest.v1"
+
+	"gopkg.in/juju/charmstore.v5/audit"
+	"gopkg.in/juju/charmstore.v5/internal/charm"
+)
+
+// TransferRequest holds the body of a transfer request.
+type TransferRequest struct {
+	// Owner holds the user or group that the charm
+	// or bundle will be transferred to.
+	Owner string
+}
+
+// TransferResponse holds the response to a transfer request.
+type TransferResponse struct {
+	// Id holds the new id of the charm or bundle.
+	Id *charm.URL
+}
+
+// POST id/transfer
+// https://github.com/juju/charmstore/blob/v5/docs/API.md#post-idtransfer
+func (h *ReqHandler) serveTransfer(id *charm.URL, w http.ResponseWriter, req *http.Request) error {
+	if req.Method != "POST" {
+		return errgo.WithCausef(nil, params.ErrMethodNotAllowed, "%s not allowed", req.Method)
+	}
+	if err := h.authenticateAdmin(req); err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	if id.User == "" {
+		return badRequestf(nil, "user not specified")
+	}
+	if id.Series != "" {
+		return badRequestf(nil, "series specified, but should not be specified")
+	}
+	if id.Revision != -1 {
+		return badRequestf(nil, "revision specified, but should not be specified")
+	}
+	var transfer TransferRequest
+	if err := json.NewDecoder(req.Body).Decode(&transfer); err != nil {
+		return badRequestf(err, "cannot unmarshal transfer request")
+	}
+	if transfer.Owner == "" {
+		return badRequestf(nil, "owner not specified")
+	}
+	if transfer.Owner == id.User {
+		return badRequestf(nil, "%s is already owned by %s", id, transfer.Owner)
+	}
+	if _, err := charm.ParseURL("cs:~" + transfer.Owner + "/" + id.Name); err != nil {
+		return badRequestf(nil, "invalid owner %q", transfer.Owner)
+	}
+	newId, err := h.Store.TransferBaseEntity(id, transfer.Owner)
+	if errgo.Cause(err) == params.ErrNotFound {
+		return errgo.WithCausef(nil, params.ErrNotFound, "no matching charm or bundle for %s", id)
+	}
+	if err != nil {
+		return errgo.NoteMask(err, "cannot transfer "+id.String(), errgo.Is(params.ErrForbidden))
+	}
+	h.addAudit(audit.Entry{
+		Op:     audit.OpTransfer,
+		Entity: id,
+		Target: newId,
+	})
+	return httprequest.WriteJSON(w, http.StatusOK, &TransferResponse{
+		Id: newId,
+	})
+}
@@ -0,0 +1,196 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package v5_test
+
+import (
+	"net/http"
+
+	"github.com/juju/charmrepo/v6/csclient/params"
+	jc "github.com/juju/testing/checkers"
+	"github.com/juju/testing/httptesting"
+	gc "gopkg.in/check.v1"
+
+	"gopkg.in/juju/charmstore.v5/audit"
+	"gopkg.in/juju/charmstore.v5/internal/charm"
+	"gopkg.in/juju/charmstore.v5/internal/storetesting"
+	"gopkg.in/juju/charmstore.v5/internal/v5"
+)
+
+func (s *APISuite) TestTransfer(c *gc.C) {
+	s.addPublicCharm(c, storetesting.NewCharm(nil), newResolvedURL("~charmers/utopic/mysql-42", 3))
+
+	var auditEntries []audit.Entry
+	s.PatchValue(v5.TestAddAuditCallback, func(e audit.Entry) {
+		auditEntries = append(auditEntries, e)
+	})
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:  s.srv,
+		Method:   "POST",
+		URL:      storeURL("~charmers/mysql/transfer"),
+		Username: testUsername,
+		Password: testPassword,
+		JSONBody: v5.TransferRequest{
+			Owner: "bob",
+		},
+		ExpectBody: v5.TransferResponse{
+			Id: charm.MustParseURL("cs:~bob/mysql"),
+		},
+	})
+	c.Assert(auditEntries, jc.DeepEquals, []audit.Entry{{
+		User:   "admin",
+		Op:     audit.OpTransfer,
+		Entity: charm.MustParseURL("cs:~charmers/mysql"),
+		Target: charm.MustParseURL("cs:~bob/mysql"),
+	}})
+
+	// Both the new id and the old id resolve
+	// to the transferred charm.
+	for _, id := range []string{"~bob/mysql", "~charmers/mysql", "~charmers/utopic/mysql-42", "mysql"} {
+		httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+			Handler: s.srv,
+			URL:     storeURL(id + "/meta/unpromulgated-id"),
+			ExpectBody: params.IdResponse{
+				Id:       charm.MustParseURL("cs:~bob/utopic/mysql-42"),
+				User:     "bob",
+				Series:   "utopic",
+				Name:     "mysql",
+				Revision: 42,
+			},
+		})
+	}
+}
+
+var transferErrorTests = []struct {
+	about        string
+	method       string
+	url          string
+	owner        string
+	expectStatus int
+	expectBody   params.Error
+}{{
+	about:        "wrong method",
+	method:       "GET",
+	url:          "~charmers/mysql/transfer",
+	expectStatus: http.StatusMethodNotAllowed,
+	expectBody: params.Error{
+		Code:    params.ErrMethodNotAllowed,
+		Message: "GET not allowed",
+	},
+}, {
+	about:        "no user",
+	method:       "POST",
+	url:          "mysql/transfer",
+	owner:        "bob",
+	expectStatus: http.StatusBadRequest,
+	expectBody: params.Error{
+		Code:    params.ErrBadRequest,
+		Message: "user not specified",
+	},
+}, {
+	about:        "series specified",
+	method:       "POST",
+	url:          "~charmers/utopic/mysql/transfer",
+	owner:        "bob",
+	expectStatus: http.StatusBadRequest,
+	expectBody: params.Error{
+		Code:    params.ErrBadRequest,
+		Message: "series specified, but should not be specified",
+	},
+}, {
+	about:        "revision specified",
+	method:       "POST",
+	url:          "~charmers/mysql-42/transfer",
+	owner:        "bob",
+	expectStatus: http.StatusBadRequest,
+	expectBody: params.Error{
+		Code:    params.ErrBadRequest,
+		Message: "revision specified, but should not be specified",
+	},
+}, {
+	about:        "no owner",
+	method:       "POST",
+	url:          "~charmers/mysql/transfer",
+	expectStatus: http.StatusBadRequest,
+	expectBody: params.Error{
+		Code:    params.ErrBadRequest,
+		Message: "owner not specified",
+	},
+}, {
+	about:        "same owner",
+	method:       "POST",
+	url:          "~charmers/mysql/transfer",
+	owner:        "charmers",
+	expectStatus: http.StatusBadRequest,
+	expectBody: params.Error{
+		Code:    params.ErrBadRequest,
+		Message: "cs:~charmers/mysql is already owned by charmers",
+	},
+}, {
+	about:        "invalid owner",
+	method:       "POST",
+	url:          "~charmers/mysql/transfer",
+	owner:        "bad/owner",
+	expectStatus: http.StatusBadRequest,
+	expectBody: params.Error{
+		Code:    params.ErrBadRequest,
+		Message: `invalid owner "bad/owner"`,
+	},
+}, {
+	about:        "not found",
+	method:       "POST",
+	url:          "~charmers/nothing/transfer",
+	owner:        "bob",
+	expectStatus: http.StatusNotFound,
+	expectBody: params.Error{
+		Code:    params.ErrNotFound,
+		Message: "no matching charm or bundle for cs:~charmers/nothing",
+	},
+}, {
+	about:        "already exists",
+	method:       "POST",
+	url:          "~charmers/mysql/transfer",
+	owner:        "alice",
+	expectStatus: http.StatusForbidden,
+	expectBody: params.Error{
+		Code:    params.ErrForbidden,
+		Message: `cannot transfer cs:~charmers/mysql: "cs:~alice/mysql" already exists`,
+	},
+}}
+
+func (s *APISuite) TestTransferErrors(c *gc.C) {
+	id, _ := s.addPublicCharm(c, storetesting.NewCharm(nil), newResolvedURL("~charmers/utopic/mysql-42", -1))
+	s.addPublicCharm(c, storetesting.NewCharm(nil), newResolvedURL("~alice/utopic/mysql-0", -1))
+	for i, test := range transferErrorTests {
+		c.Logf("test %d: %s", i, test.about)
+		httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+			Handler:  s.srv,
+			Method:   test.method,
+			URL:      storeURL(test.url),
+			Username: testUsername,
+			Password: testPassword,
+			JSONBody: v5.TransferRequest{
+				Owner: test.owner,
+			},
+			ExpectStatus: test.expectStatus,
+			ExpectBody:   test.expectBody,
+		})
+	}
+	// Nothing has been transferred.
+	_, err := s.store.FindEntity(id, nil)
+	c.Assert(err, gc.Equals, nil)
+}
+
+func (s *APISuite) TestTransferNotAdmin(c *gc.C) {
+	s.addPublicCharm(c, storetesting.NewCharm(nil), newResolvedURL("~charmers/utopic/mysql-42", -1))
+	rec := httptesting.DoRequest(c, httptesting.DoRequestParams{
+		Handler: s.srv,
+		Method:  "POST",
+		Do:      bakeryDo(s.idmServer.Client("charmers")),
+		URL:     storeURL("~charmers/mysql/transfer"),
+		JSONBody: v5.TransferRequest{
+			Owner: "bob",
+		},
+	})
+	c.Assert(rec.Code, gc.Equals, http.StatusUnauthorized, gc.Commentf("body: %s", rec.Body))
+}
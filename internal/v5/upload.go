@@ -24,13 +24,28 @@ const (
 	maxUploadExpiryDuration     = 24 * time.Hour
 )
 
-// POST /upload?expiry=expiry-duration
+// POST /upload?expiry=expiry-duration or GET /upload
 func (h *ReqHandler) serveUploadId(w http.ResponseWriter, req *http.Request) error {
-	_, err := h.Authenticate(req)
+	auth, err := h.Authenticate(req)
 	if err != nil {
 		return errgo.Mask(err, errgo.Any)
 	}
 	switch req.Method {
+	case "GET":
+		// Administrators can see everyone's uploads.
+		user := auth.Username
+		if auth.Admin {
+			user = ""
+		}
+		infos, err := h.Store.BlobStore.ListUploads(user)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		resp := make([]params.UploadInfoResponse, len(infos))
+		for i := range infos {
+			resp[i] = h.uploadInfoResponse(&infos[i])
+		}
+		return httprequest.WriteJSON(w, http.StatusOK, resp)
 	case "POST":
 		expires := defaultUploadExpiryDuration
 		if expiresStr := req.Form.Get("expires"); expiresStr != "" {
@@ -44,7 +59,7 @@ func (h *ReqHandler) serveUploadId(w http.ResponseWriter, req *http.Request) err
 			expires = exp
 		}
 		expireTime := time.Now().Add(expires)
-		uploadId, err := h.Store.BlobStore.NewUpload(expireTime)
+		uploadId, err := h.Store.BlobStore.NewUploadForUser(auth.Username, expireTime)
 		if err != nil {
 			return errgo.Mask(err)
 		}
@@ -61,7 +76,7 @@ func (h *ReqHandler) serveUploadId(w http.ResponseWriter, req *http.Request) err
 	}
 }
 
-// PUT /upload/upload-id/part-number or GET /upload/upload-id
+// PUT /upload/upload-id/part-number, GET /upload/upload-id or DELETE /upload/upload-id
 func (h *ReqHandler) serveUploadPart(w http.ResponseWriter, req *http.Request) error {
 	// Make sure we consume the full request body, before responding.
 	//
@@ -72,7 +87,7 @@ func (h *ReqHandler) serveUploadPart(w http.ResponseWriter, req *http.Request) e
 	// TODO: investigate using 100-Continue statuses to prevent
 	// unnecessary uploads.
 	defer io.Copy(ioutil.Discard, req.Body)
-	_, err := h.Authenticate(req)
+	auth, err := h.Authenticate(req)
 	if err != nil {
 		return errgo.Mask(err, errgo.Any)
 	}
@@ -98,6 +113,9 @@ func (h *ReqHandler) serveUploadPart(w http.ResponseWriter, req *http.Request) e
 					Hash: pparts.Parts[i].Hash,
 				}
 			}
+			if err := h.checkUploadCreator(auth, uploadId); err != nil {
+				return errgo.Mask(err, errgo.Is(params.ErrNotFound))
+			}
 			_, hash, err := h.Store.BlobStore.FinishUpload(uploadId, parts)
 			if err != nil {
 				return errgo.Mask(err)
@@ -133,6 +151,9 @@ func (h *ReqHandler) serveUploadPart(w http.ResponseWriter, req *http.Request) e
 			if err != nil {
 				return badRequestf(nil, "bad part number %q", partNumberStr)
 			}
+			if err := h.checkUploadCreator(auth, uploadId); err != nil {
+				return errgo.Mask(err, errgo.Is(params.ErrNotFound))
+			}
 			err = h.Store.BlobStore.PutPart(uploadId, partNumber, req.Body, req.ContentLength, offset, hash)
 			if errgo.Cause(err) == blobstore.ErrBadParams {
 				return errgo.WithCausef(err, params.ErrBadRequest, "")
@@ -145,40 +166,91 @@ func (h *ReqHandler) serveUploadPart(w http.ResponseWriter, req *http.Request) e
 			return errgo.WithCausef(nil, params.ErrNotFound, "")
 		}
 	case "GET":
-		elems := strings.Split(strings.TrimPrefix(req.URL.Path, "/"), "/")
-		if len(elems) != 1 {
-			return errgo.WithCausef(nil, params.ErrNotFound, "")
+		uploadInfo, err := h.uploadInfo(auth, req)
+		if err != nil {
+			return errgo.Mask(err, errgo.Is(params.ErrNotFound))
 		}
-		uploadId := elems[0]
-		uploadInfo, err := h.Store.BlobStore.UploadInfo(uploadId)
+		return httprequest.WriteJSON(w, http.StatusOK, h.uploadInfoResponse(uploadInfo))
+	case "DELETE":
+		// Abort the upload.
+		uploadInfo, err := h.uploadInfo(auth, req)
 		if err != nil {
-			return errgo.WithCausef(nil, params.ErrNotFound, "")
+			return errgo.Mask(err, errgo.Is(params.ErrNotFound))
 		}
-		var parts params.Parts
-		parts.Parts = make([]params.Part, len(uploadInfo.Parts))
-		for i, part := range uploadInfo.Parts {
-			if part != nil {
-				parts.Parts[i] = params.Part{
-					Offset:   part.Offset,
-					Complete: part.Complete,
-					Hash:     part.Hash,
-					Size:     part.Size,
-				}
-			}
+		if uploadInfo.Owner != "" {
+			return errgo.WithCausef(nil, params.ErrForbidden, "cannot abort upload that is already in use")
+		}
+		if err := h.Store.BlobStore.RemoveUpload(uploadInfo.Id); err != nil {
+			return errgo.Notef(err, "cannot remove upload")
 		}
-		return httprequest.WriteJSON(w, http.StatusOK, params.UploadInfoResponse{
-			UploadId:    uploadId,
-			Expires:     uploadInfo.Expires,
-			Parts:       parts,
-			MinPartSize: h.Store.BlobStore.MinPartSize,
-			MaxPartSize: h.Store.BlobStore.MaxPartSize,
-			MaxParts:    h.Store.BlobStore.MaxParts,
-		})
 		return nil
-	case "DELETE":
-		// TODO
-		return errgo.New("delete not yet implemented")
 	default:
 		return errgo.WithCausef(nil, params.ErrMethodNotAllowed, "%s not allowed", req.Method)
 	}
 }
+
+// uploadInfo returns information on the upload with the id
+// held in the request URL path. It returns a params.ErrNotFound
+// error if the upload does not exist or the authenticated user
+// does not have access to it.
+func (h *ReqHandler) uploadInfo(auth Authorization, req *http.Request) (*blobstore.UploadInfo, error) {
+	elems := strings.Split(strings.TrimPrefix(req.URL.Path, "/"), "/")
+	if len(elems) != 1 {
+		return nil, errgo.WithCausef(nil, params.ErrNotFound, "")
+	}
+	uploadInfo, err := h.Store.BlobStore.UploadInfo(elems[0])
+	if err != nil || !canAccessUpload(auth, &uploadInfo) {
+		return nil, errgo.WithCausef(nil, params.ErrNotFound, "")
+	}
+	return &uploadInfo, nil
+}
+
+// checkUploadCreator checks that the authenticated user has access
+// to the upload with the given id. If the upload does not exist,
+// it returns nil, leaving it to the subsequent blob store operation
+// to report the error.
+func (h *ReqHandler) checkUploadCreator(auth Authorization, uploadId string) error {
+	uploadInfo, err := h.Store.BlobStore.UploadInfo(uploadId)
+	if errgo.Cause(err) == blobstore.ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if !canAccessUpload(auth, &uploadInfo) {
+		// Don't reveal the existence of other users' uploads.
+		return errgo.WithCausef(nil, params.ErrNotFound, "upload id %q not found", uploadId)
+	}
+	return nil
+}
+
+// canAccessUpload reports whether the given authorization allows
+// access to the given upload. Uploads may only be accessed by
+// the user that created them or by an administrator.
+func canAccessUpload(auth Authorization, uploadInfo *blobstore.UploadInfo) bool {
+	return auth.Admin || uploadInfo.Creator == "" || uploadInfo.Creator == auth.Username
+}
+
+// uploadInfoResponse returns the response describing the given upload.
+func (h *ReqHandler) uploadInfoResponse(uploadInfo *blobstore.UploadInfo) params.UploadInfoResponse {
+	var parts params.Parts
+	parts.Parts = make([]params.Part, len(uploadInfo.Parts))
+	for i, part := range uploadInfo.Parts {
+		if part != nil {
+			parts.Parts[i] = params.Part{
+				Offset:   part.Offset,
+				Complete: part.Complete,
+				Hash:     part.Hash,
+				Size:     part.Size,
+			}
+		}
+	}
+	return params.UploadInfoResponse{
+		UploadId:    uploadInfo.Id,
+		Expires:     uploadInfo.Expires,
+		Parts:       parts,
+		MinPartSize: h.Store.BlobStore.MinPartSize,
+		MaxPartSize: h.Store.BlobStore.MaxPartSize,
+		MaxParts:    h.Store.BlobStore.MaxParts,
+	}
+}
@@ -16,6 +16,8 @@ import (
 	jc "github.com/juju/testing/checkers"
 	"github.com/juju/testing/httptesting"
 	gc "gopkg.in/check.v1"
+
+	"gopkg.in/juju/charmstore.v5/internal/blobstore"
 )
 
 func (s *APISuite) TestPostUploadFailsWithNoMacaroon(c *gc.C) {
@@ -437,6 +439,150 @@ func (s *APISuite) TestGetUploadInfoNotFound(c *gc.C) {
 	})
 }
 
+func (s *APISuite) TestListUploads(c *gc.C) {
+	s.idmServer.AddUser("alice")
+	id0 := s.postUpload(c, "bob", "2m")
+	id1 := s.postUpload(c, "bob", "1m")
+	id2 := s.postUpload(c, "alice", "3m")
+
+	resp := httptesting.DoRequest(c, httptesting.DoRequestParams{
+		Handler: s.srv,
+		Do:      bakeryDo(s.idmServer.Client("bob")),
+		URL:     storeURL("upload"),
+	})
+	c.Assert(resp.Code, gc.Equals, http.StatusOK, gc.Commentf("body: %s", resp.Body.Bytes()))
+	var uploads []params.UploadInfoResponse
+	err := json.Unmarshal(resp.Body.Bytes(), &uploads)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(uploads, gc.HasLen, 2)
+	c.Assert(uploads[0].UploadId, gc.Equals, id1)
+	c.Assert(uploads[1].UploadId, gc.Equals, id0)
+	c.Assert(uploads[0].MaxParts, gc.Equals, s.store.BlobStore.MaxParts)
+
+	// An administrator sees everyone's uploads.
+	resp = httptesting.DoRequest(c, httptesting.DoRequestParams{
+		Handler: s.srv,
+		Header:  basicAuthHeader(testUsername, testPassword),
+		URL:     storeURL("upload"),
+	})
+	c.Assert(resp.Code, gc.Equals, http.StatusOK, gc.Commentf("body: %s", resp.Body.Bytes()))
+	uploads = nil
+	err = json.Unmarshal(resp.Body.Bytes(), &uploads)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(uploads, gc.HasLen, 3)
+	c.Assert(uploads[2].UploadId, gc.Equals, id2)
+}
+
+func (s *APISuite) TestUploadOtherUserNotFound(c *gc.C) {
+	s.idmServer.AddUser("alice")
+	uploadId := s.postUpload(c, "bob", "")
+	part := "0123456789"
+	for _, method := range []string{"GET", "DELETE"} {
+		httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+			Handler:      s.srv,
+			Method:       method,
+			Do:           bakeryDo(s.idmServer.Client("alice")),
+			URL:          storeURL("upload/" + uploadId),
+			ExpectStatus: http.StatusNotFound,
+			ExpectBody: params.Error{
+				Code:    params.ErrNotFound,
+				Message: "not found",
+			},
+		})
+	}
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:      s.srv,
+		Method:       "PUT",
+		Do:           bakeryDo(s.idmServer.Client("alice")),
+		URL:          storeURL("upload/" + uploadId + "/0?hash=" + hashOfString(part) + "&offset=0"),
+		Body:         strings.NewReader(part),
+		ExpectStatus: http.StatusNotFound,
+		ExpectBody: params.Error{
+			Code:    params.ErrNotFound,
+			Message: fmt.Sprintf("upload id %q not found", uploadId),
+		},
+	})
+	info, err := s.store.BlobStore.UploadInfo(uploadId)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(info.Parts, gc.HasLen, 0)
+}
+
+func (s *APISuite) TestDeleteUpload(c *gc.C) {
+	uploadId := s.postUpload(c, "bob", "")
+	part := "0123456789"
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler: s.srv,
+		Method:  "PUT",
+		Do:      bakeryDo(s.idmServer.Client("bob")),
+		URL:     storeURL("upload/" + uploadId + "/0?hash=" + hashOfString(part) + "&offset=0"),
+		Body:    strings.NewReader(part),
+	})
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler: s.srv,
+		Method:  "DELETE",
+		Do:      bakeryDo(s.idmServer.Client("bob")),
+		URL:     storeURL("upload/" + uploadId),
+	})
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:      s.srv,
+		Method:       "GET",
+		Do:           bakeryDo(s.idmServer.Client("bob")),
+		URL:          storeURL("upload/" + uploadId),
+		ExpectStatus: http.StatusNotFound,
+		ExpectBody: params.Error{
+			Code:    params.ErrNotFound,
+			Message: "not found",
+		},
+	})
+}
+
+func (s *APISuite) TestDeleteUploadInUse(c *gc.C) {
+	uploadId := s.postUpload(c, "bob", "")
+	part := "0123456789"
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler: s.srv,
+		Method:  "PUT",
+		Do:      bakeryDo(s.idmServer.Client("bob")),
+		URL:     storeURL("upload/" + uploadId + "/0?hash=" + hashOfString(part) + "&offset=0"),
+		Body:    strings.NewReader(part),
+	})
+	_, _, err := s.store.BlobStore.FinishUpload(uploadId, []blobstore.Part{{Hash: hashOfString(part)}})
+	c.Assert(err, gc.Equals, nil)
+	err = s.store.BlobStore.SetOwner(uploadId, "someowner", time.Now().Add(time.Minute))
+	c.Assert(err, gc.Equals, nil)
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:      s.srv,
+		Method:       "DELETE",
+		Do:           bakeryDo(s.idmServer.Client("bob")),
+		URL:          storeURL("upload/" + uploadId),
+		ExpectStatus: http.StatusForbidden,
+		ExpectBody: params.Error{
+			Code:    params.ErrForbidden,
+			Message: "cannot abort upload that is already in use",
+		},
+	})
+}
+
+// postUpload starts a new upload as the given user with
+// the given expiry duration and returns its id.
+func (s *APISuite) postUpload(c *gc.C, user string, expires string) string {
+	url := "upload"
+	if expires != "" {
+		url += "?expires=" + expires
+	}
+	resp := httptesting.DoRequest(c, httptesting.DoRequestParams{
+		Handler: s.srv,
+		Method:  "POST",
+		Do:      bakeryDo(s.idmServer.Client(user)),
+		URL:     storeURL(url),
+	})
+	c.Assert(resp.Code, gc.Equals, http.StatusOK, gc.Commentf("body: %s", resp.Body.Bytes()))
+	var uploadResp params.UploadInfoResponse
+	err := json.Unmarshal(resp.Body.Bytes(), &uploadResp)
+	c.Assert(err, gc.Equals, nil)
+	return uploadResp.UploadId
+}
+
 var uploadPartErrorTests = []struct {
 	about           string
 	url             string
@@ -92,6 +92,15 @@ type ServerParams struct {
 	// refreshes of entities in the search cache.
 	SearchCacheMaxAge time.Duration
 
+	// SearchIndexDir holds the directory in which the embedded
+	// search index is stored. The embedded index is used only when
+	// no elasticsearch database is configured, and only reflects
+	// changes made through this server, so it should not be used
+	// when several servers share the same database. If it is empty
+	// and there is no elasticsearch database, searches return no
+	// results.
+	SearchIndexDir string
+
 	// MaxMgoSessions specifies a soft limit on the maximum
 	// number of mongo sessions used. Each concurrent
 	// HTTP request will use one session.
@@ -131,6 +140,21 @@ type ServerParams struct {
 	// the blobstore garbage collector worker.
 	RunBlobStoreGC bool
 
+	// RunScheduledPublisher holds whether the server will run
+	// the worker that makes scheduled publications when
+	// they become due.
+	RunScheduledPublisher bool
+
+	// RunBlobStoreScrubber holds whether the server will run
+	// the worker that periodically verifies the contents of
+	// the blob store.
+	RunBlobStoreScrubber bool
+
+	// BlobStoreScrubRate holds the maximum number of bytes per
+	// second that the blob store scrubber will read. If it's zero,
+	// the rate is not limited.
+	BlobStoreScrubRate int64
+
 	// NoIndexes specifies that none of the MongoDB indexes should be
 	// created. This speeds up initialization (useful for tests) but should
 	// never be set in production.
@@ -141,6 +165,37 @@ type ServerParams struct {
 	// If this is nil, a MongoDB backend will be used.
 	NewBlobBackend func(db *mgo.Database) blobstore.Backend
 
+	// BlobKeyring holds the master keys used to encrypt
+	// blob data. If it is nil, blobs are stored unencrypted.
+	BlobKeyring *blobstore.Keyring
+
+	// DeletedEntityRetention holds how long deleted charms and
+	// bundles are kept, and so can be restored, before they are
+	// purged by the blobstore garbage collector. If it's zero,
+	// a default of 30 days will be used.
+	DeletedEntityRetention time.Duration
+
+	// CompressBlobs holds whether new blobs are stored
+	// compressed. The hashes and sizes of blobs are always
+	// those of their uncompressed content.
+	CompressBlobs bool
+
+	// TempDir holds the directory in which temporary files
+	// holding large blobs are created. If it's empty, the
+	// default directory for temporary files is used.
+	TempDir string
+
+	// NewSecondaryBlobBackend optionally returns a blobstore
+	// backend that blobs are being migrated from. When it is
+	// set, blobs that are not found in the primary backend are
+	// read from the secondary one, and the server runs a worker
+	// that copies them to the primary backend.
+	NewSecondaryBlobBackend func(db *mgo.Database) blobstore.Backend
+
+	// BlobMigrationName holds the name under which the
+	// progress of the blob migration is recorded.
+	BlobMigrationName string
+
 	// DockerRegistryAddress contains the address of the docker
 	// registry associated with the charmstore.
 	DockerRegistryAddress string